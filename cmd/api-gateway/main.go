@@ -51,4 +51,16 @@ func authMiddleware(next http.Handler) http.Handler {
 
 func sendCommand(w http.ResponseWriter, r *http.Request) {
 	// 命令下发实现
-}
\ No newline at end of file
+}
+
+func listDevices(w http.ResponseWriter, r *http.Request) {
+	// 设备列表实现
+}
+
+func getDevice(w http.ResponseWriter, r *http.Request) {
+	// 设备详情实现
+}
+
+func createRule(w http.ResponseWriter, r *http.Request) {
+	// 规则创建实现
+}
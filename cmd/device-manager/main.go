@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
-	"time"
 	
 	"edgesphere/internal/device"
 	"edgesphere/internal/pkg/types"
@@ -33,8 +33,8 @@ func main() {
 	// 启动状态监听
 	go watchDeviceStatus(ctx, devMgr, redisCache)
 	
-	// 启动gRPC服务
-	go startGRPCServer(devMgr, 50051)
+	// 启动网关事件监听
+	go watchDeviceEvents(ctx, devMgr, redisCache)
 	
 	// 启动HTTP API
 	go startHTTPServer(devMgr, 8080)
@@ -71,6 +71,30 @@ func watchDeviceStatus(ctx context.Context, mgr *device.DeviceManager, cache *de
 	}
 }
 
+func watchDeviceEvents(ctx context.Context, mgr *device.DeviceManager, cache *device.RedisCache) {
+	events := cache.SubscribeEvents()
+	for {
+		select {
+		case msg := <-events:
+			var event types.DeviceEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("Failed to parse device event: %v", err)
+				continue
+			}
+			
+			switch event.Type {
+			case types.EventWill:
+				// 设备异常断开
+				log.Printf("Device %s will on %s: %s (%s)", event.DeviceID, event.Topic, event.Payload, event.Reason)
+				mgr.UpdateStatus(event.DeviceID, types.Offline)
+			}
+			
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func startHTTPServer(mgr *device.DeviceManager, port int) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
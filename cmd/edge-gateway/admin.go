@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"edgesphere/internal/gateway"
+)
+
+// 命令请求体上限
+const maxCommandSize = 64 << 10
+
+// HTTP管理接口: 网关统计和命令下发
+func startAdminAPI(sm *gateway.SessionManager, port int) {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sm.Stats())
+	}).Methods("GET")
+	// 设备离线时命令存入离线缓存, 上线后下发
+	r.HandleFunc("/api/v1/devices/{id}/commands", func(w http.ResponseWriter, r *http.Request) {
+		cmd, err := io.ReadAll(io.LimitReader(r.Body, maxCommandSize))
+		if err != nil || len(cmd) == 0 {
+			http.Error(w, "invalid command", http.StatusBadRequest)
+			return
+		}
+		if err := sm.SendCommand(mux.Vars(r)["id"], cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST")
+
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: r,
+	}
+	log.Printf("Admin API started on :%d", port)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Printf("Admin API failed: %v", err)
+	}
+}
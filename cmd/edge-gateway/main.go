@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 	
+	"edgesphere/internal/auth"
+	"edgesphere/internal/device"
 	"edgesphere/internal/gateway"
-	"edgesphere/internal/protocol/mqtt"
 	"edgesphere/internal/pkg/utils"
 )
 
@@ -18,15 +25,96 @@ func main() {
 	defer cancel()
 	
 	// 初始化会话管理器
-	sessionMgr := gateway.NewSessionManager()
+	sessionConfig := gateway.DefaultSessionConfig
+	sessionConfig.KeepAliveOverride = durationEnv("MQTT_KEEPALIVE_OVERRIDE")
+	sessionConfig.MinKeepAlive = durationEnv("MQTT_KEEPALIVE_MIN")
+	sessionConfig.MaxKeepAlive = durationEnv("MQTT_KEEPALIVE_MAX")
+	if strategy := os.Getenv("MQTT_SHARED_STRATEGY"); strategy != "" {
+		sessionConfig.SharedStrategy = gateway.SharedStrategy(strategy)
+	}
+	// 例如 "sparkplug/%c/metrics"
+	sessionConfig.SparkplugTopic = os.Getenv("SPARKPLUG_METRICS_TOPIC")
+	sessionMgr := gateway.NewSessionManagerWithConfig(sessionConfig)
+	
+	// 遗嘱等会话事件经Redis转发给设备管理器
+	redisHost := os.Getenv("REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	redisCache := device.NewRedisCache(net.JoinHostPort(redisHost, "6379"), "", 0)
+	sessionMgr.SetNotifier(redisCache.PublishEvent)
+	
+	// 自带注册流程的协议 (LwM2M) 在设备注册表中登记设备和在线状态
+	if dsn := os.Getenv("DEVICE_REGISTRY_POSTGRES"); dsn != "" {
+		store, err := device.NewPostgresStore(dsn)
+		if err != nil {
+			log.Fatalf("Failed to connect device registry: %v", err)
+		}
+		sessionMgr.SetDeviceRegistry(device.NewDeviceManager(store, redisCache))
+	}
+	
+	// 设备认证与主题授权, 未配置时接受所有连接
+	if path := os.Getenv("MQTT_AUTH_FILE"); path != "" {
+		store, err := auth.LoadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to load auth file %s: %v", path, err)
+		}
+		sessionMgr.SetAuthenticator(auth.Chain{auth.CertificateAuthenticator{}, store})
+		sessionMgr.SetAuthorizer(store)
+	} else if dsn := os.Getenv("MQTT_AUTH_POSTGRES"); dsn != "" {
+		store, err := device.NewPostgresStore(dsn)
+		if err != nil {
+			log.Fatalf("Failed to connect device store: %v", err)
+		}
+		deviceAuth := device.NewPostgresAuth(store, nil)
+		sessionMgr.SetAuthenticator(deviceAuth)
+		sessionMgr.SetAuthorizer(deviceAuth)
+	}
+	
+	// 清理过期的持久会话
+	go sessionMgr.ExpireSessions(ctx, time.Hour)
 	
 	// 初始化一致性哈希
 	hashRing := utils.NewConsistentHash(50)
 	hashRing.AddNode("edge-gateway-1")
 	hashRing.AddNode("edge-gateway-2")
 	
-	// 启动MQTT监听
-	go startMQTTListener(ctx, sessionMgr, 1883)
+	// 定期发布 $SYS 统计
+	sysInterval := durationEnv("MQTT_SYS_INTERVAL")
+	if sysInterval <= 0 {
+		sysInterval = 10 * time.Second
+	}
+	go sessionMgr.PublishStats(ctx, sysInterval)
+	
+	// 按配置文件启动各协议监听器, 未配置时按环境变量启动默认的MQTT监听
+	listenerConfigs := defaultListenersFromEnv()
+	if path := os.Getenv("EDGE_LISTENERS"); path != "" {
+		configs, err := gateway.LoadListenersConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to load listener config %s: %v", path, err)
+		}
+		listenerConfigs = configs
+	}
+	var listeners []gateway.Listener
+	for _, config := range listenerConfigs {
+		listener, err := sessionMgr.StartListener(ctx, config)
+		if err != nil {
+			log.Fatalf("Failed to start listener: %v", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	
+	// 收到SIGHUP时重载TLS证书, 已建立的会话不受影响
+	go reloadOnHangup(ctx, listeners)
+	
+	// 桥接到上游代理, 上游不可用期间上行消息保存在离线缓存中
+	if addr := os.Getenv("MQTT_BRIDGE_ADDRESS"); addr != "" {
+		bridgeConfig, err := bridgeConfigFromEnv(addr)
+		if err != nil {
+			log.Fatalf("Invalid MQTT bridge config: %v", err)
+		}
+		gateway.NewBridge(sessionMgr, bridgeConfig).Start(ctx)
+	}
 	
 	// 启动HTTP管理接口
 	go startAdminAPI(sessionMgr, 8080)
@@ -38,53 +126,109 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
 	log.Println("Shutting down edge gateway...")
+	
+	// 未确认的命令写回离线缓存, 重启后重传
+	sessionMgr.Shutdown(5 * time.Second)
 }
 
-func startMQTTListener(ctx context.Context, mgr *gateway.SessionManager, port int) {
-	addr := net.JoinHostPort("", strconv.Itoa(port))
-	listener, err := net.Listen("tcp", addr)
+// 读取时长环境变量, 例如 "90s", 未设置或格式错误时返回0
+func durationEnv(name string) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
 	if err != nil {
-		log.Fatalf("Failed to start MQTT listener: %v", err)
+		return 0
+	}
+	return d
+}
+
+// MQTT_BRIDGE_TOPICS 以分号分隔多条映射, 格式同 mosquitto:
+// "telemetry/# out 1 \"\" site-1/; commands/# in 1 \"\" site-1/"
+func bridgeConfigFromEnv(addr string) (gateway.BridgeConfig, error) {
+	config := gateway.DefaultBridgeConfig
+	config.Address = addr
+	if name := os.Getenv("MQTT_BRIDGE_NAME"); name != "" {
+		config.Name = name
+	}
+	config.Client.ClientID = os.Getenv("MQTT_BRIDGE_CLIENT_ID")
+	config.Client.Username = os.Getenv("MQTT_BRIDGE_USERNAME")
+	if password := os.Getenv("MQTT_BRIDGE_PASSWORD"); password != "" {
+		config.Client.Password = []byte(password)
+	}
+	if os.Getenv("MQTT_BRIDGE_TLS") == "true" {
+		config.Client.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
 	}
-	defer listener.Close()
-	log.Printf("MQTT listening on :%d", port)
 	
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Accept error: %v", err)
+	for _, entry := range strings.Split(os.Getenv("MQTT_BRIDGE_TOPICS"), ";") {
+		if strings.TrimSpace(entry) == "" {
 			continue
 		}
-		
-		go handleMQTTConnection(ctx, conn, mgr)
+		topic, err := gateway.ParseBridgeTopic(entry)
+		if err != nil {
+			return config, fmt.Errorf("%q: %w", entry, err)
+		}
+		config.Topics = append(config.Topics, topic)
 	}
+	return config, nil
 }
 
-func handleMQTTConnection(ctx context.Context, conn net.Conn, mgr *gateway.SessionManager) {
-	defer conn.Close()
-	
-	// 解析MQTT连接包
-	connectInfo, err := mqtt.DecodeConnectPacket(conn)
-	if err != nil {
-		log.Printf("MQTT decode error: %v", err)
-		return
+// 未提供 EDGE_LISTENERS 时的默认监听: MQTT 1883, MQTT over WebSocket, 配置了证书时的MQTT over TLS
+func defaultListenersFromEnv() []gateway.ListenerConfig {
+	var options json.RawMessage
+	if topic := os.Getenv("MQTT_COMMAND_TOPIC"); topic != "" {
+		options, _ = json.Marshal(map[string]string{"command_topic": topic})
 	}
+	maxPacketSize, _ := strconv.Atoi(os.Getenv("MQTT_MAX_PACKET_SIZE"))
 	
-	deviceID, ok := connectInfo["client_id"].(string)
-	if !ok || deviceID == "" {
-		log.Println("Invalid device ID")
-		return
+	configs := []gateway.ListenerConfig{
+		{Protocol: "mqtt", Address: ":1883", MaxPacketSize: maxPacketSize, Options: options},
+		{Protocol: "mqtt-ws", Address: portEnv("MQTT_WS_PORT", 8083), MaxPacketSize: maxPacketSize, Options: options},
 	}
 	
-	// 创建协议适配器
-	adapter := mqtt.NewMQTTAdapter(conn)
-	go adapter.Listen()
-	
-	// 管理会话
-	mgr.HandleConnection(ctx, deviceID, adapter)
-	log.Printf("Device %s connected", deviceID)
-	
-	// 等待连接关闭
-	<-adapter.Context().Done()
-	log.Printf("Device %s disconnected", deviceID)
-}
\ No newline at end of file
+	certFile, keyFile := os.Getenv("MQTT_TLS_CERT"), os.Getenv("MQTT_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		configs = append(configs, gateway.ListenerConfig{
+			Protocol: "mqtt",
+			Address:  portEnv("MQTT_TLS_PORT", 8883),
+			TLS: &gateway.ListenerTLS{
+				CertFile:          certFile,
+				KeyFile:           keyFile,
+				ClientCAFile:      os.Getenv("MQTT_TLS_CLIENT_CA"),
+				RequireClientCert: os.Getenv("MQTT_TLS_REQUIRE_CLIENT_CERT") == "true",
+			},
+			MaxPacketSize: maxPacketSize,
+			Options:       options,
+		})
+	}
+	return configs
+}
+
+// 读取端口环境变量, 返回监听地址
+func portEnv(name string, fallback int) string {
+	port, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || port <= 0 {
+		port = fallback
+	}
+	return net.JoinHostPort("", strconv.Itoa(port))
+}
+
+func reloadOnHangup(ctx context.Context, listeners []gateway.Listener) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	for {
+		select {
+		case <-hupCh:
+			for _, listener := range listeners {
+				reloader, ok := listener.(gateway.Reloader)
+				if !ok {
+					continue
+				}
+				if err := reloader.Reload(); err != nil {
+					log.Printf("TLS certificate reload failed on %v: %v", listener.Addr(), err)
+				}
+			}
+			log.Println("TLS certificates reloaded")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+var ErrInvalidAccess = errors.New("invalid access, want publish, subscribe or readwrite")
+
+// 主题访问权限
+type Access byte
+
+const (
+	Subscribe Access = 1 << iota
+	Publish
+	ReadWrite = Subscribe | Publish
+)
+
+func (a Access) String() string {
+	switch a {
+	case Subscribe:
+		return "subscribe"
+	case Publish:
+		return "publish"
+	case ReadWrite:
+		return "readwrite"
+	}
+	return "none"
+}
+
+func (a Access) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Access) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "subscribe":
+		*a = Subscribe
+	case "publish":
+		*a = Publish
+	case "readwrite", "":
+		*a = ReadWrite
+	default:
+		return ErrInvalidAccess
+	}
+	return nil
+}
+
+// 检查客户端对主题的发布或订阅权限
+type Authorizer interface {
+	Authorize(c *Client, access Access, topic string) bool
+}
+
+// ACL 规则, ClientID / Username 为空表示匹配所有客户端;
+// Topic 为主题过滤器, %c 替换为客户端ID, %u 替换为用户名
+type Rule struct {
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Topic    string `json:"topic"`
+	Access   Access `json:"access"`
+	Deny     bool   `json:"deny,omitempty"`
+}
+
+// 设备默认只能访问自己的主题
+var DefaultDeviceRules = []Rule{
+	{Topic: "devices/%c/#", Access: ReadWrite},
+}
+
+// 按顺序匹配规则, 第一条匹配的规则生效, 没有匹配的规则时拒绝.
+// 订阅时允许规则须覆盖整个过滤器, 拒绝规则与过滤器有交集即生效
+type ACL struct {
+	rules []Rule
+}
+
+func NewACL(rules []Rule) *ACL {
+	return &ACL{rules: rules}
+}
+
+func (acl *ACL) Authorize(c *Client, access Access, topic string) bool {
+	for _, rule := range acl.rules {
+		if rule.Access&access == 0 {
+			continue
+		}
+		if rule.ClientID != "" && rule.ClientID != c.ID {
+			continue
+		}
+		if rule.Username != "" && rule.Username != c.Username {
+			continue
+		}
+		filter, ok := expand(rule.Topic, c)
+		if !ok {
+			continue
+		}
+
+		matched := false
+		switch {
+		case access == Publish:
+			matched = mqtt.MatchTopic(filter, topic)
+		case rule.Deny:
+			matched = overlapsFilter(filter, topic)
+		default:
+			matched = coversFilter(filter, topic)
+		}
+		if matched {
+			return !rule.Deny
+		}
+	}
+	return false
+}
+
+// 替换 %c / %u; 值为空或包含通配符、层级分隔符时规则不适用, 防止借此越权
+func expand(filter string, c *Client) (string, bool) {
+	replace := func(placeholder, value string) bool {
+		if !strings.Contains(filter, placeholder) {
+			return true
+		}
+		if value == "" || strings.ContainsAny(value, "+#/") {
+			return false
+		}
+		filter = strings.ReplaceAll(filter, placeholder, value)
+		return true
+	}
+	if !replace("%c", c.ID) || !replace("%u", c.Username) {
+		return "", false
+	}
+	return filter, true
+}
+
+// 规则过滤器是否覆盖订阅过滤器匹配的所有主题
+func coversFilter(rule, filter string) bool {
+	// '$' 开头的系统主题不被首级通配符覆盖
+	if strings.HasPrefix(filter, "$") && (strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "#")) {
+		return false
+	}
+
+	ruleLevels := strings.Split(rule, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, level := range ruleLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		switch filterLevels[i] {
+		case "#":
+			return false
+		case "+":
+			if level != "+" {
+				return false
+			}
+		default:
+			if level != "+" && level != filterLevels[i] {
+				return false
+			}
+		}
+	}
+	return len(ruleLevels) == len(filterLevels)
+}
+
+// 两个过滤器是否能匹配同一个主题
+func overlapsFilter(rule, filter string) bool {
+	// '$' 开头的系统主题不被首级通配符匹配
+	if strings.HasPrefix(rule, "$") != strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	ruleLevels := strings.Split(rule, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, level := range ruleLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		switch filterLevels[i] {
+		case "#":
+			return true
+		case "+":
+		default:
+			if level != "+" && level != filterLevels[i] {
+				return false
+			}
+		}
+	}
+	// 过滤器多出的 "#" 也匹配父级主题
+	return len(ruleLevels) == len(filterLevels) ||
+		(len(filterLevels) == len(ruleLevels)+1 && filterLevels[len(ruleLevels)] == "#")
+}
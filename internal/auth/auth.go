@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+var (
+	// 认证器不处理这类凭据, 由 Chain 交给下一个认证器
+	ErrNoCredentials  = errors.New("no credentials for this authenticator")
+	ErrBadCredentials = errors.New("bad username or password")
+	ErrNotAuthorized  = errors.New("not authorized")
+)
+
+// 认证方式
+type Method string
+
+const (
+	MethodPassword    Method = "password"
+	MethodToken       Method = "token"
+	MethodCertificate Method = "certificate"
+)
+
+// CONNECT 携带的凭据
+type Credentials struct {
+	ClientID string
+	Username string
+	// 密码或访问令牌
+	Password []byte
+	// 已验证的客户端证书身份 (CN / SAN)
+	Certificates []string
+}
+
+// 认证通过的客户端, 用于授权时的 %c / %u 替换
+type Client struct {
+	ID string
+	// 已验证的用户名: 密码认证的账号或证书身份, 令牌认证时为空
+	Username string
+	Method   Method
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, c *Credentials) (*Client, error)
+}
+
+// 按顺序尝试, 跳过返回 ErrNoCredentials 的认证器; 都不处理时拒绝连接
+type Chain []Authenticator
+
+func (chain Chain) Authenticate(ctx context.Context, c *Credentials) (*Client, error) {
+	for _, a := range chain {
+		client, err := a.Authenticate(ctx, c)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return client, err
+	}
+	return nil, ErrNotAuthorized
+}
+
+// 已验证的客户端证书即为凭据, 设备ID必须是证书中的身份之一;
+// CONNECT 中的用户名未经验证, 以证书身份作为用户名
+type CertificateAuthenticator struct{}
+
+func (CertificateAuthenticator) Authenticate(ctx context.Context, c *Credentials) (*Client, error) {
+	if len(c.Certificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	for _, id := range c.Certificates {
+		if id == c.ClientID {
+			return &Client{ID: c.ClientID, Username: id, Method: MethodCertificate}, nil
+		}
+	}
+	return nil, ErrNotAuthorized
+}
+
+// 认证错误对应的 CONNACK 返回码, 后端不可用时返回服务不可用
+func ConnackCode(err error) mqtt.ConnackCode {
+	switch {
+	case errors.Is(err, ErrBadCredentials):
+		return mqtt.RefusedBadCredentials
+	case errors.Is(err, ErrNotAuthorized), errors.Is(err, ErrNoCredentials):
+		return mqtt.RefusedNotAuthorized
+	}
+	return mqtt.RefusedServerUnavailable
+}
+
+// bcrypt 只使用前72字节
+const maxSecretLength = 72
+
+var ErrSecretTooLong = errors.New("secret longer than 72 bytes")
+
+// 生成密码或令牌的 bcrypt 摘要
+func HashSecret(secret string) (string, error) {
+	return HashSecretWithCost(secret, bcrypt.DefaultCost)
+}
+
+// 指定 bcrypt 计算强度, 例如测试中使用 bcrypt.MinCost
+func HashSecretWithCost(secret string, cost int) (string, error) {
+	if len(secret) > maxSecretLength {
+		return "", ErrSecretTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// 比对摘要. 旧版 "sha256$<salt>$<hash>" 摘要仍然接受, 以便迁移到 bcrypt
+func VerifySecret(hash string, secret []byte) bool {
+	if NeedsRehash(hash) {
+		return verifySHA256(hash, secret)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), secret) == nil
+}
+
+// 旧版摘要, 验证通过后应以 HashSecret 重新生成
+func NeedsRehash(hash string) bool {
+	return strings.HasPrefix(hash, "sha256$")
+}
+
+func verifySHA256(hash string, secret []byte) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(secret)
+	expected := "sha256$" + parts[1] + "$" + hex.EncodeToString(h.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
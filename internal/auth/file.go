@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// 本地认证文件, 例如:
+//
+//	{
+//	  "users":  [{"username": "line-1", "password": "$2a$10$..."}],
+//	  "tokens": [{"client_id": "sensor-1", "token": "$2a$10$..."}],
+//	  "acl":    [{"topic": "devices/%c/#", "access": "readwrite"},
+//	             {"username": "ops", "topic": "$SYS/#", "access": "subscribe"}]
+//	}
+type FileConfig struct {
+	Users  []FileUser  `json:"users"`
+	Tokens []FileToken `json:"tokens"`
+	ACL    []Rule      `json:"acl"`
+}
+
+type FileUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"` // HashSecret 生成的摘要
+	// 非空时只允许这些客户端ID使用该账号
+	ClientIDs []string `json:"client_ids,omitempty"`
+}
+
+// 令牌绑定到设备ID, 以密码字段提交
+type FileToken struct {
+	ClientID string `json:"client_id"`
+	Token    string `json:"token"` // HashSecret 生成的摘要
+}
+
+// 基于本地文件的认证与授权, Reload 重新读取文件
+type FileStore struct {
+	path string
+
+	mu     sync.RWMutex
+	users  map[string]FileUser
+	tokens map[string][]string // 客户端ID -> 令牌摘要
+	acl    *ACL
+}
+
+func LoadFile(path string) (*FileStore, error) {
+	f := &FileStore{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileStore) Reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var config FileConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	// 旧版 sha256 摘要仍然接受, 提示重新生成
+	legacy := 0
+	users := make(map[string]FileUser, len(config.Users))
+	for _, u := range config.Users {
+		users[u.Username] = u
+		if NeedsRehash(u.Password) {
+			legacy++
+		}
+	}
+	tokens := make(map[string][]string, len(config.Tokens))
+	for _, t := range config.Tokens {
+		tokens[t.ClientID] = append(tokens[t.ClientID], t.Token)
+		if NeedsRehash(t.Token) {
+			legacy++
+		}
+	}
+	if legacy > 0 {
+		log.Printf("Auth file %s has %d sha256 hashes, regenerate them with bcrypt", f.path, legacy)
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.tokens = tokens
+	f.acl = NewACL(config.ACL)
+	f.mu.Unlock()
+	return nil
+}
+
+// 用户名匹配账号时校验密码, 否则把密码作为该客户端ID的令牌校验;
+// 令牌不验证用户名, 认证结果不带用户名
+func (f *FileStore) Authenticate(ctx context.Context, c *Credentials) (*Client, error) {
+	if c.Password == nil {
+		return nil, ErrNoCredentials
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if user, ok := f.users[c.Username]; ok && c.Username != "" {
+		if !VerifySecret(user.Password, c.Password) {
+			return nil, ErrBadCredentials
+		}
+		if len(user.ClientIDs) > 0 && !contains(user.ClientIDs, c.ClientID) {
+			return nil, ErrNotAuthorized
+		}
+		return &Client{ID: c.ClientID, Username: c.Username, Method: MethodPassword}, nil
+	}
+
+	for _, hash := range f.tokens[c.ClientID] {
+		if VerifySecret(hash, c.Password) {
+			return &Client{ID: c.ClientID, Method: MethodToken}, nil
+		}
+	}
+	return nil, ErrBadCredentials
+}
+
+func (f *FileStore) Authorize(c *Client, access Access, topic string) bool {
+	f.mu.RLock()
+	acl := f.acl
+	f.mu.RUnlock()
+	return acl.Authorize(c, access, topic)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,11 +2,26 @@ package device
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 	
 	"edgesphere/internal/pkg/types"
 )
 
+type DeviceStore interface {
+	Save(ctx context.Context, device *types.Device) error
+	BatchSave(devices []*types.Device) error
+	UpdateStatus(ctx context.Context, id string, status types.DeviceStatus) error
+}
+
+type DeviceCache interface {
+	Exists(id string) bool
+	BatchExists(ids []string) bool
+	Add(id string)
+	SetStatus(id string, status types.DeviceStatus)
+}
+
 type DeviceManager struct {
 	store  DeviceStore
 	cache  DeviceCache
@@ -23,7 +38,7 @@ func NewDeviceManager(store DeviceStore, cache DeviceCache) *DeviceManager {
 // 设备注册 (使用Bloom过滤器防重)
 func (dm *DeviceManager) RegisterDevice(ctx context.Context, device *types.Device) error {
 	if dm.cache.Exists(device.ID) {
-		return errors.New("device already exists")
+		return types.ErrDeviceExists
 	}
 	
 	if err := dm.store.Save(ctx, device); err != nil {
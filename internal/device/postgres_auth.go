@@ -0,0 +1,89 @@
+package device
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/pkg/types"
+)
+
+// 基于 devices 表的设备认证: 设备ID即客户端ID, 密码或令牌与
+// password_hash / token_hash 中的摘要比对, 未注册的设备拒绝连接.
+// 设备没有账号, CONNECT 中的用户名不被采用, 证书认证时以证书身份作为用户名
+type PostgresAuth struct {
+	db  *sql.DB
+	acl *auth.ACL
+}
+
+// acl 为nil时使用 auth.DefaultDeviceRules
+func NewPostgresAuth(store *PostgresStore, acl *auth.ACL) *PostgresAuth {
+	if acl == nil {
+		acl = auth.NewACL(auth.DefaultDeviceRules)
+	}
+	return &PostgresAuth{db: store.db, acl: acl}
+}
+
+func (a *PostgresAuth) Authenticate(ctx context.Context, c *auth.Credentials) (*auth.Client, error) {
+	var status types.DeviceStatus
+	var passwordHash, tokenHash sql.NullString
+	err := a.db.QueryRowContext(ctx, `
+		SELECT status, password_hash, token_hash 
+		FROM devices 
+		WHERE id = $1`, c.ClientID).Scan(&status, &passwordHash, &tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, auth.ErrNotAuthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status == types.Unregistered {
+		return nil, auth.ErrNotAuthorized
+	}
+
+	client := &auth.Client{ID: c.ClientID}
+	for _, id := range c.Certificates {
+		if id == c.ClientID {
+			client.Username = id
+			client.Method = auth.MethodCertificate
+			return client, nil
+		}
+	}
+	if c.Password == nil {
+		return nil, auth.ErrNotAuthorized
+	}
+
+	switch {
+	case passwordHash.Valid && auth.VerifySecret(passwordHash.String, c.Password):
+		client.Method = auth.MethodPassword
+		if auth.NeedsRehash(passwordHash.String) {
+			a.rehash(ctx, "password_hash", c)
+		}
+	case tokenHash.Valid && auth.VerifySecret(tokenHash.String, c.Password):
+		client.Method = auth.MethodToken
+		if auth.NeedsRehash(tokenHash.String) {
+			a.rehash(ctx, "token_hash", c)
+		}
+	default:
+		return nil, auth.ErrBadCredentials
+	}
+	return client, nil
+}
+
+// 验证通过的旧版摘要改写为 bcrypt, 失败时下次认证再试
+func (a *PostgresAuth) rehash(ctx context.Context, column string, c *auth.Credentials) {
+	hash, err := auth.HashSecret(string(c.Password))
+	if err != nil {
+		log.Printf("Failed to rehash %s of device %s: %v", column, c.ClientID, err)
+		return
+	}
+	if _, err := a.db.ExecContext(ctx, "UPDATE devices SET "+column+" = $1 WHERE id = $2", hash, c.ClientID); err != nil {
+		log.Printf("Failed to rehash %s of device %s: %v", column, c.ClientID, err)
+	}
+}
+
+func (a *PostgresAuth) Authorize(c *auth.Client, access auth.Access, topic string) bool {
+	return a.acl.Authorize(c, access, topic)
+}
@@ -3,7 +3,6 @@ package device
 import (
 	"context"
 	"database/sql"
-	"time"
 	
 	_ "github.com/lib/pq"
 	"edgesphere/internal/pkg/types"
@@ -24,7 +23,10 @@ const (
 	);
 	
 	CREATE INDEX IF NOT EXISTS idx_gateway_id ON devices(gateway_id);
-	CREATE INDEX IF NOT EXISTS idx_status ON devices(status);`
+	CREATE INDEX IF NOT EXISTS idx_status ON devices(status);
+	
+	ALTER TABLE devices ADD COLUMN IF NOT EXISTS password_hash TEXT;
+	ALTER TABLE devices ADD COLUMN IF NOT EXISTS token_hash TEXT;`
 )
 
 type PostgresStore struct {
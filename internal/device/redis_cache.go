@@ -3,14 +3,16 @@ package device
 import (
 	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
+	"log"
 	"time"
 	
 	"github.com/go-redis/redis/v8"
 	"edgesphere/internal/pkg/types"
 )
 
+// 发布网关事件的最长时间, Redis不可用时不长时间占用通知协程
+const eventPublishTimeout = 5 * time.Second
+
 type RedisCache struct {
 	client *redis.Client
 	prefix string
@@ -90,4 +92,25 @@ func (c *RedisCache) SubscribeStatusUpdates() <-chan *redis.Message {
 	ctx := context.Background()
 	pubsub := c.client.Subscribe(ctx, "device_status_updates")
 	return pubsub.Channel()
-}
\ No newline at end of file
+}
+
+// 网关上报的设备事件 (遗嘱等)
+func (c *RedisCache) PublishEvent(event *types.DeviceEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+	defer cancel()
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode device event: %v", err)
+		return
+	}
+	if err := c.client.Publish(ctx, "device_events", data).Err(); err != nil {
+		log.Printf("Failed to publish device event for %s: %v", event.DeviceID, err)
+	}
+}
+
+// 订阅设备事件
+func (c *RedisCache) SubscribeEvents() <-chan *redis.Message {
+	ctx := context.Background()
+	pubsub := c.client.Subscribe(ctx, "device_events")
+	return pubsub.Channel()
+}
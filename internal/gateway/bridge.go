@@ -0,0 +1,386 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+var ErrInvalidBridgeTopic = errors.New("invalid bridge topic, want: pattern [in|out|both [qos [local-prefix remote-prefix]]]")
+
+// 已连接时直接发送QoS 0消息的最长写入时间
+const bridgeSendTimeout = 5 * time.Second
+
+// 等待发送协程处理的上行消息数, 超出时丢弃
+const bridgeOutboxSize = 1024
+
+// 桥接方向
+type BridgeDirection string
+
+const (
+	BridgeOut  BridgeDirection = "out"  // 本地 -> 上游
+	BridgeIn   BridgeDirection = "in"   // 上游 -> 本地
+	BridgeBoth BridgeDirection = "both" // 双向
+)
+
+// 主题映射, 与 mosquitto 的 topic 配置一致:
+// 本地主题为 LocalPrefix+Pattern, 上游主题为 RemotePrefix+Pattern
+type BridgeTopic struct {
+	Pattern      string
+	Direction    BridgeDirection
+	QoS          byte // 桥接转发使用的最大QoS
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+func (t BridgeTopic) outbound() bool {
+	return t.Direction == BridgeOut || t.Direction == BridgeBoth
+}
+
+func (t BridgeTopic) inbound() bool {
+	return t.Direction == BridgeIn || t.Direction == BridgeBoth
+}
+
+// 解析 "telemetry/# out 1 site/ central/site-1/", 前缀为空时写作 ""
+func ParseBridgeTopic(s string) (BridgeTopic, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) == 4 || len(fields) > 5 {
+		return BridgeTopic{}, ErrInvalidBridgeTopic
+	}
+	for i, f := range fields {
+		if f == `""` {
+			fields[i] = ""
+		}
+	}
+
+	t := BridgeTopic{Pattern: fields[0], Direction: BridgeOut}
+	if len(fields) > 1 {
+		t.Direction = BridgeDirection(fields[1])
+		if !t.inbound() && !t.outbound() {
+			return BridgeTopic{}, ErrInvalidBridgeTopic
+		}
+	}
+	if len(fields) > 2 {
+		qos, err := strconv.Atoi(fields[2])
+		if err != nil || qos < 0 || qos > 2 {
+			return BridgeTopic{}, ErrInvalidBridgeTopic
+		}
+		t.QoS = byte(qos)
+	}
+	if len(fields) == 5 {
+		t.LocalPrefix, t.RemotePrefix = fields[3], fields[4]
+	}
+	if !mqtt.ValidTopicFilter(t.LocalPrefix+t.Pattern) || !mqtt.ValidTopicFilter(t.RemotePrefix+t.Pattern) {
+		return BridgeTopic{}, ErrInvalidBridgeTopic
+	}
+	return t, nil
+}
+
+// 桥接配置
+type BridgeConfig struct {
+	Name    string // 区分多个桥接的离线消息
+	Address string // 上游代理 host:port
+	Client  mqtt.ClientOptions
+	Topics  []BridgeTopic
+
+	// 重连退避, 每次失败翻倍并加入随机抖动
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// 上游断开期间在SQLite中保存的最大消息数, 超过时丢弃最早的消息; 0表示不限制
+	MaxQueued int
+}
+
+var DefaultBridgeConfig = BridgeConfig{
+	Name: "upstream",
+	Client: mqtt.ClientOptions{
+		KeepAlive:     60 * time.Second,
+		ProtocolLevel: mqtt.ProtocolLevel311,
+		DialTimeout:   10 * time.Second,
+	},
+	MinBackoff: time.Second,
+	MaxBackoff: 2 * time.Minute,
+	MaxQueued:  100000,
+}
+
+// 保存在SQLite中等待发往上游的消息
+type BridgeMessage struct {
+	ID int64
+	*QueuedMessage
+}
+
+// 到上游MQTT代理的桥接. 上行消息先写入SQLite再按顺序发送, 确认后删除,
+// 因此上游断开或网关重启期间不会丢失; 上游下发的消息按映射在本地路由
+type Bridge struct {
+	sm      *SessionManager
+	config  BridgeConfig
+	localID string // 上游下发消息在本地的来源, 用于避免回环
+	wake    chan struct{}
+	outbox  chan *QueuedMessage // 本地发布的上行消息, 由 sendLoop 发送或保存
+
+	mu     sync.Mutex
+	client *mqtt.Client
+	ctx    context.Context // Start 的ctx, 限定直接发送的QoS 0消息
+}
+
+// 创建桥接并注册到会话管理器, 调用 Start 后开始连接
+func NewBridge(sm *SessionManager, config BridgeConfig) *Bridge {
+	if config.Client.ClientID == "" {
+		config.Client.ClientID = "edge-bridge-" + config.Name
+	}
+	b := &Bridge{
+		sm:      sm,
+		config:  config,
+		localID: "$bridge/" + config.Name,
+		wake:    make(chan struct{}, 1),
+		outbox:  make(chan *QueuedMessage, bridgeOutboxSize),
+	}
+
+	sm.mu.Lock()
+	sm.bridges = append(sm.bridges, b)
+	sm.mu.Unlock()
+	return b
+}
+
+// 后台连接上游, 直到 ctx 取消
+func (b *Bridge) Start(ctx context.Context) {
+	b.mu.Lock()
+	b.ctx = ctx
+	b.mu.Unlock()
+	go b.run(ctx)
+	go b.sendLoop(ctx)
+}
+
+func (b *Bridge) Connected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.client != nil
+}
+
+func (b *Bridge) run(ctx context.Context) {
+	backoff := b.config.MinBackoff
+	for {
+		client, err := b.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			log.Printf("Bridge %s: connect to %s failed: %v, retrying in %v", b.config.Name, b.config.Address, err, wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > b.config.MaxBackoff {
+				backoff = b.config.MaxBackoff
+			}
+			continue
+		}
+
+		backoff = b.config.MinBackoff
+		log.Printf("Bridge %s: connected to %s", b.config.Name, b.config.Address)
+		b.setClient(client)
+		b.drain(ctx, client)
+		b.setClient(nil)
+		client.Close()
+
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Bridge %s: connection lost: %v", b.config.Name, client.Err())
+	}
+}
+
+func (b *Bridge) setClient(client *mqtt.Client) {
+	b.mu.Lock()
+	b.client = client
+	b.mu.Unlock()
+}
+
+// 连接上游并订阅下行主题
+func (b *Bridge) connect(ctx context.Context) (*mqtt.Client, error) {
+	opts := b.config.Client
+	opts.OnPublish = b.onRemotePublish
+	client, err := mqtt.Dial(ctx, b.config.Address, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []mqtt.Subscription
+	for _, t := range b.config.Topics {
+		if t.inbound() {
+			subs = append(subs, mqtt.Subscription{Filter: t.RemotePrefix + t.Pattern, QoS: t.QoS})
+		}
+	}
+	if len(subs) == 0 {
+		return client, nil
+	}
+	codes, err := client.Subscribe(ctx, subs)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	for i, code := range codes {
+		if code >= 0x80 && i < len(subs) {
+			log.Printf("Bridge %s: subscription to %s rejected (0x%02X)", b.config.Name, subs[i].Filter, code)
+		}
+	}
+	return client, nil
+}
+
+// 按顺序发送保存的上行消息, 连接断开或发送失败时返回, 未确认的消息留待重连后重发;
+// 只有上游以失败原因码拒绝的消息被丢弃
+func (b *Bridge) drain(ctx context.Context, client *mqtt.Client) {
+	if b.sm.cache == nil {
+		select {
+		case <-client.Done():
+		case <-ctx.Done():
+		}
+		return
+	}
+	for {
+		messages, err := b.sm.cache.PeekBridgeMessages(b.config.Name, 100)
+		if err != nil {
+			log.Printf("Bridge %s: failed to read outbox: %v", b.config.Name, err)
+			return
+		}
+		if len(messages) == 0 {
+			select {
+			case <-b.wake:
+				continue
+			case <-client.Done():
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for _, m := range messages {
+			if !m.inflight().expired() {
+				err := client.Publish(ctx, b.packet(m.QueuedMessage))
+				if err != nil && !errors.Is(err, mqtt.ErrPublishRejected) {
+					if ctx.Err() == nil {
+						log.Printf("Bridge %s: failed to send message on %s: %v", b.config.Name, m.Topic, err)
+					}
+					return
+				}
+				if err != nil {
+					// 上游拒绝 (例如无权限) 的消息重发也不会成功, 丢弃
+					log.Printf("Bridge %s: dropping message on %s: %v", b.config.Name, m.Topic, err)
+				}
+			}
+			if err := b.sm.cache.DeleteBridgeMessage(m.ID); err != nil {
+				log.Printf("Bridge %s: failed to delete sent message: %v", b.config.Name, err)
+			}
+		}
+	}
+}
+
+func (b *Bridge) packet(m *QueuedMessage) *mqtt.PublishPacket {
+	p := &mqtt.PublishPacket{
+		Topic:   m.Topic,
+		QoS:     m.QoS,
+		Retain:  m.Retain,
+		Payload: m.Payload,
+	}
+	if b.config.Client.ProtocolLevel == mqtt.ProtocolLevel5 {
+		p.Properties = m.Properties
+	}
+	return p
+}
+
+// 本地发布的消息按第一条匹配的上行映射转发. 在发布者的读取协程中调用,
+// 只放入发送队列, 上游过慢时不阻塞本地发布者
+func (b *Bridge) forward(from string, msg *inflightMessage) {
+	if from == b.localID {
+		return
+	}
+	for _, t := range b.config.Topics {
+		if !t.outbound() || !mqtt.MatchTopic(t.LocalPrefix+t.Pattern, msg.Topic) {
+			continue
+		}
+		out := &QueuedMessage{
+			Topic:      t.RemotePrefix + strings.TrimPrefix(msg.Topic, t.LocalPrefix),
+			Payload:    msg.Payload,
+			QoS:        minQoS(msg.QoS, t.QoS),
+			Retain:     msg.Retain,
+			Properties: msg.Properties,
+			ExpiresAt:  msg.ExpiresAt,
+		}
+		select {
+		case b.outbox <- out:
+		default:
+			log.Printf("Bridge %s: outbox full, dropping message on %s", b.config.Name, out.Topic)
+		}
+		return
+	}
+}
+
+func (b *Bridge) sendLoop(ctx context.Context) {
+	for {
+		select {
+		case msg := <-b.outbox:
+			b.send(msg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 已连接时QoS 0直接发送, 其余消息写入SQLite后由 drain 按顺序发送
+
+func (b *Bridge) send(msg *QueuedMessage) {
+	if msg.QoS == 0 {
+		b.mu.Lock()
+		client, ctx := b.client, b.ctx
+		b.mu.Unlock()
+		if client != nil {
+			ctx, cancel := context.WithTimeout(ctx, bridgeSendTimeout)
+			err := client.Publish(ctx, b.packet(msg))
+			cancel()
+			if err == nil {
+				return
+			}
+			// 写入超时后连接状态未知, 断开重连, 消息改为保存后发送
+			client.Close()
+		}
+	}
+
+	if b.sm.cache == nil {
+		log.Printf("Bridge %s: no offline cache, dropping message on %s", b.config.Name, msg.Topic)
+		return
+	}
+	if err := b.sm.cache.QueueBridgeMessage(b.config.Name, msg, b.config.MaxQueued); err != nil {
+		log.Printf("Bridge %s: failed to store message on %s: %v", b.config.Name, msg.Topic, err)
+		return
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 上游下发的消息按第一条匹配的下行映射在本地路由
+func (b *Bridge) onRemotePublish(p *mqtt.PublishPacket) {
+	for _, t := range b.config.Topics {
+		if !t.inbound() || !mqtt.MatchTopic(t.RemotePrefix+t.Pattern, p.Topic) {
+			continue
+		}
+		b.sm.onPublish(b.localID, &mqtt.PublishPacket{
+			Topic:      t.LocalPrefix + strings.TrimPrefix(p.Topic, t.RemotePrefix),
+			QoS:        minQoS(p.QoS, t.QoS),
+			Retain:     p.Retain,
+			Payload:    p.Payload,
+			Properties: p.Properties,
+		})
+		return
+	}
+	log.Printf("Bridge %s: no mapping for remote topic %s", b.config.Name, p.Topic)
+}
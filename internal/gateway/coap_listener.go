@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/protocol/coap"
+)
+
+var ErrTLSUnsupported = errors.New("protocol does not support tls")
+
+// 等待新对端发送第一个请求的时间
+const coapIdentifyTimeout = 10 * time.Second
+
+func init() {
+	RegisterProtocol(coap.Protocol, listenCoAP)
+}
+
+// coap 监听器选项
+type coapListenerOptions struct {
+	TelemetryPath string `json:"telemetry_path,omitempty"`
+	CommandPath   string `json:"command_path,omitempty"`
+	KeepAlive     int    `json:"keep_alive,omitempty"` // 秒
+	BlockSize     int    `json:"block_size,omitempty"`
+}
+
+// CoAP over UDP, 设备的第一个请求以 ep 查询参数声明设备ID, 以 token 查询参数认证
+func listenCoAP(ctx context.Context, config ListenerConfig, sm *SessionManager) (Listener, error) {
+	if config.TLS != nil {
+		return nil, ErrTLSUnsupported
+	}
+	var options coapListenerOptions
+	if err := config.DecodeOptions(&options); err != nil {
+		return nil, err
+	}
+
+	coapConfig := coap.DefaultConfig
+	coapConfig.MaxPeers = config.MaxConnections
+	if config.MaxPacketSize > 0 {
+		coapConfig.MaxMessageSize = config.MaxPacketSize
+	}
+	if options.BlockSize > 0 {
+		coapConfig.BlockSize = options.BlockSize
+	}
+	adapterConfig := coap.DefaultAdapterConfig
+	if options.TelemetryPath != "" {
+		adapterConfig.TelemetryPath = options.TelemetryPath
+	}
+	if options.CommandPath != "" {
+		adapterConfig.CommandPath = options.CommandPath
+	}
+	adapterConfig.KeepAlive = time.Duration(options.KeepAlive) * time.Second
+
+	server, err := coap.Listen(config.Address, coapConfig)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleCoAPConnection(ctx, conn, sm, adapterConfig)
+		}
+	}()
+	return server, nil
+}
+
+func handleCoAPConnection(ctx context.Context, conn *coap.Conn, sm *SessionManager, config coap.AdapterConfig) {
+	defer conn.Close()
+
+	// 识别和认证共用超时
+	identifyCtx, cancel := context.WithTimeout(ctx, coapIdentifyTimeout)
+	defer cancel()
+	req, err := conn.Peek(identifyCtx)
+	if err != nil {
+		return
+	}
+	deviceID := req.Query(coap.EndpointQuery)
+	if deviceID == "" {
+		log.Printf("CoAP request from %v without endpoint name", conn.RemoteAddr())
+		conn.Reject(req, coap.Unauthorized)
+		return
+	}
+	if err := sm.authenticateCoAP(identifyCtx, deviceID, req); err != nil {
+		log.Printf("CoAP device %s rejected: %v", deviceID, err)
+		conn.Reject(req, coapAuthCode(err))
+		return
+	}
+
+	adapter := coap.NewAdapterWithConfig(conn, deviceID, config)
+	sm.HandleConnection(ctx, deviceID, adapter)
+}
+
+// 令牌作为密码交给认证器; 配置了认证器而请求不带令牌时拒绝
+func (sm *SessionManager) authenticateCoAP(ctx context.Context, deviceID string, req *coap.Message) error {
+	if sm.authn == nil {
+		return nil
+	}
+	token := req.Query(coap.TokenQuery)
+	if token == "" {
+		return auth.ErrNoCredentials
+	}
+	_, err := sm.authn.Authenticate(ctx, &auth.Credentials{
+		ClientID: deviceID,
+		Password: []byte(token),
+	})
+	return err
+}
+
+// 认证错误对应的响应码, 后端不可用时返回服务不可用
+func coapAuthCode(err error) coap.Code {
+	switch {
+	case errors.Is(err, auth.ErrBadCredentials), errors.Is(err, auth.ErrNoCredentials):
+		return coap.Unauthorized
+	case errors.Is(err, auth.ErrNotAuthorized):
+		return coap.Forbidden
+	}
+	return coap.ServiceUnavailable
+}
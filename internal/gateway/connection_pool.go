@@ -39,15 +39,22 @@ func (p *ConnectionPool) Remove(id string) {
 	delete(p.pool, id)
 }
 
-// 零拷贝优化
-func (p *ConnectionPool) SendWithZeroCopy(id string, data []byte) error {
+// 当前所有连接
+func (p *ConnectionPool) List() []*types.DeviceConnection {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	
-	if conn, ok := p.pool[id]; ok {
-		// 使用io_uring系统调用 (Linux)
-		_, err := unix.IoUringSubmit(conn.Fd(), data)
-		return err
+	conns := make([]*types.DeviceConnection, 0, len(p.pool))
+	for _, conn := range p.pool {
+		conns = append(conns, conn)
 	}
-	return errors.New("connection not found")
-}
\ No newline at end of file
+	return conns
+}
+
+// 当前连接数
+func (p *ConnectionPool) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	return len(p.pool)
+}
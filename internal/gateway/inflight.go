@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 待投递命令 (离线缓存或未确认的QoS 1/2命令)
+type PendingCommand struct {
+	Payload  []byte
+	QoS      byte
+	PacketID uint16 // 非0表示已发送但未确认, 重连后以DUP重传
+	Released bool   // QoS 2已收到PUBREC, 重连后只需重发PUBREL
+}
+
+type inflightMessage struct {
+	PendingCommand
+	Topic      string
+	Retain     bool
+	Command    bool   // 设备命令, 会话断开时写回离线缓存
+	Share      string // 共享订阅过滤器, 成员断开时改投组内其他成员
+	SentAt     time.Time
+	Properties *mqtt.Properties // MQTT 5.0 转发属性
+	ExpiresAt  time.Time        // 消息过期时间, 零值表示不过期
+}
+
+// 已过期的消息不再投递
+func (m *inflightMessage) expired() bool {
+	return !m.ExpiresAt.IsZero() && time.Now().After(m.ExpiresAt)
+}
+
+// 构造 PUBLISH 报文, 消息过期间隔更新为剩余时间
+func (m *inflightMessage) packet(dup bool) *mqtt.PublishPacket {
+	props := m.Properties
+	if !m.ExpiresAt.IsZero() {
+		props = props.ForwardCopy()
+		if props == nil {
+			props = &mqtt.Properties{}
+		}
+		remaining := uint32(0)
+		if d := time.Until(m.ExpiresAt); d > 0 {
+			remaining = uint32((d + time.Second - 1) / time.Second)
+		}
+		props.MessageExpiry = &remaining
+	}
+	return &mqtt.PublishPacket{
+		Topic:      m.Topic,
+		PacketID:   m.PacketID,
+		QoS:        m.QoS,
+		Retain:     m.Retain,
+		Dup:        dup,
+		Payload:    m.Payload,
+		Properties: props,
+	}
+}
+
+// 出站QoS 1/2 飞行窗口
+type inflightWindow struct {
+	mu       sync.Mutex
+	size     int
+	nextID   uint16
+	messages map[uint16]*inflightMessage
+	order    []uint16           // 按发送顺序记录报文标识符
+	queue    []*inflightMessage // 窗口已满时排队
+}
+
+func newInflightWindow(size int) *inflightWindow {
+	return &inflightWindow{
+		size:     size,
+		messages: make(map[uint16]*inflightMessage),
+	}
+}
+
+// 加入窗口并分配报文标识符, 窗口已满时排队并返回false
+func (w *inflightWindow) push(msg *inflightMessage) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.messages) >= w.size || len(w.queue) > 0 {
+		w.queue = append(w.queue, msg)
+		return false
+	}
+	w.add(msg)
+	return true
+}
+
+// 恢复重连前已分配标识符的消息
+func (w *inflightWindow) restore(msg *inflightMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.messages[msg.PacketID]; exists || msg.PacketID == 0 {
+		msg.PacketID = w.allocate()
+	}
+	w.messages[msg.PacketID] = msg
+	w.order = append(w.order, msg.PacketID)
+}
+
+// 收到PUBREC, 标记为等待PUBCOMP
+func (w *inflightWindow) release(packetID uint16) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	msg, ok := w.messages[packetID]
+	if !ok || msg.QoS != 2 {
+		return false
+	}
+	msg.Released = true
+	return true
+}
+
+// 收到PUBACK/PUBCOMP, 移出窗口并返回可以发送的排队消息
+func (w *inflightWindow) complete(packetID uint16) []*inflightMessage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.messages[packetID]; !ok {
+		return nil
+	}
+	delete(w.messages, packetID)
+	for i, id := range w.order {
+		if id == packetID {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+
+	var ready []*inflightMessage
+	for len(w.queue) > 0 && len(w.messages) < w.size {
+		msg := w.queue[0]
+		w.queue = w.queue[1:]
+		w.add(msg)
+		ready = append(ready, msg)
+	}
+	return ready
+}
+
+// 取出所有未完成的消息 (飞行中 + 排队), 按发送顺序
+func (w *inflightWindow) drain() []*inflightMessage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	msgs := make([]*inflightMessage, 0, len(w.order)+len(w.queue))
+	for _, id := range w.order {
+		msgs = append(msgs, w.messages[id])
+	}
+	msgs = append(msgs, w.queue...)
+
+	w.messages = make(map[uint16]*inflightMessage)
+	w.order = nil
+	w.queue = nil
+	return msgs
+}
+
+func (w *inflightWindow) add(msg *inflightMessage) {
+	msg.PacketID = w.allocate()
+	msg.SentAt = time.Now()
+	w.messages[msg.PacketID] = msg
+	w.order = append(w.order, msg.PacketID)
+}
+
+// 分配未被占用的非0标识符
+func (w *inflightWindow) allocate() uint16 {
+	for {
+		w.nextID++
+		if w.nextID == 0 {
+			continue
+		}
+		if _, used := w.messages[w.nextID]; !used {
+			return w.nextID
+		}
+	}
+}
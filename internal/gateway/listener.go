@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+var ErrUnknownProtocol = errors.New("unknown listener protocol")
+
+// 监听器配置文件, 例如:
+//
+//	{"listeners": [
+//	  {"protocol": "mqtt", "address": ":1883", "max_connections": 10000},
+//	  {"protocol": "mqtt", "address": ":8883", "tls": {"cert_file": "server.pem", "key_file": "server.key"}},
+//	  {"protocol": "mqtt-ws", "address": ":8083", "options": {"path": "/mqtt"}}
+//	]}
+type ListenersConfig struct {
+	Listeners []ListenerConfig `json:"listeners"`
+}
+
+// 单个监听器
+type ListenerConfig struct {
+	Name     string       `json:"name,omitempty"`
+	Protocol string       `json:"protocol"`
+	Address  string       `json:"address"`
+	TLS      *ListenerTLS `json:"tls,omitempty"`
+
+	// 同时连接的设备数上限, 超过时直接关闭新连接; 0表示不限制
+	MaxConnections int `json:"max_connections,omitempty"`
+	// 单个入站报文的最大长度, 0表示使用协议默认值
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+
+	// 协议相关选项, 由对应的工厂解析
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+func (c ListenerConfig) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Protocol + "://" + c.Address
+}
+
+// 解析协议相关选项, 未配置时保留默认值
+func (c ListenerConfig) DecodeOptions(v interface{}) error {
+	if len(c.Options) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.Options, v)
+}
+
+// 监听器TLS配置, 证书文件变更时自动重载
+type ListenerTLS struct {
+	CertFile          string `json:"cert_file"`
+	KeyFile           string `json:"key_file"`
+	ClientCAFile      string `json:"client_ca_file,omitempty"`
+	RequireClientCert bool   `json:"require_client_cert,omitempty"`
+}
+
+func (t *ListenerTLS) config() mqtt.TLSConfig {
+	config := mqtt.DefaultTLSConfig
+	config.CertFile = t.CertFile
+	config.KeyFile = t.KeyFile
+	config.ClientCAFile = t.ClientCAFile
+	config.RequireClientCert = t.RequireClientCert
+	return config
+}
+
+func LoadListenersConfig(path string) ([]ListenerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config ListenersConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return config.Listeners, nil
+}
+
+// 运行中的监听器
+type Listener interface {
+	Addr() net.Addr
+	Close() error
+}
+
+// 支持证书重载的监听器, 例如收到SIGHUP时调用
+type Reloader interface {
+	Reload() error
+}
+
+// 协议监听器工厂: 开始监听并在后台把设备连接交给会话管理器, ctx 取消时停止
+type ListenerFactory func(ctx context.Context, config ListenerConfig, sm *SessionManager) (Listener, error)
+
+var (
+	protocolsMu sync.RWMutex
+	protocols   = make(map[string]ListenerFactory)
+)
+
+// 注册协议监听器工厂, 通常在协议包的 init 中调用
+func RegisterProtocol(name string, factory ListenerFactory) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+	protocols[name] = factory
+}
+
+// 已注册的协议
+func Protocols() []string {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 按配置启动监听器
+func (sm *SessionManager) StartListener(ctx context.Context, config ListenerConfig) (Listener, error) {
+	protocolsMu.RLock()
+	factory, ok := protocols[config.Protocol]
+	protocolsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProtocol, config.Protocol)
+	}
+
+	listener, err := factory(ctx, config, sm)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", config, err)
+	}
+	log.Printf("%s listening on %v", config.Protocol, listener.Addr())
+	return listener, nil
+}
+
+// 限制同时连接数的TCP监听器, 超过上限的连接直接关闭
+type limitListener struct {
+	net.Listener
+	name   string
+	max    int64
+	active atomic.Int64
+}
+
+func newLimitListener(l net.Listener, name string, max int) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, name: name, max: int64(max)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.active.Add(1) > l.max {
+			l.active.Add(-1)
+			log.Printf("%s: connection limit %d reached, rejecting %v", l.name, l.max, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: func() { l.active.Add(-1) }}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/coap"
+	"edgesphere/internal/protocol/lwm2m"
+)
+
+func init() {
+	RegisterProtocol(lwm2m.Protocol, listenLwM2M)
+}
+
+// lwm2m 监听器选项
+type lwm2mListenerOptions struct {
+	Format         string `json:"format,omitempty"`           // tlv 或 senml-json, 默认按设备的协议版本选择
+	QueueAwakeTime int    `json:"queue_awake_time,omitempty"` // 秒
+	BlockSize      int    `json:"block_size,omitempty"`
+}
+
+var lwm2mFormats = map[string]uint32{
+	"tlv":        lwm2m.FormatTLV,
+	"senml-json": lwm2m.FormatSenMLJSON,
+}
+
+// LwM2M服务端, 设备以注册接口 (/rd) 上线, 端点名即设备ID
+func listenLwM2M(ctx context.Context, config ListenerConfig, sm *SessionManager) (Listener, error) {
+	if config.TLS != nil {
+		return nil, ErrTLSUnsupported
+	}
+	var options lwm2mListenerOptions
+	if err := config.DecodeOptions(&options); err != nil {
+		return nil, err
+	}
+
+	coapConfig := coap.DefaultConfig
+	coapConfig.MaxPeers = config.MaxConnections
+	if config.MaxPacketSize > 0 {
+		coapConfig.MaxMessageSize = config.MaxPacketSize
+	}
+	if options.BlockSize > 0 {
+		coapConfig.BlockSize = options.BlockSize
+	}
+	serverConfig := lwm2m.DefaultConfig
+	if options.Format != "" {
+		format, ok := lwm2mFormats[options.Format]
+		if !ok {
+			return nil, errors.New("unknown lwm2m format: " + options.Format)
+		}
+		serverConfig.Format = format
+	}
+	if options.QueueAwakeTime > 0 {
+		serverConfig.QueueAwakeTime = time.Duration(options.QueueAwakeTime) * time.Second
+	}
+	// 与CoAP相同, 注册请求携带令牌, 认证通过前不登记设备也不接管同ID的会话
+	serverConfig.Authenticate = func(endpoint string, req *coap.Message) coap.Code {
+		authCtx, cancel := context.WithTimeout(ctx, coapIdentifyTimeout)
+		defer cancel()
+		if err := sm.authenticateCoAP(authCtx, endpoint, req); err != nil {
+			log.Printf("LwM2M device %s rejected: %v", endpoint, err)
+			return coapAuthCode(err)
+		}
+		return 0
+	}
+
+	server, err := coap.Listen(config.Address, coapConfig)
+	if err != nil {
+		return nil, err
+	}
+	l := &lwm2mListener{coap: server, server: lwm2m.NewServer(serverConfig)}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go l.server.ServeConn(conn)
+		}
+	}()
+	go func() {
+		for {
+			adapter, err := l.server.Accept()
+			if err != nil {
+				return
+			}
+			go handleLwM2MRegistration(ctx, sm, adapter)
+		}
+	}()
+	return l, nil
+}
+
+type lwm2mListener struct {
+	coap   *coap.Server
+	server *lwm2m.Server
+}
+
+func (l *lwm2mListener) Addr() net.Addr {
+	return l.coap.Addr()
+}
+
+func (l *lwm2mListener) Close() error {
+	l.server.Close()
+	return l.coap.Close()
+}
+
+// 注册期间设备在线: 首次注册时登记设备, 注销或注册过期后标记为离线
+func handleLwM2MRegistration(ctx context.Context, sm *SessionManager, adapter *lwm2m.Adapter) {
+	reg := adapter.Registration()
+	deviceID := reg.Endpoint
+	objects := make([]string, len(reg.Objects))
+	for i, path := range reg.Objects {
+		objects[i] = path.String()
+	}
+	now := time.Now()
+	sm.registerOnline(&types.Device{
+		ID:        deviceID,
+		Name:      deviceID,
+		Type:      lwm2m.Protocol,
+		Status:    types.Online,
+		LastSeen:  now,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Metadata: map[string]string{
+			"lwm2m_version": reg.Version,
+			"binding":       reg.Binding,
+			"lifetime":      strconv.Itoa(int(reg.Lifetime / time.Second)),
+			"objects":       strings.Join(objects, ","),
+		},
+	})
+
+	sm.HandleConnection(ctx, deviceID, adapter)
+
+	// 设备已重新注册时新的注册仍在线
+	if sm.registry != nil {
+		sm.mu.RLock()
+		current, ok := sm.sessions.Get(deviceID)
+		sm.mu.RUnlock()
+		if !ok || current.Adapter == types.ProtocolAdapter(adapter) {
+			sm.updateStatus(deviceID, types.Offline)
+		}
+	}
+}
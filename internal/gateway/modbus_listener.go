@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"edgesphere/internal/protocol/modbus"
+)
+
+// 从站不可达时的重连间隔
+const (
+	modbusMinBackoff = time.Second
+	modbusMaxBackoff = time.Minute
+)
+
+func init() {
+	RegisterProtocol(modbus.Protocol, listenModbus)
+}
+
+// modbus 监听器选项: 轮询计划文件, 或直接内嵌 "devices"
+type modbusListenerOptions struct {
+	PlanFile string `json:"plan_file,omitempty"`
+	modbus.PollPlan
+}
+
+// Modbus设备不能主动连接网关, 由网关按轮询计划连接各从站; Address 不使用
+func listenModbus(ctx context.Context, config ListenerConfig, sm *SessionManager) (Listener, error) {
+	if config.TLS != nil {
+		return nil, ErrTLSUnsupported
+	}
+	var options modbusListenerOptions
+	if err := config.DecodeOptions(&options); err != nil {
+		return nil, err
+	}
+	plan := &options.PollPlan
+	if options.PlanFile != "" {
+		var err error
+		if plan, err = modbus.LoadPollPlan(options.PlanFile); err != nil {
+			return nil, err
+		}
+	} else if err := plan.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	clients := modbusClients(plan)
+	for _, device := range plan.Devices {
+		go pollModbusDevice(ctx, sm, clients[device.Address], device)
+	}
+	go func() {
+		<-ctx.Done()
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	return &poller{addr: pollerAddr(fmt.Sprintf("%d devices", len(plan.Devices))), cancel: cancel}, nil
+}
+
+// 同一地址 (如一个串口服务器) 上的从站共用一个客户端, 请求串行发送.
+// 超时和帧间隔取这些从站中最大的
+func modbusClients(plan *modbus.PollPlan) map[string]*modbus.Client {
+	configs := make(map[string]modbus.ClientConfig)
+	for _, device := range plan.Devices {
+		config, ok := configs[device.Address]
+		if !ok {
+			config = modbus.DefaultClientConfig
+		}
+		if t := time.Duration(device.Timeout); t > config.Timeout {
+			config.Timeout = t
+		}
+		if d := time.Duration(device.FrameDelay); d > config.FrameDelay {
+			config.FrameDelay = d
+		}
+		configs[device.Address] = config
+	}
+
+	clients := make(map[string]*modbus.Client)
+	for _, device := range plan.Devices {
+		if _, ok := clients[device.Address]; !ok {
+			clients[device.Address] = device.NewClient(configs[device.Address])
+		}
+	}
+	return clients
+}
+
+// 轮询从站, 连接断开或从站不响应后按退避间隔重试. 共用的连接可能一直可用,
+// 所以先成功轮询一次才认为从站上线, 避免不响应的从站反复上下线
+func pollModbusDevice(ctx context.Context, sm *SessionManager, client *modbus.Client, plan modbus.DevicePlan) {
+	backoff := modbusMinBackoff
+	for {
+		adapter, err := probeModbusDevice(ctx, client, plan)
+		if err == nil {
+			backoff = modbusMinBackoff
+			sm.HandleConnection(ctx, plan.ID, adapter)
+		} else if ctx.Err() == nil {
+			log.Printf("Modbus device %s (unit %d at %s) unreachable: %v", plan.ID, plan.UnitID, plan.Address, err)
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > modbusMaxBackoff {
+			backoff = modbusMaxBackoff
+		}
+	}
+}
+
+func probeModbusDevice(ctx context.Context, client *modbus.Client, plan modbus.DevicePlan) (*modbus.Adapter, error) {
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	adapter := modbus.NewAdapter(client, plan)
+	if _, err := adapter.Poll(ctx); err != nil {
+		return nil, err
+	}
+	return adapter, nil
+}
+
+// 主动连接设备的协议没有监听地址, 关闭时停止轮询
+type poller struct {
+	addr   pollerAddr
+	cancel context.CancelFunc
+}
+
+func (p *poller) Addr() net.Addr {
+	return p.addr
+}
+
+func (p *poller) Close() error {
+	p.cancel()
+	return nil
+}
+
+type pollerAddr string
+
+func (a pollerAddr) Network() string { return "poll" }
+func (a pollerAddr) String() string  { return string(a) }
@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 建立连接后等待CONNECT的最长时间
+const mqttConnectTimeout = 10 * time.Second
+
+func init() {
+	RegisterProtocol(mqtt.Protocol, listenMQTT)
+	RegisterProtocol(mqtt.Protocol+"-ws", listenMQTTWebSocket)
+}
+
+// mqtt / mqtt-ws 监听器选项
+type mqttListenerOptions struct {
+	CommandTopic string `json:"command_topic,omitempty"`
+	Path         string `json:"path,omitempty"` // 仅 mqtt-ws, 默认 "/mqtt"
+}
+
+// MQTT监听器, 配置了TLS时支持证书热更新
+type mqttListener struct {
+	net.Listener
+	reloader *mqtt.CertReloader
+}
+
+// 重新读取证书, 已建立的会话不受影响
+func (l *mqttListener) Reload() error {
+	if l.reloader == nil {
+		return nil
+	}
+	return l.reloader.Reload()
+}
+
+func listenMQTT(ctx context.Context, config ListenerConfig, sm *SessionManager) (Listener, error) {
+	return startMQTTListener(ctx, config, sm, false)
+}
+
+// MQTT over WebSocket, 二进制帧被包装为字节流后复用同一套解码和会话逻辑
+func listenMQTTWebSocket(ctx context.Context, config ListenerConfig, sm *SessionManager) (Listener, error) {
+	return startMQTTListener(ctx, config, sm, true)
+}
+
+func startMQTTListener(ctx context.Context, config ListenerConfig, sm *SessionManager, websocket bool) (Listener, error) {
+	options := mqttListenerOptions{Path: "/mqtt"}
+	if err := config.DecodeOptions(&options); err != nil {
+		return nil, err
+	}
+	adapterConfig := mqtt.DefaultAdapterConfig
+	if options.CommandTopic != "" {
+		adapterConfig.CommandTopic = options.CommandTopic
+	}
+	if config.MaxPacketSize > 0 {
+		adapterConfig.MaxPacketSize = config.MaxPacketSize
+	}
+	adapterConfig.Traffic = sm.Traffic()
+
+	var reloader *mqtt.CertReloader
+	if config.TLS != nil {
+		var err error
+		if reloader, err = mqtt.NewCertReloader(config.TLS.config()); err != nil {
+			return nil, err
+		}
+	}
+
+	tcp, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	// 连接数限制作用于TCP连接, 在TLS之下以保留 *tls.Conn 供证书身份校验
+	listener := newLimitListener(tcp, config.String(), config.MaxConnections)
+	if reloader != nil {
+		go reloader.Watch(ctx.Done())
+		listener = tls.NewListener(listener, reloader.TLSConfig())
+	}
+	if websocket {
+		listener = mqtt.NewWebSocketListener(listener, options.Path)
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go serveMQTT(ctx, listener, sm, adapterConfig)
+	return &mqttListener{Listener: listener, reloader: reloader}, nil
+}
+
+func serveMQTT(ctx context.Context, listener net.Listener, sm *SessionManager, config mqtt.AdapterConfig) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, mqtt.ErrListenerClosed) {
+				return
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+
+		go handleMQTTConnection(ctx, conn, sm, config)
+	}
+}
+
+func handleMQTTConnection(ctx context.Context, conn net.Conn, sm *SessionManager, config mqtt.AdapterConfig) {
+	defer conn.Close()
+
+	// 解析MQTT连接包, 限制等待时间和报文长度, 防止空闲或超大的CONNECT占用连接
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	connect, err := mqtt.ReadConnectPacket(conn, config.MaxPacketSize)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("MQTT decode error: %v", err)
+		switch {
+		case errors.Is(err, mqtt.ErrUnacceptableProtocol):
+			mqtt.EncodeConnack(conn, false, mqtt.RefusedProtocolVersion)
+		case errors.Is(err, mqtt.ErrIdentifierRejected):
+			mqtt.EncodeConnack(conn, false, mqtt.RefusedIdentifierRejected)
+		}
+		return
+	}
+
+	// 客户端证书中的身份决定设备ID, 未指定ID时使用证书CN
+	identities := mqtt.PeerIdentities(conn)
+	impersonating := false
+	if len(identities) > 0 {
+		if connect.ClientID == "" {
+			connect.ClientID = identities[0]
+		} else {
+			impersonating = !containsString(identities, connect.ClientID)
+		}
+	}
+
+	// 5.0 客户端未指定ID时由网关分配
+	if connect.ClientID == "" && connect.ProtocolLevel == mqtt.ProtocolLevel5 {
+		id, err := generateClientID()
+		if err != nil {
+			log.Printf("Failed to assign client ID: %v", err)
+			return
+		}
+		connect.ClientID = id
+		connect.AssignedClientID = true
+	}
+
+	// 创建协议适配器, 按CONNECT协商的协议版本编解码
+	deviceID := connect.ClientID
+	adapter := mqtt.NewMQTTAdapterWithConfig(conn, deviceID, config)
+	adapter.Negotiate(connect)
+
+	if deviceID == "" {
+		log.Println("Invalid device ID")
+		adapter.Connack(false, mqtt.RefusedIdentifierRejected)
+		return
+	}
+	if impersonating {
+		log.Printf("Device %s rejected: client certificate identifies %v", deviceID, identities)
+		adapter.Connack(false, mqtt.RefusedNotAuthorized)
+		return
+	}
+
+	go adapter.Listen()
+	log.Printf("Device %s connected", deviceID)
+
+	// 管理会话并回复CONNACK, 直到连接关闭
+	sm.ServeMQTT(ctx, connect, adapter)
+	log.Printf("Device %s disconnected", deviceID)
+}
+
+// 网关分配的客户端ID, 例如 "auto-3f9c0a1b2d4e5f60"
+func generateClientID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "auto-" + hex.EncodeToString(b), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,767 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/mqtt"
+	"edgesphere/internal/protocol/sparkplug"
+)
+
+// MQTT 5.0 订阅选项中需要在转发时使用的位
+const (
+	optNoLocal           byte = 0x04
+	optRetainAsPublished byte = 0x08
+)
+
+// MQTT会话状态
+type session struct {
+	clientID   string
+	assignedID bool          // 客户端ID由网关分配, 在CONNACK中返回
+	client     *auth.Client  // 授权主体
+	cleanStart bool          // 连接时丢弃旧会话
+	expiry     time.Duration // 断开后会话的保留时间, 0表示随连接结束
+	adapter    *mqtt.MQTTAdapter
+	conn       *types.DeviceConnection
+	inflight   *inflightWindow
+	// 其它连接投递的消息经此队列由会话的发送协程写出, 慢订阅者不阻塞发布者
+	outbound   chan *inflightMessage
+	writerDone chan struct{}
+	will       *mqtt.Will
+	graceful   bool        // 收到DISCONNECT
+	takenOver  atomic.Bool // 被相同客户端ID的新连接接管
+	// 被接管的非持久会话未确认的消息, 交给新会话重发
+	handoff []*QueuedMessage
+	done    chan struct{} // 会话状态保存完成后关闭
+	// 已收到QoS 2 PUBLISH但尚未收到PUBREL的入站报文标识符
+	inboundQoS2 map[uint16]struct{}
+
+	// 过滤器 -> 非默认的 MQTT 5.0 订阅选项
+	options   map[string]byte
+	optionsMu sync.RWMutex
+}
+
+func newSession(connect *mqtt.ConnectPacket, adapter *mqtt.MQTTAdapter, maxInflight, maxQueued int) *session {
+	s := &session{
+		clientID:    connect.ClientID,
+		assignedID:  connect.AssignedClientID,
+		client:      &auth.Client{ID: connect.ClientID, Username: connect.Username},
+		cleanStart:  connect.CleanSession,
+		adapter:     adapter,
+		will:        connect.Will,
+		inboundQoS2: make(map[uint16]struct{}),
+		options:     make(map[string]byte),
+		done:        make(chan struct{}),
+		outbound:    make(chan *inflightMessage, maxQueued),
+		writerDone:  make(chan struct{}),
+	}
+
+	// 3.1.1 持久会话使用默认有效期, 5.0 由客户端指定会话过期间隔
+	if connect.ProtocolLevel == mqtt.ProtocolLevel5 {
+		if props := connect.Properties; props != nil {
+			if props.SessionExpiry != nil {
+				s.expiry = time.Duration(*props.SessionExpiry) * time.Second
+			}
+			// 飞行窗口不超过客户端的接收最大值
+			if props.ReceiveMaximum != nil && int(*props.ReceiveMaximum) < maxInflight {
+				maxInflight = int(*props.ReceiveMaximum)
+			}
+		}
+	} else if !connect.CleanSession {
+		s.expiry = DefaultSessionExpiry
+	}
+	s.inflight = newInflightWindow(maxInflight)
+	return s
+}
+
+func (s *session) v5() bool {
+	return s.adapter.ProtocolLevel() == mqtt.ProtocolLevel5
+}
+
+// 断开后保留会话状态
+func (s *session) persistent() bool {
+	return s.expiry > 0
+}
+
+// 发送QoS 1/2消息, 窗口已满时排队等待确认
+func (s *session) publish(msg *inflightMessage) error {
+	if !s.inflight.push(msg) {
+		return nil
+	}
+	return s.send(msg)
+}
+
+func (s *session) send(msg *inflightMessage) error {
+	if msg.Released {
+		return s.adapter.PubRel(msg.PacketID)
+	}
+	err := s.adapter.Publish(msg.packet(false))
+	if errors.Is(err, mqtt.ErrPacketTooLarge) {
+		// 超过客户端最大报文长度的消息丢弃, 按已确认处理
+		log.Printf("Dropping message on %s for %s: exceeds client maximum packet size", msg.Topic, s.clientID)
+		for _, next := range s.inflight.complete(msg.PacketID) {
+			s.send(next)
+		}
+	}
+	return err
+}
+
+// 重连后重传已分配标识符的消息
+func (s *session) retransmit(msg *inflightMessage) error {
+	s.inflight.restore(msg)
+	if msg.Released {
+		return s.adapter.PubRel(msg.PacketID)
+	}
+	return s.adapter.Publish(msg.packet(true))
+}
+
+// 记录订阅的 No Local / Retain As Published 选项
+func (s *session) setOptions(sub mqtt.Subscription) {
+	var options byte
+	if sub.NoLocal {
+		options |= optNoLocal
+	}
+	if sub.RetainAsPublished {
+		options |= optRetainAsPublished
+	}
+
+	s.optionsMu.Lock()
+	defer s.optionsMu.Unlock()
+	if options == 0 {
+		delete(s.options, sub.Filter)
+	} else {
+		s.options[sub.Filter] = options
+	}
+}
+
+func (s *session) removeOptions(filter string) {
+	s.optionsMu.Lock()
+	delete(s.options, filter)
+	s.optionsMu.Unlock()
+}
+
+// SUBACK 失败码, 3.1.1 只有 0x80
+func (s *session) subackFailure(reason mqtt.ReasonCode) byte {
+	if s.v5() {
+		return byte(reason)
+	}
+	return mqtt.SubackFailure
+}
+
+// MQTT设备会话处理, 阻塞直到连接关闭
+func (sm *SessionManager) ServeMQTT(ctx context.Context, connect *mqtt.ConnectPacket, adapter *mqtt.MQTTAdapter) {
+	sm.serving.Add(1)
+	defer sm.serving.Done()
+
+	deviceID := connect.ClientID
+	s := newSession(connect, adapter, sm.config.MaxInflight, sm.config.MaxQueued)
+	keepAlive := sm.keepAliveFor(connect.KeepAlive)
+
+	// 不支持增强认证
+	if s.v5() && connect.Properties != nil && connect.Properties.AuthMethod != "" {
+		adapter.ConnackWithProperties(false, mqtt.BadAuthenticationMethod, nil)
+		adapter.Close()
+		return
+	}
+
+	if err := sm.authenticate(ctx, s, connect); err != nil {
+		log.Printf("Device %s authentication failed: %v", deviceID, err)
+		adapter.Connack(false, auth.ConnackCode(err))
+		adapter.Close()
+		return
+	}
+
+	// 同一客户端ID已有连接时接管, 旧会话的状态保存后再加载
+	var handoff []*QueuedMessage
+	for old := sm.mqttSession(deviceID); old != nil; old = sm.mqttSession(deviceID) {
+		handoff = append(handoff, sm.takeover(old, adapter)...)
+	}
+
+	state := sm.loadSession(s)
+	if err := sm.connack(s, state != nil, connect.KeepAlive, keepAlive); err != nil {
+		log.Printf("Failed to send CONNACK to %s: %v", deviceID, err)
+		adapter.Close()
+		return
+	}
+	go s.writeLoop()
+
+	sm.mu.Lock()
+	other := sm.mqttSessions[deviceID]
+	sm.mqttSessions[deviceID] = s
+	sm.mu.Unlock()
+	// 并发的同ID连接在接管等待期间先完成了注册, 直接关闭
+	if other != nil {
+		other.takenOver.Store(true)
+		other.adapter.Disconnect(mqtt.SessionTakenOver, ErrSessionTakenOver)
+		sm.emitTakeover(deviceID, adapter.RemoteAddr().String())
+	}
+	s.conn = sm.handleConnection(ctx, deviceID, adapter, keepAlive)
+
+	sm.resumeSession(s, state)
+	restoreInflight(s, handoff)
+	sm.resumeCommands(s)
+
+	for packet := range adapter.Packets() {
+		s.conn.Touch()
+		sm.handlePacket(s, packet)
+	}
+	sm.handleDisconnection(s.conn)
+	sm.dropSession(s)
+	close(s.done)
+
+	// 未收到DISCONNECT的断开 (保活超时, 网络错误, 网关判定故障) 发布遗嘱;
+	// 被接管说明设备仍在线, 不发布
+	if s.will != nil && !s.takenOver.Load() && !sm.shuttingDown.Load() {
+		sm.scheduleWill(s)
+	}
+}
+
+// 关闭被接管的连接并等待其保存会话状态和未确认的命令, 返回非持久会话未确认的消息.
+// 旧连接的处理协程未及时退出时强制移除, 其后续的断开处理不影响新会话
+func (sm *SessionManager) takeover(old *session, by *mqtt.MQTTAdapter) []*QueuedMessage {
+	remote := by.RemoteAddr().String()
+	log.Printf("Session %s taken over by %s", old.clientID, remote)
+
+	old.takenOver.Store(true)
+	old.adapter.Disconnect(mqtt.SessionTakenOver, ErrSessionTakenOver)
+
+	var handoff []*QueuedMessage
+	select {
+	case <-old.done:
+		handoff = old.handoff
+	case <-time.After(takeoverTimeout):
+		log.Printf("Session %s did not stop within %v, removing it", old.clientID, takeoverTimeout)
+		sm.mu.Lock()
+		if sm.mqttSessions[old.clientID] == old {
+			delete(sm.mqttSessions, old.clientID)
+		}
+		sm.mu.Unlock()
+		if conn, ok := sm.sessions.Get(old.clientID); ok && conn.Adapter == old.adapter {
+			sm.handleDisconnection(conn)
+		}
+	}
+	sm.emitTakeover(old.clientID, remote)
+	return handoff
+}
+
+// 未设置认证器时接受所有连接
+func (sm *SessionManager) authenticate(ctx context.Context, s *session, connect *mqtt.ConnectPacket) error {
+	if sm.authn == nil {
+		return nil
+	}
+	client, err := sm.authn.Authenticate(ctx, &auth.Credentials{
+		ClientID:     connect.ClientID,
+		Username:     connect.Username,
+		Password:     connect.Password,
+		Certificates: s.adapter.PeerIdentities(),
+	})
+	if err != nil {
+		return err
+	}
+	s.client = client
+	return nil
+}
+
+// $SYS 主题只能订阅, 订阅权限由ACL决定
+func (sm *SessionManager) authorize(s *session, access auth.Access, topic string) bool {
+	if access == auth.Publish && strings.HasPrefix(topic, SysTopicPrefix) {
+		return false
+	}
+	return sm.authz == nil || sm.authz.Authorize(s.client, access, topic)
+}
+
+// 5.0 连接在CONNACK中告知网关能力和实际使用的保活时间
+func (sm *SessionManager) connack(s *session, present bool, clientKeepAlive uint16, keepAlive time.Duration) error {
+	if !s.v5() {
+		return s.adapter.Connack(present, mqtt.ConnectionAccepted)
+	}
+
+	unavailable := byte(0)
+	props := &mqtt.Properties{
+		SubIDAvailable: &unavailable,
+	}
+	if s.assignedID {
+		props.AssignedClientID = s.clientID
+	}
+	if size := s.adapter.MaxPacketSize(); size > 0 {
+		max := uint32(size)
+		props.MaximumPacketSize = &max
+	}
+	seconds := keepAlive / time.Second
+	if seconds > 0xFFFF {
+		seconds = 0xFFFF
+	}
+	if uint16(seconds) != clientKeepAlive {
+		serverKeepAlive := uint16(seconds)
+		props.ServerKeepAlive = &serverKeepAlive
+	}
+	return s.adapter.ConnackWithProperties(present, mqtt.Success, props)
+}
+
+// 遗嘱延迟间隔内重新连接则不发布; 延迟不超过会话过期间隔
+func (sm *SessionManager) scheduleWill(s *session) {
+	var delay time.Duration
+	if props := s.will.Properties; props != nil {
+		delay = time.Duration(props.WillDelay) * time.Second
+	}
+	if delay > s.expiry {
+		delay = s.expiry
+	}
+	if delay == 0 {
+		sm.publishWill(s)
+		return
+	}
+
+	sm.wheel.AfterFunc(delay, func() {
+		go func() {
+			if sm.mqttSession(s.clientID) == nil {
+				sm.publishWill(s)
+			}
+		}()
+	})
+}
+
+func (sm *SessionManager) publishWill(s *session) {
+	reason := "connection lost"
+	if s.graceful {
+		reason = mqtt.DisconnectWithWill.String()
+	} else if err := s.adapter.Err(); err != nil {
+		reason = err.Error()
+	}
+	if !sm.authorize(s, auth.Publish, s.will.Topic) {
+		log.Printf("Dropping will of %s to %s: not authorized", s.clientID, s.will.Topic)
+	} else {
+		log.Printf("Publishing will of %s to %s (%s)", s.clientID, s.will.Topic, reason)
+		sm.onPublish(s.clientID, &mqtt.PublishPacket{
+			Topic:      s.will.Topic,
+			QoS:        s.will.QoS,
+			Retain:     s.will.Retain,
+			Payload:    s.will.Payload,
+			Properties: s.will.Properties.ForwardCopy(),
+		})
+	}
+	sm.emit(&types.DeviceEvent{
+		Type:      types.EventWill,
+		DeviceID:  s.clientID,
+		Topic:     s.will.Topic,
+		Payload:   s.will.Payload,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+}
+
+func (sm *SessionManager) mqttSession(clientID string) *session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.mqttSessions[clientID]
+}
+
+// 重发离线缓存的命令, 断线前未确认的命令以DUP标志和原报文标识符重传
+func (sm *SessionManager) resumeCommands(s *session) {
+	topic := s.adapter.CommandTopic()
+	commands := sm.pendingCommands(s.clientID)
+	for i, cmd := range commands {
+		msg := &inflightMessage{PendingCommand: *cmd, Topic: topic, Command: true}
+		switch {
+		case cmd.QoS == 0:
+			// 发送失败时该命令及其后的命令写回离线缓存, 下次连接时重发
+			if err := s.adapter.Send(cmd.Payload); err != nil {
+				log.Printf("Failed to resend command to %s: %v", s.clientID, err)
+				if err := sm.cache.SavePendingCommands(s.clientID, commands[i:]); err != nil {
+					log.Printf("Failed to save %d pending commands for %s: %v", len(commands)-i, s.clientID, err)
+				}
+				return
+			}
+		case cmd.PacketID != 0:
+			s.retransmit(msg)
+		default:
+			s.publish(msg)
+		}
+	}
+}
+
+// 会话断开: 非持久会话清除订阅, 持久会话保存订阅与未确认消息;
+// 未确认的命令写回离线缓存, 重连后重传
+func (sm *SessionManager) dropSession(s *session) {
+	sm.mu.Lock()
+	current := sm.mqttSessions[s.clientID] == s
+	if current {
+		delete(sm.mqttSessions, s.clientID)
+		if !s.persistent() {
+			sm.topics.RemoveClient(s.clientID)
+		}
+	}
+	sm.mu.Unlock()
+
+	var pending []*PendingCommand
+	var inflight []*QueuedMessage
+	var shared []*inflightMessage
+	for _, msg := range append(s.inflight.drain(), s.drainOutbound()...) {
+		if msg.Command {
+			cmd := msg.PendingCommand
+			pending = append(pending, &cmd)
+			continue
+		}
+		// 共享订阅的QoS 1消息和未发送的消息改投组内其他成员; 已发送的QoS 2消息留在会话中
+		if msg.Share != "" && !s.takenOver.Load() && (msg.QoS == 1 || msg.PacketID == 0) {
+			shared = append(shared, msg)
+			continue
+		}
+		inflight = append(inflight, queuedFromInflight(msg))
+	}
+	for _, msg := range sm.redeliverShared(s, shared) {
+		inflight = append(inflight, queuedFromInflight(msg))
+	}
+
+	switch {
+	case current && s.persistent():
+		sm.saveSession(s, inflight)
+	case current && s.takenOver.Load():
+		s.handoff = inflight
+	case current && !s.cleanStart && sm.cache != nil:
+		// 5.0 恢复了旧会话但会话过期间隔为0, 会话随连接结束
+		if err := sm.cache.DeleteSession(s.clientID); err != nil {
+			log.Printf("Failed to discard session %s: %v", s.clientID, err)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if sm.cache == nil {
+		log.Printf("Dropping %d unacknowledged commands for %s: %v", len(pending), s.clientID, ErrNoOfflineCache)
+		return
+	}
+	if err := sm.cache.SavePendingCommands(s.clientID, pending); err != nil {
+		log.Printf("Failed to save %d unacknowledged commands for %s: %v", len(pending), s.clientID, err)
+	}
+}
+
+// 按报文类型分发
+func (sm *SessionManager) handlePacket(s *session, packet mqtt.Packet) {
+	adapter := s.adapter
+
+	switch p := packet.(type) {
+	case *mqtt.PublishPacket:
+		// 网关未声明主题别名最大值, 客户端不能使用主题别名
+		if p.Properties != nil && p.Properties.TopicAlias != nil {
+			adapter.Disconnect(mqtt.TopicAliasInvalid, nil)
+			return
+		}
+
+		// 无权发布的消息丢弃, 仍然确认以结束QoS流程, 5.0 在确认中返回原因码
+		if !sm.authorize(s, auth.Publish, p.Topic) {
+			log.Printf("Dropping publish from %s to %s: not authorized", s.clientID, p.Topic)
+			switch p.QoS {
+			case 1:
+				adapter.Ack(mqtt.PubAck, p.PacketID, mqtt.NotAuthorized)
+			case 2:
+				// 3.1.1 客户端收到PUBREC后仍会发送PUBREL
+				if !s.v5() {
+					s.inboundQoS2[p.PacketID] = struct{}{}
+				}
+				adapter.Ack(mqtt.PubRec, p.PacketID, mqtt.NotAuthorized)
+			}
+			return
+		}
+
+		switch p.QoS {
+		case 0:
+			sm.onPublish(s.clientID, p)
+		case 1:
+			sm.onPublish(s.clientID, p)
+			adapter.PubAck(p.PacketID)
+		case 2:
+			// 重复的QoS 2报文只回复PUBREC, 直到收到PUBREL前不再投递
+			if _, dup := s.inboundQoS2[p.PacketID]; !dup {
+				s.inboundQoS2[p.PacketID] = struct{}{}
+				sm.onPublish(s.clientID, p)
+			}
+			adapter.PubRec(p.PacketID)
+		}
+
+	case *mqtt.AckPacket:
+		sm.handleAck(s, p)
+
+	case *mqtt.SubscribePacket:
+		if p.Properties != nil && len(p.Properties.SubscriptionIDs) > 0 {
+			adapter.Disconnect(mqtt.SubscriptionIdentifiersNotSupported, nil)
+			return
+		}
+
+		// 共享订阅不能设置 No Local
+		for _, sub := range p.Subscriptions {
+			if _, _, shared := mqtt.ParseSharedFilter(sub.Filter); shared && sub.NoLocal {
+				adapter.Disconnect(mqtt.ProtocolError, nil)
+				return
+			}
+		}
+
+		existing := sm.topics.Subscriptions(s.clientID)
+		codes := make([]byte, len(p.Subscriptions))
+		for i, sub := range p.Subscriptions {
+			switch {
+			case !mqtt.ValidTopicFilter(sub.Filter):
+				codes[i] = s.subackFailure(mqtt.TopicFilterInvalid)
+			case !sm.authorize(s, auth.Subscribe, topicFilter(sub.Filter)):
+				log.Printf("Rejecting subscription of %s to %s: not authorized", s.clientID, sub.Filter)
+				codes[i] = s.subackFailure(mqtt.NotAuthorized)
+			default:
+				sm.topics.Subscribe(s.clientID, sub.Filter, sub.QoS)
+				s.setOptions(sub)
+				codes[i] = sub.QoS
+			}
+		}
+		adapter.Suback(p.PacketID, codes)
+
+		// 新订阅立即收到匹配的保留消息, 5.0 按保留消息处理选项; 共享订阅不发送保留消息
+		for i, sub := range p.Subscriptions {
+			if codes[i] >= 0x80 || topicFilter(sub.Filter) != sub.Filter {
+				continue
+			}
+			if _, exists := existing[sub.Filter]; sub.RetainHandling == 2 || (sub.RetainHandling == 1 && exists) {
+				continue
+			}
+			for _, msg := range sm.retained.match(sub.Filter) {
+				s.deliverNow(&inflightMessage{
+					PendingCommand: PendingCommand{Payload: msg.Payload, QoS: minQoS(msg.QoS, codes[i])},
+					Topic:          msg.Topic,
+					Retain:         true,
+					Properties:     msg.Properties,
+					ExpiresAt:      msg.ExpiresAt,
+				})
+			}
+		}
+
+	case *mqtt.UnsubscribePacket:
+		codes := make([]byte, len(p.Filters))
+		for i, filter := range p.Filters {
+			if !sm.topics.Unsubscribe(s.clientID, filter) {
+				codes[i] = byte(mqtt.NoSubscriptionExisted)
+			}
+			s.removeOptions(filter)
+			if topicFilter(filter) != filter && len(sm.topics.SharedMembers(filter)) == 0 {
+				sm.shared.forget(filter)
+			}
+		}
+		adapter.Unsuback(p.PacketID, codes)
+
+	case *mqtt.PingReqPacket:
+		adapter.Pingresp()
+
+	case *mqtt.DisconnectPacket:
+		if p.Properties != nil && p.Properties.SessionExpiry != nil {
+			expiry := time.Duration(*p.Properties.SessionExpiry) * time.Second
+			// CONNECT 时会话过期间隔为0, 断开时不能再改为非0; 协议错误的断开仍发布遗嘱
+			if s.expiry == 0 && expiry > 0 {
+				adapter.Disconnect(mqtt.ProtocolError, nil)
+				return
+			}
+			s.expiry = expiry
+		}
+		// 正常断开丢弃遗嘱, 5.0 客户端可以要求发布遗嘱
+		s.graceful = true
+		if p.ReasonCode != mqtt.DisconnectWithWill {
+			s.will = nil
+		}
+
+	case *mqtt.AuthPacket:
+		// 未使用增强认证的连接不能发送AUTH
+		adapter.Disconnect(mqtt.ProtocolError, nil)
+
+	default:
+		adapter.Disconnect(mqtt.ProtocolError, mqtt.ErrProtocolError)
+	}
+}
+
+// 设备发布的消息: 更新保留消息, 匹配请求响应并投递给本地订阅者
+func (sm *SessionManager) onPublish(from string, p *mqtt.PublishPacket) {
+	msg := &inflightMessage{
+		PendingCommand: PendingCommand{Payload: p.Payload, QoS: p.QoS},
+		Topic:          p.Topic,
+		Retain:         p.Retain,
+		Properties:     p.Properties.ForwardCopy(),
+	}
+	if p.Properties != nil && p.Properties.MessageExpiry != nil {
+		msg.ExpiresAt = time.Now().Add(time.Duration(*p.Properties.MessageExpiry) * time.Second)
+	}
+
+	if p.Retain {
+		sm.retained.set(&RetainedMessage{
+			Topic:      p.Topic,
+			Payload:    p.Payload,
+			QoS:        p.QoS,
+			Properties: msg.Properties,
+			ExpiresAt:  msg.ExpiresAt,
+		})
+	}
+	sm.matchResponse(p)
+	sm.route(from, msg)
+
+	sm.mu.RLock()
+	bridges := sm.bridges
+	sm.mu.RUnlock()
+	for _, b := range bridges {
+		b.forward(from, msg)
+	}
+
+	if sparkplug.IsTopic(p.Topic) {
+		sm.onSparkplug(p)
+	}
+}
+
+// 将消息投递给所有匹配的本地订阅者, QoS取发布与订阅的较小值;
+// 离线的持久会话排队QoS 1/2消息
+func (sm *SessionManager) route(from string, msg *inflightMessage) {
+	for clientID, granted := range sm.topics.Match(msg.Topic) {
+		qos := minQoS(msg.QoS, granted)
+		if sub := sm.mqttSession(clientID); sub != nil {
+			noLocal, retainAsPublished := sm.subscriptionOptions(sub, msg.Topic)
+			if noLocal && clientID == from {
+				continue
+			}
+			out := *msg
+			out.QoS = qos
+			out.Retain = msg.Retain && retainAsPublished
+			deliver(sub, &out)
+			continue
+		}
+		if qos == 0 || sm.cache == nil {
+			continue
+		}
+		err := sm.cache.QueueMessage(clientID, &QueuedMessage{
+			Topic:      msg.Topic,
+			Payload:    msg.Payload,
+			QoS:        qos,
+			Properties: msg.Properties,
+			ExpiresAt:  msg.ExpiresAt,
+		}, sm.config.MaxOfflineMessages)
+		if err != nil {
+			log.Printf("Failed to queue message for offline session %s: %v", clientID, err)
+		}
+	}
+
+	for filter, members := range sm.topics.MatchShared(msg.Topic) {
+		sm.routeShared(from, filter, members, msg)
+	}
+}
+
+// 合并匹配主题的所有订阅的选项: 全部设置 No Local 才不转发, 任一设置 Retain As Published 即保留原标志
+func (sm *SessionManager) subscriptionOptions(s *session, topic string) (noLocal, retainAsPublished bool) {
+	s.optionsMu.RLock()
+	defer s.optionsMu.RUnlock()
+	if len(s.options) == 0 {
+		return false, false
+	}
+
+	noLocal = true
+	for filter := range sm.topics.Subscriptions(s.clientID) {
+		if !mqtt.MatchTopic(filter, topic) {
+			continue
+		}
+		options := s.options[filter]
+		noLocal = noLocal && options&optNoLocal != 0
+		retainAsPublished = retainAsPublished || options&optRetainAsPublished != 0
+	}
+	return noLocal, retainAsPublished
+}
+
+// 放入会话的出站队列; 队列已满时丢弃QoS 0消息, QoS 1/2断开过慢的订阅者
+func deliver(s *session, msg *inflightMessage) {
+	select {
+	case s.outbound <- msg:
+		return
+	default:
+	}
+	if msg.QoS == 0 {
+		log.Printf("Dropping message on %s for %s: session queue full", msg.Topic, s.clientID)
+		return
+	}
+	log.Printf("Disconnecting %s: session queue full", s.clientID)
+	s.adapter.Disconnect(mqtt.QuotaExceeded, ErrSessionQueueFull)
+}
+
+// 按顺序写出出站队列中的消息, 连接关闭后退出
+func (s *session) writeLoop() {
+	defer close(s.writerDone)
+	for {
+		select {
+		case msg := <-s.outbound:
+			s.deliverNow(msg)
+		case <-s.adapter.Context().Done():
+			return
+		}
+	}
+}
+
+// 发送协程退出后取出出站队列中未发送的QoS 1/2消息, 与未确认的消息一同保存或改投
+func (s *session) drainOutbound() []*inflightMessage {
+	<-s.writerDone
+	var messages []*inflightMessage
+	for {
+		select {
+		case msg := <-s.outbound:
+			if msg.QoS > 0 && !msg.expired() {
+				messages = append(messages, msg)
+			}
+		default:
+			return messages
+		}
+	}
+}
+
+// 在当前协程直接发送, 过期的消息不再投递
+func (s *session) deliverNow(msg *inflightMessage) {
+	if msg.expired() {
+		return
+	}
+	if msg.QoS == 0 {
+		s.adapter.Publish(msg.packet(false))
+		return
+	}
+	s.publish(msg)
+}
+
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// 出站QoS流程确认
+func (sm *SessionManager) handleAck(s *session, ack *mqtt.AckPacket) {
+	switch ack.Kind {
+	case mqtt.PubAck, mqtt.PubComp:
+		for _, msg := range s.inflight.complete(ack.PacketID) {
+			s.send(msg)
+		}
+	case mqtt.PubRec:
+		// 5.0 PUBREC 失败码结束QoS 2流程
+		if ack.ReasonCode.Failed() {
+			for _, msg := range s.inflight.complete(ack.PacketID) {
+				s.send(msg)
+			}
+			return
+		}
+		// 未知标识符也回复PUBREL以结束对端流程
+		if !s.inflight.release(ack.PacketID) {
+			s.adapter.Ack(mqtt.PubRel, ack.PacketID, mqtt.PacketIdentifierNotFound)
+			return
+		}
+		s.adapter.PubRel(ack.PacketID)
+	case mqtt.PubRel:
+		if _, ok := s.inboundQoS2[ack.PacketID]; !ok {
+			s.adapter.Ack(mqtt.PubComp, ack.PacketID, mqtt.PacketIdentifierNotFound)
+			return
+		}
+		delete(s.inboundQoS2, ack.PacketID)
+		s.adapter.PubComp(ack.PacketID)
+	}
+}
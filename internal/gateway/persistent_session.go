@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 持久会话中排队或未确认的消息
+type QueuedMessage struct {
+	Topic    string `json:"topic"`
+	Payload  []byte `json:"payload"`
+	QoS      byte   `json:"qos"`
+	Retain   bool   `json:"retain,omitempty"`
+	PacketID uint16 `json:"packet_id,omitempty"`
+	Released bool   `json:"released,omitempty"`
+
+	Properties *mqtt.Properties `json:"properties,omitempty"`
+	ExpiresAt  time.Time        `json:"expires_at,omitempty"`
+}
+
+// 持久会话状态 (clean-session=false 或 MQTT 5.0 会话过期间隔>0)
+type SessionState struct {
+	Subscriptions map[string]byte  `json:"subscriptions"`
+	Options       map[string]byte  `json:"options,omitempty"` // MQTT 5.0 订阅选项 (No Local, Retain As Published)
+	Inflight      []*QueuedMessage `json:"inflight"`
+	InboundQoS2   []uint16         `json:"inbound_qos2"`
+}
+
+func queuedFromInflight(msg *inflightMessage) *QueuedMessage {
+	return &QueuedMessage{
+		Topic:    msg.Topic,
+		Payload:  msg.Payload,
+		QoS:      msg.QoS,
+		Retain:   msg.Retain,
+		PacketID: msg.PacketID,
+		Released: msg.Released,
+
+		Properties: msg.Properties,
+		ExpiresAt:  msg.ExpiresAt,
+	}
+}
+
+func (m *QueuedMessage) inflight() *inflightMessage {
+	return &inflightMessage{
+		PendingCommand: PendingCommand{
+			Payload:  m.Payload,
+			QoS:      m.QoS,
+			PacketID: m.PacketID,
+			Released: m.Released,
+		},
+		Topic:      m.Topic,
+		Retain:     m.Retain,
+		Properties: m.Properties,
+		ExpiresAt:  m.ExpiresAt,
+	}
+}
+
+// 读取之前的持久会话; 清理会话连接时丢弃旧会话并返回nil
+func (sm *SessionManager) loadSession(s *session) *SessionState {
+	if s.cleanStart {
+		sm.topics.RemoveClient(s.clientID)
+		if sm.cache == nil {
+			return nil
+		}
+		if err := sm.cache.DeleteSession(s.clientID); err != nil {
+			log.Printf("Failed to discard session %s: %v", s.clientID, err)
+		}
+		return nil
+	}
+	if sm.cache == nil {
+		return nil
+	}
+
+	state, err := sm.cache.LoadSession(s.clientID)
+	if err != nil {
+		log.Printf("Failed to load session %s: %v", s.clientID, err)
+		return nil
+	}
+	return state
+}
+
+// 恢复订阅与QoS状态, 重传未确认的消息并投递离线期间排队的消息
+func (sm *SessionManager) resumeSession(s *session, state *SessionState) {
+	if state != nil {
+		for filter, qos := range state.Subscriptions {
+			sm.topics.Subscribe(s.clientID, filter, qos)
+		}
+		for filter, options := range state.Options {
+			s.options[filter] = options
+		}
+		for _, id := range state.InboundQoS2 {
+			s.inboundQoS2[id] = struct{}{}
+		}
+		restoreInflight(s, state.Inflight)
+	}
+	if s.cleanStart || sm.cache == nil {
+		return
+	}
+
+	queued, err := sm.cache.TakeQueuedMessages(s.clientID)
+	if err != nil {
+		log.Printf("Failed to load queued messages for %s: %v", s.clientID, err)
+		return
+	}
+	for _, m := range queued {
+		s.deliverNow(m.inflight())
+	}
+}
+
+// 已发送的消息以原标识符重传, 未发送的过期消息丢弃
+func restoreInflight(s *session, messages []*QueuedMessage) {
+	for _, m := range messages {
+		if m.PacketID == 0 && m.inflight().expired() {
+			continue
+		}
+		if m.PacketID != 0 {
+			s.retransmit(m.inflight())
+		} else {
+			s.publish(m.inflight())
+		}
+	}
+}
+
+func (sm *SessionManager) saveSession(s *session, inflight []*QueuedMessage) {
+	if sm.cache == nil {
+		log.Printf("Dropping session %s: %v", s.clientID, ErrNoOfflineCache)
+		return
+	}
+	state := &SessionState{
+		Subscriptions: sm.topics.Subscriptions(s.clientID),
+		Options:       make(map[string]byte),
+		Inflight:      inflight,
+	}
+	s.optionsMu.RLock()
+	for filter, options := range s.options {
+		state.Options[filter] = options
+	}
+	s.optionsMu.RUnlock()
+	for id := range s.inboundQoS2 {
+		state.InboundQoS2 = append(state.InboundQoS2, id)
+	}
+
+	if err := sm.cache.SaveSessionWithExpiry(s.clientID, state, s.expiry); err != nil {
+		log.Printf("Failed to save session %s: %v", s.clientID, err)
+	}
+}
+
+// 网关启动时恢复离线持久会话的订阅, 以便为其排队消息
+func (sm *SessionManager) restoreSubscriptions() {
+	if sm.cache == nil {
+		return
+	}
+	sessions, err := sm.cache.LoadSessions()
+	if err != nil {
+		log.Printf("Failed to restore persistent sessions: %v", err)
+		return
+	}
+	for clientID, state := range sessions {
+		for filter, qos := range state.Subscriptions {
+			sm.topics.Subscribe(clientID, filter, qos)
+		}
+	}
+}
+
+// 定期清理超过有效期的持久会话
+func (sm *SessionManager) ExpireSessions(ctx context.Context, interval time.Duration) {
+	if sm.cache == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := sm.cache.DeleteExpiredSessions()
+			if err != nil {
+				log.Printf("Failed to expire sessions: %v", err)
+				continue
+			}
+			for _, clientID := range expired {
+				if sm.mqttSession(clientID) == nil {
+					sm.topics.RemoveClient(clientID)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
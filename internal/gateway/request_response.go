@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+var (
+	ErrDeviceOffline      = errors.New("device offline")
+	ErrRequestUnsupported = errors.New("request-response requires an MQTT 5.0 session")
+)
+
+// 设备对请求命令的响应
+type CommandResponse struct {
+	Topic      string
+	Payload    []byte
+	Properties *mqtt.Properties
+}
+
+// 响应主题
+func (sm *SessionManager) ResponseTopic(deviceID string) string {
+	return strings.ReplaceAll(sm.config.ResponseTopic, "%c", deviceID)
+}
+
+// 下发携带响应主题和关联数据的命令, 等待设备以相同关联数据回复.
+// 仅支持在线的MQTT 5.0会话
+func (sm *SessionManager) RequestCommand(ctx context.Context, deviceID string, cmd []byte, qos byte) (*CommandResponse, error) {
+	if qos > 2 {
+		return nil, errors.New("invalid QoS level")
+	}
+	s := sm.mqttSession(deviceID)
+	if s == nil {
+		return nil, ErrDeviceOffline
+	}
+	if !s.v5() {
+		return nil, ErrRequestUnsupported
+	}
+
+	correlation := make([]byte, 16)
+	if _, err := rand.Read(correlation); err != nil {
+		return nil, err
+	}
+	key := string(correlation)
+	ch := make(chan *CommandResponse, 1)
+
+	sm.requestsMu.Lock()
+	sm.requests[key] = ch
+	sm.requestsMu.Unlock()
+	defer func() {
+		sm.requestsMu.Lock()
+		delete(sm.requests, key)
+		sm.requestsMu.Unlock()
+	}()
+
+	msg := &inflightMessage{
+		PendingCommand: PendingCommand{Payload: cmd, QoS: qos},
+		Topic:          s.adapter.CommandTopic(),
+		Command:        true,
+		Properties: &mqtt.Properties{
+			ResponseTopic:   sm.ResponseTopic(deviceID),
+			CorrelationData: correlation,
+		},
+	}
+	var err error
+	if qos == 0 {
+		err = s.adapter.Publish(msg.packet(false))
+	} else {
+		err = s.publish(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 关联数据匹配等待中的请求时交给请求方, 消息仍按普通发布路由
+func (sm *SessionManager) matchResponse(p *mqtt.PublishPacket) {
+	if p.Properties == nil || len(p.Properties.CorrelationData) == 0 {
+		return
+	}
+
+	sm.requestsMu.Lock()
+	ch, ok := sm.requests[string(p.Properties.CorrelationData)]
+	sm.requestsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- &CommandResponse{Topic: p.Topic, Payload: p.Payload, Properties: p.Properties}:
+	default:
+	}
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 保留消息
+type RetainedMessage struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Properties *mqtt.Properties // MQTT 5.0 转发属性
+	ExpiresAt  time.Time        // 消息过期后不再发送给新订阅者
+}
+
+// 保留消息存储, 内存索引 + SQLite持久化
+type retainedStore struct {
+	messages map[string]*RetainedMessage
+	cache    *SQLiteCache
+	mu       sync.RWMutex
+}
+
+func newRetainedStore(cache *SQLiteCache) *retainedStore {
+	store := &retainedStore{
+		messages: make(map[string]*RetainedMessage),
+		cache:    cache,
+	}
+
+	// 网关重启后恢复保留消息; 离线缓存不可用时只保存在内存中
+	if cache == nil {
+		return store
+	}
+	messages, err := cache.LoadRetained()
+	if err != nil {
+		log.Printf("Failed to load retained messages: %v", err)
+	}
+	for _, msg := range messages {
+		store.messages[msg.Topic] = msg
+	}
+	return store
+}
+
+// 更新主题的保留消息, 空负载清除; $SYS 统计只保存在内存中, 重启后不恢复过时的数值
+func (r *retainedStore) set(msg *RetainedMessage) {
+	r.mu.Lock()
+	if len(msg.Payload) == 0 {
+		delete(r.messages, msg.Topic)
+	} else {
+		r.messages[msg.Topic] = msg
+	}
+	r.mu.Unlock()
+
+	if r.cache == nil || strings.HasPrefix(msg.Topic, SysTopicPrefix) {
+		return
+	}
+
+	if err := r.cache.SaveRetained(msg); err != nil {
+		log.Printf("Failed to persist retained message on %s: %v", msg.Topic, err)
+	}
+}
+
+// 匹配订阅过滤器的保留消息
+func (r *retainedStore) match(filter string) []*RetainedMessage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	var matches []*RetainedMessage
+	for topic, msg := range r.messages {
+		if !msg.ExpiresAt.IsZero() && now.After(msg.ExpiresAt) {
+			continue
+		}
+		if mqtt.MatchTopic(filter, topic) {
+			matches = append(matches, msg)
+		}
+	}
+	return matches
+}
@@ -3,33 +3,338 @@ package gateway
 import (
 	"context"
 	"errors"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	
+	"edgesphere/internal/auth"
 	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/pkg/utils"
+	"edgesphere/internal/protocol/mqtt"
+	"edgesphere/internal/protocol/sparkplug"
+)
+
+// 会话管理配置
+type SessionConfig struct {
+	CachePath   string
+	CommandQoS  byte // SendCommand 默认QoS
+	MaxInflight int  // 每个会话的出站QoS 1/2飞行窗口
+	// 每个会话待发送的出站消息上限, 订阅者过慢时丢弃QoS 0消息, QoS 1/2断开连接
+	MaxQueued int
+	// 每个离线持久会话排队的消息上限, 超出时丢弃最早的消息, 0 表示不限制
+	MaxOfflineMessages int
+
+	// 保活: 超过 1.5 倍保活时间没有收到任何报文即判定断开
+	DefaultKeepAlive  time.Duration // 未协商保活时间的连接 (非MQTT适配器)
+	KeepAliveOverride time.Duration // 非0时忽略客户端CONNECT中的保活时间
+	MinKeepAlive      time.Duration
+	MaxKeepAlive      time.Duration // 非0时也用于 keep_alive=0 的客户端
+
+	// MQTT 5.0 请求-响应命令的响应主题, %c 替换为设备ID
+	ResponseTopic string
+	// 非MQTT设备未指定主题的上行消息发布到该主题, %c 替换为设备ID
+	TelemetryTopic string
+	// 共享订阅 $share/<group>/<filter> 的组内分发策略
+	SharedStrategy SharedStrategy
+	// 非空时把Sparkplug B指标 (别名已解析) 以JSON发布到该主题, %c 替换为节点或设备ID
+	SparkplugTopic string
+}
+
+var DefaultSessionConfig = SessionConfig{
+	CachePath:          "/data/offline.db",
+	CommandQoS:         1,
+	MaxInflight:        32,
+	MaxQueued:          1000,
+	MaxOfflineMessages: 10000,
+	DefaultKeepAlive:   20 * time.Second,
+	ResponseTopic:      "devices/%c/responses",
+	TelemetryTopic:     "devices/%c/telemetry",
+	SharedStrategy:     SharedRoundRobin,
+}
+
+var (
+	ErrKeepAliveTimeout = errors.New("keepalive timeout")
+	ErrSessionTakenOver = errors.New("session taken over")
+	ErrSessionQueueFull = errors.New("session queue full")
+	// 离线缓存打开失败时网关仍可运行, 但不保存离线命令, 消息和持久会话
+	ErrNoOfflineCache = errors.New("offline cache unavailable")
+)
+
+// 接管时等待旧连接保存会话状态的最长时间
+const takeoverTimeout = 5 * time.Second
+
+// 登记设备时等待设备注册表的最长时间
+const registryTimeout = 5 * time.Second
+
+// 等待后台登记的注册表操作数, 超出时丢弃
+const registryQueueSize = 1024
+
+// 等待后台通知的会话事件数, 超出时丢弃
+const eventQueueSize = 1024
+
+// 心跳时间轮精度, 4层64槽可覆盖约4.6小时, 更长的保活时间到达顶层后重新排入
+const (
+	heartbeatTick     = 100 * time.Millisecond
+	heartbeatSlotBits = 6
+	heartbeatLevels   = 4
 )
 
 type SessionManager struct {
-	sessions  *ConnectionPool
-	cache     *SQLiteCache
-	heartbeat map[string]*time.Ticker
-	mu        sync.RWMutex
+	config       SessionConfig
+	sessions     *ConnectionPool
+	cache        *SQLiteCache
+	wheel        *utils.TimingWheel
+	heartbeat    map[string]*utils.WheelTimer
+	mqttSessions map[string]*session
+	topics       *TopicTree
+	shared       *sharedDispatcher
+	retained     *retainedStore
+	traffic      *mqtt.Traffic
+	started      time.Time
+	notify       EventNotifier
+	events       chan *types.DeviceEvent
+	notifyOnce   sync.Once
+	authn        auth.Authenticator // 为nil时接受所有连接
+	authz        auth.Authorizer    // 为nil时不限制主题访问
+	registry     DeviceRegistry     // 为nil时不登记设备
+	registryOps  chan registryOp
+	registryOnce sync.Once
+	workersDone  chan struct{} // 关闭时停止注册表和事件通知协程
+	workersStop  sync.Once
+	sparkplug    *sparkplug.Host
+	bridges      []*Bridge
+	requests     map[string]chan *CommandResponse // 关联数据 -> 等待响应的请求
+	requestsMu   sync.Mutex
+	shuttingDown atomic.Bool
+	serving      sync.WaitGroup
+	mu           sync.RWMutex
+}
+
+// 会话事件通知, 例如转发给设备管理器
+type EventNotifier func(event *types.DeviceEvent)
+
+// 设备注册表, 由 device.DeviceManager 实现. 用于自带注册流程的协议, 例如LwM2M
+type DeviceRegistry interface {
+	RegisterDevice(ctx context.Context, device *types.Device) error
+	UpdateStatus(deviceID string, status types.DeviceStatus)
 }
 
 func NewSessionManager() *SessionManager {
-	cache, _ := NewSQLiteCache("/data/offline.db")
-	return &SessionManager{
-		sessions:  NewConnectionPool(10000),
-		cache:     cache,
-		heartbeat: make(map[string]*time.Ticker),
+	return NewSessionManagerWithConfig(DefaultSessionConfig)
+}
+
+func NewSessionManagerWithConfig(config SessionConfig) *SessionManager {
+	cache, err := NewSQLiteCache(config.CachePath)
+	if err != nil {
+		log.Printf("Failed to open offline cache %s: %v", config.CachePath, err)
+	}
+	
+	sm := &SessionManager{
+		config:       config,
+		sessions:     NewConnectionPool(10000),
+		cache:        cache,
+		wheel:        utils.NewTimingWheel(heartbeatTick, heartbeatSlotBits, heartbeatLevels),
+		heartbeat:    make(map[string]*utils.WheelTimer),
+		mqttSessions: make(map[string]*session),
+		topics:       NewTopicTree(),
+		shared:       newSharedDispatcher(config.SharedStrategy),
+		retained:     newRetainedStore(cache),
+		traffic:      &mqtt.Traffic{},
+		started:      time.Now(),
+		requests:     make(map[string]chan *CommandResponse),
+		registryOps:  make(chan registryOp, registryQueueSize),
+		events:       make(chan *types.DeviceEvent, eventQueueSize),
+		workersDone:  make(chan struct{}),
+		sparkplug:    sparkplug.NewHost(sparkplug.DefaultConfig),
+	}
+	sm.restoreSubscriptions()
+	sm.wheel.Start()
+	return sm
+}
+
+func (sm *SessionManager) SetNotifier(notify EventNotifier) {
+	sm.notify = notify
+	if notify != nil {
+		sm.notifyOnce.Do(func() { go sm.notifyLoop() })
+	}
+}
+
+func (sm *SessionManager) SetAuthenticator(authn auth.Authenticator) {
+	sm.authn = authn
+}
+
+func (sm *SessionManager) SetAuthorizer(authz auth.Authorizer) {
+	sm.authz = authz
+}
+
+func (sm *SessionManager) SetDeviceRegistry(registry DeviceRegistry) {
+	sm.registry = registry
+	if registry != nil {
+		sm.registryOnce.Do(func() { go sm.registryLoop() })
+	}
+}
+
+// 注册表操作, device 非nil时登记上线的设备, 否则更新状态
+type registryOp struct {
+	device *types.Device
+	id     string
+	status types.DeviceStatus
+}
+
+// 在设备注册表中登记上线的设备, 已登记的设备只更新为在线
+func (sm *SessionManager) registerOnline(device *types.Device) {
+	sm.enqueueRegistry(registryOp{device: device, id: device.ID})
+}
+
+// 更新设备注册表中的状态
+func (sm *SessionManager) updateStatus(deviceID string, status types.DeviceStatus) {
+	sm.enqueueRegistry(registryOp{id: deviceID, status: status})
+}
+
+// 注册表可能访问数据库, 由后台协程按顺序执行, 不阻塞协议处理
+func (sm *SessionManager) enqueueRegistry(op registryOp) {
+	if sm.registry == nil {
+		return
+	}
+	select {
+	case sm.registryOps <- op:
+	default:
+		log.Printf("Device registry queue full, dropping update of %s", op.id)
+	}
+}
+
+func (sm *SessionManager) registryLoop() {
+	for {
+		select {
+		case op := <-sm.registryOps:
+			sm.applyRegistry(op)
+		case <-sm.workersDone:
+			return
+		}
+	}
+}
+
+func (sm *SessionManager) applyRegistry(op registryOp) {
+	registry := sm.registry
+	if registry == nil {
+		return
+	}
+	if op.device == nil {
+		registry.UpdateStatus(op.id, op.status)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	if err := registry.RegisterDevice(ctx, op.device); errors.Is(err, types.ErrDeviceExists) {
+		registry.UpdateStatus(op.id, types.Online)
+	} else if err != nil {
+		log.Printf("Failed to register device %s: %v", op.id, err)
 	}
 }
 
-// 设备连接处理
+// 通知可能访问Redis等外部服务, 由后台协程按顺序发送, 不阻塞连接和遗嘱处理
+func (sm *SessionManager) emit(event *types.DeviceEvent) {
+	if sm.notify == nil {
+		return
+	}
+	select {
+	case sm.events <- event:
+	default:
+		log.Printf("Event queue full, dropping %s event of %s", event.Type, event.DeviceID)
+	}
+}
+
+func (sm *SessionManager) notifyLoop() {
+	for {
+		select {
+		case event := <-sm.events:
+			if notify := sm.notify; notify != nil {
+				notify(event)
+			}
+		case <-sm.workersDone:
+			return
+		}
+	}
+}
+
+// 非MQTT协议的设备连接处理: 上行消息按主题路由给订阅者, 重连后下发离线命令;
+// 阻塞直到连接关闭
 func (sm *SessionManager) HandleConnection(ctx context.Context, deviceID string, adapter types.ProtocolAdapter) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	sm.serving.Add(1)
+	defer sm.serving.Done()
+	
+	keepAlive := sm.config.DefaultKeepAlive
+	if k, ok := adapter.(types.KeepAliver); ok && k.KeepAlive() > 0 {
+		keepAlive = k.KeepAlive()
+	}
+	conn := sm.handleConnection(ctx, deviceID, adapter, keepAlive)
+	adapter.OnMessage(func(msg *types.Message) {
+		conn.Touch()
+		sm.onMessage(deviceID, adapter.Protocol(), msg)
+	})
+	if h, ok := adapter.(types.Heartbeater); ok {
+		h.OnHeartbeat(func(keepAlive time.Duration) {
+			conn.Touch()
+			if keepAlive > 0 {
+				sm.resetHeartbeat(conn, keepAlive)
+			}
+		})
+	}
+	go adapter.Listen()
+	log.Printf("Device %s connected via %s from %v", deviceID, adapter.Protocol(), adapter.RemoteAddr())
 	
+	commands := sm.pendingCommands(deviceID)
+	// 发送失败时该命令及其后的命令写回离线缓存, 下次连接时重发
+	for i, cmd := range commands {
+		if err := adapter.Send(cmd.Payload); err != nil {
+			log.Printf("Failed to resend command to %s: %v", deviceID, err)
+			if err := sm.cache.SavePendingCommands(deviceID, commands[i:]); err != nil {
+				log.Printf("Failed to save %d pending commands for %s: %v", len(commands)-i, deviceID, err)
+			}
+			break
+		}
+	}
+	
+	select {
+	case <-adapter.Context().Done():
+	case <-ctx.Done():
+		adapter.CloseWithReason(types.CloseServerShutdown)
+	}
+	sm.handleDisconnection(conn)
+	log.Printf("Device %s disconnected: %v", deviceID, adapter.Err())
+}
+
+// 非MQTT设备的上行消息, 与MQTT发布相同地授权和路由
+func (sm *SessionManager) onMessage(deviceID, protocol string, msg *types.Message) {
+	topic := msg.Topic
+	if topic == "" {
+		topic = strings.ReplaceAll(sm.config.TelemetryTopic, "%c", deviceID)
+	}
+	client := &auth.Client{ID: deviceID}
+	if strings.HasPrefix(topic, SysTopicPrefix) || (sm.authz != nil && !sm.authz.Authorize(client, auth.Publish, topic)) {
+		log.Printf("Dropping %s message from %s to %s: not authorized", protocol, deviceID, topic)
+		return
+	}
+	
+	p := &mqtt.PublishPacket{Topic: topic, QoS: msg.QoS, Payload: msg.Payload}
+	if len(msg.Properties) > 0 {
+		keys := make([]string, 0, len(msg.Properties))
+		for key := range msg.Properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		p.Properties = &mqtt.Properties{}
+		for _, key := range keys {
+			p.Properties.User = append(p.Properties.User, mqtt.UserProperty{Key: key, Value: msg.Properties[key]})
+		}
+	}
+	sm.onPublish(deviceID, p)
+}
+
+func (sm *SessionManager) handleConnection(ctx context.Context, deviceID string, adapter types.ProtocolAdapter, keepAlive time.Duration) *types.DeviceConnection {
 	// 添加到连接池
 	conn := &types.DeviceConnection{
 		ID:        deviceID,
@@ -37,71 +342,199 @@ func (sm *SessionManager) HandleConnection(ctx context.Context, deviceID string,
 		LastSeen:  time.Now(),
 		Status:    types.Online,
 	}
-	sm.sessions.Put(deviceID, conn)
 	
-	// 启动心跳检测
-	ticker := time.NewTicker(calculateHeartbeatInterval())
-	sm.heartbeat[deviceID] = ticker
+	sm.mu.Lock()
+	old, replaced := sm.sessions.Get(deviceID)
+	replaced = replaced && old.Adapter != adapter
+	if replaced {
+		old.Status = types.Offline
+	}
+	sm.sessions.Put(deviceID, conn)
+	sm.startHeartbeat(conn, keepAlive)
+	sm.mu.Unlock()
 	
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				if time.Since(conn.LastSeen) > 30*time.Second {
-					sm.handleDisconnection(deviceID)
-					return
-				}
-			case <-ctx.Done():
-				return
-			}
+	// 旧连接仍在 (例如半开的TCP连接) 时关闭旧连接, 其保活定时器已被替换.
+	// MQTT会话的接管事件已由 takeover 发出
+	if replaced {
+		old.Adapter.CloseWithReason(types.CloseTakenOver)
+		if old.Adapter.Protocol() != mqtt.Protocol {
+			sm.emitTakeover(deviceID, "")
 		}
-	}()
+	}
+	return conn
 }
 
-// 自适应心跳算法
-func calculateHeartbeatInterval() time.Duration {
-	base := 15 * time.Second
-	// 模拟网络延迟检测 (实际从监控系统获取)
-	latency := 150 * time.Millisecond 
-	return base + time.Duration(float64(base)*0.1*math.Log(float64(latency)))
+// 注册保活定时器, 替换同一设备旧连接的定时器; 调用时持有 sm.mu
+func (sm *SessionManager) startHeartbeat(conn *types.DeviceConnection, keepAlive time.Duration) {
+	deviceID := conn.ID
+	if old, ok := sm.heartbeat[deviceID]; ok {
+		old.Stop()
+		delete(sm.heartbeat, deviceID)
+	}
+	// 保活时间为0时不检测
+	if keepAlive <= 0 {
+		return
+	}
+	
+	// 注册保活定时器. 收到报文时只更新 LastActive, 到期时再按最后活动时间顺延,
+	// 避免每个报文都操作时间轮
+	timeout := keepAlive * 3 / 2
+	var timer *utils.WheelTimer
+	timer = sm.wheel.NewTimer(func() {
+		if idle := time.Since(conn.LastActive()); idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+		// 回调运行在时间轮驱动协程中, 断开处理需要加锁和关闭连接
+		go sm.expireConnection(conn, timer)
+	})
+	sm.heartbeat[deviceID] = timer
+	timer.Reset(timeout)
 }
 
-// 断网处理
-func (sm *SessionManager) handleDisconnection(deviceID string) {
+// 连接期间保活时间改变, 连接已断开或被接管时忽略
+func (sm *SessionManager) resetHeartbeat(conn *types.DeviceConnection, keepAlive time.Duration) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	if current, ok := sm.sessions.Get(conn.ID); ok && current == conn {
+		sm.startHeartbeat(conn, keepAlive)
+	}
+}
+
+// 保活超时, 定时器已被停止或替换时忽略
+func (sm *SessionManager) expireConnection(conn *types.DeviceConnection, timer *utils.WheelTimer) {
+	sm.mu.RLock()
+	current := sm.heartbeat[conn.ID] == timer
+	sm.mu.RUnlock()
+	if !current {
+		return
+	}
 	
-	if conn, ok := sm.sessions.Get(deviceID); ok {
-		conn.Status = types.Offline
-		sm.cache.SaveSession(deviceID, conn)
-		sm.sessions.Remove(deviceID)
+	if s := sm.mqttSession(conn.ID); s != nil && conn.Adapter == s.adapter {
+		s.adapter.Disconnect(mqtt.KeepAliveTimeout, ErrKeepAliveTimeout)
+	} else {
+		conn.Adapter.CloseWithReason(types.CloseKeepAliveTimeout)
+	}
+	sm.handleDisconnection(conn)
+}
+
+func (sm *SessionManager) emitTakeover(deviceID string, remote string) {
+	reason := ErrSessionTakenOver.Error()
+	if remote != "" {
+		reason += " by " + remote
+	}
+	sm.emit(&types.DeviceEvent{
+		Type:      types.EventTakeover,
+		DeviceID:  deviceID,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+}
+
+// 根据客户端CONNECT中的保活时间 (秒) 和网关配置计算实际保活时间
+func (sm *SessionManager) keepAliveFor(clientKeepAlive uint16) time.Duration {
+	if sm.config.KeepAliveOverride > 0 {
+		return sm.config.KeepAliveOverride
 	}
 	
-	if ticker, ok := sm.heartbeat[deviceID]; ok {
-		ticker.Stop()
-		delete(sm.heartbeat, deviceID)
+	keepAlive := time.Duration(clientKeepAlive) * time.Second
+	if keepAlive == 0 {
+		return sm.config.MaxKeepAlive
+	}
+	if sm.config.MinKeepAlive > 0 && keepAlive < sm.config.MinKeepAlive {
+		keepAlive = sm.config.MinKeepAlive
+	}
+	if sm.config.MaxKeepAlive > 0 && keepAlive > sm.config.MaxKeepAlive {
+		keepAlive = sm.config.MaxKeepAlive
+	}
+	return keepAlive
+}
+
+// 断网处理, 连接已被同一设备的新连接接管时不影响新连接
+func (sm *SessionManager) handleDisconnection(conn *types.DeviceConnection) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	
+	conn.Status = types.Offline
+	// 关闭连接, 由连接处理协程保存未确认的命令
+	conn.Adapter.Close()
+	
+	if current, ok := sm.sessions.Get(conn.ID); !ok || current != conn {
+		return
+	}
+	sm.sessions.Remove(conn.ID)
+	if timer, ok := sm.heartbeat[conn.ID]; ok {
+		timer.Stop()
+		delete(sm.heartbeat, conn.ID)
 	}
 }
 
 // 指令下发
 func (sm *SessionManager) SendCommand(deviceID string, cmd []byte) error {
+	return sm.SendCommandQoS(deviceID, cmd, sm.config.CommandQoS)
+}
+
+// 按指定QoS下发指令, QoS 1/2 仅对MQTT会话生效
+func (sm *SessionManager) SendCommandQoS(deviceID string, cmd []byte, qos byte) error {
+	if qos > 2 {
+		return errors.New("invalid QoS level")
+	}
+	
 	conn, ok := sm.sessions.Get(deviceID)
 	if !ok {
 		// 设备离线，存入缓存
-		return sm.cache.SaveCommand(deviceID, cmd)
+		if sm.cache == nil {
+			return ErrNoOfflineCache
+		}
+		return sm.cache.SavePendingCommands(deviceID, []*PendingCommand{{Payload: cmd, QoS: qos}})
 	}
 	
+	if s := sm.mqttSession(deviceID); s != nil && qos > 0 {
+		return s.publish(&inflightMessage{
+			PendingCommand: PendingCommand{Payload: cmd, QoS: qos},
+			Topic:          s.adapter.CommandTopic(),
+			Command:        true,
+		})
+	}
 	return conn.Adapter.Send(cmd)
 }
 
-// 故障转移
-func (sm *SessionManager) FailoverToBackup(deviceID string) {
-	if backupConn := getBackupNode(deviceID); backupConn != nil {
-		sm.sessions.Put(deviceID, backupConn)
-		// 重发缓存命令
-		commands, _ := sm.cache.GetCommands(deviceID)
-		for _, cmd := range commands {
-			backupConn.Adapter.Send(cmd)
+// 关闭所有连接并等待未确认的命令写回离线缓存, 网关停机不发布遗嘱
+func (sm *SessionManager) Shutdown(timeout time.Duration) {
+	sm.shuttingDown.Store(true)
+	
+	sm.mu.RLock()
+	for _, s := range sm.mqttSessions {
+		s.adapter.Disconnect(mqtt.ServerShuttingDown, nil)
+	}
+	sm.mu.RUnlock()
+	for _, conn := range sm.sessions.List() {
+		if conn.Adapter.Protocol() != mqtt.Protocol {
+			conn.Adapter.CloseWithReason(types.CloseServerShutdown)
 		}
 	}
-}
\ No newline at end of file
+	
+	done := make(chan struct{})
+	go func() {
+		sm.serving.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	sm.wheel.Stop()
+	sm.workersStop.Do(func() { close(sm.workersDone) })
+}
+
+// 取出离线缓存中的待投递命令, 缓存不可用时为空
+func (sm *SessionManager) pendingCommands(deviceID string) []*PendingCommand {
+	if sm.cache == nil {
+		return nil
+	}
+	commands, err := sm.cache.GetPendingCommands(deviceID)
+	if err != nil {
+		log.Printf("Failed to load pending commands for %s: %v", deviceID, err)
+	}
+	return commands
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 共享订阅的分发策略
+type SharedStrategy string
+
+const (
+	// 按组成员轮流投递
+	SharedRoundRobin SharedStrategy = "round_robin"
+	// 同一发布者的消息固定投递给同一成员, 该成员离开后重新分配
+	SharedSticky SharedStrategy = "sticky"
+)
+
+// 共享订阅组的分发状态
+type sharedDispatcher struct {
+	strategy SharedStrategy
+
+	mu     sync.Mutex
+	next   map[string]int               // 共享订阅过滤器 -> 轮询位置
+	sticky map[string]map[string]string // 共享订阅过滤器 -> 发布者 -> 成员
+}
+
+func newSharedDispatcher(strategy SharedStrategy) *sharedDispatcher {
+	return &sharedDispatcher{
+		strategy: strategy,
+		next:     make(map[string]int),
+		sticky:   make(map[string]map[string]string),
+	}
+}
+
+// 从候选成员中选择一个, candidates 已排序且非空
+func (d *sharedDispatcher) pick(filter, from string, candidates []string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.strategy == SharedSticky && from != "" {
+		if member, ok := d.sticky[filter][from]; ok && containsMember(candidates, member) {
+			return member
+		}
+	}
+
+	member := candidates[d.next[filter]%len(candidates)]
+	d.next[filter]++
+
+	if d.strategy == SharedSticky && from != "" {
+		if d.sticky[filter] == nil {
+			d.sticky[filter] = make(map[string]string)
+		}
+		d.sticky[filter][from] = member
+	}
+	return member
+}
+
+// 组内所有成员退订后清除分发状态
+func (d *sharedDispatcher) forget(filter string) {
+	d.mu.Lock()
+	delete(d.next, filter)
+	delete(d.sticky, filter)
+	d.mu.Unlock()
+}
+
+func containsMember(members []string, clientID string) bool {
+	i := sort.SearchStrings(members, clientID)
+	return i < len(members) && members[i] == clientID
+}
+
+// 共享订阅的消息只投递给组内一个成员, 优先在线成员;
+// 成员都离线时排队给其中一个持久会话. 没有可投递的成员时返回false
+func (sm *SessionManager) routeShared(from, filter string, members map[string]byte, msg *inflightMessage) bool {
+	var online, offline []string
+	for clientID := range members {
+		if sm.mqttSession(clientID) != nil {
+			online = append(online, clientID)
+		} else {
+			offline = append(offline, clientID)
+		}
+	}
+	candidates := online
+	if len(candidates) == 0 {
+		if msg.QoS == 0 {
+			return false
+		}
+		candidates = offline
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	sort.Strings(candidates)
+
+	clientID := sm.shared.pick(filter, from, candidates)
+	qos := minQoS(msg.QoS, members[clientID])
+	if sub := sm.mqttSession(clientID); sub != nil {
+		sub.optionsMu.RLock()
+		retainAsPublished := sub.options[filter]&optRetainAsPublished != 0
+		sub.optionsMu.RUnlock()
+
+		out := *msg
+		out.QoS = qos
+		out.Retain = msg.Retain && retainAsPublished
+		out.Share = filter
+		deliver(sub, &out)
+		return true
+	}
+
+	if qos == 0 || sm.cache == nil {
+		return false
+	}
+	err := sm.cache.QueueMessage(clientID, &QueuedMessage{
+		Topic:      msg.Topic,
+		Payload:    msg.Payload,
+		QoS:        qos,
+		Properties: msg.Properties,
+		ExpiresAt:  msg.ExpiresAt,
+	}, sm.config.MaxOfflineMessages)
+	if err != nil {
+		log.Printf("Failed to queue shared message for offline session %s: %v", clientID, err)
+	}
+	return true
+}
+
+// 断开的成员未确认的共享订阅消息改投给组内其他成员, 返回无法改投的消息
+func (sm *SessionManager) redeliverShared(s *session, messages []*inflightMessage) []*inflightMessage {
+	var remaining []*inflightMessage
+	for _, msg := range messages {
+		members := sm.topics.SharedMembers(msg.Share)
+		delete(members, s.clientID)
+
+		out := *msg
+		out.PacketID = 0
+		out.SentAt = time.Time{}
+		if len(members) > 0 && sm.routeShared("", msg.Share, members, &out) {
+			continue
+		}
+		remaining = append(remaining, msg)
+	}
+	if n := len(messages) - len(remaining); n > 0 {
+		log.Printf("Redelivered %d unacknowledged shared subscription messages of %s", n, s.clientID)
+	}
+	return remaining
+}
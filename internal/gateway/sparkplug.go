@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/mqtt"
+	"edgesphere/internal/protocol/sparkplug"
+)
+
+// Sparkplug B 消息: 出生/死亡证明驱动节点和设备的在线状态, 序号不连续时请求节点重生.
+// 原始消息照常路由给订阅者
+func (sm *SessionManager) onSparkplug(p *mqtt.PublishPacket) {
+	topic, err := sparkplug.ParseTopic(p.Topic)
+	if err != nil {
+		log.Printf("Ignoring Sparkplug message on %s: %v", p.Topic, err)
+		return
+	}
+	switch topic.Type {
+	case sparkplug.NCMD, sparkplug.DCMD, sparkplug.STATE:
+		return
+	}
+	payload, err := sparkplug.Unmarshal(p.Payload)
+	if err != nil {
+		log.Printf("Invalid Sparkplug payload on %s: %v", p.Topic, err)
+		return
+	}
+
+	update := sm.sparkplug.Handle(topic, payload)
+	for _, id := range update.Offline {
+		log.Printf("Sparkplug %s offline", id)
+		sm.updateStatus(id, types.Offline)
+	}
+	for _, id := range update.Online {
+		log.Printf("Sparkplug %s online", id)
+		sm.registerOnline(sparkplugDevice(topic, id))
+	}
+	if update.Rebirth {
+		ncmd, payload := sparkplug.RebirthCommand(topic.Group, topic.Node)
+		log.Printf("Requesting Sparkplug rebirth of %s", topic.NodeID())
+		sm.onPublish("", &mqtt.PublishPacket{Topic: ncmd, Payload: payload})
+	}
+	if sm.config.SparkplugTopic != "" && len(update.Metrics) > 0 {
+		sm.publishSparkplugMetrics(topic.DeviceID(), update.Metrics)
+	}
+}
+
+func sparkplugDevice(topic sparkplug.Topic, id string) *types.Device {
+	now := time.Now()
+	device := &types.Device{
+		ID:        id,
+		Name:      topic.Node,
+		Type:      "sparkplug",
+		Status:    types.Online,
+		LastSeen:  now,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Metadata: map[string]string{
+			"group":     topic.Group,
+			"edge_node": topic.Node,
+		},
+	}
+	if id != topic.NodeID() {
+		device.Name = topic.Device
+		device.Metadata["device"] = topic.Device
+	}
+	return device
+}
+
+// 以 {"指标名": 值} 发布解析后的指标, 空值为null
+func (sm *SessionManager) publishSparkplugMetrics(id string, metrics []sparkplug.Metric) {
+	values := make(map[string]interface{}, len(metrics))
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+	payload, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("Failed to encode Sparkplug metrics of %s: %v", id, err)
+		return
+	}
+	sm.onPublish("", &mqtt.PublishPacket{
+		Topic:   strings.ReplaceAll(sm.config.SparkplugTopic, "%c", id),
+		Payload: payload,
+	})
+}
@@ -4,11 +4,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 	
 	_ "github.com/mattn/go-sqlite3"
-	"edgesphere/internal/pkg/types"
+	
+	"edgesphere/internal/protocol/mqtt"
 )
 
 type SQLiteCache struct {
@@ -34,55 +36,297 @@ func NewSQLiteCache(path string) (*SQLiteCache, error) {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		device_id TEXT,
 		command BLOB,
+		qos INTEGER NOT NULL DEFAULT 0,
+		packet_id INTEGER NOT NULL DEFAULT 0,
+		released INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	
+	CREATE TABLE IF NOT EXISTS session_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client_id TEXT,
+		topic TEXT,
+		payload BLOB,
+		qos INTEGER NOT NULL DEFAULT 0,
+		retain INTEGER NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);`)
+	);
 	
-	return &SQLiteCache{db: db}, err
+	CREATE INDEX IF NOT EXISTS idx_session_messages_client ON session_messages(client_id);
+	
+	CREATE TABLE IF NOT EXISTS retained (
+		topic TEXT PRIMARY KEY,
+		payload BLOB,
+		qos INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	
+	CREATE TABLE IF NOT EXISTS bridge_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		bridge TEXT,
+		topic TEXT,
+		payload BLOB,
+		qos INTEGER NOT NULL DEFAULT 0,
+		retain INTEGER NOT NULL DEFAULT 0,
+		properties BLOB,
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	
+	CREATE INDEX IF NOT EXISTS idx_bridge_outbox_bridge ON bridge_outbox(bridge, id);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	
+	// 旧版本数据库补充QoS相关列和MQTT 5.0消息属性
+	for _, col := range []struct{ table, column string }{
+		{"commands", "qos INTEGER NOT NULL DEFAULT 0"},
+		{"commands", "packet_id INTEGER NOT NULL DEFAULT 0"},
+		{"commands", "released INTEGER NOT NULL DEFAULT 0"},
+		{"session_messages", "properties BLOB"},
+		{"session_messages", "expires_at INTEGER NOT NULL DEFAULT 0"},
+		{"retained", "properties BLOB"},
+		{"retained", "expires_at INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addColumnIfMissing(db, col.table, col.column); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	
+	return &SQLiteCache{db: db}, nil
 }
 
-func (c *SQLiteCache) SaveSession(deviceID string, conn *types.DeviceConnection) error {
+func addColumnIfMissing(db *sql.DB, table, column string) error {
+	name := strings.Fields(column)[0]
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	
+	for rows.Next() {
+		var existing string
+		if err := rows.Scan(&existing); err != nil {
+			return err
+		}
+		if existing == name {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column))
+	return err
+}
+
+// 3.1.1 持久会话 (clean-session=false) 的有效期
+const DefaultSessionExpiry = 7 * 24 * time.Hour
+
+// 保存持久会话, 7天后过期
+func (c *SQLiteCache) SaveSession(clientID string, state *SessionState) error {
+	return c.SaveSessionWithExpiry(clientID, state, DefaultSessionExpiry)
+}
+
+// 保存持久会话, expiry 为断开后的保留时间
+func (c *SQLiteCache) SaveSessionWithExpiry(clientID string, state *SessionState, expiry time.Duration) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	
-	data, err := json.Marshal(conn)
+	data, err := json.Marshal(state)
 	if err != nil {
 		return err
 	}
 	
 	_, err = c.db.Exec(`
 		INSERT OR REPLACE INTO sessions (device_id, connection, expires_at)
-		VALUES (?, ?, datetime('now','+7 days'))`,
-		deviceID, data)
+		VALUES (?, ?, datetime('now', ?))`,
+		clientID, data, fmt.Sprintf("+%d seconds", int64(expiry/time.Second)))
 	return err
 }
 
-func (c *SQLiteCache) SaveCommand(deviceID string, cmd []byte) error {
+// 读取未过期的持久会话, 不存在时返回nil
+func (c *SQLiteCache) LoadSession(clientID string) (*SessionState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	var data []byte
+	err := c.db.QueryRow(`
+		SELECT connection FROM sessions 
+		WHERE device_id = ? AND expires_at >= datetime('now')`, clientID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	state := &SessionState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// 所有未过期的持久会话, 网关启动时恢复订阅
+func (c *SQLiteCache) LoadSessions() (map[string]*SessionState, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	
-	_, err := c.db.Exec(`
-		INSERT INTO commands (device_id, command) 
-		VALUES (?, ?)`, deviceID, cmd)
+	rows, err := c.db.Query(`
+		SELECT device_id, connection FROM sessions 
+		WHERE expires_at >= datetime('now')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	sessions := make(map[string]*SessionState)
+	for rows.Next() {
+		var clientID string
+		var data []byte
+		if err := rows.Scan(&clientID, &data); err != nil {
+			return nil, err
+		}
+		state := &SessionState{}
+		if err := json.Unmarshal(data, state); err != nil {
+			continue
+		}
+		sessions[clientID] = state
+	}
+	return sessions, rows.Err()
+}
+
+// 删除持久会话及其排队消息
+func (c *SQLiteCache) DeleteSession(clientID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	if _, err := c.db.Exec("DELETE FROM sessions WHERE device_id = ?", clientID); err != nil {
+		return err
+	}
+	_, err := c.db.Exec("DELETE FROM session_messages WHERE client_id = ?", clientID)
+	return err
+}
+
+// 离线持久会话的排队消息, limit > 0 时只保留最新的 limit 条
+func (c *SQLiteCache) QueueMessage(clientID string, msg *QueuedMessage, limit int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	props, err := marshalProperties(msg.Properties)
+	if err != nil {
+		return err
+	}
+	
+	_, err = c.db.Exec(`
+		INSERT INTO session_messages (client_id, topic, payload, qos, retain, properties, expires_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		clientID, msg.Topic, msg.Payload, msg.QoS, msg.Retain, props, unixTime(msg.ExpiresAt))
+	if err != nil || limit <= 0 {
+		return err
+	}
+	
+	_, err = c.db.Exec(`
+		DELETE FROM session_messages WHERE client_id = ? AND id <= (
+			SELECT id FROM session_messages WHERE client_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+		)`, clientID, clientID, limit)
 	return err
 }
 
+// 取出并删除排队消息, 已过期的消息丢弃
+func (c *SQLiteCache) TakeQueuedMessages(clientID string) ([]*QueuedMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	rows, err := c.db.Query(`
+		SELECT topic, payload, qos, retain, properties, expires_at FROM session_messages 
+		WHERE client_id = ? AND (expires_at = 0 OR expires_at > ?)
+		ORDER BY id ASC`, clientID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var messages []*QueuedMessage
+	for rows.Next() {
+		msg := &QueuedMessage{}
+		var props []byte
+		var expiresAt int64
+		if err := rows.Scan(&msg.Topic, &msg.Payload, &msg.QoS, &msg.Retain, &props, &expiresAt); err != nil {
+			return nil, err
+		}
+		if msg.Properties, err = unmarshalProperties(props); err != nil {
+			return nil, err
+		}
+		msg.ExpiresAt = fromUnixTime(expiresAt)
+		messages = append(messages, msg)
+	}
+	
+	_, _ = c.db.Exec("DELETE FROM session_messages WHERE client_id = ?", clientID)
+	return messages, nil
+}
+
+func (c *SQLiteCache) SaveCommand(deviceID string, cmd []byte) error {
+	return c.SavePendingCommands(deviceID, []*PendingCommand{{Payload: cmd}})
+}
+
+// 保存待投递命令, 包括会话断开时未确认的QoS 1/2命令
+func (c *SQLiteCache) SavePendingCommands(deviceID string, cmds []*PendingCommand) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	
+	for _, cmd := range cmds {
+		_, err := tx.Exec(`
+			INSERT INTO commands (device_id, command, qos, packet_id, released) 
+			VALUES (?, ?, ?, ?, ?)`,
+			deviceID, cmd.Payload, cmd.QoS, cmd.PacketID, cmd.Released)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (c *SQLiteCache) GetCommands(deviceID string) ([][]byte, error) {
+	pending, err := c.GetPendingCommands(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	
+	commands := make([][]byte, 0, len(pending))
+	for _, cmd := range pending {
+		commands = append(commands, cmd.Payload)
+	}
+	return commands, nil
+}
+
+func (c *SQLiteCache) GetPendingCommands(deviceID string) ([]*PendingCommand, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	
 	rows, err := c.db.Query(`
-		SELECT command FROM commands 
+		SELECT command, qos, packet_id, released FROM commands 
 		WHERE device_id = ? 
-		ORDER BY created_at ASC`, deviceID)
+		ORDER BY created_at ASC, id ASC`, deviceID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	
-	var commands [][]byte
+	var commands []*PendingCommand
 	for rows.Next() {
-		var cmd []byte
-		if err := rows.Scan(&cmd); err != nil {
+		cmd := &PendingCommand{}
+		if err := rows.Scan(&cmd.Payload, &cmd.QoS, &cmd.PacketID, &cmd.Released); err != nil {
 			return nil, err
 		}
 		commands = append(commands, cmd)
@@ -93,10 +337,196 @@ func (c *SQLiteCache) GetCommands(deviceID string) ([][]byte, error) {
 	return commands, nil
 }
 
+// 离线队列深度: 待下发的命令数和持久会话排队的消息数
+func (c *SQLiteCache) QueueDepth() (commands, messages int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	if err = c.db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&commands); err != nil {
+		return 0, 0, err
+	}
+	err = c.db.QueryRow("SELECT COUNT(*) FROM session_messages").Scan(&messages)
+	return commands, messages, err
+}
+
+// 保留消息, 空负载表示清除
+func (c *SQLiteCache) SaveRetained(msg *RetainedMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	if len(msg.Payload) == 0 {
+		_, err := c.db.Exec("DELETE FROM retained WHERE topic = ?", msg.Topic)
+		return err
+	}
+	
+	props, err := marshalProperties(msg.Properties)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT OR REPLACE INTO retained (topic, payload, qos, properties, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+		msg.Topic, msg.Payload, msg.QoS, props, unixTime(msg.ExpiresAt))
+	return err
+}
+
+// 未过期的保留消息
+func (c *SQLiteCache) LoadRetained() ([]*RetainedMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	rows, err := c.db.Query(`
+		SELECT topic, payload, qos, properties, expires_at FROM retained
+		WHERE expires_at = 0 OR expires_at > ?`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var messages []*RetainedMessage
+	for rows.Next() {
+		msg := &RetainedMessage{}
+		var props []byte
+		var expiresAt int64
+		if err := rows.Scan(&msg.Topic, &msg.Payload, &msg.QoS, &props, &expiresAt); err != nil {
+			return nil, err
+		}
+		if msg.Properties, err = unmarshalProperties(props); err != nil {
+			return nil, err
+		}
+		msg.ExpiresAt = fromUnixTime(expiresAt)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// 桥接上行消息, 发送成功后删除; 超过 limit 条时丢弃最早的消息
+func (c *SQLiteCache) QueueBridgeMessage(bridge string, msg *QueuedMessage, limit int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	props, err := marshalProperties(msg.Properties)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT INTO bridge_outbox (bridge, topic, payload, qos, retain, properties, expires_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		bridge, msg.Topic, msg.Payload, msg.QoS, msg.Retain, props, unixTime(msg.ExpiresAt))
+	if err != nil || limit <= 0 {
+		return err
+	}
+	
+	_, err = c.db.Exec(`
+		DELETE FROM bridge_outbox WHERE bridge = ? AND id <= (
+			SELECT id FROM bridge_outbox WHERE bridge = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+		)`, bridge, bridge, limit)
+	return err
+}
+
+// 按写入顺序读取最多 n 条待发送的桥接消息, 不删除
+func (c *SQLiteCache) PeekBridgeMessages(bridge string, n int) ([]*BridgeMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	rows, err := c.db.Query(`
+		SELECT id, topic, payload, qos, retain, properties, expires_at FROM bridge_outbox 
+		WHERE bridge = ? ORDER BY id ASC LIMIT ?`, bridge, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var messages []*BridgeMessage
+	for rows.Next() {
+		msg := &BridgeMessage{QueuedMessage: &QueuedMessage{}}
+		var props []byte
+		var expiresAt int64
+		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Payload, &msg.QoS, &msg.Retain, &props, &expiresAt); err != nil {
+			return nil, err
+		}
+		if msg.Properties, err = unmarshalProperties(props); err != nil {
+			return nil, err
+		}
+		msg.ExpiresAt = fromUnixTime(expiresAt)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (c *SQLiteCache) DeleteBridgeMessage(id int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	_, err := c.db.Exec("DELETE FROM bridge_outbox WHERE id = ?", id)
+	return err
+}
+
+// MQTT 5.0 消息属性以JSON保存
+func marshalProperties(props *mqtt.Properties) ([]byte, error) {
+	if props == nil {
+		return nil, nil
+	}
+	return json.Marshal(props)
+}
+
+func unmarshalProperties(data []byte) (*mqtt.Properties, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	props := &mqtt.Properties{}
+	if err := json.Unmarshal(data, props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// 过期时间按Unix秒保存, 0表示不过期
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
 // 清理过期会话
 func (c *SQLiteCache) Cleanup() {
 	ticker := time.NewTicker(1 * time.Hour)
 	for range ticker.C {
-		c.db.Exec("DELETE FROM sessions WHERE expires_at < datetime('now')")
+		c.DeleteExpiredSessions()
+	}
+}
+
+// 删除过期会话及其排队消息, 返回被删除的客户端ID
+func (c *SQLiteCache) DeleteExpiredSessions() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	rows, err := c.db.Query("SELECT device_id FROM sessions WHERE expires_at < datetime('now')")
+	if err != nil {
+		return nil, err
+	}
+	var expired []string
+	for rows.Next() {
+		var clientID string
+		if err := rows.Scan(&clientID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, clientID)
+	}
+	rows.Close()
+	
+	for _, clientID := range expired {
+		c.db.Exec("DELETE FROM sessions WHERE device_id = ?", clientID)
+		c.db.Exec("DELETE FROM session_messages WHERE client_id = ?", clientID)
 	}
+	return expired, nil
 }
\ No newline at end of file
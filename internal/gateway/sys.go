@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 网关统计主题前缀, 客户端只能订阅
+const SysTopicPrefix = "$SYS/"
+
+// 网关运行统计
+type Stats struct {
+	ClientsConnected int
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	BytesSent        uint64
+	QueuedCommands   int // 离线缓存中待下发的命令
+	QueuedMessages   int // 离线持久会话排队的消息
+	Subscriptions    int
+	Uptime           time.Duration
+}
+
+// MQTT适配器共享的流量统计, 监听时设置到 AdapterConfig.Traffic
+func (sm *SessionManager) Traffic() *mqtt.Traffic {
+	return sm.traffic
+}
+
+func (sm *SessionManager) Stats() *Stats {
+	stats := &Stats{
+		ClientsConnected: sm.sessions.Count(),
+		MessagesReceived: sm.traffic.MessagesIn.Load(),
+		MessagesSent:     sm.traffic.MessagesOut.Load(),
+		BytesReceived:    sm.traffic.BytesIn.Load(),
+		BytesSent:        sm.traffic.BytesOut.Load(),
+		Subscriptions:    sm.topics.Count(),
+		Uptime:           time.Since(sm.started),
+	}
+	if sm.cache != nil {
+		commands, messages, err := sm.cache.QueueDepth()
+		if err != nil {
+			log.Printf("Failed to read offline queue depth: %v", err)
+		}
+		stats.QueuedCommands, stats.QueuedMessages = commands, messages
+	}
+	return stats
+}
+
+// 定期以保留消息发布 $SYS 统计, 直到 ctx 取消
+func (sm *SessionManager) PublishStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sm.publishStats(sm.Stats())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (sm *SessionManager) publishStats(stats *Stats) {
+	values := map[string]string{
+		"broker/clients/connected":    strconv.Itoa(stats.ClientsConnected),
+		"broker/messages/received":    strconv.FormatUint(stats.MessagesReceived, 10),
+		"broker/messages/sent":        strconv.FormatUint(stats.MessagesSent, 10),
+		"broker/bytes/received":       strconv.FormatUint(stats.BytesReceived, 10),
+		"broker/bytes/sent":           strconv.FormatUint(stats.BytesSent, 10),
+		"broker/store/commands/count": strconv.Itoa(stats.QueuedCommands),
+		"broker/store/messages/count": strconv.Itoa(stats.QueuedMessages),
+		"broker/subscriptions/count":  strconv.Itoa(stats.Subscriptions),
+		"broker/uptime":               strconv.FormatInt(int64(stats.Uptime/time.Second), 10) + " seconds",
+	}
+	for topic, value := range values {
+		sm.onPublish(SysTopicPrefix, &mqtt.PublishPacket{
+			Topic:   SysTopicPrefix + topic,
+			Retain:  true,
+			Payload: []byte(value),
+		})
+	}
+}
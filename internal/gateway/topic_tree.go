@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 订阅树节点, 每一级主题对应一个节点
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[string]byte // clientID -> 授予的QoS
+	// 共享订阅 "$share/<group>/<filter>" -> clientID -> QoS
+	shared map[string]map[string]byte
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[string]byte),
+		shared:      make(map[string]map[string]byte),
+	}
+}
+
+// 支持 '+' / '#' 通配符的订阅树
+type TopicTree struct {
+	root    *topicNode
+	clients map[string]map[string]byte // clientID -> filter -> QoS
+	mu      sync.RWMutex
+}
+
+func NewTopicTree() *TopicTree {
+	return &TopicTree{
+		root:    newTopicNode(),
+		clients: make(map[string]map[string]byte),
+	}
+}
+
+// 添加订阅, 同一过滤器重复订阅时替换QoS; 共享订阅挂在组内过滤器对应的节点上
+func (t *TopicTree) Subscribe(clientID, filter string, qos byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node := t.root
+	for _, level := range strings.Split(topicFilter(filter), "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	if topicFilter(filter) != filter {
+		if node.shared[filter] == nil {
+			node.shared[filter] = make(map[string]byte)
+		}
+		node.shared[filter][clientID] = qos
+	} else {
+		node.subscribers[clientID] = qos
+	}
+
+	if t.clients[clientID] == nil {
+		t.clients[clientID] = make(map[string]byte)
+	}
+	t.clients[clientID][filter] = qos
+}
+
+func (t *TopicTree) Unsubscribe(clientID, filter string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.clients[clientID][filter]; !ok {
+		return false
+	}
+	delete(t.clients[clientID], filter)
+	if len(t.clients[clientID]) == 0 {
+		delete(t.clients, clientID)
+	}
+
+	t.remove(t.root, filter, strings.Split(topicFilter(filter), "/"), clientID)
+	return true
+}
+
+// 移除客户端的全部订阅
+func (t *TopicTree) RemoveClient(clientID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for filter := range t.clients[clientID] {
+		t.remove(t.root, filter, strings.Split(topicFilter(filter), "/"), clientID)
+	}
+	delete(t.clients, clientID)
+}
+
+// 客户端当前的订阅
+func (t *TopicTree) Subscriptions(clientID string) map[string]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	subs := make(map[string]byte, len(t.clients[clientID]))
+	for filter, qos := range t.clients[clientID] {
+		subs[filter] = qos
+	}
+	return subs
+}
+
+// 订阅总数
+func (t *TopicTree) Count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n := 0
+	for _, subs := range t.clients {
+		n += len(subs)
+	}
+	return n
+}
+
+// 匹配主题的订阅者, 同一客户端多个过滤器匹配时取最大QoS; 不含共享订阅
+func (t *TopicTree) Match(topic string) map[string]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	matches := make(map[string]byte)
+	t.walk(topic, func(node *topicNode) {
+		collect(node, matches)
+	})
+	return matches
+}
+
+// 匹配主题的共享订阅: 共享订阅过滤器 -> 组成员 -> QoS
+func (t *TopicTree) MatchShared(topic string) map[string]map[string]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	matches := make(map[string]map[string]byte)
+	t.walk(topic, func(node *topicNode) {
+		for filter, members := range node.shared {
+			matches[filter] = copyMembers(members)
+		}
+	})
+	return matches
+}
+
+// 共享订阅当前的组成员
+func (t *TopicTree) SharedMembers(filter string) map[string]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	node := t.root
+	for _, level := range strings.Split(topicFilter(filter), "/") {
+		if node = node.children[level]; node == nil {
+			return nil
+		}
+	}
+	return copyMembers(node.shared[filter])
+}
+
+func copyMembers(members map[string]byte) map[string]byte {
+	out := make(map[string]byte, len(members))
+	for clientID, qos := range members {
+		out[clientID] = qos
+	}
+	return out
+}
+
+// 对匹配主题的每个过滤器节点调用 visit
+func (t *TopicTree) walk(topic string, visit func(node *topicNode)) {
+	levels := strings.Split(topic, "/")
+	// '$' 开头的系统主题不匹配首级通配符
+	t.match(t.root, levels, 0, strings.HasPrefix(topic, "$"), visit)
+}
+
+func (t *TopicTree) match(node *topicNode, levels []string, depth int, system bool, visit func(node *topicNode)) {
+	wildcard := !(system && depth == 0)
+
+	// '#' 同时匹配父级本身
+	if wildcard {
+		if child, ok := node.children["#"]; ok {
+			visit(child)
+		}
+	}
+
+	if depth == len(levels) {
+		visit(node)
+		return
+	}
+
+	if child, ok := node.children[levels[depth]]; ok {
+		t.match(child, levels, depth+1, system, visit)
+	}
+	if wildcard {
+		if child, ok := node.children["+"]; ok {
+			t.match(child, levels, depth+1, system, visit)
+		}
+	}
+}
+
+func collect(node *topicNode, matches map[string]byte) {
+	for clientID, qos := range node.subscribers {
+		if current, ok := matches[clientID]; !ok || qos > current {
+			matches[clientID] = qos
+		}
+	}
+}
+
+// 删除订阅并回收空节点
+func (t *TopicTree) remove(node *topicNode, filter string, levels []string, clientID string) bool {
+	if len(levels) == 0 {
+		if members, ok := node.shared[filter]; ok {
+			delete(members, clientID)
+			if len(members) == 0 {
+				delete(node.shared, filter)
+			}
+		} else {
+			delete(node.subscribers, clientID)
+		}
+	} else if child, ok := node.children[levels[0]]; ok {
+		if t.remove(child, filter, levels[1:], clientID) {
+			delete(node.children, levels[0])
+		}
+	}
+	return len(node.subscribers) == 0 && len(node.shared) == 0 && len(node.children) == 0
+}
+
+// 共享订阅返回组内的过滤器, 其他过滤器原样返回
+func topicFilter(filter string) string {
+	if _, f, ok := mqtt.ParseSharedFilter(filter); ok {
+		return f
+	}
+	return filter
+}
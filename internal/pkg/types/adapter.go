@@ -0,0 +1,70 @@
+package types
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// 协议无关的设备上行消息
+type Message struct {
+	DeviceID  string
+	Topic     string // 为空时由网关使用默认遥测主题
+	Payload   []byte
+	QoS       byte
+	Timestamp time.Time
+	// 协议相关的附加信息, 例如 CoAP 选项或 MQTT 5.0 用户属性
+	Properties map[string]string
+}
+
+// 入站消息回调, 在适配器的读取协程中调用
+type MessageHandler func(msg *Message)
+
+// 连接关闭原因
+type CloseReason string
+
+const (
+	CloseNormal           CloseReason = "normal disconnection"
+	CloseKeepAliveTimeout CloseReason = "keepalive timeout"
+	CloseTakenOver        CloseReason = "session taken over"
+	CloseServerShutdown   CloseReason = "server shutting down"
+	CloseProtocolError    CloseReason = "protocol error"
+	CloseNotAuthorized    CloseReason = "not authorized"
+)
+
+func (r CloseReason) Error() string {
+	return string(r)
+}
+
+// 设备协议适配器, 各协议以相同方式接入会话管理器
+type ProtocolAdapter interface {
+	// 协议名称, 例如 "mqtt", "coap"
+	Protocol() string
+	RemoteAddr() net.Addr
+	// 连接关闭后取消
+	Context() context.Context
+	// 设置入站消息回调, 必须在 Listen 之前调用
+	OnMessage(handler MessageHandler)
+	// 读取入站数据, 阻塞直到连接关闭
+	Listen()
+	// 向设备下发数据
+	Send(data []byte) error
+	// 关闭连接, 协议支持时把原因告知设备
+	CloseWithReason(reason CloseReason) error
+	Close() error
+	// 连接结束的原因, Context 取消后有效
+	Err() error
+}
+
+// 可选接口: 由适配器决定保活时间, 例如按CoAP设备的上报周期; 返回0时使用网关默认值
+type KeepAliver interface {
+	KeepAlive() time.Duration
+}
+
+// 心跳回调, keepAlive 非0时表示保活时间改变
+type HeartbeatHandler func(keepAlive time.Duration)
+
+// 可选接口: 不产生上行消息的心跳, 例如LwM2M注册更新; 必须在 Listen 之前设置
+type Heartbeater interface {
+	OnHeartbeat(handler HeartbeatHandler)
+}
@@ -1,8 +1,9 @@
 package types
 
 import (
+	"errors"
+	"sync"
 	"time"
-	"net"
 )
 
 type DeviceStatus int
@@ -13,6 +14,8 @@ const (
 	Unregistered
 )
 
+var ErrDeviceExists = errors.New("device already exists")
+
 type Device struct {
 	ID           string       `json:"id"`
 	Name         string       `json:"name"`
@@ -31,11 +34,37 @@ type DeviceConnection struct {
 	Status    DeviceStatus
 	LastSeen  time.Time
 	Fd        int // 文件描述符用于零拷贝
+	mu        sync.Mutex
+}
+
+// 收到报文时刷新最近活跃时间
+func (c *DeviceConnection) Touch() {
+	c.mu.Lock()
+	c.LastSeen = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *DeviceConnection) LastActive() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.LastSeen
 }
 
-type ProtocolAdapter interface {
-	Send(data []byte) error
-	Close() error
+// 网关上报的设备事件
+type DeviceEventType string
+
+const (
+	EventWill     DeviceEventType = "will"     // 设备异常断开, 发布遗嘱消息
+	EventTakeover DeviceEventType = "takeover" // 设备以相同ID重新连接, 旧连接被关闭
+)
+
+type DeviceEvent struct {
+	Type      DeviceEventType `json:"type"`
+	DeviceID  string          `json:"device_id"`
+	Topic     string          `json:"topic,omitempty"`
+	Payload   []byte          `json:"payload,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
 }
 
 type Command struct {
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// 分层时间轮: 每层 2^slotBits 个槽, 第 i 层每个槽跨度为 tick * 2^(slotBits*i).
+// 定时器按剩余时间放入对应层, 高层槽到期时逐级下沉到低层, 由单个驱动协程推进.
+// 添加/重置/停止均为O(1).
+type TimingWheel struct {
+	tick     time.Duration
+	slotBits uint
+	mask     uint64
+	levels   [][]*wheelBucket
+	now      uint64 // 当前已推进的tick数
+	start    time.Time
+	mu       sync.Mutex
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// 时间轮定时器, 回调在驱动协程中执行, 不能阻塞
+type WheelTimer struct {
+	wheel  *TimingWheel
+	f      func()
+	expire uint64
+	bucket *wheelBucket
+	prev   *WheelTimer
+	next   *WheelTimer
+}
+
+// 槽内定时器的双向链表, head 为哨兵节点
+type wheelBucket struct {
+	head WheelTimer
+}
+
+func newWheelBucket() *wheelBucket {
+	b := &wheelBucket{}
+	b.head.prev = &b.head
+	b.head.next = &b.head
+	return b
+}
+
+func (b *wheelBucket) push(t *WheelTimer) {
+	t.bucket = b
+	t.prev = b.head.prev
+	t.next = &b.head
+	b.head.prev.next = t
+	b.head.prev = t
+}
+
+// 取出槽内全部定时器
+func (b *wheelBucket) flush() []*WheelTimer {
+	var timers []*WheelTimer
+	for t := b.head.next; t != &b.head; {
+		next := t.next
+		t.bucket, t.prev, t.next = nil, nil, nil
+		timers = append(timers, t)
+		t = next
+	}
+	b.head.prev = &b.head
+	b.head.next = &b.head
+	return timers
+}
+
+func (t *WheelTimer) unlink() bool {
+	if t.bucket == nil {
+		return false
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.bucket, t.prev, t.next = nil, nil, nil
+	return true
+}
+
+// tick 为精度, 可覆盖 tick * 2^(slotBits*levels) 的时长, 更长的定时器到达顶层后重新排入
+func NewTimingWheel(tick time.Duration, slotBits uint, levels int) *TimingWheel {
+	tw := &TimingWheel{
+		tick:     tick,
+		slotBits: slotBits,
+		mask:     1<<slotBits - 1,
+		levels:   make([][]*wheelBucket, levels),
+		stopCh:   make(chan struct{}),
+	}
+	for i := range tw.levels {
+		tw.levels[i] = make([]*wheelBucket, 1<<slotBits)
+		for j := range tw.levels[i] {
+			tw.levels[i][j] = newWheelBucket()
+		}
+	}
+	return tw
+}
+
+// 启动驱动协程
+func (tw *TimingWheel) Start() {
+	tw.start = time.Now()
+	go tw.run()
+}
+
+func (tw *TimingWheel) Stop() {
+	tw.stopOnce.Do(func() { close(tw.stopCh) })
+}
+
+// 创建未启动的定时器, 通过 Reset 设置到期时间
+func (tw *TimingWheel) NewTimer(f func()) *WheelTimer {
+	return &WheelTimer{wheel: tw, f: f}
+}
+
+func (tw *TimingWheel) AfterFunc(d time.Duration, f func()) *WheelTimer {
+	t := tw.NewTimer(f)
+	t.Reset(d)
+	return t
+}
+
+// 重新设置为 d 之后到期, 返回定时器之前是否处于等待状态
+func (t *WheelTimer) Reset(d time.Duration) bool {
+	tw := t.wheel
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	active := t.unlink()
+	ticks := uint64((d + tw.tick - 1) / tw.tick)
+	if ticks == 0 {
+		ticks = 1
+	}
+	t.expire = tw.now + ticks
+	tw.add(t)
+	return active
+}
+
+// 停止定时器, 返回定时器之前是否处于等待状态
+func (t *WheelTimer) Stop() bool {
+	tw := t.wheel
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return t.unlink()
+}
+
+// 按剩余tick数选择层, 按到期tick的对应位选择槽
+func (tw *TimingWheel) add(t *WheelTimer) {
+	delta := uint64(0)
+	if t.expire > tw.now {
+		delta = t.expire - tw.now
+	}
+
+	expire := t.expire
+	for level := range tw.levels {
+		shift := tw.slotBits * uint(level)
+		if delta>>(shift+tw.slotBits) == 0 || level == len(tw.levels)-1 {
+			if delta>>(shift+tw.slotBits) != 0 {
+				// 超出时间轮范围, 放入顶层最远的槽, 到期后重新排入
+				expire = tw.now + (1<<(shift+tw.slotBits) - 1)
+			}
+			tw.levels[level][(expire>>shift)&tw.mask].push(t)
+			return
+		}
+	}
+}
+
+func (tw *TimingWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// 按实际经过时间推进, 驱动协程被延迟时补齐
+			target := uint64(time.Since(tw.start) / tw.tick)
+			for {
+				tw.mu.Lock()
+				if tw.now >= target {
+					tw.mu.Unlock()
+					break
+				}
+				expired := tw.advance()
+				tw.mu.Unlock()
+
+				for _, t := range expired {
+					t.f()
+				}
+			}
+		case <-tw.stopCh:
+			return
+		}
+	}
+}
+
+// 推进一个tick: 自顶向下下沉到达边界的高层槽, 返回第0层当前槽中到期的定时器
+func (tw *TimingWheel) advance() []*WheelTimer {
+	tw.now++
+
+	for level := len(tw.levels) - 1; level > 0; level-- {
+		shift := tw.slotBits * uint(level)
+		if tw.now&(1<<shift-1) != 0 {
+			continue
+		}
+		for _, t := range tw.levels[level][(tw.now>>shift)&tw.mask].flush() {
+			tw.add(t)
+		}
+	}
+
+	var expired []*WheelTimer
+	for _, t := range tw.levels[0][tw.now&tw.mask].flush() {
+		if t.expire <= tw.now {
+			expired = append(expired, t)
+		} else {
+			tw.add(t)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,225 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+)
+
+const Protocol = "coap"
+
+// 设备在请求的查询参数中携带设备ID, 与LwM2M注册相同, 例如 "POST /telemetry?ep=sensor-1"
+const EndpointQuery = "ep"
+
+// 网关配置了认证器时, 第一个请求还须携带预共享密钥或访问令牌, 例如 "?ep=sensor-1&token=..."
+const TokenQuery = "token"
+
+var ErrCommandRejected = errors.New("command rejected by device")
+
+type AdapterConfig struct {
+	// POST/PUT到该路径的上行消息发布到默认遥测主题, 其它路径作为主题
+	TelemetryPath string
+	// 设备观察该资源时以通知下发命令, 否则POST到设备上的该资源
+	CommandPath string
+	// 设备的保活时间, 通常为上报周期; 0表示使用网关默认值
+	KeepAlive time.Duration
+	// 下发命令等待设备确认的最长时间
+	SendTimeout time.Duration
+}
+
+var DefaultAdapterConfig = AdapterConfig{
+	TelemetryPath: "telemetry",
+	CommandPath:   "commands",
+	SendTimeout:   2 * time.Minute,
+}
+
+// CoAP设备适配器: 设备的POST/PUT作为上行消息, 命令通过Observe通知或POST下发
+type Adapter struct {
+	conn     *Conn
+	deviceID string
+	config   AdapterConfig
+	handler  types.MessageHandler
+
+	mu         sync.Mutex
+	observer   []byte // 设备观察命令资源的令牌
+	observeSeq uint32
+}
+
+func NewAdapter(conn *Conn, deviceID string) *Adapter {
+	return NewAdapterWithConfig(conn, deviceID, DefaultAdapterConfig)
+}
+
+func NewAdapterWithConfig(conn *Conn, deviceID string, config AdapterConfig) *Adapter {
+	a := &Adapter{conn: conn, deviceID: deviceID, config: config}
+	conn.Handle(a.serve)
+	return a
+}
+
+func (a *Adapter) Protocol() string {
+	return Protocol
+}
+
+func (a *Adapter) RemoteAddr() net.Addr {
+	return a.conn.RemoteAddr()
+}
+
+func (a *Adapter) Context() context.Context {
+	return a.conn.Context()
+}
+
+func (a *Adapter) OnMessage(handler types.MessageHandler) {
+	a.handler = handler
+}
+
+func (a *Adapter) KeepAlive() time.Duration {
+	return a.config.KeepAlive
+}
+
+// 处理设备请求, 阻塞直到连接关闭
+func (a *Adapter) Listen() {
+	a.conn.Serve()
+}
+
+func (a *Adapter) serve(c *Conn, req *Message) *Message {
+	if ep := req.Query(EndpointQuery); ep != "" && ep != a.deviceID {
+		return &Message{Code: Forbidden}
+	}
+
+	path := req.Path()
+	switch {
+	case req.Code == GET && path == a.config.CommandPath:
+		return a.observeCommands(req)
+	case req.Code == POST || req.Code == PUT:
+		a.message(path, req)
+		return &Message{Code: Changed}
+	}
+	return &Message{Code: MethodNotAllowed}
+}
+
+// 上行消息, CON 对应 QoS 1
+func (a *Adapter) message(path string, req *Message) {
+	if a.handler == nil {
+		return
+	}
+	msg := &types.Message{
+		DeviceID:   a.deviceID,
+		Payload:    req.Payload,
+		Timestamp:  time.Now(),
+		Properties: map[string]string{"path": path},
+	}
+	if path != "" && path != a.config.TelemetryPath {
+		msg.Topic = path
+	}
+	if req.Type == Confirmable {
+		msg.QoS = 1
+	}
+	if format, ok := req.Uint(ContentFormat); ok {
+		msg.Properties["content_format"] = strconv.FormatUint(uint64(format), 10)
+	}
+	a.handler(msg)
+}
+
+// 设备以 Observe=0 观察命令资源, Observe=1 取消
+func (a *Adapter) observeCommands(req *Message) *Message {
+	observe, ok := req.Uint(Observe)
+
+	a.mu.Lock()
+	switch {
+	case ok && observe == 0:
+		a.observer = req.Token
+	case ok && observe == 1 && bytes.Equal(a.observer, req.Token):
+		a.observer = nil
+	}
+	observing := a.observer != nil && bytes.Equal(a.observer, req.Token)
+	seq := a.nextSeq()
+	a.mu.Unlock()
+
+	resp := &Message{Code: Content}
+	if observing {
+		resp.SetUint(Observe, seq)
+	}
+	return resp
+}
+
+// 调用时持有 a.mu
+func (a *Adapter) nextSeq() uint32 {
+	a.observeSeq = (a.observeSeq + 1) & observeSeqMask
+	return a.observeSeq
+}
+
+// 下发命令, 等待设备确认
+func (a *Adapter) Send(data []byte) error {
+	ctx, cancel := context.WithTimeout(a.conn.Context(), a.config.SendTimeout)
+	defer cancel()
+
+	a.mu.Lock()
+	token := a.observer
+	seq := a.nextSeq()
+	a.mu.Unlock()
+
+	// 通知不分块, 大命令改用POST
+	if token != nil && len(data) <= 1<<(a.conn.szx+4) {
+		notification := &Message{Type: Confirmable, Code: Content, Token: token, Payload: data}
+		notification.SetUint(Observe, seq)
+		err := a.conn.WriteMessage(ctx, notification)
+		if err == nil || !(errors.Is(err, ErrReset) || errors.Is(err, ErrTimeout)) {
+			return err
+		}
+		// 设备拒绝或未确认通知时删除观察者
+		a.mu.Lock()
+		if bytes.Equal(a.observer, token) {
+			a.observer = nil
+		}
+		a.mu.Unlock()
+		if errors.Is(err, ErrTimeout) {
+			return err
+		}
+	}
+
+	req := &Message{Type: Confirmable, Code: POST, Payload: data}
+	req.SetPath(a.config.CommandPath)
+	resp, err := a.conn.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Code.IsSuccess() {
+		return fmt.Errorf("%w: %v", ErrCommandRejected, resp.Code)
+	}
+	return nil
+}
+
+// CoAP没有连接, 以错误通知结束设备对命令资源的观察
+func (a *Adapter) CloseWithReason(reason types.CloseReason) error {
+	a.mu.Lock()
+	token := a.observer
+	a.observer = nil
+	a.mu.Unlock()
+
+	// 错误响应不带Observe选项, 设备收到后删除观察
+	if token != nil {
+		code := ServiceUnavailable
+		if reason == types.CloseNotAuthorized {
+			code = Forbidden
+		}
+		notification := &Message{Type: NonConfirmable, Code: code, Token: token, Payload: []byte(reason)}
+		a.conn.WriteMessage(context.Background(), notification)
+	}
+	a.conn.closeWithError(reason)
+	return nil
+}
+
+func (a *Adapter) Close() error {
+	a.conn.closeWithError(types.CloseNormal)
+	return nil
+}
+
+func (a *Adapter) Err() error {
+	return a.conn.Err()
+}
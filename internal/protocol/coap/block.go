@@ -0,0 +1,70 @@
+package coap
+
+import "errors"
+
+var ErrInvalidBlockSize = errors.New("block size must be a power of two between 16 and 1024")
+
+// Block1/Block2 选项 (RFC 7959): 块序号、是否还有后续块和块大小指数
+type Block struct {
+	Num  uint32
+	More bool
+	SZX  uint8 // 块大小为 1<<(SZX+4), 0-6
+}
+
+func (b Block) Size() int {
+	return 1 << (b.SZX + 4)
+}
+
+// 本块在完整负载中的起始位置
+func (b Block) Offset() int {
+	return int(b.Num) * b.Size()
+}
+
+func (b Block) value() uint32 {
+	v := b.Num<<4 | uint32(b.SZX)
+	if b.More {
+		v |= 0x08
+	}
+	return v
+}
+
+func (m *Message) Block(id OptionID) (Block, bool) {
+	v, ok := m.Uint(id)
+	if !ok {
+		return Block{}, false
+	}
+	b := Block{Num: v >> 4, More: v&0x08 != 0, SZX: uint8(v & 0x07)}
+	// SZX 7 保留
+	if b.SZX == 7 {
+		return Block{}, false
+	}
+	return b, true
+}
+
+func (m *Message) SetBlock(id OptionID, b Block) {
+	m.SetUint(id, b.value())
+}
+
+// 块大小对应的 SZX
+func szxFor(size int) (uint8, error) {
+	for szx := uint8(0); szx <= 6; szx++ {
+		if 1<<(szx+4) == size {
+			return szx, nil
+		}
+	}
+	return 0, ErrInvalidBlockSize
+}
+
+// 取出负载中的第 num 块, 返回块内容和是否还有后续块
+func sliceBlock(payload []byte, num uint32, szx uint8) ([]byte, bool) {
+	size := 1 << (szx + 4)
+	start := int(num) * size
+	if start >= len(payload) {
+		return nil, false
+	}
+	end := start + size
+	if end >= len(payload) {
+		return payload[start:], false
+	}
+	return payload[start:end], true
+}
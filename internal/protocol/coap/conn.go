@@ -0,0 +1,760 @@
+package coap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// 传输参数 (RFC 7252 4.8)
+type Config struct {
+	AckTimeout      time.Duration
+	AckRandomFactor float64
+	MaxRetransmit   int
+	// 超过该大小的负载按块传输, 16-1024 之间的2的幂
+	BlockSize int
+	// 分块上传重组后的最大负载
+	MaxBodySize int
+	// 丢弃超过该长度的入站数据报
+	MaxMessageSize int
+	// 重复消息检测和分块传输状态的保留时间
+	ExchangeLifetime time.Duration
+	// 服务端同时通信的对端上限, 0表示不限制
+	MaxPeers int
+}
+
+var DefaultConfig = Config{
+	AckTimeout:       2 * time.Second,
+	AckRandomFactor:  1.5,
+	MaxRetransmit:    4,
+	BlockSize:        1024,
+	MaxBodySize:      1 << 20,
+	MaxMessageSize:   65507,
+	ExchangeLifetime: 247 * time.Second,
+}
+
+var (
+	ErrTimeout       = errors.New("no acknowledgement from peer")
+	ErrReset         = errors.New("message reset by peer")
+	ErrConnClosed    = errors.New("connection closed")
+	ErrNotObservable = errors.New("resource is not observable")
+	ErrBlockMismatch = errors.New("unexpected block in response")
+)
+
+// 处理对端的请求, 返回的响应只需填写 Code、Options 和 Payload;
+// 返回nil时不响应 (CON请求回复空ACK). 在 Serve 协程中调用, 不能在其中调用 Do
+type Handler func(c *Conn, req *Message) *Message
+
+// 与单个对端的CoAP通信: 消息ID和令牌、CON重传、重复消息检测、分块传输和Observe
+type Conn struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	config  Config
+	szx     uint8
+	in      chan []byte
+	peeked  *Message
+	onClose func()
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	err          error
+	handler      Handler
+	nextMID      uint16
+	pending      map[uint16]chan *Message // 等待ACK/RST的CON消息
+	exchanges    map[string]chan *Message // 令牌 -> 等待响应的请求
+	observations map[string]*Observation
+	seen         map[uint16]*seenMessage
+	uploads      map[string]*blockBody // Block1 重组, 按路径
+	downloads    map[string]*blockBody // Block2 待取的响应, 按路径
+}
+
+// 收到过的消息及当时的回复, 重复消息直接重发回复
+type seenMessage struct {
+	reply   []byte
+	expires time.Time
+}
+
+type blockBody struct {
+	code    Code
+	options []Option
+	payload []byte
+	expires time.Time
+}
+
+// 处理不过来时丢弃入站数据报, 对端会重传CON消息
+const inboundQueue = 64
+
+// 清理过期的去重记录和分块传输状态的间隔
+const pruneInterval = 10 * time.Second
+
+func newConn(pc net.PacketConn, addr net.Addr, config Config, onClose func()) *Conn {
+	szx, err := szxFor(config.BlockSize)
+	if err != nil {
+		szx = 6
+	}
+	var mid [2]byte
+	rand.Read(mid[:])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		pc:           pc,
+		addr:         addr,
+		config:       config,
+		szx:          szx,
+		in:           make(chan []byte, inboundQueue),
+		onClose:      onClose,
+		ctx:          ctx,
+		cancel:       cancel,
+		nextMID:      binary.BigEndian.Uint16(mid[:]),
+		pending:      make(map[uint16]chan *Message),
+		exchanges:    make(map[string]chan *Message),
+		observations: make(map[string]*Observation),
+		seen:         make(map[uint16]*seenMessage),
+		uploads:      make(map[string]*blockBody),
+		downloads:    make(map[string]*blockBody),
+	}
+}
+
+// 连接CoAP服务端, 返回的连接已在处理入站消息
+func Dial(addr string, config Config) (*Conn, error) {
+	if _, err := szxFor(config.BlockSize); err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(pc, raddr, config, func() { pc.Close() })
+	go func() {
+		buf := make([]byte, config.MaxMessageSize+1)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				c.closeWithError(err)
+				return
+			}
+			if n > config.MaxMessageSize || !sameAddr(from, raddr) {
+				continue
+			}
+			c.deliver(append([]byte(nil), buf[:n]...))
+		}
+	}()
+	go c.Serve()
+	return c, nil
+}
+
+func sameAddr(a net.Addr, b *net.UDPAddr) bool {
+	u, ok := a.(*net.UDPAddr)
+	return ok && u.Port == b.Port && u.IP.Equal(b.IP)
+}
+
+// 设置请求处理函数, 未设置时所有请求回复 4.04
+func (c *Conn) Handle(handler Handler) {
+	c.mu.Lock()
+	c.handler = handler
+	c.mu.Unlock()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+// 连接关闭后取消
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// 关闭的原因, 连接未关闭时为nil
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) Close() error {
+	c.closeWithError(ErrConnClosed)
+	return nil
+}
+
+func (c *Conn) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		c.cancel()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *Conn) deliver(data []byte) {
+	select {
+	case c.in <- data:
+	default:
+	}
+}
+
+// 读取第一个可解析的消息但不处理, 之后由 Serve 首先处理该消息.
+// 用于在交给适配器之前识别设备
+func (c *Conn) Peek(ctx context.Context) (*Message, error) {
+	if c.peeked != nil {
+		return c.peeked, nil
+	}
+	for {
+		select {
+		case data := <-c.in:
+			m, err := Unmarshal(data)
+			if err != nil {
+				continue
+			}
+			c.peeked = m
+			return m, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.ctx.Done():
+			return nil, c.Err()
+		}
+	}
+}
+
+// 处理入站消息, 阻塞直到连接关闭
+func (c *Conn) Serve() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	if m := c.peeked; m != nil {
+		c.peeked = nil
+		c.handleMessage(m)
+	}
+	for {
+		select {
+		case data := <-c.in:
+			c.handle(data)
+		case now := <-ticker.C:
+			c.prune(now)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Conn) handle(data []byte) {
+	m, err := Unmarshal(data)
+	if err != nil {
+		// 无法解析的CON消息回复RST, 其它直接忽略
+		if len(data) >= 4 && data[0]>>6 == version && Type(data[0]>>4&0x03) == Confirmable {
+			c.write(&Message{Type: Reset, MessageID: binary.BigEndian.Uint16(data[2:])})
+		}
+		return
+	}
+	c.handleMessage(m)
+}
+
+func (c *Conn) handleMessage(m *Message) {
+	switch {
+	case m.Type == Acknowledgement || m.Type == Reset:
+		c.mu.Lock()
+		ch, ok := c.pending[m.MessageID]
+		delete(c.pending, m.MessageID)
+		c.mu.Unlock()
+		if ok {
+			ch <- m
+		}
+	case m.IsEmpty():
+		// CoAP ping
+		if m.Type == Confirmable {
+			c.write(&Message{Type: Reset, MessageID: m.MessageID})
+		}
+	case m.Code.IsRequest():
+		if !c.duplicate(m) {
+			c.handleRequest(m)
+		}
+	case m.Code.IsResponse():
+		if !c.duplicate(m) {
+			c.handleResponse(m)
+		}
+	default:
+		if m.Type == Confirmable {
+			c.write(&Message{Type: Reset, MessageID: m.MessageID})
+		}
+	}
+}
+
+// 重复的消息重发之前的回复
+func (c *Conn) duplicate(m *Message) bool {
+	c.mu.Lock()
+	seen, ok := c.seen[m.MessageID]
+	if !ok {
+		c.seen[m.MessageID] = &seenMessage{expires: time.Now().Add(c.config.ExchangeLifetime)}
+	}
+	c.mu.Unlock()
+
+	if ok && seen.reply != nil {
+		c.writeRaw(seen.reply)
+	}
+	return ok
+}
+
+// 发送对 mid 消息的回复并记录, 用于重复消息
+func (c *Conn) reply(mid uint16, m *Message) {
+	data, err := m.Marshal()
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	if seen, ok := c.seen[mid]; ok {
+		seen.reply = data
+	}
+	c.mu.Unlock()
+	c.writeRaw(data)
+}
+
+func (c *Conn) handleRequest(req *Message) {
+	c.mu.Lock()
+	handler := c.handler
+	c.mu.Unlock()
+
+	resp := c.serveRequest(handler, req)
+	if resp == nil {
+		if req.Type == Confirmable {
+			c.reply(req.MessageID, &Message{Type: Acknowledgement, MessageID: req.MessageID})
+		}
+		return
+	}
+
+	resp.Token = req.Token
+	if req.Type == Confirmable {
+		// 响应附带在ACK中
+		resp.Type = Acknowledgement
+		resp.MessageID = req.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		resp.MessageID = c.newMID()
+	}
+	c.reply(req.MessageID, resp)
+}
+
+func (c *Conn) serveRequest(handler Handler, req *Message) *Message {
+	for _, opt := range req.Options {
+		if opt.ID.Critical() && !knownOption(opt.ID) {
+			return &Message{Code: BadOption}
+		}
+	}
+
+	// 分块响应的后续块
+	if b, ok := req.Block(Block2); ok && b.Num > 0 {
+		return c.nextBlock2(req.Path(), b)
+	}
+
+	b1, upload := req.Block(Block1)
+	if upload {
+		full, resp := c.reassemble(req, b1)
+		if resp != nil {
+			return resp
+		}
+		req = full
+	}
+
+	if handler == nil {
+		return &Message{Code: NotFound}
+	}
+	resp := handler(c, req)
+	if resp == nil {
+		return nil
+	}
+	if upload {
+		resp.SetBlock(Block1, Block{Num: b1.Num, SZX: b1.SZX})
+	}
+	return c.firstBlock2(req, resp)
+}
+
+func knownOption(id OptionID) bool {
+	switch id {
+	case IfMatch, URIHost, IfNoneMatch, URIPort, URIPath, URIQuery, Accept, Block1, Block2:
+		return true
+	}
+	return false
+}
+
+// 按块重组上传的负载, 未完成时返回需要回复的响应
+func (c *Conn) reassemble(req *Message, b Block) (*Message, *Message) {
+	key := req.Path()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	upload := c.uploads[key]
+	if b.Num == 0 {
+		upload = &blockBody{}
+		c.uploads[key] = upload
+	}
+	if upload == nil || b.Offset() != len(upload.payload) {
+		delete(c.uploads, key)
+		return nil, &Message{Code: RequestEntityIncomplete}
+	}
+	if len(upload.payload)+len(req.Payload) > c.config.MaxBodySize {
+		delete(c.uploads, key)
+		resp := &Message{Code: RequestEntityTooLarge}
+		resp.SetUint(Size1, uint32(c.config.MaxBodySize))
+		return nil, resp
+	}
+	upload.payload = append(upload.payload, req.Payload...)
+	upload.expires = time.Now().Add(c.config.ExchangeLifetime)
+
+	if b.More {
+		// 要求对端使用不超过本端的块大小
+		szx := b.SZX
+		if szx > c.szx {
+			szx = c.szx
+		}
+		resp := &Message{Code: Continue}
+		resp.SetBlock(Block1, Block{Num: b.Num, More: true, SZX: szx})
+		return nil, resp
+	}
+
+	delete(c.uploads, key)
+	full := *req
+	full.Options = append([]Option(nil), req.Options...)
+	full.RemoveOption(Block1)
+	full.RemoveOption(Size1)
+	full.Payload = upload.payload
+	return &full, nil
+}
+
+// 超过块大小的响应只发送第一块, 其余块保存到对端请求
+func (c *Conn) firstBlock2(req *Message, resp *Message) *Message {
+	szx := c.szx
+	if b, ok := req.Block(Block2); ok && b.SZX < szx {
+		szx = b.SZX
+	}
+	block, more := sliceBlock(resp.Payload, 0, szx)
+	if !more {
+		return resp
+	}
+
+	c.mu.Lock()
+	c.downloads[req.Path()] = &blockBody{
+		code:    resp.Code,
+		options: resp.Options,
+		payload: resp.Payload,
+		expires: time.Now().Add(c.config.ExchangeLifetime),
+	}
+	c.mu.Unlock()
+
+	first := &Message{Code: resp.Code, Options: append([]Option(nil), resp.Options...), Payload: block}
+	first.SetBlock(Block2, Block{Num: 0, More: true, SZX: szx})
+	first.SetUint(Size2, uint32(len(resp.Payload)))
+	return first
+}
+
+func (c *Conn) nextBlock2(path string, b Block) *Message {
+	c.mu.Lock()
+	download := c.downloads[path]
+	c.mu.Unlock()
+	if download == nil {
+		return &Message{Code: RequestEntityIncomplete}
+	}
+
+	block, more := sliceBlock(download.payload, b.Num, b.SZX)
+	if block == nil {
+		return &Message{Code: BadOption}
+	}
+	if !more {
+		c.mu.Lock()
+		if c.downloads[path] == download {
+			delete(c.downloads, path)
+		}
+		c.mu.Unlock()
+	}
+
+	resp := &Message{Code: download.code, Options: append([]Option(nil), download.options...), Payload: block}
+	resp.RemoveOption(Observe)
+	resp.SetBlock(Block2, Block{Num: b.Num, More: more, SZX: b.SZX})
+	return resp
+}
+
+func (c *Conn) handleResponse(resp *Message) {
+	token := string(resp.Token)
+	c.mu.Lock()
+	ch, waiting := c.exchanges[token]
+	delete(c.exchanges, token)
+	obs := c.observations[token]
+	c.mu.Unlock()
+
+	if !waiting && obs == nil {
+		// 未知的令牌, 例如已取消的观察
+		c.reply(resp.MessageID, &Message{Type: Reset, MessageID: resp.MessageID})
+		return
+	}
+	if resp.Type == Confirmable {
+		c.reply(resp.MessageID, &Message{Type: Acknowledgement, MessageID: resp.MessageID})
+	}
+	if waiting {
+		ch <- resp
+	} else {
+		obs.deliver(resp)
+	}
+}
+
+func (c *Conn) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for mid, seen := range c.seen {
+		if now.After(seen.expires) {
+			delete(c.seen, mid)
+		}
+	}
+	for key, body := range c.uploads {
+		if now.After(body.expires) {
+			delete(c.uploads, key)
+		}
+	}
+	for key, body := range c.downloads {
+		if now.After(body.expires) {
+			delete(c.downloads, key)
+		}
+	}
+}
+
+func (c *Conn) newMID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextMID++
+	return c.nextMID
+}
+
+func newToken() []byte {
+	token := make([]byte, 4)
+	rand.Read(token)
+	return token
+}
+
+func (c *Conn) write(m *Message) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.writeRaw(data)
+}
+
+func (c *Conn) writeRaw(data []byte) error {
+	_, err := c.pc.WriteTo(data, c.addr)
+	return err
+}
+
+// 发送CON消息并按指数退避重传, 返回对端的ACK或RST
+func (c *Conn) transmit(ctx context.Context, m *Message) (*Message, error) {
+	ch := make(chan *Message, 1)
+	m.Type = Confirmable
+	m.MessageID = c.newMID()
+	c.mu.Lock()
+	c.pending[m.MessageID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, m.MessageID)
+		c.mu.Unlock()
+	}()
+
+	data, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	// 初始超时在 [ACK_TIMEOUT, ACK_TIMEOUT*ACK_RANDOM_FACTOR] 之间随机
+	timeout := c.config.AckTimeout + time.Duration(mathrand.Float64()*(c.config.AckRandomFactor-1)*float64(c.config.AckTimeout))
+	for attempt := 0; ; attempt++ {
+		if err := c.writeRaw(data); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case ack := <-ch:
+			timer.Stop()
+			return ack, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-c.ctx.Done():
+			timer.Stop()
+			return nil, c.Err()
+		}
+		if attempt >= c.config.MaxRetransmit {
+			return nil, ErrTimeout
+		}
+		timeout *= 2
+	}
+}
+
+// 发送不需要响应的消息, 例如Observe通知. CON消息等待对端确认, 对端回复RST时返回 ErrReset
+func (c *Conn) WriteMessage(ctx context.Context, m *Message) error {
+	if m.Type != Confirmable {
+		m.MessageID = c.newMID()
+		return c.write(m)
+	}
+	ack, err := c.transmit(ctx, m)
+	if err != nil {
+		return err
+	}
+	if ack.Type == Reset {
+		return ErrReset
+	}
+	return nil
+}
+
+// 拒绝请求, 用于在 Serve 之前处理 Peek 读到的消息
+func (c *Conn) Reject(req *Message, code Code) error {
+	switch {
+	case req.Code.IsRequest() && req.Type == Confirmable:
+		return c.write(&Message{Type: Acknowledgement, Code: code, MessageID: req.MessageID, Token: req.Token})
+	case req.Code.IsRequest():
+		return c.write(&Message{Type: NonConfirmable, Code: code, MessageID: c.newMID(), Token: req.Token})
+	case req.Type == Confirmable:
+		return c.write(&Message{Type: Reset, MessageID: req.MessageID})
+	}
+	return nil
+}
+
+// 发送请求并等待响应. 大负载按 Block1 分块发送, 分块的响应自动取回完整负载.
+// 请求的 Type 默认为CON, 不能在 Handler 中调用
+func (c *Conn) Do(ctx context.Context, req *Message) (*Message, error) {
+	if len(req.Payload) > 1<<(c.szx+4) {
+		return c.doBlock1(ctx, req)
+	}
+	resp, err := c.exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return c.fetchBlock2(ctx, req, resp)
+}
+
+func (c *Conn) exchange(ctx context.Context, req *Message) (*Message, error) {
+	if len(req.Token) == 0 {
+		req.Token = newToken()
+	}
+	token := string(req.Token)
+	ch := make(chan *Message, 1)
+	c.mu.Lock()
+	c.exchanges[token] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.exchanges[token] == ch {
+			delete(c.exchanges, token)
+		}
+		c.mu.Unlock()
+	}()
+
+	if req.Type == NonConfirmable {
+		req.MessageID = c.newMID()
+		if err := c.write(req); err != nil {
+			return nil, err
+		}
+	} else {
+		ack, err := c.transmit(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if ack.Type == Reset {
+			return nil, ErrReset
+		}
+		if !ack.IsEmpty() {
+			return ack, nil
+		}
+		// 空ACK, 响应稍后单独发送
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.Err()
+	}
+}
+
+func (c *Conn) doBlock1(ctx context.Context, req *Message) (*Message, error) {
+	szx := c.szx
+	offset := 0
+	for {
+		num := uint32(offset >> (szx + 4))
+		block, more := sliceBlock(req.Payload, num, szx)
+		part := &Message{Type: req.Type, Code: req.Code, Options: append([]Option(nil), req.Options...), Payload: block}
+		part.SetBlock(Block1, Block{Num: num, More: more, SZX: szx})
+		if num == 0 {
+			part.SetUint(Size1, uint32(len(req.Payload)))
+		}
+
+		resp, err := c.exchange(ctx, part)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return c.fetchBlock2(ctx, req, resp)
+		}
+		if resp.Code != Continue {
+			return resp, nil
+		}
+		// 对端可以要求更小的块
+		if b, ok := resp.Block(Block1); ok && b.SZX < szx {
+			szx = b.SZX
+		}
+		offset += len(block)
+	}
+}
+
+func (c *Conn) fetchBlock2(ctx context.Context, req *Message, resp *Message) (*Message, error) {
+	b, ok := resp.Block(Block2)
+	if !ok || !b.More {
+		return resp, nil
+	}
+
+	payload := append([]byte(nil), resp.Payload...)
+	for b.More {
+		next := &Message{Type: req.Type, Code: req.Code, Options: append([]Option(nil), req.Options...)}
+		next.RemoveOption(Block1)
+		next.RemoveOption(Size1)
+		next.RemoveOption(Observe)
+		next.SetBlock(Block2, Block{Num: b.Num + 1, SZX: b.SZX})
+
+		r, err := c.exchange(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		if !r.Code.IsSuccess() {
+			return r, nil
+		}
+		nb, ok := r.Block(Block2)
+		if !ok || nb.Num != b.Num+1 {
+			return nil, fmt.Errorf("%w: %v", ErrBlockMismatch, r)
+		}
+		payload = append(payload, r.Payload...)
+		resp, b = r, nb
+	}
+
+	full := *resp
+	full.Options = append([]Option(nil), resp.Options...)
+	full.RemoveOption(Block2)
+	full.Payload = payload
+	return &full, nil
+}
@@ -0,0 +1,405 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 消息类型
+type Type uint8
+
+const (
+	Confirmable     Type = 0
+	NonConfirmable  Type = 1
+	Acknowledgement Type = 2
+	Reset           Type = 3
+)
+
+func (t Type) String() string {
+	switch t {
+	case Confirmable:
+		return "CON"
+	case NonConfirmable:
+		return "NON"
+	case Acknowledgement:
+		return "ACK"
+	case Reset:
+		return "RST"
+	}
+	return fmt.Sprintf("Type(%d)", uint8(t))
+}
+
+// 请求方法和响应码, 高3位为类别, 低5位为详情, 例如 2.05 = 0x45
+type Code uint8
+
+const (
+	Empty Code = 0x00
+
+	GET    Code = 0x01
+	POST   Code = 0x02
+	PUT    Code = 0x03
+	DELETE Code = 0x04
+
+	Created  Code = 0x41
+	Deleted  Code = 0x42
+	Valid    Code = 0x43
+	Changed  Code = 0x44
+	Content  Code = 0x45
+	Continue Code = 0x5f // RFC 7959
+
+	BadRequest               Code = 0x80
+	Unauthorized             Code = 0x81
+	BadOption                Code = 0x82
+	Forbidden                Code = 0x83
+	NotFound                 Code = 0x84
+	MethodNotAllowed         Code = 0x85
+	NotAcceptable            Code = 0x86
+	RequestEntityIncomplete  Code = 0x88
+	PreconditionFailed       Code = 0x8c
+	RequestEntityTooLarge    Code = 0x8d
+	UnsupportedContentFormat Code = 0x8f
+
+	InternalServerError Code = 0xa0
+	NotImplemented      Code = 0xa1
+	ServiceUnavailable  Code = 0xa3
+	GatewayTimeout      Code = 0xa4
+)
+
+func (c Code) Class() uint8 {
+	return uint8(c) >> 5
+}
+
+func (c Code) IsRequest() bool {
+	return c.Class() == 0 && c != Empty
+}
+
+func (c Code) IsResponse() bool {
+	return c.Class() >= 2
+}
+
+// 2.xx 成功响应
+func (c Code) IsSuccess() bool {
+	return c.Class() == 2
+}
+
+func (c Code) String() string {
+	switch c {
+	case GET:
+		return "GET"
+	case POST:
+		return "POST"
+	case PUT:
+		return "PUT"
+	case DELETE:
+		return "DELETE"
+	}
+	return fmt.Sprintf("%d.%02d", c.Class(), uint8(c)&0x1f)
+}
+
+// 选项编号
+type OptionID uint16
+
+const (
+	IfMatch       OptionID = 1
+	URIHost       OptionID = 3
+	ETag          OptionID = 4
+	IfNoneMatch   OptionID = 5
+	Observe       OptionID = 6 // RFC 7641
+	URIPort       OptionID = 7
+	LocationPath  OptionID = 8
+	URIPath       OptionID = 11
+	ContentFormat OptionID = 12
+	MaxAge        OptionID = 14
+	URIQuery      OptionID = 15
+	Accept        OptionID = 17
+	LocationQuery OptionID = 20
+	Block2        OptionID = 23 // RFC 7959
+	Block1        OptionID = 27
+	Size2         OptionID = 28
+	ProxyURI      OptionID = 35
+	ProxyScheme   OptionID = 39
+	Size1         OptionID = 60
+)
+
+// 奇数编号的选项为关键选项, 不认识时必须拒绝请求
+func (id OptionID) Critical() bool {
+	return id&1 == 1
+}
+
+// 常用内容格式
+const (
+	TextPlain     uint32 = 0
+	AppLinkFormat uint32 = 40
+	AppOctets     uint32 = 42
+	AppJSON       uint32 = 50
+	AppCBOR       uint32 = 60
+)
+
+type Option struct {
+	ID    OptionID
+	Value []byte
+}
+
+const (
+	version       = 1
+	payloadMarker = 0xff
+	maxTokenLen   = 8
+)
+
+var (
+	ErrMalformedMessage = errors.New("malformed CoAP message")
+	ErrInvalidVersion   = errors.New("unsupported CoAP version")
+)
+
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// 空消息, 仅用于ACK/RST和CoAP ping
+func (m *Message) IsEmpty() bool {
+	return m.Code == Empty
+}
+
+// 编码为数据报, 选项按编号排序
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > maxTokenLen {
+		return nil, ErrMalformedMessage
+	}
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	buf[0] = version<<6 | byte(m.Type)<<4 | byte(len(m.Token))
+	buf[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(buf[2:], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	options := make([]Option, len(m.Options))
+	copy(options, m.Options)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].ID < options[j].ID })
+
+	var last OptionID
+	for _, opt := range options {
+		delta, deltaExt := optionNibble(int(opt.ID - last))
+		length, lengthExt := optionNibble(len(opt.Value))
+		buf = append(buf, delta<<4|length)
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, opt.Value...)
+		last = opt.ID
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, payloadMarker)
+		buf = append(buf, m.Payload...)
+	}
+	return buf, nil
+}
+
+// 选项增量和长度: 0-12 直接编码, 13 后跟1字节, 14 后跟2字节
+func optionNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 4 {
+		return nil, ErrMalformedMessage
+	}
+	if data[0]>>6 != version {
+		return nil, ErrInvalidVersion
+	}
+	tokenLen := int(data[0] & 0x0f)
+	if tokenLen > maxTokenLen || len(data) < 4+tokenLen {
+		return nil, ErrMalformedMessage
+	}
+
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x03),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+	}
+	if tokenLen > 0 {
+		m.Token = append([]byte(nil), data[4:4+tokenLen]...)
+	}
+
+	data = data[4+tokenLen:]
+	var last int
+	for len(data) > 0 {
+		if data[0] == payloadMarker {
+			// 标记后必须有负载
+			if len(data) == 1 {
+				return nil, ErrMalformedMessage
+			}
+			m.Payload = append([]byte(nil), data[1:]...)
+			break
+		}
+
+		b := data[0]
+		data = data[1:]
+		delta, rest, err := readOptionNibble(b>>4, data)
+		if err != nil {
+			return nil, err
+		}
+		length, rest, err := readOptionNibble(b&0x0f, rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < length || last+delta > 0xffff {
+			return nil, ErrMalformedMessage
+		}
+		last += delta
+		m.Options = append(m.Options, Option{ID: OptionID(last), Value: append([]byte(nil), rest[:length]...)})
+		data = rest[length:]
+	}
+
+	// 空消息不能有令牌、选项和负载
+	if m.Code == Empty && (tokenLen > 0 || len(m.Options) > 0 || len(m.Payload) > 0) {
+		return nil, ErrMalformedMessage
+	}
+	return m, nil
+}
+
+func readOptionNibble(n byte, data []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, ErrMalformedMessage
+		}
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		// 保留给负载标记
+		return 0, nil, ErrMalformedMessage
+	}
+	return int(n), data, nil
+}
+
+// 第一个指定编号的选项值
+func (m *Message) Option(id OptionID) ([]byte, bool) {
+	for _, opt := range m.Options {
+		if opt.ID == id {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Message) AddOption(id OptionID, value []byte) {
+	m.Options = append(m.Options, Option{ID: id, Value: value})
+}
+
+// 替换所有同编号的选项
+func (m *Message) SetOption(id OptionID, value []byte) {
+	m.RemoveOption(id)
+	m.AddOption(id, value)
+}
+
+func (m *Message) RemoveOption(id OptionID) {
+	options := m.Options[:0]
+	for _, opt := range m.Options {
+		if opt.ID != id {
+			options = append(options, opt)
+		}
+	}
+	m.Options = options
+}
+
+// 无符号整数选项, 按最少字节的大端序编码
+func (m *Message) Uint(id OptionID) (uint32, bool) {
+	value, ok := m.Option(id)
+	if !ok || len(value) > 4 {
+		return 0, false
+	}
+	var v uint32
+	for _, b := range value {
+		v = v<<8 | uint32(b)
+	}
+	return v, true
+}
+
+func (m *Message) SetUint(id OptionID, v uint32) {
+	m.SetOption(id, encodeUint(v))
+}
+
+func encodeUint(v uint32) []byte {
+	var buf []byte
+	for ; v > 0; v >>= 8 {
+		buf = append([]byte{byte(v)}, buf...)
+	}
+	return buf
+}
+
+func (m *Message) strings(id OptionID) []string {
+	var values []string
+	for _, opt := range m.Options {
+		if opt.ID == id {
+			values = append(values, string(opt.Value))
+		}
+	}
+	return values
+}
+
+// 请求路径, 不含开头的 "/"
+func (m *Message) Path() string {
+	return strings.Join(m.strings(URIPath), "/")
+}
+
+func (m *Message) SetPath(path string) {
+	m.RemoveOption(URIPath)
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment != "" {
+			m.AddOption(URIPath, []byte(segment))
+		}
+	}
+}
+
+// 查询参数的值, 例如 Query("ep") 读取 "ep=sensor-1"
+func (m *Message) Query(name string) string {
+	for _, q := range m.strings(URIQuery) {
+		key, value, _ := strings.Cut(q, "=")
+		if key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+func (m *Message) AddQuery(name, value string) {
+	m.AddOption(URIQuery, []byte(name+"="+value))
+}
+
+// 响应中的资源位置, 例如注册接口返回的 "rd/1a2b"
+func (m *Message) LocationPath() string {
+	return strings.Join(m.strings(LocationPath), "/")
+}
+
+func (m *Message) SetLocationPath(path string) {
+	m.RemoveOption(LocationPath)
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment != "" {
+			m.AddOption(LocationPath, []byte(segment))
+		}
+	}
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("%v %v mid=%d token=%x path=%q payload=%d", m.Type, m.Code, m.MessageID, m.Token, m.Path(), len(m.Payload))
+}
@@ -0,0 +1,82 @@
+package coap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 观察序号为24位, 超过该时间的通知总是视为更新 (RFC 7641 3.4)
+const (
+	observeSeqMask  = 1<<24 - 1
+	observeFreshAge = 128 * time.Second
+)
+
+// 对对端资源的观察, 通知按序号丢弃过时和重复的
+type Observation struct {
+	c      *Conn
+	token  string
+	notify func(*Message)
+
+	mu       sync.Mutex
+	seq      uint32
+	last     time.Time
+	received bool
+}
+
+// 以 Observe=0 发送GET请求, 首个响应和之后的通知都交给 notify.
+// 对端不支持观察时返回 ErrNotObservable
+func (c *Conn) Observe(ctx context.Context, req *Message, notify func(*Message)) (*Observation, error) {
+	req.Code = GET
+	req.Token = newToken()
+	req.SetUint(Observe, 0)
+	obs := &Observation{c: c, token: string(req.Token), notify: notify}
+	c.mu.Lock()
+	c.observations[obs.token] = obs
+	c.mu.Unlock()
+
+	resp, err := c.exchange(ctx, req)
+	if err != nil {
+		obs.Cancel()
+		return nil, err
+	}
+	if _, ok := resp.Uint(Observe); !ok || !resp.Code.IsSuccess() {
+		obs.Cancel()
+		return nil, fmt.Errorf("%w: %v", ErrNotObservable, resp.Code)
+	}
+	obs.deliver(resp)
+	return obs, nil
+}
+
+func (o *Observation) deliver(m *Message) {
+	seq, ok := m.Uint(Observe)
+	now := time.Now()
+
+	o.mu.Lock()
+	fresh := !o.received || !ok ||
+		(o.seq < seq && seq-o.seq < 1<<23) ||
+		(o.seq > seq && o.seq-seq > 1<<23) ||
+		now.After(o.last.Add(observeFreshAge))
+	if fresh {
+		o.seq, o.last, o.received = seq, now, true
+	}
+	o.mu.Unlock()
+
+	if fresh {
+		o.notify(m)
+	}
+	// 不带Observe选项的响应 (例如错误) 表示对端结束了观察
+	if !ok || !m.Code.IsSuccess() {
+		o.Cancel()
+	}
+}
+
+// 停止观察, 之后收到的通知回复RST使对端删除观察者
+func (o *Observation) Cancel() {
+	o.c.mu.Lock()
+	if o.c.observations[o.token] == o {
+		delete(o.c.observations, o.token)
+	}
+	o.c.mu.Unlock()
+}
@@ -0,0 +1,137 @@
+package coap
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// 未被接受的新对端上限, 超过时丢弃
+const acceptBacklog = 64
+
+// UDP上的CoAP服务端, 按对端地址把数据报分发给各自的 Conn
+type Server struct {
+	pc     net.PacketConn
+	config Config
+
+	mu        sync.Mutex
+	conns     map[string]*Conn
+	accept    chan *Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func Listen(addr string, config Config) (*Server, error) {
+	if _, err := szxFor(config.BlockSize); err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(pc, config), nil
+}
+
+func NewServer(pc net.PacketConn, config Config) *Server {
+	s := &Server{
+		pc:     pc,
+		config: config,
+		conns:  make(map[string]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		done:   make(chan struct{}),
+	}
+	go s.read()
+	return s
+}
+
+func (s *Server) read() {
+	buf := make([]byte, s.config.MaxMessageSize+1)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("CoAP read error: %v", err)
+				s.Close()
+			}
+			return
+		}
+		// 可能被截断的超长数据报
+		if n > s.config.MaxMessageSize {
+			continue
+		}
+
+		key := addr.String()
+		s.mu.Lock()
+		c, ok := s.conns[key]
+		if !ok {
+			if s.config.MaxPeers > 0 && len(s.conns) >= s.config.MaxPeers {
+				s.mu.Unlock()
+				continue
+			}
+			c = s.newConn(key, addr)
+		}
+		s.mu.Unlock()
+
+		c.deliver(append([]byte(nil), buf[:n]...))
+		if !ok {
+			select {
+			case s.accept <- c:
+			default:
+				c.Close()
+			}
+		}
+	}
+}
+
+// 调用时持有 s.mu
+func (s *Server) newConn(key string, addr net.Addr) *Conn {
+	var c *Conn
+	c = newConn(s.pc, addr, s.config, func() {
+		s.mu.Lock()
+		if s.conns[key] == c {
+			delete(s.conns, key)
+		}
+		s.mu.Unlock()
+	})
+	s.conns[key] = c
+	return c
+}
+
+// 等待新的对端, 返回的连接需要调用 Serve 处理消息
+func (s *Server) Accept() (*Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, ErrServerClosed
+	}
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// 停止监听并关闭所有对端连接
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.pc.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return err
+}
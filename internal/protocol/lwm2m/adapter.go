@@ -0,0 +1,532 @@
+package lwm2m
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/coap"
+)
+
+const Protocol = "lwm2m"
+
+// 设备管理操作
+type Operation string
+
+const (
+	OpRead          Operation = "read"
+	OpWrite         Operation = "write"
+	OpExecute       Operation = "execute"
+	OpObserve       Operation = "observe"
+	OpCancelObserve Operation = "cancel-observe"
+	// 上行消息的操作类型: 观察通知和设备主动上报 (1.1 Send)
+	OpNotify Operation = "notify"
+	OpSend   Operation = "send"
+)
+
+var (
+	ErrInvalidCommand    = errors.New("invalid lwm2m command")
+	ErrOperationFailed   = errors.New("lwm2m operation failed")
+	ErrUnsupportedFormat = errors.New("unsupported lwm2m content format")
+)
+
+// 下发给设备的命令, 例如:
+//
+//	{"op": "read", "path": "/3/0"}
+//	{"op": "write", "path": "/1/0/1", "value": 300}
+//	{"op": "write", "path": "/3303/0", "value": {"5750": "boiler", "5701": "Cel"}}
+//	{"op": "execute", "path": "/3/0/4", "args": "0='now'"}
+//	{"op": "observe", "path": "/3303/0/5700"}
+//
+// 读取结果和观察通知以 {"/3303/0/5700": 21.5} 的形式作为上行消息发布
+type Command struct {
+	Operation Operation       `json:"op"`
+	Path      string          `json:"path"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Args      string          `json:"args,omitempty"`
+}
+
+// 一个LwM2M注册: 注册更新作为心跳, 有效期即保活时间. 注销或被接管时结束
+type Adapter struct {
+	server   *Server
+	config   Config
+	id       string
+	endpoint string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wake     chan struct{}
+
+	mu           sync.Mutex
+	reg          Registration
+	conn         *coap.Conn
+	lastSeen     time.Time
+	observations map[string]*coap.Observation // 路径
+	reobserve    bool
+	pending      []Command // 队列模式的设备休眠时暂存的命令
+	handler      types.MessageHandler
+	heartbeat    types.HeartbeatHandler
+	err          error
+}
+
+func newAdapter(s *Server, c *coap.Conn, reg Registration) *Adapter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Adapter{
+		server:       s,
+		config:       s.config,
+		id:           reg.ID,
+		endpoint:     reg.Endpoint,
+		ctx:          ctx,
+		cancel:       cancel,
+		wake:         make(chan struct{}, 1),
+		reg:          reg,
+		conn:         c,
+		lastSeen:     time.Now(),
+		observations: make(map[string]*coap.Observation),
+	}
+}
+
+func (a *Adapter) Protocol() string {
+	return Protocol
+}
+
+func (a *Adapter) RemoteAddr() net.Addr {
+	return a.currentConn().RemoteAddr()
+}
+
+func (a *Adapter) Context() context.Context {
+	return a.ctx
+}
+
+func (a *Adapter) OnMessage(handler types.MessageHandler) {
+	a.mu.Lock()
+	a.handler = handler
+	a.mu.Unlock()
+}
+
+func (a *Adapter) OnHeartbeat(handler types.HeartbeatHandler) {
+	a.mu.Lock()
+	a.heartbeat = handler
+	a.mu.Unlock()
+}
+
+// 注册有效期内没有更新即视为离线
+func (a *Adapter) KeepAlive() time.Duration {
+	return a.Registration().Lifetime
+}
+
+func (a *Adapter) Registration() Registration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reg
+}
+
+func (a *Adapter) currentConn() *coap.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn
+}
+
+// 设备的请求由注册接口处理; 这里在设备可达时执行暂存的命令, 阻塞直到注册结束
+func (a *Adapter) Listen() {
+	for {
+		select {
+		case <-a.wake:
+			a.flush()
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Adapter) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 注册更新: 刷新心跳, 地址改变时切换到新连接并重新建立观察
+func (a *Adapter) update(c *coap.Conn, req *coap.Message) *coap.Message {
+	a.mu.Lock()
+	reg := a.reg
+	if err := reg.apply(req); err != nil {
+		a.mu.Unlock()
+		return &coap.Message{Code: coap.BadRequest}
+	}
+	var keepAlive time.Duration
+	if reg.Lifetime != a.reg.Lifetime {
+		keepAlive = reg.Lifetime
+	}
+	a.reg = reg
+	a.lastSeen = time.Now()
+	old := a.conn
+	if c != old {
+		a.conn = c
+		a.reobserve = len(a.observations) > 0
+	}
+	heartbeat := a.heartbeat
+	a.mu.Unlock()
+
+	if c != old {
+		a.server.rebind(a, old, c)
+	}
+	if heartbeat != nil {
+		heartbeat(keepAlive)
+	}
+	a.signal()
+	return &coap.Message{Code: coap.Changed}
+}
+
+// 设备主动上报的资源值 (1.1 Send)
+func (a *Adapter) send(req *coap.Message) *coap.Message {
+	a.mu.Lock()
+	a.lastSeen = time.Now()
+	a.mu.Unlock()
+	if err := a.publish(OpSend, nil, req); err != nil {
+		return &coap.Message{Code: coap.BadRequest}
+	}
+	a.signal()
+	return &coap.Message{Code: coap.Changed}
+}
+
+// 队列模式的设备只在最近一次请求后的一段时间内可达
+func (a *Adapter) asleep() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reg.Queue && time.Since(a.lastSeen) > a.config.QueueAwakeTime
+}
+
+func (a *Adapter) flush() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	var observed []string
+	if a.reobserve {
+		for path := range a.observations {
+			observed = append(observed, path)
+		}
+		a.reobserve = false
+	}
+	a.mu.Unlock()
+
+	for _, path := range observed {
+		if err := a.execute(Command{Operation: OpObserve, Path: path}); err != nil {
+			log.Printf("LwM2M %s: re-observing %s failed: %v", a.endpoint, path, err)
+		}
+	}
+	for _, cmd := range pending {
+		if err := a.execute(cmd); err != nil {
+			log.Printf("LwM2M %s: queued %s %s failed: %v", a.endpoint, cmd.Operation, cmd.Path, err)
+		}
+	}
+}
+
+// 执行命令, 等待设备响应. 队列模式的设备休眠时命令暂存到下次注册更新后执行
+func (a *Adapter) Send(data []byte) error {
+	var cmd Command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+	}
+	switch cmd.Operation {
+	case OpRead, OpWrite, OpExecute, OpObserve, OpCancelObserve:
+	default:
+		return fmt.Errorf("%w: unknown operation %q", ErrInvalidCommand, cmd.Operation)
+	}
+	if _, err := ParsePath(cmd.Path); err != nil {
+		return err
+	}
+	if a.ctx.Err() != nil {
+		return a.Err()
+	}
+
+	if a.asleep() {
+		a.mu.Lock()
+		a.pending = append(a.pending, cmd)
+		a.mu.Unlock()
+		return nil
+	}
+	return a.execute(cmd)
+}
+
+func (a *Adapter) execute(cmd Command) error {
+	path, err := ParsePath(cmd.Path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, a.config.RequestTimeout)
+	defer cancel()
+
+	switch cmd.Operation {
+	case OpRead:
+		req := a.request(coap.GET, path)
+		req.SetUint(coap.Accept, a.format())
+		resp, err := a.do(ctx, req)
+		if err != nil {
+			return err
+		}
+		return a.publish(OpRead, path, resp)
+
+	case OpWrite:
+		req, err := a.writeRequest(path, cmd.Value)
+		if err != nil {
+			return err
+		}
+		_, err = a.do(ctx, req)
+		return err
+
+	case OpExecute:
+		if len(path) != 3 {
+			return fmt.Errorf("%w: execute on %s", ErrInvalidPath, path)
+		}
+		req := a.request(coap.POST, path)
+		if cmd.Args != "" {
+			req.SetUint(coap.ContentFormat, FormatText)
+			req.Payload = []byte(cmd.Args)
+		}
+		_, err := a.do(ctx, req)
+		return err
+
+	case OpObserve:
+		a.cancelObservation(path.String())
+		req := a.request(coap.GET, path)
+		req.SetUint(coap.Accept, a.format())
+		obs, err := a.currentConn().Observe(ctx, req, func(m *coap.Message) {
+			if err := a.publish(OpNotify, path, m); err != nil {
+				log.Printf("LwM2M %s: notification for %s: %v", a.endpoint, path, err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.observations[path.String()] = obs
+		a.mu.Unlock()
+		return nil
+
+	case OpCancelObserve:
+		// 之后的通知回复RST, 设备随即删除观察
+		a.cancelObservation(path.String())
+		return nil
+	}
+	return fmt.Errorf("%w: unknown operation %q", ErrInvalidCommand, cmd.Operation)
+}
+
+func (a *Adapter) cancelObservation(path string) {
+	a.mu.Lock()
+	obs, ok := a.observations[path]
+	delete(a.observations, path)
+	a.mu.Unlock()
+	if ok {
+		obs.Cancel()
+	}
+}
+
+func (a *Adapter) format() uint32 {
+	if a.config.Format != 0 {
+		return a.config.Format
+	}
+	return a.Registration().defaultFormat()
+}
+
+func (a *Adapter) request(code coap.Code, path Path) *coap.Message {
+	req := &coap.Message{Type: coap.Confirmable, Code: code}
+	req.SetPath(a.Registration().Root + path.String())
+	return req
+}
+
+func (a *Adapter) do(ctx context.Context, req *coap.Message) (*coap.Message, error) {
+	resp, err := a.currentConn().Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Code.IsSuccess() {
+		return nil, fmt.Errorf("%w: %s %s: %v", ErrOperationFailed, req.Code, req.Path(), resp.Code)
+	}
+	return resp, nil
+}
+
+// 写资源用PUT (替换), 写对象实例用POST (部分更新)
+func (a *Adapter) writeRequest(path Path, raw json.RawMessage) (*coap.Message, error) {
+	resources, err := a.writeResources(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	format := a.format()
+	var payload []byte
+	switch format {
+	case FormatTLV:
+		payload, err = a.config.Model.EncodeTLV(path, resources)
+	case FormatSenMLJSON:
+		payload, err = a.config.Model.EncodeSenML(path, resources)
+	default:
+		err = fmt.Errorf("%w: %d", ErrUnsupportedFormat, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	code := coap.PUT
+	if len(path) == 2 {
+		code = coap.POST
+	}
+	req := a.request(code, path)
+	req.SetUint(coap.ContentFormat, format)
+	req.Payload = payload
+	return req, nil
+}
+
+// 命令中的值: 资源为单个值, 多实例资源为 {"实例ID": 值}, 对象实例为 {"资源ID": 值或多实例对象}
+func (a *Adapter) writeResources(path Path, raw json.RawMessage) ([]Resource, error) {
+	if len(path) < 2 || len(path) > 3 {
+		return nil, fmt.Errorf("%w: write on %s", ErrInvalidPath, path)
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCommand, err)
+	}
+	var resources []Resource
+	err := a.collect(path, v, &resources)
+	return resources, err
+}
+
+func (a *Adapter) collect(path Path, v interface{}, resources *[]Resource) error {
+	children, ok := v.(map[string]interface{})
+	if !ok {
+		if len(path) < 3 {
+			return fmt.Errorf("%w: %s needs resource values", ErrInvalidCommand, path)
+		}
+		value, err := a.config.Model.convert(path, v)
+		if err != nil {
+			return err
+		}
+		*resources = append(*resources, Resource{Path: path, Value: value})
+		return nil
+	}
+	if len(path) >= 4 {
+		return fmt.Errorf("%w: nested value under %s", ErrInvalidCommand, path)
+	}
+
+	ids := make([]int, 0, len(children))
+	for key := range children {
+		id, err := strconv.ParseUint(key, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%w: %s/%s", ErrInvalidPath, path, key)
+		}
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := a.collect(path.Append(uint16(id)), children[strconv.Itoa(id)], resources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解码响应或通知, 以 路径->值 的JSON作为上行消息发布
+func (a *Adapter) publish(op Operation, path Path, m *coap.Message) error {
+	resources, err := a.decode(path, m)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{}, len(resources))
+	for _, r := range resources {
+		values[r.Path.String()] = r.Value
+	}
+	payload, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	handler := a.handler
+	a.mu.Unlock()
+	if handler == nil {
+		return nil
+	}
+	msg := &types.Message{
+		DeviceID:   a.endpoint,
+		Payload:    payload,
+		Timestamp:  time.Now(),
+		Properties: map[string]string{"operation": string(op)},
+	}
+	if path != nil {
+		msg.Properties["path"] = path.String()
+	}
+	if format, ok := m.Uint(coap.ContentFormat); ok {
+		msg.Properties["content_format"] = strconv.FormatUint(uint64(format), 10)
+	}
+	handler(msg)
+	return nil
+}
+
+func (a *Adapter) decode(path Path, m *coap.Message) ([]Resource, error) {
+	format, ok := m.Uint(coap.ContentFormat)
+	if !ok {
+		format = FormatText
+	}
+	model := a.config.Model
+	switch format {
+	case FormatTLV:
+		return model.DecodeTLV(path, m.Payload)
+	case FormatSenMLJSON:
+		return model.DecodeSenML(m.Payload)
+	case FormatText, FormatOpaque:
+		if len(path) < 3 {
+			return nil, fmt.Errorf("%w: %d for %s", ErrUnsupportedFormat, format, path)
+		}
+		if format == FormatOpaque {
+			return []Resource{{Path: path, Value: append([]byte(nil), m.Payload...)}}, nil
+		}
+		v, err := model.parseText(path, string(m.Payload))
+		if err != nil {
+			return nil, err
+		}
+		return []Resource{{Path: path, Value: v}}, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedFormat, format)
+}
+
+func (a *Adapter) closeWithError(err error) {
+	a.mu.Lock()
+	if a.err != nil {
+		a.mu.Unlock()
+		return
+	}
+	a.err = err
+	conn := a.conn
+	observations := a.observations
+	a.observations = make(map[string]*coap.Observation)
+	a.mu.Unlock()
+
+	for _, obs := range observations {
+		obs.Cancel()
+	}
+	a.cancel()
+	a.server.remove(a, conn)
+}
+
+// LwM2M没有服务端发起的注销, 删除注册后设备的下次更新收到 4.04 并重新注册
+func (a *Adapter) CloseWithReason(reason types.CloseReason) error {
+	a.closeWithError(reason)
+	return nil
+}
+
+func (a *Adapter) Close() error {
+	a.closeWithError(types.CloseNormal)
+	return nil
+}
+
+func (a *Adapter) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
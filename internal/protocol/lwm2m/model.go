@@ -0,0 +1,217 @@
+package lwm2m
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LwM2M使用的内容格式
+const (
+	FormatText      uint32 = 0
+	FormatLinks     uint32 = 40
+	FormatOpaque    uint32 = 42
+	FormatSenMLJSON uint32 = 110
+	FormatTLV       uint32 = 11542
+)
+
+var (
+	ErrInvalidPath  = errors.New("invalid lwm2m path")
+	ErrInvalidValue = errors.New("invalid lwm2m resource value")
+)
+
+// 对象/实例/资源/资源实例路径, 例如 /3/0/9 为 {3, 0, 9}
+type Path []uint16
+
+func ParsePath(s string) (Path, error) {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPath, s)
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) > 4 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPath, s)
+	}
+	path := make(Path, len(parts))
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 16)
+		// 65535 保留
+		if err != nil || id == math.MaxUint16 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPath, s)
+		}
+		path[i] = uint16(id)
+	}
+	return path, nil
+}
+
+func (p Path) String() string {
+	var b strings.Builder
+	for _, id := range p {
+		b.WriteByte('/')
+		b.WriteString(strconv.Itoa(int(id)))
+	}
+	return b.String()
+}
+
+func (p Path) Append(id uint16) Path {
+	return append(append(Path(nil), p...), id)
+}
+
+// 资源ID, 路径不到资源层时为false
+func (p Path) resource() (uint16, bool) {
+	if len(p) < 3 {
+		return 0, false
+	}
+	return p[2], true
+}
+
+// 资源值的类型, 决定TLV和文本格式的编解码方式
+type ResourceType string
+
+const (
+	String     ResourceType = "string"
+	Integer    ResourceType = "integer"
+	Unsigned   ResourceType = "unsigned"
+	Float      ResourceType = "float"
+	Boolean    ResourceType = "boolean"
+	Opaque     ResourceType = "opaque"
+	Time       ResourceType = "time"
+	ObjectLink ResourceType = "objlnk"
+	Executable ResourceType = "none"
+)
+
+// 对象ID -> 资源ID -> 类型
+type Model map[uint16]map[uint16]ResourceType
+
+// 核心对象和常用IPSO资源, 未知资源按不透明数据处理
+var DefaultModel = Model{
+	1: { // Server
+		0: Integer, 1: Integer, 2: Integer, 3: Integer, 5: Integer,
+		6: Boolean, 7: String, 8: Executable,
+	},
+	3: { // Device
+		0: String, 1: String, 2: String, 3: String, 4: Executable, 5: Executable,
+		6: Integer, 7: Integer, 8: Integer, 9: Integer, 10: Integer, 11: Integer,
+		12: Executable, 13: Time, 14: String, 15: String, 16: String, 17: String,
+		18: String, 19: String, 20: Integer, 21: Integer,
+	},
+	4: { // Connectivity Monitoring
+		0: Integer, 1: Integer, 2: Integer, 3: Integer, 4: String, 5: String,
+		6: Integer, 7: String, 8: Integer, 9: Integer, 10: Integer,
+	},
+	5: { // Firmware Update
+		0: Opaque, 1: String, 2: Executable, 3: Integer, 5: Integer, 6: String, 7: String,
+	},
+	6: { // Location
+		0: Float, 1: Float, 2: Float, 3: Float, 4: Opaque, 5: Time, 6: Float,
+	},
+}
+
+// IPSO对象 (ID >= 3200) 共用的资源定义
+var ipsoResources = map[uint16]ResourceType{
+	5500: Boolean, 5501: Integer, 5601: Float, 5602: Float, 5603: Float, 5604: Float,
+	5605: Executable, 5700: Float, 5701: String, 5750: String, 5800: Float,
+	5805: Float, 5821: Float, 5850: Boolean, 5851: Integer, 5900: Float,
+}
+
+func (m Model) Type(object, resource uint16) ResourceType {
+	if t, ok := m[object][resource]; ok {
+		return t
+	}
+	if object >= 3200 {
+		if t, ok := ipsoResources[resource]; ok {
+			return t
+		}
+	}
+	return Opaque
+}
+
+// 资源路径对应的类型
+func (m Model) typeOf(path Path) ResourceType {
+	resource, ok := path.resource()
+	if !ok {
+		return Opaque
+	}
+	return m.Type(path[0], resource)
+}
+
+// 解码后的资源值: string, int64, uint64, float64, bool, []byte (不透明), 时间为秒数
+type Resource struct {
+	Path  Path
+	Value interface{}
+}
+
+// 文本格式的单个资源值
+func (m Model) parseText(path Path, text string) (interface{}, error) {
+	var (
+		v   interface{}
+		err error
+	)
+	switch m.typeOf(path) {
+	case String, ObjectLink:
+		return text, nil
+	case Integer, Time:
+		v, err = strconv.ParseInt(text, 10, 64)
+	case Unsigned:
+		v, err = strconv.ParseUint(text, 10, 64)
+	case Float:
+		v, err = strconv.ParseFloat(text, 64)
+	case Boolean:
+		v, err = strconv.ParseBool(text)
+	default:
+		return []byte(text), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidValue, path, err)
+	}
+	return v, nil
+}
+
+// 把命令中的JSON值 (float64/string/bool) 转换为资源类型的值
+func (m Model) convert(path Path, v interface{}) (interface{}, error) {
+	invalid := fmt.Errorf("%w: %s: %v", ErrInvalidValue, path, v)
+	t := m.typeOf(path)
+	switch value := v.(type) {
+	case float64:
+		switch t {
+		case Integer, Time:
+			if value != math.Trunc(value) {
+				return nil, invalid
+			}
+			return int64(value), nil
+		case Unsigned:
+			if value < 0 || value != math.Trunc(value) {
+				return nil, invalid
+			}
+			return uint64(value), nil
+		case Float:
+			return value, nil
+		}
+	case string:
+		switch t {
+		case String, ObjectLink:
+			return value, nil
+		case Opaque:
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, invalid
+			}
+			return data, nil
+		case Time:
+			ts, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, invalid
+			}
+			return ts.Unix(), nil
+		}
+	case bool:
+		if t == Boolean {
+			return value, nil
+		}
+	}
+	return nil, invalid
+}
@@ -0,0 +1,133 @@
+package lwm2m
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"edgesphere/internal/protocol/coap"
+)
+
+// 注册接口的查询参数
+const (
+	queryEndpoint = "ep"
+	queryLifetime = "lt"
+	queryVersion  = "lwm2m"
+	queryBinding  = "b"
+	queryQueue    = "Q"
+)
+
+// 未指定有效期时的默认值 (秒)
+const defaultLifetime = 86400
+
+var ErrInvalidRegistration = errors.New("invalid lwm2m registration")
+
+// 设备的注册信息
+type Registration struct {
+	ID       string
+	Endpoint string
+	Lifetime time.Duration
+	Version  string // 未指定时为 1.0
+	Binding  string
+	// 队列模式: 设备只在发送注册更新后的一段时间内可达
+	Queue bool
+	// 设备声明的对象实例, 例如 /3/0; 只声明了对象时为 /3
+	Objects []Path
+	// 设备资源的根路径, 通常为空
+	Root string
+}
+
+// 从注册或更新请求中读取参数, 更新时只覆盖请求中出现的参数
+func (r *Registration) apply(req *coap.Message) error {
+	if lt := req.Query(queryLifetime); lt != "" {
+		seconds, err := strconv.ParseUint(lt, 10, 32)
+		if err != nil || seconds == 0 {
+			return ErrInvalidRegistration
+		}
+		r.Lifetime = time.Duration(seconds) * time.Second
+	}
+	if v := req.Query(queryVersion); v != "" {
+		r.Version = v
+	}
+	// 1.0 在绑定模式中声明队列模式 (UQ), 1.1 使用不带值的 Q 参数
+	if b := req.Query(queryBinding); b != "" {
+		r.Binding = b
+		r.Queue = strings.Contains(b, "Q")
+	}
+	if hasQuery(req, queryQueue) {
+		r.Queue = true
+	}
+
+	if len(req.Payload) > 0 {
+		if format, ok := req.Uint(coap.ContentFormat); ok && format != FormatLinks {
+			return ErrInvalidRegistration
+		}
+		r.Root, r.Objects = parseLinks(string(req.Payload))
+	}
+	return nil
+}
+
+func hasQuery(req *coap.Message, name string) bool {
+	for _, opt := range req.Options {
+		if opt.ID == coap.URIQuery && (string(opt.Value) == name || strings.HasPrefix(string(opt.Value), name+"=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// 1.0 的设备默认使用TLV, 之后的版本支持SenML JSON
+func (r Registration) defaultFormat() uint32 {
+	if r.Version == "" || r.Version == "1.0" {
+		return FormatTLV
+	}
+	return FormatSenMLJSON
+}
+
+// 解析CoRE链接格式的对象列表, 例如 </>;rt="oma.lwm2m",</1/0>,</3/0>;ver=1.1.
+// rt="oma.lwm2m" 的链接声明了根路径
+func parseLinks(payload string) (string, []Path) {
+	var (
+		root    string
+		objects []Path
+	)
+	for _, link := range splitLinks(payload) {
+		target, attrs, _ := strings.Cut(strings.TrimSpace(link), ";")
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		uri := strings.TrimSuffix(target[1:len(target)-1], "/")
+		if strings.Contains(attrs, `rt="oma.lwm2m"`) {
+			root = uri
+			continue
+		}
+		path, err := ParsePath(strings.TrimPrefix(uri, root))
+		if err != nil || len(path) > 2 {
+			continue
+		}
+		objects = append(objects, path)
+	}
+	return root, objects
+}
+
+// 按逗号分割链接, 忽略引号中的逗号
+func splitLinks(s string) []string {
+	var (
+		links  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				links = append(links, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(links, s[start:])
+}
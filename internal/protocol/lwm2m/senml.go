@@ -0,0 +1,113 @@
+package lwm2m
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrInvalidSenML = errors.New("invalid senml record")
+
+// SenML JSON记录 (RFC 8428), 名称为资源路径. 时间字段暂不使用
+type senmlRecord struct {
+	BaseName    string   `json:"bn,omitempty"`
+	Name        string   `json:"n,omitempty"`
+	Value       *float64 `json:"v,omitempty"`
+	StringValue *string  `json:"vs,omitempty"`
+	BoolValue   *bool    `json:"vb,omitempty"`
+	DataValue   *string  `json:"vd,omitempty"`
+	ObjectLink  *string  `json:"vlo,omitempty"`
+}
+
+// 解码SenML JSON, 基础名称作用于之后的记录. 数值按资源类型转换为整数
+func (m Model) DecodeSenML(data []byte) ([]Resource, error) {
+	var records []senmlRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSenML, err)
+	}
+
+	var (
+		resources []Resource
+		baseName  string
+	)
+	for _, r := range records {
+		if r.BaseName != "" {
+			baseName = r.BaseName
+		}
+		path, err := ParsePath(baseName + r.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		var v interface{}
+		switch {
+		case r.Value != nil:
+			v = *r.Value
+			switch m.typeOf(path) {
+			case Integer, Time:
+				v = int64(*r.Value)
+			case Unsigned:
+				v = uint64(math.Max(*r.Value, 0))
+			}
+		case r.StringValue != nil:
+			v = *r.StringValue
+		case r.BoolValue != nil:
+			v = *r.BoolValue
+		case r.ObjectLink != nil:
+			v = *r.ObjectLink
+		case r.DataValue != nil:
+			if v, err = base64.RawURLEncoding.DecodeString(*r.DataValue); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSenML, path, err)
+			}
+		default:
+			// 没有值的记录, 例如执行或观察的目标
+			continue
+		}
+		resources = append(resources, Resource{Path: path, Value: v})
+	}
+	return resources, nil
+}
+
+// 编码写入的资源, 名称相对于 base 路径
+func (m Model) EncodeSenML(base Path, resources []Resource) ([]byte, error) {
+	records := make([]senmlRecord, 0, len(resources))
+	baseName := base.String()
+	for i, r := range resources {
+		name := r.Path.String()
+		if len(name) < len(baseName) || name[:len(baseName)] != baseName {
+			return nil, fmt.Errorf("%w: %s outside %s", ErrInvalidPath, r.Path, base)
+		}
+		record := senmlRecord{Name: name[len(baseName):]}
+		if i == 0 {
+			record.BaseName = baseName
+		}
+
+		switch value := r.Value.(type) {
+		case string:
+			if m.typeOf(r.Path) == ObjectLink {
+				record.ObjectLink = &value
+			} else {
+				record.StringValue = &value
+			}
+		case bool:
+			record.BoolValue = &value
+		case []byte:
+			data := base64.RawURLEncoding.EncodeToString(value)
+			record.DataValue = &data
+		case float64:
+			record.Value = &value
+		case int64:
+			f := float64(value)
+			record.Value = &f
+		case uint64:
+			f := float64(value)
+			record.Value = &f
+		default:
+			return nil, fmt.Errorf("%w: %s: %T", ErrInvalidValue, r.Path, r.Value)
+		}
+		records = append(records, record)
+	}
+	return json.Marshal(records)
+}
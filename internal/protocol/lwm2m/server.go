@@ -0,0 +1,215 @@
+package lwm2m
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/coap"
+)
+
+type Config struct {
+	// 资源类型定义, 用于TLV和文本格式
+	Model Model
+	// 读写使用的内容格式, 0表示按设备的协议版本选择
+	Format uint32
+	// 队列模式的设备在注册更新后保持可达的时间
+	QueueAwakeTime time.Duration
+	// 单个操作等待设备响应的最长时间
+	RequestTimeout time.Duration
+	// 新对端在该时间内没有注册时关闭
+	RegisterTimeout time.Duration
+	// 非nil时在接受注册前调用, 返回非0响应码时以该响应码拒绝注册
+	Authenticate func(endpoint string, req *coap.Message) coap.Code
+}
+
+var DefaultConfig = Config{
+	Model:           DefaultModel,
+	QueueAwakeTime:  93 * time.Second,
+	RequestTimeout:  time.Minute,
+	RegisterTimeout: 30 * time.Second,
+}
+
+var ErrServerClosed = errors.New("lwm2m server closed")
+
+// 等待处理的新注册上限, 超过时回复 5.03
+const registerBacklog = 64
+
+// LwM2M服务端的注册接口 (/rd). 每个注册对应一个 Adapter, 注册更新可以来自新的地址 (NAT重绑定)
+type Server struct {
+	config Config
+
+	mu            sync.Mutex
+	registrations map[string]*Adapter // 注册ID
+	conns         map[*coap.Conn]*Adapter
+	accept        chan *Adapter
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewServer(config Config) *Server {
+	if config.Model == nil {
+		config.Model = DefaultModel
+	}
+	return &Server{
+		config:        config,
+		registrations: make(map[string]*Adapter),
+		conns:         make(map[*coap.Conn]*Adapter),
+		accept:        make(chan *Adapter, registerBacklog),
+		done:          make(chan struct{}),
+	}
+}
+
+// 处理对端的请求, 阻塞直到连接关闭. 超时未注册的连接被关闭
+func (s *Server) ServeConn(c *coap.Conn) {
+	c.Handle(s.handle)
+	timer := time.AfterFunc(s.config.RegisterTimeout, func() {
+		s.mu.Lock()
+		_, bound := s.conns[c]
+		s.mu.Unlock()
+		if !bound {
+			c.Close()
+		}
+	})
+	defer timer.Stop()
+	c.Serve()
+}
+
+// 等待新的注册
+func (s *Server) Accept() (*Adapter, error) {
+	select {
+	case a := <-s.accept:
+		return a, nil
+	case <-s.done:
+		return nil, ErrServerClosed
+	}
+}
+
+// 停止接受注册并关闭所有注册
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		adapters := make([]*Adapter, 0, len(s.registrations))
+		for _, a := range s.registrations {
+			adapters = append(adapters, a)
+		}
+		s.mu.Unlock()
+		for _, a := range adapters {
+			a.CloseWithReason(types.CloseServerShutdown)
+		}
+	})
+	return nil
+}
+
+func (s *Server) handle(c *coap.Conn, req *coap.Message) *coap.Message {
+	parts := strings.Split(req.Path(), "/")
+	switch {
+	case parts[0] == "rd" && len(parts) == 1:
+		if req.Code != coap.POST {
+			return &coap.Message{Code: coap.MethodNotAllowed}
+		}
+		return s.register(c, req)
+	case parts[0] == "rd" && len(parts) == 2:
+		s.mu.Lock()
+		a := s.registrations[parts[1]]
+		s.mu.Unlock()
+		// 未知的注册ID, 设备收到 4.04 后重新注册
+		if a == nil {
+			return &coap.Message{Code: coap.NotFound}
+		}
+		switch req.Code {
+		case coap.POST:
+			return a.update(c, req)
+		case coap.DELETE:
+			a.closeWithError(types.CloseNormal)
+			return &coap.Message{Code: coap.Deleted}
+		}
+		return &coap.Message{Code: coap.MethodNotAllowed}
+	case parts[0] == "dp" && len(parts) == 1 && req.Code == coap.POST:
+		s.mu.Lock()
+		a := s.conns[c]
+		s.mu.Unlock()
+		if a == nil {
+			return &coap.Message{Code: coap.Unauthorized}
+		}
+		return a.send(req)
+	}
+	return &coap.Message{Code: coap.NotFound}
+}
+
+func (s *Server) register(c *coap.Conn, req *coap.Message) *coap.Message {
+	reg := Registration{
+		ID:       newRegistrationID(),
+		Endpoint: req.Query(queryEndpoint),
+		Lifetime: defaultLifetime * time.Second,
+		Binding:  "U",
+	}
+	if reg.Endpoint == "" {
+		return &coap.Message{Code: coap.BadRequest}
+	}
+	if err := reg.apply(req); err != nil {
+		return &coap.Message{Code: coap.BadRequest}
+	}
+	if s.config.Authenticate != nil {
+		if code := s.config.Authenticate(reg.Endpoint, req); code != 0 {
+			return &coap.Message{Code: code}
+		}
+	}
+
+	a := newAdapter(s, c, reg)
+	s.mu.Lock()
+	s.registrations[reg.ID] = a
+	s.conns[c] = a
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case s.accept <- a:
+		resp := &coap.Message{Code: coap.Created}
+		resp.SetLocationPath("rd/" + reg.ID)
+		return resp
+	default:
+		log.Printf("LwM2M registration backlog full, rejecting %s", reg.Endpoint)
+	}
+	s.remove(a, c)
+	return &coap.Message{Code: coap.ServiceUnavailable}
+}
+
+// 注册更新来自新的地址, 旧连接不再使用
+func (s *Server) rebind(a *Adapter, old, c *coap.Conn) {
+	s.mu.Lock()
+	if s.conns[old] == a {
+		delete(s.conns, old)
+	}
+	s.conns[c] = a
+	s.mu.Unlock()
+	old.Close()
+}
+
+// 删除注册, 关闭仍属于该注册的连接
+func (s *Server) remove(a *Adapter, c *coap.Conn) {
+	s.mu.Lock()
+	if s.registrations[a.id] == a {
+		delete(s.registrations, a.id)
+	}
+	owned := c != nil && s.conns[c] == a
+	if owned {
+		delete(s.conns, c)
+	}
+	s.mu.Unlock()
+	if owned {
+		c.Close()
+	}
+}
+
+func newRegistrationID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
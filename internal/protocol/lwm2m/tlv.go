@@ -0,0 +1,299 @@
+package lwm2m
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidTLV = errors.New("invalid lwm2m tlv")
+
+// TLV标识符类型, 类型字节的最高两位
+type tlvKind byte
+
+const (
+	tlvObjectInstance   tlvKind = 0
+	tlvResourceInstance tlvKind = 1
+	tlvMultipleResource tlvKind = 2
+	tlvResource         tlvKind = 3
+)
+
+// 标识符对应的路径层级
+func (k tlvKind) level() int {
+	switch k {
+	case tlvObjectInstance:
+		return 2
+	case tlvResourceInstance:
+		return 4
+	}
+	return 3
+}
+
+type tlv struct {
+	kind     tlvKind
+	id       uint16
+	value    []byte
+	children []tlv // 对象实例和多实例资源
+}
+
+func decodeTLV(data []byte) ([]tlv, error) {
+	var items []tlv
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, ErrInvalidTLV
+		}
+		typ := data[0]
+		item := tlv{kind: tlvKind(typ >> 6)}
+		data = data[1:]
+
+		if typ&0x20 != 0 {
+			if len(data) < 2 {
+				return nil, ErrInvalidTLV
+			}
+			item.id = binary.BigEndian.Uint16(data)
+			data = data[2:]
+		} else {
+			item.id = uint16(data[0])
+			data = data[1:]
+		}
+
+		length := int(typ & 0x07)
+		if n := int(typ >> 3 & 0x03); n > 0 {
+			if len(data) < n {
+				return nil, ErrInvalidTLV
+			}
+			length = 0
+			for _, b := range data[:n] {
+				length = length<<8 | int(b)
+			}
+			data = data[n:]
+		}
+		if len(data) < length {
+			return nil, ErrInvalidTLV
+		}
+		item.value, data = data[:length], data[length:]
+
+		if item.kind == tlvObjectInstance || item.kind == tlvMultipleResource {
+			children, err := decodeTLV(item.value)
+			if err != nil {
+				return nil, err
+			}
+			item.children, item.value = children, nil
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func appendTLV(buf []byte, item tlv) []byte {
+	value := item.value
+	if item.kind == tlvObjectInstance || item.kind == tlvMultipleResource {
+		value = nil
+		for _, child := range item.children {
+			value = appendTLV(value, child)
+		}
+	}
+
+	typ := byte(item.kind) << 6
+	var id []byte
+	if item.id > 0xff {
+		typ |= 0x20
+		id = binary.BigEndian.AppendUint16(nil, item.id)
+	} else {
+		id = []byte{byte(item.id)}
+	}
+	var length []byte
+	switch n := len(value); {
+	case n < 8:
+		typ |= byte(n)
+	case n <= 0xff:
+		typ |= 1 << 3
+		length = []byte{byte(n)}
+	case n <= 0xffff:
+		typ |= 2 << 3
+		length = binary.BigEndian.AppendUint16(nil, uint16(n))
+	default:
+		typ |= 3 << 3
+		length = []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+
+	buf = append(buf, typ)
+	buf = append(buf, id...)
+	buf = append(buf, length...)
+	return append(buf, value...)
+}
+
+// 解码对 base 路径请求的TLV负载, 标识符补全为完整路径
+func (m Model) DecodeTLV(base Path, data []byte) ([]Resource, error) {
+	items, err := decodeTLV(data)
+	if err != nil {
+		return nil, err
+	}
+	var resources []Resource
+	err = m.walkTLV(base, items, &resources)
+	return resources, err
+}
+
+func (m Model) walkTLV(base Path, items []tlv, resources *[]Resource) error {
+	for _, item := range items {
+		level := item.kind.level()
+		if len(base) < level-1 {
+			return fmt.Errorf("%w: identifier %d under %s", ErrInvalidTLV, item.id, base)
+		}
+		path := base[:level-1].Append(item.id)
+		if item.kind == tlvObjectInstance || item.kind == tlvMultipleResource {
+			if err := m.walkTLV(path, item.children, resources); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := m.decodeValue(path, item.value)
+		if err != nil {
+			return err
+		}
+		*resources = append(*resources, Resource{Path: path, Value: v})
+	}
+	return nil
+}
+
+// TLV中的值按资源类型解码, 整数为1/2/4/8字节大端补码
+func (m Model) decodeValue(path Path, b []byte) (interface{}, error) {
+	invalid := fmt.Errorf("%w: %s: %d bytes", ErrInvalidValue, path, len(b))
+	switch m.typeOf(path) {
+	case String:
+		return string(b), nil
+	case Integer, Time:
+		switch len(b) {
+		case 1:
+			return int64(int8(b[0])), nil
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		case 8:
+			return int64(binary.BigEndian.Uint64(b)), nil
+		}
+		return nil, invalid
+	case Unsigned:
+		switch len(b) {
+		case 1:
+			return uint64(b[0]), nil
+		case 2:
+			return uint64(binary.BigEndian.Uint16(b)), nil
+		case 4:
+			return uint64(binary.BigEndian.Uint32(b)), nil
+		case 8:
+			return binary.BigEndian.Uint64(b), nil
+		}
+		return nil, invalid
+	case Float:
+		switch len(b) {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+		return nil, invalid
+	case Boolean:
+		if len(b) != 1 || b[0] > 1 {
+			return nil, invalid
+		}
+		return b[0] == 1, nil
+	case ObjectLink:
+		if len(b) != 4 {
+			return nil, invalid
+		}
+		return fmt.Sprintf("%d:%d", binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:])), nil
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// 编码资源值, 整数使用能容纳该值的最短长度
+func (m Model) encodeValue(path Path, v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok && m.typeOf(path) == ObjectLink {
+		if link, ok := parseObjectLink(s); ok {
+			return link, nil
+		}
+		return nil, fmt.Errorf("%w: %s: %q", ErrInvalidValue, path, s)
+	}
+	switch value := v.(type) {
+	case string:
+		return []byte(value), nil
+	case []byte:
+		return value, nil
+	case bool:
+		if value {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case float64:
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(value)), nil
+	case int64:
+		switch {
+		case value >= math.MinInt8 && value <= math.MaxInt8:
+			return []byte{byte(value)}, nil
+		case value >= math.MinInt16 && value <= math.MaxInt16:
+			return binary.BigEndian.AppendUint16(nil, uint16(value)), nil
+		case value >= math.MinInt32 && value <= math.MaxInt32:
+			return binary.BigEndian.AppendUint32(nil, uint32(value)), nil
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(value)), nil
+	case uint64:
+		switch {
+		case value <= math.MaxUint8:
+			return []byte{byte(value)}, nil
+		case value <= math.MaxUint16:
+			return binary.BigEndian.AppendUint16(nil, uint16(value)), nil
+		case value <= math.MaxUint32:
+			return binary.BigEndian.AppendUint32(nil, uint32(value)), nil
+		}
+		return binary.BigEndian.AppendUint64(nil, value), nil
+	}
+	return nil, fmt.Errorf("%w: %s: %T", ErrInvalidValue, path, v)
+}
+
+// 按 base 路径编码写入的资源: base 为资源时只能包含该资源 (及其实例), 为对象实例时包含其下的资源
+func (m Model) EncodeTLV(base Path, resources []Resource) ([]byte, error) {
+	var items []tlv
+	multiple := make(map[uint16]int) // 资源ID -> items 中的下标
+	for _, r := range resources {
+		if len(r.Path) < 3 || len(r.Path) < len(base) || r.Path[:len(base)].String() != base.String() {
+			return nil, fmt.Errorf("%w: %s outside %s", ErrInvalidPath, r.Path, base)
+		}
+		value, err := m.encodeValue(r.Path, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Path) == 3 {
+			items = append(items, tlv{kind: tlvResource, id: r.Path[2], value: value})
+			continue
+		}
+		i, ok := multiple[r.Path[2]]
+		if !ok {
+			i = len(items)
+			multiple[r.Path[2]] = i
+			items = append(items, tlv{kind: tlvMultipleResource, id: r.Path[2]})
+		}
+		items[i].children = append(items[i].children, tlv{kind: tlvResourceInstance, id: r.Path[3], value: value})
+	}
+
+	var buf []byte
+	for _, item := range items {
+		buf = appendTLV(buf, item)
+	}
+	return buf, nil
+}
+
+// 对象链接 "3:0"
+func parseObjectLink(s string) ([]byte, bool) {
+	object, instance, ok := strings.Cut(s, ":")
+	o, err1 := strconv.ParseUint(object, 10, 16)
+	i, err2 := strconv.ParseUint(instance, 10, 16)
+	if !ok || err1 != nil || err2 != nil {
+		return nil, false
+	}
+	return []byte{byte(o >> 8), byte(o), byte(i >> 8), byte(i)}, true
+}
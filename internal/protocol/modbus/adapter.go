@@ -0,0 +1,294 @@
+package modbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+)
+
+const Protocol = "modbus"
+
+var (
+	ErrUnknownPoint = errors.New("unknown modbus point")
+	ErrNotWritable  = errors.New("modbus point is not writable")
+	ErrInvalidValue = errors.New("invalid value for modbus write")
+)
+
+// 写命令, 按测点名写入 (按测点类型和比例换算):
+//
+//	{"point": "setpoint", "value": 22.5}
+//
+// 或直接写线圈/保持寄存器, value 可以是数组以写入连续多个:
+//
+//	{"table": "coil", "address": 3, "value": true}
+//	{"table": "holding", "address": 10, "value": [1, 2, 3]}
+type Command struct {
+	Point   string          `json:"point,omitempty"`
+	Table   Table           `json:"table,omitempty"`
+	Address uint16          `json:"address,omitempty"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// 轮询的从站设备: 按计划周期读取寄存器作为上行消息, 命令写入寄存器或线圈.
+// 客户端可能由同一地址的多个从站共用, 由调用方负责关闭
+type Adapter struct {
+	client *Client
+	plan   DevicePlan
+	remote net.Addr
+	points map[string]pointRef
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	handler types.MessageHandler
+
+	mu  sync.Mutex
+	err error
+}
+
+type pointRef struct {
+	table Table
+	point Point
+}
+
+func NewAdapter(client *Client, plan DevicePlan) *Adapter {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Adapter{
+		client: client,
+		plan:   plan,
+		remote: client.RemoteAddr(),
+		points: make(map[string]pointRef),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, r := range plan.Ranges {
+		for _, p := range r.Points {
+			a.points[p.Name] = pointRef{table: r.Table, point: p}
+		}
+	}
+	return a
+}
+
+func (a *Adapter) Protocol() string {
+	return Protocol
+}
+
+func (a *Adapter) RemoteAddr() net.Addr {
+	return a.remote
+}
+
+func (a *Adapter) Context() context.Context {
+	return a.ctx
+}
+
+func (a *Adapter) OnMessage(handler types.MessageHandler) {
+	a.handler = handler
+}
+
+// 允许错过一个轮询周期
+func (a *Adapter) KeepAlive() time.Duration {
+	return 2 * time.Duration(a.plan.Interval)
+}
+
+// 按计划轮询, 直到连接出错或关闭. 异常响应只跳过对应区间
+func (a *Adapter) Listen() {
+	ticker := time.NewTicker(time.Duration(a.plan.Interval))
+	defer ticker.Stop()
+
+	for {
+		values, err := a.Poll(a.ctx)
+		if err != nil {
+			a.closeWithError(err)
+			return
+		}
+		if len(values) > 0 && a.handler != nil {
+			payload, _ := json.Marshal(values)
+			a.handler(&types.Message{
+				DeviceID:   a.plan.ID,
+				Payload:    payload,
+				Timestamp:  time.Now(),
+				Properties: map[string]string{"unit_id": strconv.Itoa(int(a.plan.UnitID))},
+			})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+// 计划中的超时作用于单个请求, 未配置时使用客户端的超时
+func (a *Adapter) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.plan.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(a.plan.Timeout))
+	}
+	return context.WithCancel(ctx)
+}
+
+// 读取计划中的所有测点, 返回测点名到换算后数值的映射
+func (a *Adapter) Poll(ctx context.Context) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, r := range a.plan.Ranges {
+		err := a.pollRange(ctx, r, values)
+		var exception *ExceptionError
+		if errors.As(err, &exception) {
+			log.Printf("Modbus device %s: reading %s %d+%d: %v", a.plan.ID, r.Table, r.Start, r.Count, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (a *Adapter) pollRange(ctx context.Context, r RegisterRange, values map[string]interface{}) error {
+	ctx, cancel := a.requestContext(ctx)
+	defer cancel()
+
+	unit := a.plan.UnitID
+	if r.Table.bits() {
+		read := a.client.ReadCoils
+		if r.Table == DiscreteInputs {
+			read = a.client.ReadDiscreteInputs
+		}
+		bits, err := read(ctx, unit, r.Start, r.Count)
+		if err != nil {
+			return err
+		}
+		for _, p := range r.Points {
+			values[p.Name] = bits[p.Address-r.Start]
+		}
+		return nil
+	}
+
+	read := a.client.ReadHoldingRegisters
+	if r.Table == InputRegisters {
+		read = a.client.ReadInputRegisters
+	}
+	regs, err := read(ctx, unit, r.Start, r.Count)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.Points {
+		t := p.dataType(r.Table)
+		offset := int(p.Address - r.Start)
+		v, err := decodeRegisters(t, p.ByteOrder, regs[offset:offset+t.Registers()])
+		if err != nil {
+			return err
+		}
+		values[p.Name] = v*p.scale() + p.Offset
+	}
+	return nil
+}
+
+// 执行写命令, 等待从站确认
+func (a *Adapter) Send(data []byte) error {
+	var cmd Command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+	if a.ctx.Err() != nil {
+		return a.Err()
+	}
+	ctx, cancel := a.requestContext(a.ctx)
+	defer cancel()
+
+	if cmd.Point != "" {
+		ref, ok := a.points[cmd.Point]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownPoint, cmd.Point)
+		}
+		if !ref.point.Writable {
+			return fmt.Errorf("%w: %s", ErrNotWritable, cmd.Point)
+		}
+		return a.writePoint(ctx, ref, cmd.Value)
+	}
+	return a.writeRaw(ctx, cmd)
+}
+
+func (a *Adapter) writePoint(ctx context.Context, ref pointRef, raw json.RawMessage) error {
+	p := ref.point
+	if ref.table == Coils {
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return a.client.WriteSingleCoil(ctx, a.plan.UnitID, p.Address, v)
+	}
+
+	var v float64
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+	regs, err := encodeRegisters(p.dataType(ref.table), p.ByteOrder, (v-p.Offset)/p.scale())
+	if err != nil {
+		return err
+	}
+	if len(regs) == 1 {
+		return a.client.WriteSingleRegister(ctx, a.plan.UnitID, p.Address, regs[0])
+	}
+	return a.client.WriteMultipleRegisters(ctx, a.plan.UnitID, p.Address, regs)
+}
+
+func (a *Adapter) writeRaw(ctx context.Context, cmd Command) error {
+	unit := a.plan.UnitID
+	switch cmd.Table {
+	case Coils:
+		var v bool
+		if json.Unmarshal(cmd.Value, &v) == nil {
+			return a.client.WriteSingleCoil(ctx, unit, cmd.Address, v)
+		}
+		var values []bool
+		if err := json.Unmarshal(cmd.Value, &values); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return a.client.WriteMultipleCoils(ctx, unit, cmd.Address, values)
+	case HoldingRegisters:
+		var v uint16
+		if json.Unmarshal(cmd.Value, &v) == nil {
+			return a.client.WriteSingleRegister(ctx, unit, cmd.Address, v)
+		}
+		var values []uint16
+		if err := json.Unmarshal(cmd.Value, &values); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return a.client.WriteMultipleRegisters(ctx, unit, cmd.Address, values)
+	}
+	return fmt.Errorf("%w: table %q", ErrNotWritable, cmd.Table)
+}
+
+func (a *Adapter) closeWithError(err error) {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+	a.cancel()
+}
+
+// Modbus没有断开通知, 停止轮询即可
+func (a *Adapter) CloseWithReason(reason types.CloseReason) error {
+	a.closeWithError(reason)
+	return nil
+}
+
+func (a *Adapter) Close() error {
+	a.closeWithError(types.CloseNormal)
+	return nil
+}
+
+func (a *Adapter) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
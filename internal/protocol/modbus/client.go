@@ -0,0 +1,298 @@
+package modbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MBAP头: 事务ID、协议ID (0)、后续长度、单元ID
+const mbapHeaderLength = 7
+
+type ClientConfig struct {
+	// 单个请求等待响应的最长时间
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	// 仅用于RTU: 两帧之间总线至少空闲的时间
+	FrameDelay time.Duration
+}
+
+var DefaultClientConfig = ClientConfig{
+	Timeout:     time.Second,
+	DialTimeout: 5 * time.Second,
+	FrameDelay:  10 * time.Millisecond,
+}
+
+// 报文在连接上的封装方式, 每个连接一个
+type framer interface {
+	// 发送请求PDU并读取对应的响应PDU
+	roundTrip(unit byte, pdu []byte, deadline time.Time) ([]byte, error)
+	// 出错后连接是否还能继续使用
+	recoverable(err error) bool
+}
+
+// Modbus 客户端 (主站). 请求按顺序串行发送, 多个单元ID可以共用一个客户端;
+// 连接断开后在下次请求时重连
+type Client struct {
+	addr      string
+	config    ClientConfig
+	newFramer func(conn net.Conn, config ClientConfig) framer
+
+	mu     sync.Mutex
+	conn   net.Conn
+	framer framer
+}
+
+// Modbus TCP 客户端
+func NewClient(addr string, config ClientConfig) *Client {
+	return &Client{addr: addr, config: config, newFramer: newTCPFramer}
+}
+
+// 通过串口服务器透传的 Modbus RTU 客户端
+func NewRTUClient(addr string, config ClientConfig) *Client {
+	return &Client{addr: addr, config: config, newFramer: newRTUFramer}
+}
+
+// 建立连接, 已连接时直接返回
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connect(ctx)
+}
+
+// 调用时持有 c.mu
+func (c *Client) connect(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+	dialer := net.Dialer{Timeout: c.config.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.framer = c.newFramer(conn, c.config)
+	return nil
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeConn()
+}
+
+// 调用时持有 c.mu
+func (c *Client) closeConn() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.framer = nil
+	return err
+}
+
+// 当前连接的对端地址, 未连接时为nil
+func (c *Client) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// 发送请求PDU并返回响应PDU; 连接不可用时关闭连接, 异常响应返回 *ExceptionError
+func (c *Client) send(ctx context.Context, unit byte, pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	resp, err := c.framer.roundTrip(unit, pdu, deadline)
+	if err != nil {
+		if !c.framer.recoverable(err) {
+			c.closeConn()
+		}
+		return nil, err
+	}
+
+	fn := FunctionCode(pdu[0])
+	switch {
+	case len(resp) == 2 && resp[0] == byte(fn)|exceptionFlag:
+		return nil, &ExceptionError{Function: fn, Code: ExceptionCode(resp[1])}
+	case len(resp) < 2 || resp[0] != byte(fn):
+		return nil, ErrInvalidResponse
+	}
+	return resp, nil
+}
+
+func (c *Client) readBits(ctx context.Context, fn FunctionCode, unit byte, address, quantity uint16) ([]bool, error) {
+	if quantity == 0 || quantity > maxReadBits {
+		return nil, ErrInvalidQuantity
+	}
+	resp, err := c.send(ctx, unit, readRequest(fn, address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if int(resp[1]) != (int(quantity)+7)/8 || len(resp) != 2+int(resp[1]) {
+		return nil, ErrInvalidResponse
+	}
+	return unpackBits(resp[2:], int(quantity)), nil
+}
+
+func (c *Client) readRegisters(ctx context.Context, fn FunctionCode, unit byte, address, quantity uint16) ([]uint16, error) {
+	if quantity == 0 || quantity > maxReadRegisters {
+		return nil, ErrInvalidQuantity
+	}
+	resp, err := c.send(ctx, unit, readRequest(fn, address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if int(resp[1]) != 2*int(quantity) || len(resp) != 2+int(resp[1]) {
+		return nil, ErrInvalidResponse
+	}
+	return unpackRegisters(resp[2:]), nil
+}
+
+func (c *Client) ReadCoils(ctx context.Context, unit byte, address, quantity uint16) ([]bool, error) {
+	return c.readBits(ctx, ReadCoils, unit, address, quantity)
+}
+
+func (c *Client) ReadDiscreteInputs(ctx context.Context, unit byte, address, quantity uint16) ([]bool, error) {
+	return c.readBits(ctx, ReadDiscreteInputs, unit, address, quantity)
+}
+
+func (c *Client) ReadHoldingRegisters(ctx context.Context, unit byte, address, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(ctx, ReadHoldingRegisters, unit, address, quantity)
+}
+
+func (c *Client) ReadInputRegisters(ctx context.Context, unit byte, address, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(ctx, ReadInputRegisters, unit, address, quantity)
+}
+
+// 单个写入的响应原样回显请求
+func (c *Client) writeSingle(ctx context.Context, fn FunctionCode, unit byte, address, value uint16) error {
+	pdu := readRequest(fn, address, value)
+	resp, err := c.send(ctx, unit, pdu)
+	if err != nil {
+		return err
+	}
+	if string(resp) != string(pdu) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+func (c *Client) WriteSingleCoil(ctx context.Context, unit byte, address uint16, value bool) error {
+	var v uint16
+	if value {
+		v = 0xff00
+	}
+	return c.writeSingle(ctx, WriteSingleCoil, unit, address, v)
+}
+
+func (c *Client) WriteSingleRegister(ctx context.Context, unit byte, address, value uint16) error {
+	return c.writeSingle(ctx, WriteSingleRegister, unit, address, value)
+}
+
+// 多个写入的响应回显起始地址和数量
+func (c *Client) writeMultiple(ctx context.Context, fn FunctionCode, unit byte, address uint16, quantity int, data []byte) error {
+	pdu := append(readRequest(fn, address, uint16(quantity)), byte(len(data)))
+	pdu = append(pdu, data...)
+	resp, err := c.send(ctx, unit, pdu)
+	if err != nil {
+		return err
+	}
+	if string(resp) != string(pdu[:5]) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+func (c *Client) WriteMultipleCoils(ctx context.Context, unit byte, address uint16, values []bool) error {
+	if len(values) == 0 || len(values) > maxWriteBits {
+		return ErrInvalidQuantity
+	}
+	return c.writeMultiple(ctx, WriteMultipleCoils, unit, address, len(values), packBits(values))
+}
+
+func (c *Client) WriteMultipleRegisters(ctx context.Context, unit byte, address uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > maxWriteRegisters {
+		return ErrInvalidQuantity
+	}
+	return c.writeMultiple(ctx, WriteMultipleRegisters, unit, address, len(values), packRegisters(values))
+}
+
+// Modbus TCP: MBAP头中的事务ID匹配请求和响应
+type tcpFramer struct {
+	conn        net.Conn
+	r           *bufio.Reader
+	transaction uint16
+}
+
+func newTCPFramer(conn net.Conn, config ClientConfig) framer {
+	return &tcpFramer{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (f *tcpFramer) roundTrip(unit byte, pdu []byte, deadline time.Time) ([]byte, error) {
+	f.conn.SetDeadline(deadline)
+	f.transaction++
+	if _, err := f.conn.Write(appendMBAP(nil, f.transaction, unit, pdu)); err != nil {
+		return nil, err
+	}
+	for {
+		transaction, respUnit, resp, err := readMBAP(f.r)
+		if err != nil {
+			return nil, err
+		}
+		// 之前超时的请求迟到的响应
+		if transaction != f.transaction {
+			continue
+		}
+		if respUnit != unit {
+			return nil, ErrInvalidResponse
+		}
+		return resp, nil
+	}
+}
+
+// 流可能已经错位, 重新连接
+func (f *tcpFramer) recoverable(err error) bool {
+	return false
+}
+
+func appendMBAP(buf []byte, transaction uint16, unit byte, pdu []byte) []byte {
+	var header [mbapHeaderLength]byte
+	binary.BigEndian.PutUint16(header[0:], transaction)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(pdu)+1))
+	header[6] = unit
+	buf = append(buf, header[:]...)
+	return append(buf, pdu...)
+}
+
+func readMBAP(r io.Reader) (transaction uint16, unit byte, pdu []byte, err error) {
+	var header [mbapHeaderLength]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > maxPDULength+1 {
+		err = ErrInvalidFrame
+		return
+	}
+	pdu = make([]byte, length-1)
+	if _, err = io.ReadFull(r, pdu); err != nil {
+		return
+	}
+	return binary.BigEndian.Uint16(header[0:]), header[6], pdu, nil
+}
@@ -0,0 +1,157 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// 测点的数据类型, 多寄存器类型占用连续的寄存器
+type DataType string
+
+const (
+	Bool    DataType = "bool" // 线圈和离散输入
+	Uint16  DataType = "uint16"
+	Int16   DataType = "int16"
+	Uint32  DataType = "uint32"
+	Int32   DataType = "int32"
+	Float32 DataType = "float32"
+	Uint64  DataType = "uint64"
+	Int64   DataType = "int64"
+	Float64 DataType = "float64"
+)
+
+var (
+	ErrInvalidDataType  = errors.New("invalid modbus data type")
+	ErrInvalidByteOrder = errors.New("invalid modbus byte order")
+	ErrValueOutOfRange  = errors.New("value out of range for data type")
+)
+
+// 占用的寄存器数
+func (t DataType) Registers() int {
+	switch t {
+	case Bool, Uint16, Int16:
+		return 1
+	case Uint32, Int32, Float32:
+		return 2
+	case Uint64, Int64, Float64:
+		return 4
+	}
+	return 0
+}
+
+// 多寄存器数值的字节序, 以32位数值的四个字节 ABCD (大端) 表示
+type ByteOrder string
+
+const (
+	BigEndian    ByteOrder = "ABCD"
+	WordSwap     ByteOrder = "CDAB" // 低字在前, 常见于PLC
+	ByteSwap     ByteOrder = "BADC"
+	LittleEndian ByteOrder = "DCBA"
+)
+
+func (o ByteOrder) valid() bool {
+	switch o {
+	case "", BigEndian, WordSwap, ByteSwap, LittleEndian:
+		return true
+	}
+	return false
+}
+
+// 在寄存器字节和大端字节之间转换, 两个方向的变换相同
+func (o ByteOrder) apply(b []byte) []byte {
+	out := append([]byte(nil), b...)
+	if o == ByteSwap || o == LittleEndian {
+		for i := 0; i+1 < len(out); i += 2 {
+			out[i], out[i+1] = out[i+1], out[i]
+		}
+	}
+	if o == WordSwap || o == LittleEndian {
+		words := len(out) / 2
+		for i := 0; i < words/2; i++ {
+			j := words - 1 - i
+			out[2*i], out[2*i+1], out[2*j], out[2*j+1] = out[2*j], out[2*j+1], out[2*i], out[2*i+1]
+		}
+	}
+	return out
+}
+
+// 按数据类型和字节序解码寄存器
+func decodeRegisters(t DataType, order ByteOrder, regs []uint16) (float64, error) {
+	if len(regs) != t.Registers() || t == Bool {
+		return 0, ErrInvalidDataType
+	}
+	b := order.apply(packRegisters(regs))
+	switch t {
+	case Uint16:
+		return float64(binary.BigEndian.Uint16(b)), nil
+	case Int16:
+		return float64(int16(binary.BigEndian.Uint16(b))), nil
+	case Uint32:
+		return float64(binary.BigEndian.Uint32(b)), nil
+	case Int32:
+		return float64(int32(binary.BigEndian.Uint32(b))), nil
+	case Float32:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case Uint64:
+		return float64(binary.BigEndian.Uint64(b)), nil
+	case Int64:
+		return float64(int64(binary.BigEndian.Uint64(b))), nil
+	case Float64:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return 0, ErrInvalidDataType
+}
+
+// 编码为寄存器, 整数类型四舍五入并检查范围
+func encodeRegisters(t DataType, order ByteOrder, v float64) ([]uint16, error) {
+	if math.IsNaN(v) && t != Float32 && t != Float64 {
+		return nil, ErrValueOutOfRange
+	}
+	b := make([]byte, 2*t.Registers())
+	switch t {
+	case Uint16, Int16, Uint32, Int32, Uint64, Int64:
+		r := math.Round(v)
+		lo, hi := integerRange(t)
+		if r < lo || r > hi {
+			return nil, ErrValueOutOfRange
+		}
+		switch t {
+		case Uint16:
+			binary.BigEndian.PutUint16(b, uint16(r))
+		case Int16:
+			binary.BigEndian.PutUint16(b, uint16(int16(r)))
+		case Uint32:
+			binary.BigEndian.PutUint32(b, uint32(r))
+		case Int32:
+			binary.BigEndian.PutUint32(b, uint32(int32(r)))
+		case Uint64:
+			binary.BigEndian.PutUint64(b, uint64(r))
+		case Int64:
+			binary.BigEndian.PutUint64(b, uint64(int64(r)))
+		}
+	case Float32:
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(v)))
+	case Float64:
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	default:
+		return nil, ErrInvalidDataType
+	}
+	return unpackRegisters(order.apply(b)), nil
+}
+
+func integerRange(t DataType) (float64, float64) {
+	switch t {
+	case Uint16:
+		return 0, math.MaxUint16
+	case Int16:
+		return math.MinInt16, math.MaxInt16
+	case Uint32:
+		return 0, math.MaxUint32
+	case Int32:
+		return math.MinInt32, math.MaxInt32
+	case Uint64:
+		return 0, math.MaxUint64
+	}
+	return math.MinInt64, math.MaxInt64
+}
@@ -0,0 +1,121 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 功能码
+type FunctionCode byte
+
+const (
+	ReadCoils              FunctionCode = 0x01
+	ReadDiscreteInputs     FunctionCode = 0x02
+	ReadHoldingRegisters   FunctionCode = 0x03
+	ReadInputRegisters     FunctionCode = 0x04
+	WriteSingleCoil        FunctionCode = 0x05
+	WriteSingleRegister    FunctionCode = 0x06
+	WriteMultipleCoils     FunctionCode = 0x0f
+	WriteMultipleRegisters FunctionCode = 0x10
+)
+
+// 异常响应的功能码最高位置1
+const exceptionFlag = 0x80
+
+// 异常码
+type ExceptionCode byte
+
+const (
+	IllegalFunction                    ExceptionCode = 0x01
+	IllegalDataAddress                 ExceptionCode = 0x02
+	IllegalDataValue                   ExceptionCode = 0x03
+	ServerDeviceFailure                ExceptionCode = 0x04
+	Acknowledge                        ExceptionCode = 0x05
+	ServerDeviceBusy                   ExceptionCode = 0x06
+	GatewayPathUnavailable             ExceptionCode = 0x0a
+	GatewayTargetDeviceFailedToRespond ExceptionCode = 0x0b
+)
+
+var exceptionNames = map[ExceptionCode]string{
+	IllegalFunction:                    "illegal function",
+	IllegalDataAddress:                 "illegal data address",
+	IllegalDataValue:                   "illegal data value",
+	ServerDeviceFailure:                "server device failure",
+	Acknowledge:                        "acknowledge",
+	ServerDeviceBusy:                   "server device busy",
+	GatewayPathUnavailable:             "gateway path unavailable",
+	GatewayTargetDeviceFailedToRespond: "gateway target device failed to respond",
+}
+
+// 从站返回的异常响应, 连接仍然可用
+type ExceptionError struct {
+	Function FunctionCode
+	Code     ExceptionCode
+}
+
+func (e *ExceptionError) Error() string {
+	name, ok := exceptionNames[e.Code]
+	if !ok {
+		name = fmt.Sprintf("exception 0x%02x", byte(e.Code))
+	}
+	return fmt.Sprintf("modbus function 0x%02x: %s", byte(e.Function), name)
+}
+
+// 单次请求的数量上限
+const (
+	maxReadBits       = 2000
+	maxReadRegisters  = 125
+	maxWriteBits      = 1968
+	maxWriteRegisters = 123
+	maxPDULength      = 253
+)
+
+var (
+	ErrInvalidQuantity = errors.New("invalid modbus quantity")
+	ErrInvalidResponse = errors.New("invalid modbus response")
+	ErrInvalidFrame    = errors.New("invalid modbus frame")
+)
+
+func readRequest(fn FunctionCode, address, quantity uint16) []byte {
+	pdu := make([]byte, 5)
+	pdu[0] = byte(fn)
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], quantity)
+	return pdu
+}
+
+// 位按字节内从低到高打包
+func packBits(values []bool) []byte {
+	buf := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			buf[i/8] |= 1 << (i % 8)
+		}
+	}
+	return buf
+}
+
+func unpackBits(data []byte, quantity int) []bool {
+	values := make([]bool, quantity)
+	for i := range values {
+		values[i] = data[i/8]&(1<<(i%8)) != 0
+	}
+	return values
+}
+
+func packRegisters(values []uint16) []byte {
+	buf := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(buf[2*i:], v)
+	}
+	return buf
+}
+
+func unpackRegisters(data []byte) []uint16 {
+	values := make([]uint16, len(data)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return values
+}
@@ -0,0 +1,230 @@
+package modbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// 寄存器表
+type Table string
+
+const (
+	Coils            Table = "coil"
+	DiscreteInputs   Table = "discrete"
+	HoldingRegisters Table = "holding"
+	InputRegisters   Table = "input"
+)
+
+func (t Table) bits() bool {
+	return t == Coils || t == DiscreteInputs
+}
+
+// 只有线圈和保持寄存器可写
+func (t Table) writable() bool {
+	return t == Coils || t == HoldingRegisters
+}
+
+// 报文封装方式
+type Framing string
+
+const (
+	FramingTCP Framing = "tcp"
+	FramingRTU Framing = "rtu" // 经串口服务器透传的RTU帧
+)
+
+var ErrInvalidPlan = errors.New("invalid modbus poll plan")
+
+// 轮询计划, 例如:
+//
+//	{"devices": [{
+//	  "id": "plc-1", "address": "10.0.0.5:502", "unit_id": 1, "interval": "5s",
+//	  "ranges": [{"table": "holding", "start": 0, "count": 4, "points": [
+//	    {"name": "temperature", "address": 0, "type": "int16", "scale": 0.1},
+//	    {"name": "flow", "address": 2, "type": "float32", "byte_order": "CDAB"},
+//	    {"name": "setpoint", "address": 1, "type": "int16", "scale": 0.1, "writable": true}
+//	  ]}]
+//	}]}
+//
+// 串口服务器后面的RTU从站设置 "framing": "rtu", 同一地址的多个从站用 unit_id 区分.
+type PollPlan struct {
+	Devices []DevicePlan `json:"devices"`
+}
+
+// 单个从站的轮询计划, 每个周期读取所有寄存器区间并作为一条遥测消息上报.
+// 地址相同的从站共用一个连接, 请求依次发送
+type DevicePlan struct {
+	ID         string          `json:"id"`
+	Address    string          `json:"address"`
+	Framing    Framing         `json:"framing,omitempty"` // 默认tcp
+	UnitID     byte            `json:"unit_id"`
+	Interval   Duration        `json:"interval"`
+	Timeout    Duration        `json:"timeout,omitempty"`
+	FrameDelay Duration        `json:"frame_delay,omitempty"` // 仅用于rtu
+	Ranges     []RegisterRange `json:"ranges"`
+}
+
+// 一次请求读取的连续区间
+type RegisterRange struct {
+	Table  Table   `json:"table"`
+	Start  uint16  `json:"start"`
+	Count  uint16  `json:"count"`
+	Points []Point `json:"points"`
+}
+
+// 区间中的测点, 上报值为 原始值*Scale + Offset
+type Point struct {
+	Name      string    `json:"name"`
+	Address   uint16    `json:"address"`
+	Type      DataType  `json:"type,omitempty"` // 默认寄存器为uint16, 线圈和离散输入为bool
+	ByteOrder ByteOrder `json:"byte_order,omitempty"`
+	Scale     float64   `json:"scale,omitempty"`
+	Offset    float64   `json:"offset,omitempty"`
+	Writable  bool      `json:"writable,omitempty"`
+}
+
+func (p *Point) dataType(table Table) DataType {
+	if p.Type != "" {
+		return p.Type
+	}
+	if table.bits() {
+		return Bool
+	}
+	return Uint16
+}
+
+func (p *Point) scale() float64 {
+	if p.Scale == 0 {
+		return 1
+	}
+	return p.Scale
+}
+
+// JSON中的时长, 可以是 "5s" 这样的字符串或秒数
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		v, err := time.ParseDuration(s)
+		*d = Duration(v)
+		return err
+	}
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func LoadPollPlan(path string) (*PollPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan PollPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, err
+	}
+	return &plan, plan.Validate()
+}
+
+func (p *PollPlan) Validate() error {
+	ids := make(map[string]bool)
+	framings := make(map[string]Framing)
+	for i := range p.Devices {
+		d := &p.Devices[i]
+		if ids[d.ID] {
+			return fmt.Errorf("%w: duplicate device %q", ErrInvalidPlan, d.ID)
+		}
+		ids[d.ID] = true
+		if err := d.Validate(); err != nil {
+			return err
+		}
+		if f, ok := framings[d.Address]; ok && f != d.framing() {
+			return fmt.Errorf("%w: device %q: mixed framing on %s", ErrInvalidPlan, d.ID, d.Address)
+		}
+		framings[d.Address] = d.framing()
+	}
+	return nil
+}
+
+func (d *DevicePlan) framing() Framing {
+	if d.Framing == "" {
+		return FramingTCP
+	}
+	return d.Framing
+}
+
+// 按封装方式创建客户端
+func (d *DevicePlan) NewClient(config ClientConfig) *Client {
+	if d.framing() == FramingRTU {
+		return NewRTUClient(d.Address, config)
+	}
+	return NewClient(d.Address, config)
+}
+
+func (d *DevicePlan) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: device %q: %s", ErrInvalidPlan, d.ID, fmt.Sprintf(format, args...))
+	}
+	if d.ID == "" || d.Address == "" {
+		return invalid("id and address are required")
+	}
+	if d.Interval <= 0 {
+		return invalid("interval must be positive")
+	}
+	switch d.framing() {
+	case FramingTCP:
+	case FramingRTU:
+		// 0为广播, 从站不响应
+		if d.UnitID < 1 || d.UnitID > 247 {
+			return invalid("rtu unit id %d out of range", d.UnitID)
+		}
+	default:
+		return invalid("unknown framing %q", d.Framing)
+	}
+
+	names := make(map[string]bool)
+	for _, r := range d.Ranges {
+		limit := maxReadRegisters
+		switch {
+		case r.Table.bits():
+			limit = maxReadBits
+		case r.Table != HoldingRegisters && r.Table != InputRegisters:
+			return invalid("unknown table %q", r.Table)
+		}
+		if r.Count == 0 || int(r.Count) > limit || int(r.Start)+int(r.Count) > 0x10000 {
+			return invalid("%s range %d+%d out of bounds", r.Table, r.Start, r.Count)
+		}
+
+		for _, p := range r.Points {
+			if p.Name == "" || names[p.Name] {
+				return invalid("missing or duplicate point name %q", p.Name)
+			}
+			names[p.Name] = true
+
+			t := p.dataType(r.Table)
+			if t.Registers() == 0 || (t == Bool) != r.Table.bits() {
+				return invalid("point %s: %v", p.Name, ErrInvalidDataType)
+			}
+			if !p.ByteOrder.valid() {
+				return invalid("point %s: %v", p.Name, ErrInvalidByteOrder)
+			}
+			if p.Address < r.Start || int(p.Address)+t.Registers() > int(r.Start)+int(r.Count) {
+				return invalid("point %s outside %s range %d+%d", p.Name, r.Table, r.Start, r.Count)
+			}
+			if p.Writable && !r.Table.writable() {
+				return invalid("point %s: %s table is read-only", p.Name, r.Table)
+			}
+		}
+	}
+	return nil
+}
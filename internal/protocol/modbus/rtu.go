@@ -0,0 +1,199 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// RTU帧: 单元ID、PDU、CRC16 (低字节在前)
+const (
+	rtuMinFrameLength = 4
+	rtuMaxFrameLength = 256
+)
+
+// 连续超时这么多次后认为串口服务器的连接已失效
+const rtuMaxTimeouts = 3
+
+var ErrChecksum = errors.New("modbus rtu crc mismatch")
+
+// Modbus CRC16: 多项式 0xA001 (反序), 初值 0xFFFF
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func appendRTU(buf []byte, unit byte, pdu []byte) []byte {
+	start := len(buf)
+	buf = append(buf, unit)
+	buf = append(buf, pdu...)
+	return binary.LittleEndian.AppendUint16(buf, crc16(buf[start:]))
+}
+
+func validCRC(frame []byte) bool {
+	n := len(frame) - 2
+	return crc16(frame[:n]) == binary.LittleEndian.Uint16(frame[n:])
+}
+
+// RTU帧没有长度字段, 按功能码推算; 返回0表示无法识别
+func rtuResponseLength(header []byte) int {
+	fn := FunctionCode(header[1])
+	switch {
+	case fn&exceptionFlag != 0:
+		return 5
+	case fn >= ReadCoils && fn <= ReadInputRegisters:
+		return 5 + int(header[2])
+	case fn == WriteSingleCoil, fn == WriteSingleRegister, fn == WriteMultipleCoils, fn == WriteMultipleRegisters:
+		return 8
+	}
+	return 0
+}
+
+// 请求帧长度, header 至少7字节; 返回0表示无法识别
+func rtuRequestLength(header []byte) int {
+	switch fn := FunctionCode(header[1]); {
+	case fn >= ReadCoils && fn <= WriteSingleRegister:
+		return 8
+	case fn == WriteMultipleCoils, fn == WriteMultipleRegisters:
+		return 9 + int(header[6])
+	}
+	return 0
+}
+
+// 在流中查找一帧: 跳过不属于该单元或CRC错误的字节, 直到读出完整的帧或超时.
+// 串口服务器常把一帧拆成多个TCP分段, 所以按长度而不是按字符间隔分帧
+func readRTUFrame(r *bufio.Reader, unit byte, headerLength int, frameLength func([]byte) int) ([]byte, error) {
+	var crcErr error
+	for {
+		header, err := r.Peek(headerLength)
+		if err != nil {
+			return nil, firstError(crcErr, err)
+		}
+		n := frameLength(header)
+		if header[0] != unit || n < rtuMinFrameLength || n > rtuMaxFrameLength {
+			r.Discard(1)
+			continue
+		}
+		frame, err := r.Peek(n)
+		if err != nil {
+			return nil, firstError(crcErr, err)
+		}
+		if !validCRC(frame) {
+			crcErr = ErrChecksum
+			r.Discard(1)
+			continue
+		}
+		frame = append([]byte(nil), frame...)
+		r.Discard(n)
+		return frame, nil
+	}
+}
+
+// 超时前丢弃过CRC错误的帧时报告校验错误
+func firstError(crcErr, err error) error {
+	if crcErr != nil && isTimeout(err) {
+		return crcErr
+	}
+	return err
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Modbus RTU over TCP: 串口服务器把帧原样转发到RS-485总线. 总线同时只能有一个请求,
+// 响应没有事务ID, 只能靠帧间的静默间隔区分
+type rtuFramer struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	delay time.Duration
+
+	last     time.Time // 上一帧结束的时间
+	dirty    bool      // 上次请求出错, 流中可能还有迟到的响应
+	timeouts int
+}
+
+func newRTUFramer(conn net.Conn, config ClientConfig) framer {
+	return &rtuFramer{conn: conn, r: bufio.NewReader(conn), delay: config.FrameDelay}
+}
+
+func (f *rtuFramer) roundTrip(unit byte, pdu []byte, deadline time.Time) ([]byte, error) {
+	resp, err := f.exchange(unit, pdu, deadline)
+	f.last = time.Now()
+	switch {
+	case err == nil:
+		f.timeouts = 0
+	case isTimeout(err):
+		f.timeouts++
+		fallthrough
+	default:
+		f.dirty = true
+	}
+	return resp, err
+}
+
+func (f *rtuFramer) exchange(unit byte, pdu []byte, deadline time.Time) ([]byte, error) {
+	if err := f.waitIdle(deadline); err != nil {
+		return nil, err
+	}
+	f.conn.SetDeadline(deadline)
+	if _, err := f.conn.Write(appendRTU(nil, unit, pdu)); err != nil {
+		return nil, err
+	}
+	frame, err := readRTUFrame(f.r, unit, 3, rtuResponseLength)
+	if err != nil {
+		return nil, err
+	}
+	return frame[1 : len(frame)-2], nil
+}
+
+// 发送前等待总线空闲 delay. 上次请求出错时, 丢弃空闲前到达的数据 (迟到的响应或噪声)
+func (f *rtuFramer) waitIdle(deadline time.Time) error {
+	if !f.dirty {
+		time.Sleep(time.Until(f.last.Add(f.delay)))
+		return nil
+	}
+
+	f.r.Discard(f.r.Buffered())
+	idle := time.Now().Add(f.delay)
+	for {
+		if idle.After(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		f.conn.SetReadDeadline(idle)
+		_, err := f.r.ReadByte()
+		if isTimeout(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		f.r.Discard(f.r.Buffered())
+		idle = time.Now().Add(f.delay)
+	}
+	f.dirty = false
+	return nil
+}
+
+// 单个从站不响应或帧损坏不影响总线上的其它从站, 连接保留;
+// 但所有请求都持续超时说明连接本身已失效
+func (f *rtuFramer) recoverable(err error) bool {
+	if errors.Is(err, ErrChecksum) {
+		return true
+	}
+	return isTimeout(err) && f.timeouts < rtuMaxTimeouts
+}
@@ -0,0 +1,314 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// 内存中的Modbus从站, 用于测试和现场联调. 每个单元ID有独立的寄存器表;
+// ServeRTU 模拟串口服务器后面挂着多个RTU从站的总线
+type Server struct {
+	mu        sync.Mutex
+	units     map[byte]*unitData
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	requests  int
+	splitGap  time.Duration
+}
+
+type unitData struct {
+	coils     []bool
+	discrete  []bool
+	holding   []uint16
+	input     []uint16
+	exception ExceptionCode // 非0时所有请求返回该异常
+	offline   bool
+}
+
+func NewServer() *Server {
+	return &Server{
+		units:     make(map[byte]*unitData),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// 调用时持有 s.mu
+func (s *Server) unit(id byte) *unitData {
+	u, ok := s.units[id]
+	if !ok {
+		u = &unitData{
+			coils:    make([]bool, 0x10000),
+			discrete: make([]bool, 0x10000),
+			holding:  make([]uint16, 0x10000),
+			input:    make([]uint16, 0x10000),
+		}
+		s.units[id] = u
+	}
+	return u
+}
+
+func (s *Server) SetCoils(unit byte, address uint16, values ...bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.unit(unit).coils[address:], values)
+}
+
+func (s *Server) Coils(unit byte, address, quantity uint16) []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool(nil), s.unit(unit).coils[address:int(address)+int(quantity)]...)
+}
+
+func (s *Server) SetDiscreteInputs(unit byte, address uint16, values ...bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.unit(unit).discrete[address:], values)
+}
+
+func (s *Server) SetHoldingRegisters(unit byte, address uint16, values ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.unit(unit).holding[address:], values)
+}
+
+func (s *Server) HoldingRegisters(unit byte, address, quantity uint16) []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint16(nil), s.unit(unit).holding[address:int(address)+int(quantity)]...)
+}
+
+func (s *Server) SetInputRegisters(unit byte, address uint16, values ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.unit(unit).input[address:], values)
+}
+
+// 模拟从站故障, code 为0时恢复正常
+func (s *Server) SetException(unit byte, code ExceptionCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unit(unit).exception = code
+}
+
+// 模拟从站离线: RTU不响应, TCP返回网关目标无响应异常
+func (s *Server) SetOffline(unit byte, offline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unit(unit).offline = offline
+}
+
+// 模拟串口服务器把响应拆成两个TCP分段, 中间间隔 gap
+func (s *Server) SetSplitResponses(gap time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.splitGap = gap
+}
+
+// 已处理的请求数
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// 在监听器上接受 Modbus TCP 主站连接, 阻塞直到监听器关闭
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, s.serveConn)
+}
+
+// 在监听器上接受 Modbus RTU over TCP 主站连接, 阻塞直到监听器关闭
+func (s *Server) ServeRTU(l net.Listener) error {
+	return s.serve(l, s.serveRTUConn)
+}
+
+func (s *Server) serve(l net.Listener, serveConn func(net.Conn)) error {
+	s.mu.Lock()
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			defer s.closeConn(conn)
+			serveConn(conn)
+		}()
+	}
+}
+
+// 关闭所有监听器和连接, 模拟设备掉线; 寄存器保留, 之后可以重新 Serve
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) closeConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		transaction, unit, pdu, err := readMBAP(r)
+		if err != nil {
+			return
+		}
+		resp := s.handle(unit, pdu)
+		if resp == nil {
+			resp = []byte{pdu[0] | exceptionFlag, byte(GatewayTargetDeviceFailedToRespond)}
+		}
+		if err := s.write(conn, appendMBAP(nil, transaction, unit, resp)); err != nil {
+			return
+		}
+	}
+}
+
+// RTU总线上每个从站只响应发给自己的请求; CRC错误的帧和广播 (单元ID 0) 不响应
+func (s *Server) serveRTUConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.Peek(7)
+		if err != nil {
+			return
+		}
+		n := rtuRequestLength(header)
+		if n == 0 {
+			r.Discard(1)
+			continue
+		}
+		frame, err := r.Peek(n)
+		if err != nil {
+			return
+		}
+		if !validCRC(frame) {
+			r.Discard(1)
+			continue
+		}
+		unit, pdu := frame[0], append([]byte(nil), frame[1:n-2]...)
+		r.Discard(n)
+
+		resp := s.handle(unit, pdu)
+		if resp == nil || unit == 0 {
+			continue
+		}
+		if err := s.write(conn, appendRTU(nil, unit, resp)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) write(conn net.Conn, frame []byte) error {
+	s.mu.Lock()
+	gap := s.splitGap
+	s.mu.Unlock()
+	if gap > 0 {
+		if _, err := conn.Write(frame[:len(frame)/2]); err != nil {
+			return err
+		}
+		time.Sleep(gap)
+		frame = frame[len(frame)/2:]
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// 处理请求PDU, 返回响应PDU; 从站离线时返回nil
+func (s *Server) handle(unitID byte, pdu []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	fn := FunctionCode(pdu[0])
+	exception := func(code ExceptionCode) []byte {
+		return []byte{byte(fn) | exceptionFlag, byte(code)}
+	}
+	u := s.unit(unitID)
+	if u.offline {
+		return nil
+	}
+	if u.exception != 0 {
+		return exception(u.exception)
+	}
+	if len(pdu) < 5 {
+		return exception(IllegalDataValue)
+	}
+	address := binary.BigEndian.Uint16(pdu[1:])
+	value := binary.BigEndian.Uint16(pdu[3:])
+	inRange := func(quantity, limit int) bool {
+		return quantity >= 1 && quantity <= limit && int(address)+quantity <= 0x10000
+	}
+
+	switch fn {
+	case ReadCoils, ReadDiscreteInputs:
+		if !inRange(int(value), maxReadBits) {
+			return exception(IllegalDataValue)
+		}
+		table := u.coils
+		if fn == ReadDiscreteInputs {
+			table = u.discrete
+		}
+		data := packBits(table[address : int(address)+int(value)])
+		return append([]byte{byte(fn), byte(len(data))}, data...)
+	case ReadHoldingRegisters, ReadInputRegisters:
+		if !inRange(int(value), maxReadRegisters) {
+			return exception(IllegalDataValue)
+		}
+		table := u.holding
+		if fn == ReadInputRegisters {
+			table = u.input
+		}
+		data := packRegisters(table[address : int(address)+int(value)])
+		return append([]byte{byte(fn), byte(len(data))}, data...)
+	case WriteSingleCoil:
+		if value != 0xff00 && value != 0 {
+			return exception(IllegalDataValue)
+		}
+		u.coils[address] = value == 0xff00
+		return pdu
+	case WriteSingleRegister:
+		u.holding[address] = value
+		return pdu
+	case WriteMultipleCoils, WriteMultipleRegisters:
+		if len(pdu) < 6 || len(pdu) != 6+int(pdu[5]) {
+			return exception(IllegalDataValue)
+		}
+		data := pdu[6:]
+		if fn == WriteMultipleCoils {
+			if !inRange(int(value), maxWriteBits) || len(data) != (int(value)+7)/8 {
+				return exception(IllegalDataValue)
+			}
+			copy(u.coils[address:], unpackBits(data, int(value)))
+		} else {
+			if !inRange(int(value), maxWriteRegisters) || len(data) != 2*int(value) {
+				return exception(IllegalDataValue)
+			}
+			copy(u.holding[address:], unpackRegisters(data))
+		}
+		return pdu[:5]
+	}
+	return exception(IllegalFunction)
+}
@@ -1,49 +1,348 @@
 package mqtt
 
 import (
-	"encoding/binary"
+	"bufio"
+	"context"
 	"errors"
-	
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
 	"edgesphere/internal/pkg/types"
 )
 
+// 协议名称
+const Protocol = "mqtt"
+
+// 关闭前发送DISCONNECT的最长时间
+const disconnectTimeout = time.Second
+
+// 适配器配置
+type AdapterConfig struct {
+	// 命令下发主题, %c 替换为设备ID
+	CommandTopic string
+	// 单个入站报文的最大剩余长度
+	MaxPacketSize int
+	// 非nil时累计收发的字节数和消息数
+	Traffic *Traffic
+	// 单个报文写入的最长时间, 防止半开连接阻塞发送方; 0表示不限制
+	WriteTimeout time.Duration
+}
+
+var DefaultAdapterConfig = AdapterConfig{
+	CommandTopic:  "devices/%c/commands",
+	MaxPacketSize: 1 << 20,
+	WriteTimeout:  10 * time.Second,
+}
+
 type MQTTAdapter struct {
-	conn      net.Conn
-	deviceID  string
-	messageCh chan []byte
+	conn     net.Conn
+	deviceID string
+	config   AdapterConfig
+	packets  chan Packet
+	writeMu  sync.Mutex
+	handler  types.MessageHandler // 入站PUBLISH的协议无关回调, 可选
+
+	version       byte // CONNECT 协商的协议级别
+	maxPacketSize int  // 客户端可接收的最大报文长度, 0表示不限制
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	err       error // 导致连接结束的读取错误, 收到DISCONNECT时为nil
+	closeErr  error // 会话层主动关闭的原因
+	errMu     sync.Mutex
 }
 
 func NewMQTTAdapter(conn net.Conn) *MQTTAdapter {
+	return NewMQTTAdapterWithConfig(conn, "", DefaultAdapterConfig)
+}
+
+func NewMQTTAdapterWithConfig(conn net.Conn, deviceID string, config AdapterConfig) *MQTTAdapter {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &MQTTAdapter{
-		conn:      conn,
-		messageCh: make(chan []byte, 100),
+		conn:     conn,
+		deviceID: deviceID,
+		config:   config,
+		packets:  make(chan Packet, 100),
+		version:  ProtocolLevel311,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// 按CONNECT设置协议级别和客户端的最大报文长度, 必须在 Listen 之前调用
+func (a *MQTTAdapter) Negotiate(connect *ConnectPacket) {
+	a.version = connect.ProtocolLevel
+	if connect.Properties != nil && connect.Properties.MaximumPacketSize != nil {
+		a.maxPacketSize = int(*connect.Properties.MaximumPacketSize)
 	}
 }
 
+func (a *MQTTAdapter) ProtocolLevel() byte {
+	return a.version
+}
+
+// 网关可接收的最大报文长度 (含固定报头), 0表示不限制
+func (a *MQTTAdapter) MaxPacketSize() int {
+	if a.config.MaxPacketSize <= 0 {
+		return 0
+	}
+	// 剩余长度字段最多4字节
+	return a.config.MaxPacketSize + 5
+}
+
+func (a *MQTTAdapter) Protocol() string {
+	return Protocol
+}
+
+// 入站PUBLISH同时以协议无关的消息交给回调, 会话层仍从 Packets 读取完整报文
+func (a *MQTTAdapter) OnMessage(handler types.MessageHandler) {
+	a.handler = handler
+}
+
+// 连接关闭后取消
+func (a *MQTTAdapter) Context() context.Context {
+	return a.ctx
+}
+
+// 入站报文, Listen 退出后关闭
+func (a *MQTTAdapter) Packets() <-chan Packet {
+	return a.packets
+}
+
+// 连接结束的原因, Packets 关闭后有效
+func (a *MQTTAdapter) Err() error {
+	a.errMu.Lock()
+	defer a.errMu.Unlock()
+	if a.closeErr != nil {
+		return a.closeErr
+	}
+	return a.err
+}
+
+func (a *MQTTAdapter) RemoteAddr() net.Addr {
+	return a.conn.RemoteAddr()
+}
+
+// TLS客户端证书中已验证的身份
+func (a *MQTTAdapter) PeerIdentities() []string {
+	return PeerIdentities(a.conn)
+}
+
+// 命令主题
+func (a *MQTTAdapter) CommandTopic() string {
+	return strings.ReplaceAll(a.config.CommandTopic, "%c", a.deviceID)
+}
+
+// 将命令以QoS 0发布到设备命令主题
 func (a *MQTTAdapter) Send(data []byte) error {
-	if a.conn == nil {
+	return a.Publish(&PublishPacket{
+		Topic:   a.CommandTopic(),
+		Payload: data,
+	})
+}
+
+// 3.1.1 返回码, 5.0 连接转换为对应的原因码
+func (a *MQTTAdapter) Connack(sessionPresent bool, code ConnackCode) error {
+	reason := ReasonCode(code)
+	if a.version == ProtocolLevel5 {
+		reason = code.ReasonCode()
+	}
+	return a.write(&ConnAckPacket{SessionPresent: sessionPresent, ReasonCode: reason})
+}
+
+func (a *MQTTAdapter) ConnackWithProperties(sessionPresent bool, reason ReasonCode, props *Properties) error {
+	return a.write(&ConnAckPacket{SessionPresent: sessionPresent, ReasonCode: reason, Properties: props})
+}
+
+// 超过客户端最大报文长度时返回 ErrPacketTooLarge, 消息不发送
+func (a *MQTTAdapter) Publish(p *PublishPacket) error {
+	return a.write(p)
+}
+
+func (a *MQTTAdapter) PubAck(packetID uint16) error {
+	return a.write(&AckPacket{Kind: PubAck, PacketID: packetID})
+}
+
+func (a *MQTTAdapter) PubRec(packetID uint16) error {
+	return a.write(&AckPacket{Kind: PubRec, PacketID: packetID})
+}
+
+func (a *MQTTAdapter) PubRel(packetID uint16) error {
+	return a.write(&AckPacket{Kind: PubRel, PacketID: packetID})
+}
+
+func (a *MQTTAdapter) PubComp(packetID uint16) error {
+	return a.write(&AckPacket{Kind: PubComp, PacketID: packetID})
+}
+
+// 带原因码的 PUBACK / PUBREC / PUBREL / PUBCOMP, 3.1.1 连接忽略原因码
+func (a *MQTTAdapter) Ack(kind ControlPacket, packetID uint16, reason ReasonCode) error {
+	return a.write(&AckPacket{Kind: kind, PacketID: packetID, ReasonCode: reason})
+}
+
+func (a *MQTTAdapter) Suback(packetID uint16, returnCodes []byte) error {
+	return a.write(&SubAckPacket{Kind: SubAck, PacketID: packetID, ReturnCodes: returnCodes})
+}
+
+// reasonCodes 仅5.0连接发送
+func (a *MQTTAdapter) Unsuback(packetID uint16, reasonCodes []byte) error {
+	return a.write(&SubAckPacket{Kind: UnsubAck, PacketID: packetID, ReturnCodes: reasonCodes})
+}
+
+func (a *MQTTAdapter) Pingresp() error {
+	return a.write(&PingRespPacket{})
+}
+
+// 服务端发送DISCONNECT后关闭连接, 3.1.1 连接直接关闭; err 为记录的关闭原因.
+// DISCONNECT 最多等待 disconnectTimeout, 半开连接不会拖住会话过期和接管
+func (a *MQTTAdapter) Disconnect(reason ReasonCode, err error) error {
+	if a.version == ProtocolLevel5 && a.conn != nil {
+		// 先缩短截止时间, 让阻塞中的写入尽快返回并释放写锁
+		a.conn.SetWriteDeadline(time.Now().Add(disconnectTimeout))
+		a.writeTimeout(&DisconnectPacket{ReasonCode: reason}, disconnectTimeout)
+	}
+	if err == nil {
+		err = errors.New(reason.String())
+	}
+	return a.CloseWithError(err)
+}
+
+func (a *MQTTAdapter) write(p Packet) error {
+	return a.writeTimeout(p, a.config.WriteTimeout)
+}
+
+func (a *MQTTAdapter) writeTimeout(p Packet, timeout time.Duration) error {
+	if a.conn == nil || a.ctx.Err() != nil {
 		return errors.New("connection closed")
 	}
-	
-	// MQTT协议简化帧: [类型(1)|长度(2)|数据(N)]
-	header := make([]byte, 3)
-	header[0] = 0x30 // PUBLISH
-	binary.BigEndian.PutUint16(header[1:], uint16(len(data)))
-	
-	frame := append(header, data...)
-	_, err := a.conn.Write(frame)
+
+	buf, err := AppendPacket(nil, p, a.version)
+	if err != nil {
+		return err
+	}
+	if a.maxPacketSize > 0 && len(buf) > a.maxPacketSize {
+		return ErrPacketTooLarge
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if timeout > 0 {
+		a.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := a.conn.Write(buf)
+	if a.config.Traffic != nil {
+		a.config.Traffic.sent(p, n)
+	}
+	return err
+}
+
+// 关闭原因对应的 DISCONNECT 原因码
+var closeReasonCodes = map[types.CloseReason]ReasonCode{
+	types.CloseNormal:           NormalDisconnection,
+	types.CloseKeepAliveTimeout: KeepAliveTimeout,
+	types.CloseTakenOver:        SessionTakenOver,
+	types.CloseServerShutdown:   ServerShuttingDown,
+	types.CloseProtocolError:    ProtocolError,
+	types.CloseNotAuthorized:    NotAuthorized,
+}
+
+// 5.0 连接以对应的原因码发送DISCONNECT
+func (a *MQTTAdapter) CloseWithReason(reason types.CloseReason) error {
+	code, ok := closeReasonCodes[reason]
+	if !ok {
+		code = UnspecifiedError
+	}
+	return a.Disconnect(code, reason)
+}
+
+// 记录关闭原因后关闭连接
+func (a *MQTTAdapter) CloseWithError(reason error) error {
+	a.errMu.Lock()
+	if a.closeErr == nil {
+		a.closeErr = reason
+	}
+	a.errMu.Unlock()
+	return a.Close()
+}
+
+func (a *MQTTAdapter) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		a.cancel()
+		err = a.conn.Close()
+	})
 	return err
 }
 
+func (a *MQTTAdapter) setErr(err error) {
+	a.errMu.Lock()
+	a.err = err
+	a.errMu.Unlock()
+}
+
+// 逐个读取控制报文交给会话层
 func (a *MQTTAdapter) Listen() {
-	defer a.conn.Close()
-	buf := make([]byte, 1024)
-	
+	defer a.Close()
+	defer close(a.packets)
+	var src io.Reader = a.conn
+	if a.config.Traffic != nil {
+		src = countingReader{r: a.conn, n: &a.config.Traffic.BytesIn}
+	}
+	r := bufio.NewReader(src)
+
 	for {
-		n, err := a.conn.Read(buf)
+		packet, err := ReadPacketVersion(r, a.config.MaxPacketSize, a.version)
 		if err != nil {
-			break
+			a.setErr(err)
+			// 5.0 连接在关闭前告知客户端原因
+			switch {
+			case errors.Is(err, ErrPacketTooLarge):
+				a.Disconnect(PacketTooLarge, err)
+			case errors.Is(err, ErrMalformedPacket):
+				a.Disconnect(MalformedPacket, err)
+			case errors.Is(err, ErrProtocolError):
+				a.Disconnect(ProtocolError, err)
+			}
+			return
+		}
+
+		if a.config.Traffic != nil {
+			a.config.Traffic.received(packet)
+		}
+		if p, ok := packet.(*PublishPacket); ok && a.handler != nil {
+			a.handler(a.message(p))
+		}
+
+		select {
+		case a.packets <- packet:
+		case <-a.ctx.Done():
+			a.setErr(errors.New("connection closed"))
+			return
+		}
+
+		if _, ok := packet.(*DisconnectPacket); ok {
+			return
 		}
-		a.messageCh <- buf[:n]
 	}
-}
\ No newline at end of file
+}
+
+func (a *MQTTAdapter) message(p *PublishPacket) *types.Message {
+	msg := &types.Message{
+		DeviceID:  a.deviceID,
+		Topic:     p.Topic,
+		Payload:   p.Payload,
+		QoS:       p.QoS,
+		Timestamp: time.Now(),
+	}
+	if p.Properties != nil && len(p.Properties.User) > 0 {
+		msg.Properties = make(map[string]string, len(p.Properties.User))
+		for _, up := range p.Properties.User {
+			msg.Properties[up.Key] = up.Value
+		}
+	}
+	return msg
+}
@@ -0,0 +1,395 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClientClosed      = errors.New("mqtt client closed")
+	ErrConnectionRefused = errors.New("connection refused by broker")
+	ErrPingTimeout       = errors.New("no PINGRESP from broker")
+	ErrTooManyInflight   = errors.New("no free packet identifier")
+	ErrUnexpectedPacket  = errors.New("unexpected packet from broker")
+	// 代理以失败原因码确认PUBLISH, 重发也不会成功
+	ErrPublishRejected = errors.New("publish rejected by broker")
+)
+
+// 出站MQTT客户端配置, 用于桥接到上游代理
+type ClientOptions struct {
+	ClientID      string
+	Username      string
+	Password      []byte
+	CleanSession  bool
+	KeepAlive     time.Duration
+	ProtocolLevel byte // 默认 3.1.1
+	Will          *Will
+	TLS           *tls.Config // 非nil时使用TLS连接
+	DialTimeout   time.Duration
+
+	// 收到上游下发的消息, 在读取协程中调用, QoS 1/2 在返回后确认
+	OnPublish func(p *PublishPacket)
+}
+
+var DefaultClientOptions = ClientOptions{
+	CleanSession:  true,
+	KeepAlive:     60 * time.Second,
+	ProtocolLevel: ProtocolLevel311,
+	DialTimeout:   10 * time.Second,
+}
+
+// 连接到上游代理的MQTT客户端, 断开后不重连, 由调用方重新 Dial
+type Client struct {
+	conn    net.Conn
+	opts    ClientOptions
+	writeMu sync.Mutex
+
+	SessionPresent bool
+
+	mu       sync.Mutex
+	nextID   uint16
+	pending  map[uint16]chan Packet // 等待确认的报文
+	inbound  map[uint16]struct{}    // 已收到未释放的QoS 2消息
+	lastRecv time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func Dial(ctx context.Context, addr string, opts ClientOptions) (*Client, error) {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+	var conn net.Conn
+	var err error
+	if opts.TLS != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: opts.TLS}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(ctx, conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// 在已建立的连接上发送CONNECT并等待CONNACK
+func NewClient(ctx context.Context, conn net.Conn, opts ClientOptions) (*Client, error) {
+	if opts.ProtocolLevel == 0 {
+		opts.ProtocolLevel = ProtocolLevel311
+	}
+	c := &Client{
+		conn:     conn,
+		opts:     opts,
+		pending:  make(map[uint16]chan Packet),
+		inbound:  make(map[uint16]struct{}),
+		lastRecv: time.Now(),
+		done:     make(chan struct{}),
+	}
+
+	keepAlive := opts.KeepAlive / time.Second
+	if keepAlive > 0xFFFF {
+		keepAlive = 0xFFFF
+	}
+	connect := &ConnectPacket{
+		ProtocolLevel: opts.ProtocolLevel,
+		CleanSession:  opts.CleanSession,
+		KeepAlive:     uint16(keepAlive),
+		ClientID:      opts.ClientID,
+		Will:          opts.Will,
+		Username:      opts.Username,
+		Password:      opts.Password,
+		HasUsername:   opts.Username != "",
+		HasPassword:   opts.Password != nil,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if opts.DialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(opts.DialTimeout))
+	}
+	if err := c.write(connect); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	packet, err := ReadPacketVersion(r, 0, opts.ProtocolLevel)
+	if err != nil {
+		return nil, err
+	}
+	connack, ok := packet.(*ConnAckPacket)
+	if !ok {
+		return nil, ErrUnexpectedPacket
+	}
+	if connack.ReasonCode != 0 {
+		if opts.ProtocolLevel != ProtocolLevel5 {
+			return nil, fmt.Errorf("%w: %s", ErrConnectionRefused, ConnackCode(connack.ReasonCode))
+		}
+		return nil, fmt.Errorf("%w: %s", ErrConnectionRefused, connack.ReasonCode)
+	}
+	conn.SetDeadline(time.Time{})
+	c.SessionPresent = connack.SessionPresent
+
+	go c.readLoop(r)
+	if opts.KeepAlive > 0 {
+		go c.keepAlive()
+	}
+	return c, nil
+}
+
+// 连接断开时关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// 导致连接断开的错误
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// QoS 0 写出即返回, ctx 的截止时间限制写入时间; QoS 1/2 等待确认流程完成
+func (c *Client) Publish(ctx context.Context, p *PublishPacket) error {
+	if p.QoS == 0 {
+		deadline, _ := ctx.Deadline()
+		return c.writeDeadline(p, deadline)
+	}
+
+	out := *p
+	id, ack, err := c.allocate()
+	if err != nil {
+		return err
+	}
+	defer c.release(id)
+	out.PacketID = id
+
+	if err := c.write(&out); err != nil {
+		return err
+	}
+	reply, err := c.wait(ctx, ack)
+	if err != nil {
+		return err
+	}
+	if err := ackError(reply); err != nil || p.QoS == 1 {
+		return err
+	}
+
+	// QoS 2: PUBREC 之后发送 PUBREL 并等待 PUBCOMP
+	if err := c.write(&AckPacket{Kind: PubRel, PacketID: id}); err != nil {
+		return err
+	}
+	reply, err = c.wait(ctx, ack)
+	if err != nil {
+		return err
+	}
+	return ackError(reply)
+}
+
+func ackError(p Packet) error {
+	ack, ok := p.(*AckPacket)
+	if !ok {
+		return ErrUnexpectedPacket
+	}
+	if ack.ReasonCode.Failed() {
+		return fmt.Errorf("%w: %s", ErrPublishRejected, ack.ReasonCode)
+	}
+	return nil
+}
+
+// 返回每个过滤器的SUBACK返回码
+func (c *Client) Subscribe(ctx context.Context, subs []Subscription) ([]byte, error) {
+	id, ack, err := c.allocate()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(id)
+
+	if err := c.write(&SubscribePacket{PacketID: id, Subscriptions: subs}); err != nil {
+		return nil, err
+	}
+	reply, err := c.wait(ctx, ack)
+	if err != nil {
+		return nil, err
+	}
+	suback, ok := reply.(*SubAckPacket)
+	if !ok {
+		return nil, ErrUnexpectedPacket
+	}
+	return suback.ReturnCodes, nil
+}
+
+// 发送DISCONNECT后关闭连接
+func (c *Client) Close() error {
+	c.write(&DisconnectPacket{})
+	c.closeWithError(ErrClientClosed)
+	return nil
+}
+
+func (c *Client) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func (c *Client) write(p Packet) error {
+	return c.writeDeadline(p, time.Time{})
+}
+
+// deadline 为零值时不限制写入时间
+func (c *Client) writeDeadline(p Packet, deadline time.Time) error {
+	buf, err := AppendPacket(nil, p, c.opts.ProtocolLevel)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(buf)
+	return err
+}
+
+func (c *Client) allocate() (uint16, chan Packet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i < 0xFFFF; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, used := c.pending[c.nextID]; !used {
+			ack := make(chan Packet, 1)
+			c.pending[c.nextID] = ack
+			return c.nextID, ack, nil
+		}
+	}
+	return 0, nil, ErrTooManyInflight
+}
+
+func (c *Client) release(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) wait(ctx context.Context, ack chan Packet) (Packet, error) {
+	select {
+	case p := <-ack:
+		return p, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		packet, err := ReadPacketVersion(r, 0, c.opts.ProtocolLevel)
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+		c.mu.Lock()
+		c.lastRecv = time.Now()
+		c.mu.Unlock()
+
+		switch p := packet.(type) {
+		case *PublishPacket:
+			c.handlePublish(p)
+		case *AckPacket:
+			if p.Kind == PubRel {
+				c.mu.Lock()
+				delete(c.inbound, p.PacketID)
+				c.mu.Unlock()
+				c.write(&AckPacket{Kind: PubComp, PacketID: p.PacketID})
+				continue
+			}
+			c.deliverAck(p.PacketID, p)
+		case *SubAckPacket:
+			c.deliverAck(p.PacketID, p)
+		case *PingRespPacket:
+		case *DisconnectPacket:
+			c.closeWithError(errors.New(p.ReasonCode.String()))
+			return
+		default:
+			c.closeWithError(ErrUnexpectedPacket)
+			return
+		}
+	}
+}
+
+func (c *Client) deliverAck(id uint16, p Packet) {
+	c.mu.Lock()
+	ack := c.pending[id]
+	c.mu.Unlock()
+	if ack == nil {
+		return
+	}
+	select {
+	case ack <- p:
+	default:
+	}
+}
+
+// 重复的QoS 2消息只回复PUBREC
+func (c *Client) handlePublish(p *PublishPacket) {
+	if p.QoS == 2 {
+		c.mu.Lock()
+		_, dup := c.inbound[p.PacketID]
+		c.inbound[p.PacketID] = struct{}{}
+		c.mu.Unlock()
+		if !dup && c.opts.OnPublish != nil {
+			c.opts.OnPublish(p)
+		}
+		c.write(&AckPacket{Kind: PubRec, PacketID: p.PacketID})
+		return
+	}
+
+	if c.opts.OnPublish != nil {
+		c.opts.OnPublish(p)
+	}
+	if p.QoS == 1 {
+		c.write(&AckPacket{Kind: PubAck, PacketID: p.PacketID})
+	}
+}
+
+// 每个保活周期发送PINGREQ, 1.5倍周期内没有收到任何报文即断开
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			idle := time.Since(c.lastRecv)
+			c.mu.Unlock()
+			if idle > c.opts.KeepAlive*3/2 {
+				c.closeWithError(ErrPingTimeout)
+				return
+			}
+			if err := c.write(&PingReqPacket{}); err != nil {
+				c.closeWithError(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -14,6 +15,9 @@ const (
 	ConnAck     ControlPacket = 2
 	Publish     ControlPacket = 3
 	PubAck      ControlPacket = 4
+	PubRec      ControlPacket = 5
+	PubRel      ControlPacket = 6
+	PubComp     ControlPacket = 7
 	Subscribe   ControlPacket = 8
 	SubAck      ControlPacket = 9
 	Unsubscribe ControlPacket = 10
@@ -21,6 +25,33 @@ const (
 	PingReq     ControlPacket = 12
 	PingResp    ControlPacket = 13
 	Disconnect  ControlPacket = 14
+	Auth        ControlPacket = 15 // 仅MQTT 5.0
+)
+
+// 协议级别
+const (
+	ProtocolLevel31  byte = 3 // MQTT 3.1 ("MQIsdp")
+	ProtocolLevel311 byte = 4 // MQTT 3.1.1 ("MQTT")
+	ProtocolLevel5   byte = 5 // MQTT 5.0 ("MQTT")
+)
+
+// CONNECT 连接标志位
+const (
+	flagReserved     byte = 0x01
+	flagCleanSession byte = 0x02
+	flagWill         byte = 0x04
+	flagWillQoS      byte = 0x18
+	flagWillRetain   byte = 0x20
+	flagPassword     byte = 0x40
+	flagUsername     byte = 0x80
+)
+
+var (
+	ErrMalformedPacket      = errors.New("malformed MQTT packet")
+	ErrProtocolError        = errors.New("MQTT protocol error")
+	ErrInvalidProtocolName  = errors.New("invalid MQTT protocol name")
+	ErrUnacceptableProtocol = errors.New("unacceptable MQTT protocol version")
+	ErrIdentifierRejected   = errors.New("client identifier rejected")
 )
 
 type Header struct {
@@ -29,6 +60,33 @@ type Header struct {
 	Remaining int
 }
 
+// 遗嘱消息
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties *Properties // 仅MQTT 5.0, 包含遗嘱延迟和消息属性
+}
+
+// CONNECT 报文, 可选字段由连接标志决定
+type ConnectPacket struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool // MQTT 5.0 为 Clean Start
+	KeepAlive     uint16
+	ClientID      string
+	Will          *Will // 未设置遗嘱标志时为nil
+	Username      string
+	Password      []byte
+	HasUsername   bool
+	HasPassword   bool
+	Properties    *Properties // 仅MQTT 5.0
+
+	// 客户端ID为空, 由服务端分配 (5.0 在CONNACK中返回); 不在线路上编码
+	AssignedClientID bool
+}
+
 func DecodeHeader(r io.Reader) (*Header, error) {
 	buf := make([]byte, 1)
 	if _, err := io.ReadFull(r, buf); err != nil {
@@ -49,73 +107,470 @@ func DecodeHeader(r io.Reader) (*Header, error) {
 		}
 		digit := buf[0]
 		value += int(digit&127) * multiplier
-		multiplier *= 128
 		if (digit & 128) == 0 {
 			break
 		}
+		// 剩余长度最多4字节
+		if multiplier == 128*128*128 {
+			return nil, ErrMalformedPacket
+		}
+		multiplier *= 128
 	}
 
 	header.Remaining = value
 	return header, nil
 }
 
-func DecodeConnectPacket(r io.Reader) (map[string]interface{}, error) {
+// 读取一个完整的MQTT 3.1.1控制报文, 剩余长度超过 maxSize 时返回 ErrPacketTooLarge
+func ReadPacket(r io.Reader, maxSize int) (Packet, error) {
+	return ReadPacketVersion(r, maxSize, ProtocolLevel311)
+}
+
+// 按CONNECT协商的协议级别读取控制报文
+func ReadPacketVersion(r io.Reader, maxSize int, version byte) (Packet, error) {
 	header, err := DecodeHeader(r)
-	if err != nil || header.Type != Connect {
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && header.Remaining > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	body := make([]byte, header.Remaining)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return DecodePacketVersion(header, body, version)
+}
+
+func DecodePacket(header *Header, body []byte) (Packet, error) {
+	return DecodePacketVersion(header, body, ProtocolLevel311)
+}
+
+// 按报文类型解码报文体, 返回的报文不引用 body 以外的缓冲区
+func DecodePacketVersion(header *Header, body []byte, version byte) (Packet, error) {
+	br := bytes.NewReader(body)
+	v5 := version == ProtocolLevel5
+
+	switch header.Type {
+	case ConnAck:
+		return decodeConnack(header, br, v5)
+	case Publish:
+		return decodePublish(header, br, v5)
+	case PubAck, PubRec, PubComp, PubRel:
+		return decodeAck(header, br, v5)
+	case Subscribe:
+		return decodeSubscribe(header, br, v5)
+	case SubAck, UnsubAck:
+		return decodeSuback(header, br, v5)
+	case Unsubscribe:
+		return decodeUnsubscribe(header, br, v5)
+	case PingReq, PingResp:
+		if header.Flags != 0 || header.Remaining != 0 {
+			return nil, ErrMalformedPacket
+		}
+		if header.Type == PingResp {
+			return &PingRespPacket{}, nil
+		}
+		return &PingReqPacket{}, nil
+	case Disconnect:
+		if header.Flags != 0 || (!v5 && header.Remaining != 0) {
+			return nil, ErrMalformedPacket
+		}
+		p := &DisconnectPacket{}
+		var err error
+		p.ReasonCode, p.Properties, err = decodeReason(br, Disconnect)
+		return p, err
+	case Auth:
+		if !v5 || header.Flags != 0 {
+			return nil, ErrMalformedPacket
+		}
+		p := &AuthPacket{}
+		var err error
+		p.ReasonCode, p.Properties, err = decodeReason(br, Auth)
+		return p, err
+	}
+	return nil, fmt.Errorf("%w: unexpected MQTT packet type %d", ErrProtocolError, header.Type)
+}
+
+// 5.0 报文末尾可省略的原因码和属性, 省略时原因码为0
+func decodeReason(br *bytes.Reader, t ControlPacket) (ReasonCode, *Properties, error) {
+	if br.Len() == 0 {
+		return Success, nil, nil
+	}
+	code, _ := br.ReadByte()
+	if br.Len() == 0 {
+		return ReasonCode(code), nil, nil
+	}
+	props, err := decodeProperties(br, t)
+	if err != nil {
+		return 0, nil, err
+	}
+	if br.Len() != 0 {
+		return 0, nil, ErrMalformedPacket
+	}
+	return ReasonCode(code), props, nil
+}
+
+func decodeConnack(header *Header, br *bytes.Reader, v5 bool) (*ConnAckPacket, error) {
+	if header.Flags != 0 || (!v5 && header.Remaining != 2) {
+		return nil, ErrMalformedPacket
+	}
+	flags, err := readByte(br)
+	if err != nil || flags&0xFE != 0 {
+		return nil, ErrMalformedPacket
+	}
+	code, err := readByte(br)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &ConnAckPacket{SessionPresent: flags == 1, ReasonCode: ReasonCode(code)}
+	if v5 {
+		if p.Properties, err = decodeProperties(br, ConnAck); err != nil {
+			return nil, err
+		}
+	}
+	if br.Len() != 0 {
+		return nil, ErrMalformedPacket
+	}
+	return p, nil
+}
+
+func decodePublish(header *Header, br *bytes.Reader, v5 bool) (*PublishPacket, error) {
+	p := &PublishPacket{
+		QoS:    (header.Flags >> 1) & 0x03,
+		Dup:    header.Flags&0x08 != 0,
+		Retain: header.Flags&0x01 != 0,
+	}
+	if p.QoS > 2 {
+		return nil, ErrMalformedPacket
+	}
+
+	topic, err := readString(br)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+	// 5.0 使用主题别名时主题名可以为空
+	if !ValidTopicName(topic) && !(v5 && topic == "") {
+		return nil, ErrMalformedPacket
+	}
+	p.Topic = topic
+
+	if p.QoS > 0 {
+		if p.PacketID, err = readUint16(br); err != nil || p.PacketID == 0 {
+			return nil, ErrMalformedPacket
+		}
+	}
+
+	if v5 {
+		if p.Properties, err = decodeProperties(br, Publish); err != nil {
+			return nil, err
+		}
+		if p.Topic == "" && p.Properties.TopicAlias == nil {
+			return nil, ErrProtocolError
+		}
+	}
+
+	p.Payload = make([]byte, br.Len())
+	br.Read(p.Payload)
+	return p, nil
+}
+
+func decodeAck(header *Header, br *bytes.Reader, v5 bool) (*AckPacket, error) {
+	want := byte(0)
+	if header.Type == PubRel {
+		want = 0x02
+	}
+	if header.Flags != want || (!v5 && header.Remaining != 2) {
+		return nil, ErrMalformedPacket
+	}
+	id, err := readUint16(br)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &AckPacket{Kind: header.Type, PacketID: id}
+	if v5 {
+		if p.ReasonCode, p.Properties, err = decodeReason(br, header.Type); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func decodeSubscribe(header *Header, br *bytes.Reader, v5 bool) (*SubscribePacket, error) {
+	if header.Flags != 0x02 {
+		return nil, ErrMalformedPacket
+	}
+	id, err := readUint16(br)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &SubscribePacket{PacketID: id}
+	if v5 {
+		if p.Properties, err = decodeProperties(br, Subscribe); err != nil {
+			return nil, err
+		}
+	}
+	for br.Len() > 0 {
+		filter, err := readString(br)
+		if err != nil || filter == "" {
+			return nil, ErrMalformedPacket
+		}
+		options, err := readByte(br)
+		if err != nil {
+			return nil, ErrMalformedPacket
+		}
+
+		sub := Subscription{Filter: filter, QoS: options & 0x03}
+		if v5 {
+			// 订阅选项: bit0-1 QoS, bit2 No Local, bit3 Retain As Published, bit4-5 保留消息处理
+			sub.NoLocal = options&0x04 != 0
+			sub.RetainAsPublished = options&0x08 != 0
+			sub.RetainHandling = (options >> 4) & 0x03
+			if options&0xC0 != 0 || sub.RetainHandling > 2 {
+				return nil, ErrMalformedPacket
+			}
+		} else if options&0xFC != 0 {
+			return nil, ErrMalformedPacket
+		}
+		if sub.QoS > 2 {
+			return nil, ErrMalformedPacket
+		}
+		p.Subscriptions = append(p.Subscriptions, sub)
+	}
+
+	// 至少包含一个订阅
+	if len(p.Subscriptions) == 0 {
+		return nil, ErrProtocolError
+	}
+	return p, nil
+}
+
+func decodeSuback(header *Header, br *bytes.Reader, v5 bool) (*SubAckPacket, error) {
+	if header.Flags != 0 {
+		return nil, ErrMalformedPacket
+	}
+	id, err := readUint16(br)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &SubAckPacket{Kind: header.Type, PacketID: id}
+	if v5 {
+		if p.Properties, err = decodeProperties(br, header.Type); err != nil {
+			return nil, err
+		}
+	}
+	// 3.1.1 的 UNSUBACK 只有报文标识符
+	if header.Type == UnsubAck && !v5 {
+		if br.Len() != 0 {
+			return nil, ErrMalformedPacket
+		}
+		return p, nil
+	}
+
+	p.ReturnCodes = make([]byte, br.Len())
+	br.Read(p.ReturnCodes)
+	if len(p.ReturnCodes) == 0 {
+		return nil, ErrMalformedPacket
+	}
+	return p, nil
+}
+
+func decodeUnsubscribe(header *Header, br *bytes.Reader, v5 bool) (*UnsubscribePacket, error) {
+	if header.Flags != 0x02 {
+		return nil, ErrMalformedPacket
+	}
+	id, err := readUint16(br)
+	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &UnsubscribePacket{PacketID: id}
+	if v5 {
+		if p.Properties, err = decodeProperties(br, Unsubscribe); err != nil {
+			return nil, err
+		}
+	}
+	for br.Len() > 0 {
+		filter, err := readString(br)
+		if err != nil || filter == "" {
+			return nil, ErrMalformedPacket
+		}
+		p.Filters = append(p.Filters, filter)
+	}
+
+	if len(p.Filters) == 0 {
+		return nil, ErrProtocolError
+	}
+	return p, nil
+}
+
+func DecodeConnectPacket(r io.Reader) (*ConnectPacket, error) {
+	return ReadConnectPacket(r, 0)
+}
+
+// 剩余长度超过 maxSize 时返回 ErrPacketTooLarge, 不分配报文缓冲区; maxSize 为0表示不限制
+func ReadConnectPacket(r io.Reader, maxSize int) (*ConnectPacket, error) {
+	header, err := DecodeHeader(r)
+	if err != nil || header.Type != Connect || header.Flags != 0 {
 		return nil, errors.New("invalid CONNECT packet")
 	}
+	if maxSize > 0 && header.Remaining > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	// 按剩余长度读取完整报文, 避免读入后续报文
+	body := make([]byte, header.Remaining)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(body)
 
 	// 读取协议名
-	protoName, err := readString(r)
+	protoName, err := readString(br)
 	if err != nil {
-		return nil, err
+		return nil, ErrMalformedPacket
 	}
 
 	// 协议版本
-	version, err := readByte(r)
+	version, err := readByte(br)
 	if err != nil {
-		return nil, err
+		return nil, ErrMalformedPacket
+	}
+
+	switch {
+	case protoName == "MQTT" && (version == ProtocolLevel311 || version == ProtocolLevel5):
+	case protoName == "MQIsdp" && version == ProtocolLevel31:
+	case protoName == "MQTT" || protoName == "MQIsdp":
+		return nil, ErrUnacceptableProtocol
+	default:
+		return nil, ErrInvalidProtocolName
 	}
 
 	// 连接标志
-	flags, err := readByte(r)
+	flags, err := readByte(br)
 	if err != nil {
+		return nil, ErrMalformedPacket
+	}
+	if err := validateConnectFlags(flags, version); err != nil {
 		return nil, err
 	}
 
 	// 保活时间
-	keepAlive, err := readUint16(r)
+	keepAlive, err := readUint16(br)
 	if err != nil {
-		return nil, err
+		return nil, ErrMalformedPacket
+	}
+
+	// 5.0 连接属性
+	var props *Properties
+	if version == ProtocolLevel5 {
+		if props, err = decodeProperties(br, Connect); err != nil {
+			return nil, err
+		}
 	}
 
 	// 客户端ID
-	clientID, err := readString(r)
+	clientID, err := readString(br)
 	if err != nil {
-		return nil, err
+		return nil, ErrMalformedPacket
+	}
+
+	packet := &ConnectPacket{
+		ProtocolName:  protoName,
+		ProtocolLevel: version,
+		CleanSession:  flags&flagCleanSession != 0,
+		KeepAlive:     keepAlive,
+		ClientID:      clientID,
+		HasUsername:   flags&flagUsername != 0,
+		HasPassword:   flags&flagPassword != 0,
+		Properties:    props,
+	}
+
+	// 3.1.1 持久会话必须携带客户端ID, 5.0 由服务端分配
+	if clientID == "" && !packet.CleanSession && version != ProtocolLevel5 {
+		return nil, ErrIdentifierRejected
+	}
+
+	// 遗嘱主题与遗嘱消息
+	if flags&flagWill != 0 {
+		will := &Will{
+			QoS:    (flags & flagWillQoS) >> 3,
+			Retain: flags&flagWillRetain != 0,
+		}
+		if version == ProtocolLevel5 {
+			if will.Properties, err = decodeProperties(br, willProperties); err != nil {
+				return nil, err
+			}
+		}
+		if will.Topic, err = readString(br); err != nil {
+			return nil, ErrMalformedPacket
+		}
+		if will.Payload, err = readBinary(br); err != nil {
+			return nil, ErrMalformedPacket
+		}
+		packet.Will = will
 	}
 
-	return map[string]interface{}{
-		"protocol":   protoName,
-		"version":    version,
-		"flags":      flags,
-		"keep_alive": keepAlive,
-		"client_id":  clientID,
-	}, nil
+	// 用户名与密码
+	if packet.HasUsername {
+		if packet.Username, err = readString(br); err != nil {
+			return nil, ErrMalformedPacket
+		}
+	}
+	if packet.HasPassword {
+		if packet.Password, err = readBinary(br); err != nil {
+			return nil, ErrMalformedPacket
+		}
+	}
+
+	if br.Len() != 0 {
+		return nil, ErrMalformedPacket
+	}
+	return packet, nil
+}
+
+// 校验连接标志的组合是否合法
+func validateConnectFlags(flags byte, version byte) error {
+	if flags&flagReserved != 0 {
+		return ErrMalformedPacket
+	}
+	willQoS := (flags & flagWillQoS) >> 3
+	if flags&flagWill == 0 {
+		if willQoS != 0 || flags&flagWillRetain != 0 {
+			return ErrMalformedPacket
+		}
+	} else if willQoS > 2 {
+		return ErrMalformedPacket
+	}
+	// 5.0 允许只携带密码
+	if flags&flagPassword != 0 && flags&flagUsername == 0 && version != ProtocolLevel5 {
+		return ErrMalformedPacket
+	}
+	return nil
 }
 
 func readString(r io.Reader) (string, error) {
+	b, err := readBinary(r)
+	return string(b), err
+}
+
+func readBinary(r io.Reader) ([]byte, error) {
 	lenBuf := make([]byte, 2)
 	if _, err := io.ReadFull(r, lenBuf); err != nil {
-		return "", err
+		return nil, err
 	}
 	length := binary.BigEndian.Uint16(lenBuf)
 
-	strBuf := make([]byte, length)
-	if _, err := io.ReadFull(r, strBuf); err != nil {
-		return "", err
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
 	}
-	return string(strBuf), nil
+	return buf, nil
 }
 
 func readByte(r io.Reader) (byte, error) {
@@ -131,4 +586,4 @@ func readUint16(r io.Reader) (uint16, error) {
 		return 0, err
 	}
 	return binary.BigEndian.Uint16(buf), nil
-}
\ No newline at end of file
+}
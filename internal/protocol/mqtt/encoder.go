@@ -0,0 +1,314 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 剩余长度可编码的最大值 (4字节变长整数)
+const MaxRemainingLength = 268435455
+
+var (
+	ErrPacketTooLarge  = errors.New("MQTT packet exceeds maximum remaining length")
+	ErrInvalidTopic    = errors.New("invalid MQTT topic name")
+	ErrInvalidQoS      = errors.New("invalid MQTT QoS level")
+	ErrMissingPacketID = errors.New("packet identifier required for QoS > 0")
+)
+
+// CONNACK 返回码
+type ConnackCode byte
+
+const (
+	ConnectionAccepted        ConnackCode = 0x00
+	RefusedProtocolVersion    ConnackCode = 0x01
+	RefusedIdentifierRejected ConnackCode = 0x02
+	RefusedServerUnavailable  ConnackCode = 0x03
+	RefusedBadCredentials     ConnackCode = 0x04
+	RefusedNotAuthorized      ConnackCode = 0x05
+)
+
+// SUBACK 失败返回码
+const SubackFailure byte = 0x80
+
+func (c ConnackCode) String() string {
+	switch c {
+	case ConnectionAccepted:
+		return "connection accepted"
+	case RefusedProtocolVersion:
+		return "unacceptable protocol version"
+	case RefusedIdentifierRejected:
+		return "identifier rejected"
+	case RefusedServerUnavailable:
+		return "server unavailable"
+	case RefusedBadCredentials:
+		return "bad user name or password"
+	case RefusedNotAuthorized:
+		return "not authorized"
+	}
+	return "unknown return code"
+}
+
+func EncodeConnack(w io.Writer, sessionPresent bool, code ConnackCode) error {
+	return WritePacket(w, &ConnAckPacket{SessionPresent: sessionPresent, ReasonCode: ReasonCode(code)}, ProtocolLevel311)
+}
+
+func EncodePublish(w io.Writer, p *PublishPacket) error {
+	return WritePacket(w, p, ProtocolLevel311)
+}
+
+func EncodePubAck(w io.Writer, packetID uint16) error {
+	return WritePacket(w, &AckPacket{Kind: PubAck, PacketID: packetID}, ProtocolLevel311)
+}
+
+func EncodePubRec(w io.Writer, packetID uint16) error {
+	return WritePacket(w, &AckPacket{Kind: PubRec, PacketID: packetID}, ProtocolLevel311)
+}
+
+// PUBREL 固定报头标志位必须为0010
+func EncodePubRel(w io.Writer, packetID uint16) error {
+	return WritePacket(w, &AckPacket{Kind: PubRel, PacketID: packetID}, ProtocolLevel311)
+}
+
+func EncodePubComp(w io.Writer, packetID uint16) error {
+	return WritePacket(w, &AckPacket{Kind: PubComp, PacketID: packetID}, ProtocolLevel311)
+}
+
+func EncodeUnsuback(w io.Writer, packetID uint16) error {
+	return WritePacket(w, &SubAckPacket{Kind: UnsubAck, PacketID: packetID}, ProtocolLevel311)
+}
+
+// returnCodes 为每个订阅授予的QoS, 失败时为 SubackFailure
+func EncodeSuback(w io.Writer, packetID uint16, returnCodes []byte) error {
+	return WritePacket(w, &SubAckPacket{Kind: SubAck, PacketID: packetID, ReturnCodes: returnCodes}, ProtocolLevel311)
+}
+
+func EncodePingresp(w io.Writer) error {
+	return WritePacket(w, &PingRespPacket{}, ProtocolLevel311)
+}
+
+// 按协议级别编码控制报文, 整个报文一次写入
+func WritePacket(w io.Writer, p Packet, version byte) error {
+	buf, err := AppendPacket(nil, p, version)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// 将编码后的报文追加到 buf
+func AppendPacket(buf []byte, p Packet, version byte) ([]byte, error) {
+	v5 := version == ProtocolLevel5
+
+	var flags byte
+	var body []byte
+	switch p := p.(type) {
+	case *ConnectPacket:
+		var err error
+		if body, err = encodeConnect(p); err != nil {
+			return nil, err
+		}
+	case *ConnAckPacket:
+		// 拒绝连接时会话存在标志必须为0
+		var ackFlags byte
+		if p.SessionPresent && p.ReasonCode == Success {
+			ackFlags = 0x01
+		}
+		body = []byte{ackFlags, byte(p.ReasonCode)}
+		if v5 {
+			body = appendProperties(body, p.Properties)
+		}
+	case *PublishPacket:
+		if !ValidTopicName(p.Topic) && !(v5 && p.Topic == "" && p.Properties != nil && p.Properties.TopicAlias != nil) {
+			return nil, ErrInvalidTopic
+		}
+		if p.QoS > 2 {
+			return nil, ErrInvalidQoS
+		}
+		if p.QoS > 0 && p.PacketID == 0 {
+			return nil, ErrMissingPacketID
+		}
+		flags = p.QoS << 1
+		if p.Dup {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+
+		// 可变报头: 主题名 + 报文标识符(QoS>0) + 属性(5.0)
+		size := 2 + len(p.Topic) + 2 + len(p.Payload)
+		if v5 {
+			size += propertiesSize(p.Properties)
+		}
+		body = appendString(make([]byte, 0, size), p.Topic)
+		if p.QoS > 0 {
+			body = binary.BigEndian.AppendUint16(body, p.PacketID)
+		}
+		if v5 {
+			body = appendProperties(body, p.Properties)
+		}
+		body = append(body, p.Payload...)
+	case *AckPacket:
+		if p.Kind == PubRel {
+			flags = 0x02
+		}
+		body = binary.BigEndian.AppendUint16(nil, p.PacketID)
+		if v5 {
+			body = appendReason(body, p.ReasonCode, p.Properties)
+		}
+	case *SubscribePacket:
+		flags = 0x02
+		body = binary.BigEndian.AppendUint16(nil, p.PacketID)
+		if v5 {
+			body = appendProperties(body, p.Properties)
+		}
+		for _, sub := range p.Subscriptions {
+			options := sub.QoS
+			if v5 {
+				if sub.NoLocal {
+					options |= 0x04
+				}
+				if sub.RetainAsPublished {
+					options |= 0x08
+				}
+				options |= sub.RetainHandling << 4
+			}
+			body = append(appendString(body, sub.Filter), options)
+		}
+	case *SubAckPacket:
+		body = binary.BigEndian.AppendUint16(nil, p.PacketID)
+		if v5 {
+			body = appendProperties(body, p.Properties)
+		}
+		if p.Kind == SubAck || v5 {
+			body = append(body, p.ReturnCodes...)
+		}
+	case *UnsubscribePacket:
+		flags = 0x02
+		body = binary.BigEndian.AppendUint16(nil, p.PacketID)
+		if v5 {
+			body = appendProperties(body, p.Properties)
+		}
+		for _, filter := range p.Filters {
+			body = appendString(body, filter)
+		}
+	case *PingReqPacket, *PingRespPacket:
+	case *DisconnectPacket:
+		if v5 {
+			body = appendReason(nil, p.ReasonCode, p.Properties)
+		}
+	case *AuthPacket:
+		if !v5 {
+			return nil, errors.New("AUTH requires MQTT 5.0")
+		}
+		body = appendReason(nil, p.ReasonCode, p.Properties)
+	default:
+		return nil, fmt.Errorf("cannot encode MQTT packet type %d", p.Type())
+	}
+
+	buf, err := appendHeader(buf, p.Type(), flags, len(body))
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, body...), nil
+}
+
+// 原因码为0且没有属性时省略, 没有属性时省略属性长度
+func appendReason(buf []byte, code ReasonCode, props *Properties) []byte {
+	encoded := props.encode()
+	if code == Success && len(encoded) == 0 {
+		return buf
+	}
+	buf = append(buf, byte(code))
+	if len(encoded) == 0 {
+		return buf
+	}
+	buf = appendRemainingLength(buf, len(encoded))
+	return append(buf, encoded...)
+}
+
+func encodeConnect(p *ConnectPacket) ([]byte, error) {
+	name := p.ProtocolName
+	if name == "" {
+		name = "MQTT"
+	}
+	v5 := p.ProtocolLevel == ProtocolLevel5
+
+	var flags byte
+	if p.CleanSession {
+		flags |= flagCleanSession
+	}
+	if p.Will != nil {
+		if p.Will.QoS > 2 {
+			return nil, ErrInvalidQoS
+		}
+		flags |= flagWill | p.Will.QoS<<3
+		if p.Will.Retain {
+			flags |= flagWillRetain
+		}
+	}
+	if p.HasUsername {
+		flags |= flagUsername
+	}
+	if p.HasPassword {
+		flags |= flagPassword
+	}
+
+	body := appendString(nil, name)
+	body = append(body, p.ProtocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, p.KeepAlive)
+	if v5 {
+		body = appendProperties(body, p.Properties)
+	}
+	body = appendString(body, p.ClientID)
+	if p.Will != nil {
+		if v5 {
+			body = appendProperties(body, p.Will.Properties)
+		}
+		body = appendString(body, p.Will.Topic)
+		body = appendBinary(body, p.Will.Payload)
+	}
+	if p.HasUsername {
+		body = appendString(body, p.Username)
+	}
+	if p.HasPassword {
+		body = appendBinary(body, p.Password)
+	}
+	return body, nil
+}
+
+func appendHeader(buf []byte, t ControlPacket, flags byte, remaining int) ([]byte, error) {
+	if remaining > MaxRemainingLength {
+		return nil, ErrPacketTooLarge
+	}
+	buf = append(buf, byte(t)<<4|flags)
+	return appendRemainingLength(buf, remaining), nil
+}
+
+// 剩余长度按变长整数编码, 每字节低7位为数据, 最高位为延续标志
+func appendRemainingLength(buf []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		buf = append(buf, digit)
+		if n == 0 {
+			return buf
+		}
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendBinary(buf []byte, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
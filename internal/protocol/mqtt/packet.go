@@ -0,0 +1,90 @@
+package mqtt
+
+// 会话层接收的控制报文
+type Packet interface {
+	Type() ControlPacket
+}
+
+// CONNACK 报文
+type ConnAckPacket struct {
+	SessionPresent bool
+	ReasonCode     ReasonCode // 3.1.1 为 ConnackCode 的数值
+	Properties     *Properties
+}
+
+// PUBLISH 报文
+type PublishPacket struct {
+	Topic      string
+	PacketID   uint16 // 仅QoS>0时有效
+	QoS        byte
+	Retain     bool
+	Dup        bool
+	Payload    []byte
+	Properties *Properties // 仅MQTT 5.0
+}
+
+// PUBACK / PUBREC / PUBREL / PUBCOMP 报文
+type AckPacket struct {
+	Kind       ControlPacket
+	PacketID   uint16
+	ReasonCode ReasonCode // 仅MQTT 5.0
+	Properties *Properties
+}
+
+// 订阅请求中的单个主题过滤器
+type Subscription struct {
+	Filter string
+	QoS    byte
+
+	// MQTT 5.0 订阅选项
+	NoLocal           bool // 不接收自己发布的消息
+	RetainAsPublished bool // 转发时保留原始的保留标志
+	RetainHandling    byte // 0 订阅时发送保留消息, 1 仅新订阅时发送, 2 不发送
+}
+
+type SubscribePacket struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+	Properties    *Properties
+}
+
+// SUBACK / UNSUBACK 报文, 3.1.1 的 UNSUBACK 没有返回码
+type SubAckPacket struct {
+	Kind        ControlPacket
+	PacketID    uint16
+	ReturnCodes []byte
+	Properties  *Properties
+}
+
+type UnsubscribePacket struct {
+	PacketID   uint16
+	Filters    []string
+	Properties *Properties
+}
+
+type PingReqPacket struct{}
+
+type PingRespPacket struct{}
+
+type DisconnectPacket struct {
+	ReasonCode ReasonCode // 仅MQTT 5.0
+	Properties *Properties
+}
+
+// AUTH 报文, 仅MQTT 5.0
+type AuthPacket struct {
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+func (p *ConnectPacket) Type() ControlPacket     { return Connect }
+func (p *ConnAckPacket) Type() ControlPacket     { return ConnAck }
+func (p *PublishPacket) Type() ControlPacket     { return Publish }
+func (p *AckPacket) Type() ControlPacket         { return p.Kind }
+func (p *SubscribePacket) Type() ControlPacket   { return Subscribe }
+func (p *SubAckPacket) Type() ControlPacket      { return p.Kind }
+func (p *UnsubscribePacket) Type() ControlPacket { return Unsubscribe }
+func (p *PingReqPacket) Type() ControlPacket     { return PingReq }
+func (p *PingRespPacket) Type() ControlPacket    { return PingResp }
+func (p *DisconnectPacket) Type() ControlPacket  { return Disconnect }
+func (p *AuthPacket) Type() ControlPacket        { return Auth }
@@ -0,0 +1,403 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// MQTT 5.0 属性标识符
+const (
+	propPayloadFormat        byte = 0x01
+	propMessageExpiry        byte = 0x02
+	propContentType          byte = 0x03
+	propResponseTopic        byte = 0x08
+	propCorrelationData      byte = 0x09
+	propSubscriptionID       byte = 0x0B
+	propSessionExpiry        byte = 0x11
+	propAssignedClientID     byte = 0x12
+	propServerKeepAlive      byte = 0x13
+	propAuthMethod           byte = 0x15
+	propAuthData             byte = 0x16
+	propRequestProblemInfo   byte = 0x17
+	propWillDelay            byte = 0x18
+	propRequestResponseInfo  byte = 0x19
+	propResponseInfo         byte = 0x1A
+	propServerReference      byte = 0x1C
+	propReasonString         byte = 0x1F
+	propReceiveMaximum       byte = 0x21
+	propTopicAliasMaximum    byte = 0x22
+	propTopicAlias           byte = 0x23
+	propMaximumQoS           byte = 0x24
+	propRetainAvailable      byte = 0x25
+	propUser                 byte = 0x26
+	propMaximumPacketSize    byte = 0x27
+	propWildcardSubAvailable byte = 0x28
+	propSubIDAvailable       byte = 0x29
+	propSharedSubAvailable   byte = 0x2A
+)
+
+// 遗嘱属性在 CONNECT 中单独出现, 用伪报文类型区分
+const willProperties ControlPacket = 0
+
+// 各属性允许出现的报文类型
+var propertyPackets = map[byte][]ControlPacket{
+	propPayloadFormat:        {Publish, willProperties},
+	propMessageExpiry:        {Publish, willProperties},
+	propContentType:          {Publish, willProperties},
+	propResponseTopic:        {Publish, willProperties},
+	propCorrelationData:      {Publish, willProperties},
+	propSubscriptionID:       {Publish, Subscribe},
+	propSessionExpiry:        {Connect, ConnAck, Disconnect},
+	propAssignedClientID:     {ConnAck},
+	propServerKeepAlive:      {ConnAck},
+	propAuthMethod:           {Connect, ConnAck, Auth},
+	propAuthData:             {Connect, ConnAck, Auth},
+	propRequestProblemInfo:   {Connect},
+	propWillDelay:            {willProperties},
+	propRequestResponseInfo:  {Connect},
+	propResponseInfo:         {ConnAck},
+	propServerReference:      {ConnAck, Disconnect},
+	propReasonString:         {ConnAck, PubAck, PubRec, PubRel, PubComp, SubAck, UnsubAck, Disconnect, Auth},
+	propReceiveMaximum:       {Connect, ConnAck},
+	propTopicAliasMaximum:    {Connect, ConnAck},
+	propTopicAlias:           {Publish},
+	propMaximumQoS:           {ConnAck},
+	propRetainAvailable:      {ConnAck},
+	propUser:                 {Connect, ConnAck, Publish, PubAck, PubRec, PubRel, PubComp, Subscribe, SubAck, Unsubscribe, UnsubAck, Disconnect, Auth, willProperties},
+	propMaximumPacketSize:    {Connect, ConnAck},
+	propWildcardSubAvailable: {ConnAck},
+	propSubIDAvailable:       {ConnAck},
+	propSharedSubAvailable:   {ConnAck},
+}
+
+// 用户属性, 同一键可以出现多次
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// MQTT 5.0 属性. 缺省值有特殊含义的属性使用指针, nil 表示未携带
+type Properties struct {
+	PayloadFormat   byte     `json:"payload_format,omitempty"`
+	MessageExpiry   *uint32  `json:"message_expiry,omitempty"` // 秒
+	ContentType     string   `json:"content_type,omitempty"`
+	ResponseTopic   string   `json:"response_topic,omitempty"`
+	CorrelationData []byte   `json:"correlation_data,omitempty"`
+	SubscriptionIDs []uint32 `json:"subscription_ids,omitempty"`
+
+	SessionExpiry       *uint32 `json:"-"` // 秒, 0xFFFFFFFF 表示永不过期
+	AssignedClientID    string  `json:"-"`
+	ServerKeepAlive     *uint16 `json:"-"`
+	AuthMethod          string  `json:"-"`
+	AuthData            []byte  `json:"-"`
+	RequestProblemInfo  *byte   `json:"-"`
+	WillDelay           uint32  `json:"-"` // 秒
+	RequestResponseInfo byte    `json:"-"`
+	ResponseInfo        string  `json:"-"`
+	ServerReference     string  `json:"-"`
+	ReasonString        string  `json:"-"`
+
+	ReceiveMaximum       *uint16 `json:"-"`
+	TopicAliasMaximum    uint16  `json:"-"`
+	TopicAlias           *uint16 `json:"-"`
+	MaximumQoS           *byte   `json:"-"`
+	RetainAvailable      *byte   `json:"-"`
+	MaximumPacketSize    *uint32 `json:"-"`
+	WildcardSubAvailable *byte   `json:"-"`
+	SubIDAvailable       *byte   `json:"-"`
+	SharedSubAvailable   *byte   `json:"-"`
+
+	User []UserProperty `json:"user,omitempty"`
+}
+
+// 读取属性长度和属性列表, 校验属性是否允许出现在该报文中
+func decodeProperties(br *bytes.Reader, packet ControlPacket) (*Properties, error) {
+	length, err := readVarInt(br)
+	if err != nil || length > br.Len() {
+		return nil, ErrMalformedPacket
+	}
+	data := make([]byte, length)
+	br.Read(data)
+	pr := bytes.NewReader(data)
+
+	p := &Properties{}
+	seen := make(map[byte]bool)
+	for pr.Len() > 0 {
+		id, _ := pr.ReadByte()
+		if !propertyAllowed(id, packet) {
+			return nil, ErrProtocolError
+		}
+		// 除用户属性和订阅标识符外, 每个属性最多出现一次
+		if seen[id] && id != propUser && id != propSubscriptionID {
+			return nil, ErrProtocolError
+		}
+		seen[id] = true
+
+		if err := p.decode(id, pr); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func propertyAllowed(id byte, packet ControlPacket) bool {
+	for _, t := range propertyPackets[id] {
+		if t == packet {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Properties) decode(id byte, r *bytes.Reader) error {
+	var err error
+	switch id {
+	case propPayloadFormat:
+		if p.PayloadFormat, err = readByte(r); err == nil && p.PayloadFormat > 1 {
+			return ErrProtocolError
+		}
+	case propMessageExpiry:
+		p.MessageExpiry, err = readUint32Ptr(r)
+	case propContentType:
+		p.ContentType, err = readString(r)
+	case propResponseTopic:
+		if p.ResponseTopic, err = readString(r); err == nil && !ValidTopicName(p.ResponseTopic) {
+			return ErrProtocolError
+		}
+	case propCorrelationData:
+		p.CorrelationData, err = readBinary(r)
+	case propSubscriptionID:
+		var v int
+		if v, err = readVarInt(r); err == nil {
+			if v == 0 {
+				return ErrProtocolError
+			}
+			p.SubscriptionIDs = append(p.SubscriptionIDs, uint32(v))
+		}
+	case propSessionExpiry:
+		p.SessionExpiry, err = readUint32Ptr(r)
+	case propAssignedClientID:
+		p.AssignedClientID, err = readString(r)
+	case propServerKeepAlive:
+		p.ServerKeepAlive, err = readUint16Ptr(r)
+	case propAuthMethod:
+		p.AuthMethod, err = readString(r)
+	case propAuthData:
+		p.AuthData, err = readBinary(r)
+	case propRequestProblemInfo:
+		if p.RequestProblemInfo, err = readBytePtr(r); err == nil && *p.RequestProblemInfo > 1 {
+			return ErrProtocolError
+		}
+	case propWillDelay:
+		p.WillDelay, err = readUint32(r)
+	case propRequestResponseInfo:
+		if p.RequestResponseInfo, err = readByte(r); err == nil && p.RequestResponseInfo > 1 {
+			return ErrProtocolError
+		}
+	case propResponseInfo:
+		p.ResponseInfo, err = readString(r)
+	case propServerReference:
+		p.ServerReference, err = readString(r)
+	case propReasonString:
+		p.ReasonString, err = readString(r)
+	case propReceiveMaximum:
+		if p.ReceiveMaximum, err = readUint16Ptr(r); err == nil && *p.ReceiveMaximum == 0 {
+			return ErrProtocolError
+		}
+	case propTopicAliasMaximum:
+		p.TopicAliasMaximum, err = readUint16(r)
+	case propTopicAlias:
+		if p.TopicAlias, err = readUint16Ptr(r); err == nil && *p.TopicAlias == 0 {
+			return ErrProtocolError
+		}
+	case propMaximumQoS:
+		if p.MaximumQoS, err = readBytePtr(r); err == nil && *p.MaximumQoS > 1 {
+			return ErrProtocolError
+		}
+	case propRetainAvailable:
+		p.RetainAvailable, err = readBytePtr(r)
+	case propUser:
+		var u UserProperty
+		if u.Key, err = readString(r); err == nil {
+			if u.Value, err = readString(r); err == nil {
+				p.User = append(p.User, u)
+			}
+		}
+	case propMaximumPacketSize:
+		if p.MaximumPacketSize, err = readUint32Ptr(r); err == nil && *p.MaximumPacketSize == 0 {
+			return ErrProtocolError
+		}
+	case propWildcardSubAvailable:
+		p.WildcardSubAvailable, err = readBytePtr(r)
+	case propSubIDAvailable:
+		p.SubIDAvailable, err = readBytePtr(r)
+	case propSharedSubAvailable:
+		p.SharedSubAvailable, err = readBytePtr(r)
+	default:
+		return ErrMalformedPacket
+	}
+	if err != nil {
+		return ErrMalformedPacket
+	}
+	return nil
+}
+
+// 追加属性长度和属性列表, p 为nil时写入长度0
+func appendProperties(buf []byte, p *Properties) []byte {
+	props := p.encode()
+	buf = appendRemainingLength(buf, len(props))
+	return append(buf, props...)
+}
+
+// 编码后的属性长度 (含长度字段本身)
+func propertiesSize(p *Properties) int {
+	n := len(p.encode())
+	return len(appendRemainingLength(nil, n)) + n
+}
+
+func (p *Properties) encode() []byte {
+	if p == nil {
+		return nil
+	}
+
+	var buf []byte
+	if p.PayloadFormat != 0 {
+		buf = append(buf, propPayloadFormat, p.PayloadFormat)
+	}
+	if p.MessageExpiry != nil {
+		buf = binary.BigEndian.AppendUint32(append(buf, propMessageExpiry), *p.MessageExpiry)
+	}
+	if p.ContentType != "" {
+		buf = appendString(append(buf, propContentType), p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		buf = appendString(append(buf, propResponseTopic), p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		buf = appendBinary(append(buf, propCorrelationData), p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIDs {
+		buf = appendRemainingLength(append(buf, propSubscriptionID), int(id))
+	}
+	if p.SessionExpiry != nil {
+		buf = binary.BigEndian.AppendUint32(append(buf, propSessionExpiry), *p.SessionExpiry)
+	}
+	if p.AssignedClientID != "" {
+		buf = appendString(append(buf, propAssignedClientID), p.AssignedClientID)
+	}
+	if p.ServerKeepAlive != nil {
+		buf = binary.BigEndian.AppendUint16(append(buf, propServerKeepAlive), *p.ServerKeepAlive)
+	}
+	if p.AuthMethod != "" {
+		buf = appendString(append(buf, propAuthMethod), p.AuthMethod)
+	}
+	if p.AuthData != nil {
+		buf = appendBinary(append(buf, propAuthData), p.AuthData)
+	}
+	if p.RequestProblemInfo != nil {
+		buf = append(buf, propRequestProblemInfo, *p.RequestProblemInfo)
+	}
+	if p.WillDelay != 0 {
+		buf = binary.BigEndian.AppendUint32(append(buf, propWillDelay), p.WillDelay)
+	}
+	if p.RequestResponseInfo != 0 {
+		buf = append(buf, propRequestResponseInfo, p.RequestResponseInfo)
+	}
+	if p.ResponseInfo != "" {
+		buf = appendString(append(buf, propResponseInfo), p.ResponseInfo)
+	}
+	if p.ServerReference != "" {
+		buf = appendString(append(buf, propServerReference), p.ServerReference)
+	}
+	if p.ReasonString != "" {
+		buf = appendString(append(buf, propReasonString), p.ReasonString)
+	}
+	if p.ReceiveMaximum != nil {
+		buf = binary.BigEndian.AppendUint16(append(buf, propReceiveMaximum), *p.ReceiveMaximum)
+	}
+	if p.TopicAliasMaximum != 0 {
+		buf = binary.BigEndian.AppendUint16(append(buf, propTopicAliasMaximum), p.TopicAliasMaximum)
+	}
+	if p.TopicAlias != nil {
+		buf = binary.BigEndian.AppendUint16(append(buf, propTopicAlias), *p.TopicAlias)
+	}
+	if p.MaximumQoS != nil {
+		buf = append(buf, propMaximumQoS, *p.MaximumQoS)
+	}
+	if p.RetainAvailable != nil {
+		buf = append(buf, propRetainAvailable, *p.RetainAvailable)
+	}
+	for _, u := range p.User {
+		buf = appendString(appendString(append(buf, propUser), u.Key), u.Value)
+	}
+	if p.MaximumPacketSize != nil {
+		buf = binary.BigEndian.AppendUint32(append(buf, propMaximumPacketSize), *p.MaximumPacketSize)
+	}
+	if p.WildcardSubAvailable != nil {
+		buf = append(buf, propWildcardSubAvailable, *p.WildcardSubAvailable)
+	}
+	if p.SubIDAvailable != nil {
+		buf = append(buf, propSubIDAvailable, *p.SubIDAvailable)
+	}
+	if p.SharedSubAvailable != nil {
+		buf = append(buf, propSharedSubAvailable, *p.SharedSubAvailable)
+	}
+	return buf
+}
+
+// 转发给订阅者的应用消息属性, 主题别名和订阅标识符由每个连接单独决定
+func (p *Properties) ForwardCopy() *Properties {
+	if p == nil {
+		return nil
+	}
+	return &Properties{
+		PayloadFormat:   p.PayloadFormat,
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		User:            p.User,
+	}
+}
+
+// 变长整数, 与剩余长度编码相同
+func readVarInt(r *bytes.Reader) (int, error) {
+	multiplier := 1
+	value := 0
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(digit&127) * multiplier
+		if digit&128 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedPacket
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func readUint32Ptr(r io.Reader) (*uint32, error) {
+	v, err := readUint32(r)
+	return &v, err
+}
+
+func readUint16Ptr(r io.Reader) (*uint16, error) {
+	v, err := readUint16(r)
+	return &v, err
+}
+
+func readBytePtr(r io.Reader) (*byte, error) {
+	v, err := readByte(r)
+	return &v, err
+}
@@ -0,0 +1,194 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoCertificate   = errors.New("tls certificate and key are required")
+	ErrInvalidCABundle = errors.New("no certificates found in CA bundle")
+)
+
+// TLS监听配置
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// 客户端证书的CA, 为空时不校验客户端证书
+	ClientCAFile string
+	// 为true时拒绝未提供有效客户端证书的连接, 否则仅在提供时校验
+	RequireClientCert bool
+	// 检查证书文件变更的间隔, 0表示只通过 Reload 手动重载
+	ReloadInterval time.Duration
+}
+
+var DefaultTLSConfig = TLSConfig{
+	ReloadInterval: time.Minute,
+}
+
+// 持有当前的证书和CA, 重载只影响新的握手, 已建立的连接不受影响
+type CertReloader struct {
+	config TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTime  time.Time
+}
+
+func NewCertReloader(config TLSConfig) (*CertReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, ErrNoCertificate
+	}
+	r := &CertReloader{config: config}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 重新读取证书、私钥和CA, 失败时保留原有证书
+func (r *CertReloader) Reload() error {
+	modTime := r.latestModTime()
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrInvalidCABundle
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCA = pool
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// 证书文件中最晚的修改时间
+func (r *CertReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// 定期检查证书文件, 有变更时重载, 直到 done 关闭
+func (r *CertReloader) Watch(done <-chan struct{}) {
+	if r.config.ReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.RLock()
+			changed := r.latestModTime().After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("TLS certificate reload failed: %v", err)
+				continue
+			}
+			log.Printf("TLS certificate reloaded from %s", r.config.CertFile)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// 每次握手使用当前的证书和CA
+func (r *CertReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		pool := r.clientCA
+		r.mu.RUnlock()
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		switch {
+		case pool == nil:
+			config.ClientAuth = tls.NoClientCert
+		case r.config.RequireClientCert:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		config.ClientCAs = pool
+		return config, nil
+	}
+	return base
+}
+
+// 监听TLS端口, 返回的 CertReloader 用于热更新证书
+func ListenTLS(addr string, config TLSConfig) (net.Listener, *CertReloader, error) {
+	reloader, err := NewCertReloader(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := tls.Listen("tcp", addr, reloader.TLSConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, reloader, nil
+}
+
+// 已验证的客户端证书中的身份 (CN 和 DNS/URI SAN), 必须在握手完成后调用.
+// 非TLS连接或未提供证书时返回nil. 支持 *tls.Conn 和经HTTPS升级的 WebSocketConn
+func PeerIdentities(conn net.Conn) []string {
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	leaf := state.VerifiedChains[0][0]
+	var ids []string
+	if leaf.Subject.CommonName != "" {
+		ids = append(ids, leaf.Subject.CommonName)
+	}
+	ids = append(ids, leaf.DNSNames...)
+	for _, uri := range leaf.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"strings"
+)
+
+// 共享订阅过滤器前缀, 完整格式为 "$share/<group>/<filter>"
+const SharedPrefix = "$share/"
+
+// 拆分共享订阅过滤器, 不是共享订阅或共享名为空时 ok 为 false
+func ParseSharedFilter(filter string) (group, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, SharedPrefix) {
+		return "", "", false
+	}
+	group, topicFilter, found := strings.Cut(filter[len(SharedPrefix):], "/")
+	if !found || group == "" || topicFilter == "" || strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+	return group, topicFilter, true
+}
+
+// 校验订阅主题过滤器: '#' 只能作为最后一级, '+' 必须独占一级
+func ValidTopicFilter(filter string) bool {
+	if filter == "" || len(filter) > 65535 {
+		return false
+	}
+	if strings.HasPrefix(filter, SharedPrefix) {
+		_, topicFilter, ok := ParseSharedFilter(filter)
+		return ok && ValidTopicFilter(topicFilter)
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+// 校验发布主题名, 不允许通配符
+func ValidTopicName(topic string) bool {
+	return topic != "" && len(topic) <= 65535 && !strings.ContainsAny(topic, "+#")
+}
+
+// 判断主题名是否匹配过滤器
+func MatchTopic(filter, topic string) bool {
+	// '$' 开头的系统主题不匹配首级通配符
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, level := range fl {
+		if level == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if level != "+" && level != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
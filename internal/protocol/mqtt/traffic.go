@@ -0,0 +1,39 @@
+package mqtt
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// 连接流量统计, 多个适配器共享同一实例时累计所有连接
+type Traffic struct {
+	BytesIn     atomic.Uint64
+	BytesOut    atomic.Uint64
+	MessagesIn  atomic.Uint64 // 收到的 PUBLISH
+	MessagesOut atomic.Uint64 // 发送的 PUBLISH
+}
+
+func (t *Traffic) received(p Packet) {
+	if _, ok := p.(*PublishPacket); ok {
+		t.MessagesIn.Add(1)
+	}
+}
+
+func (t *Traffic) sent(p Packet, n int) {
+	t.BytesOut.Add(uint64(n))
+	if _, ok := p.(*PublishPacket); ok {
+		t.MessagesOut.Add(1)
+	}
+}
+
+// 统计读取的字节数
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
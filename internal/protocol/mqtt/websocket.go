@@ -0,0 +1,225 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MQTT over WebSocket 子协议
+const WebSocketSubprotocol = "mqtt"
+
+var (
+	ErrListenerClosed  = errors.New("listener closed")
+	ErrNonBinaryFrame  = errors.New("MQTT over WebSocket requires binary frames")
+	errMissingProtocol = "missing mqtt websocket subprotocol"
+)
+
+// 将WebSocket二进制帧包装为字节流, 供 DecodeConnectPacket 和 MQTTAdapter 直接使用.
+// 一个MQTT报文可以跨多个帧, 一个帧也可以包含多个报文
+type WebSocketConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader // 当前正在读取的消息
+	writeMu sync.Mutex
+	tls     *tls.ConnectionState // HTTPS 升级时的TLS状态
+
+	// 写截止时间在下一次写入时生效, websocket.Conn 不允许与写入并发设置
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+}
+
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{ws: ws}
+}
+
+// 底层TLS连接的状态, 供 PeerIdentities 读取客户端证书; 非TLS连接返回零值
+func (c *WebSocketConn) ConnectionState() tls.ConnectionState {
+	if c.tls == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.tls
+}
+
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, ErrNonBinaryFrame
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			// 当前消息读完, 继续读取下一帧
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// 每次写入作为一个二进制消息发送
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.deadlineMu.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMu.Unlock()
+	if err := c.ws.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 发送关闭帧后关闭底层连接
+func (c *WebSocketConn) Close() error {
+	c.writeMu.Lock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+// 在HTTP服务上接受MQTT over WebSocket连接, 以 net.Listener 的形式交给MQTT监听循环
+type WebSocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	conns    chan net.Conn
+	done     chan struct{}
+	closeMu  sync.Once
+}
+
+// 监听 addr, path 为WebSocket端点路径, 例如 "/mqtt"
+func ListenWebSocket(addr, path string) (*WebSocketListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebSocketListener(listener, path), nil
+}
+
+// 在已有的监听器 (例如TLS) 上提供WebSocket端点
+func NewWebSocketListener(listener net.Listener, path string) *WebSocketListener {
+	l := &WebSocketListener{
+		listener: listener,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{WebSocketSubprotocol},
+			// 浏览器维护工具可能来自任意源, 身份在CONNECT中认证
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.handleUpgrade)
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := l.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("WebSocket server error: %v", err)
+		}
+	}()
+	return l
+}
+
+func (l *WebSocketListener) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	// 客户端必须声明 mqtt 子协议
+	if !hasSubprotocol(websocket.Subprotocols(r), WebSocketSubprotocol) {
+		http.Error(w, errMissingProtocol, http.StatusBadRequest)
+		return
+	}
+
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	conn := NewWebSocketConn(ws)
+	conn.tls = r.TLS
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+func hasSubprotocol(protocols []string, want string) bool {
+	for _, p := range protocols {
+		if p == want {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	var err error
+	l.closeMu.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
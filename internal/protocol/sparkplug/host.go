@@ -0,0 +1,245 @@
+package sparkplug
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 节点控制和会话序号指标
+const (
+	RebirthMetric = "Node Control/Rebirth"
+	BdSeqMetric   = "bdSeq"
+)
+
+// 消息序号范围 0-255
+const seqModulus = 256
+
+type Config struct {
+	// 同一节点两次重生请求的最小间隔, 期间等待节点发布新的出生证明
+	RebirthInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	RebirthInterval: 10 * time.Second,
+}
+
+// 一条消息引起的状态变化
+type Update struct {
+	Online  []string // 上线的节点或设备ID
+	Offline []string
+	// 消息中的指标, 别名已替换为名称和类型
+	Metrics []Metric
+	// 序号不连续, 未知的别名或出生证明之前的数据: 需要请求节点重生
+	Rebirth bool
+}
+
+// 按主机应用的规则跟踪边缘节点和设备的在线状态
+type Host struct {
+	config Config
+
+	mu    sync.Mutex
+	nodes map[string]*node // 节点ID
+}
+
+type node struct {
+	online    bool
+	bdSeq     *uint64 // 出生证明中的会话序号, 用于识别过期的死亡证明
+	seq       uint64  // 上一条消息的序号
+	aliases   map[uint64]Metric
+	devices   map[string]bool // 在线的设备ID
+	rebirthAt time.Time       // 上次请求重生的时间
+}
+
+func NewHost(config Config) *Host {
+	return &Host{
+		config: config,
+		nodes:  make(map[string]*node),
+	}
+}
+
+// 节点或设备是否在线
+func (h *Host) Online(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n, ok := h.nodes[id]; ok {
+		return n.online
+	}
+	for _, n := range h.nodes {
+		if n.devices[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// 处理节点发布的消息, 命令和主机状态消息不改变状态
+func (h *Host) Handle(t Topic, p *Payload) Update {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var u Update
+	switch t.Type {
+	case NBIRTH, NDEATH, DBIRTH, DDEATH, NDATA, DDATA:
+	default:
+		return u
+	}
+	id := t.NodeID()
+	n := h.nodes[id]
+	if n == nil {
+		n = &node{}
+		h.nodes[id] = n
+	}
+
+	switch t.Type {
+	case NBIRTH:
+		// 重生: 之前的设备需要重新发布出生证明
+		u.Offline = n.clearDevices()
+		u.Online = []string{id}
+		n.online = true
+		n.bdSeq = bdSeq(p)
+		n.seq = 0
+		if p.Seq != nil {
+			n.seq = *p.Seq
+		}
+		n.aliases = make(map[uint64]Metric)
+		n.rebirthAt = time.Time{}
+		n.learn(p.Metrics)
+		u.Metrics = n.resolve(p.Metrics)
+		return u
+
+	case NDEATH:
+		// 旧会话的遗嘱 (会话序号与当前出生证明不同) 不影响重连后的节点
+		if seq := bdSeq(p); !n.online || (seq != nil && n.bdSeq != nil && *seq != *n.bdSeq) {
+			return u
+		}
+		u.Offline = append(n.clearDevices(), id)
+		n.online = false
+		return u
+	}
+
+	if !n.online {
+		u.Rebirth = h.rebirth(n)
+		return u
+	}
+	if !n.next(p.Seq) {
+		u.Rebirth = h.rebirth(n)
+	}
+
+	deviceID := t.DeviceID()
+	switch t.Type {
+	case DBIRTH:
+		n.learn(p.Metrics)
+		if !n.devices[deviceID] {
+			n.devices[deviceID] = true
+			u.Online = []string{deviceID}
+		}
+	case DDEATH:
+		if n.devices[deviceID] {
+			delete(n.devices, deviceID)
+			u.Offline = []string{deviceID}
+		}
+		return u
+	case DDATA:
+		if !n.devices[deviceID] {
+			u.Rebirth = h.rebirth(n) || u.Rebirth
+		}
+	}
+
+	u.Metrics = n.resolve(p.Metrics)
+	if len(u.Metrics) < len(p.Metrics) {
+		u.Rebirth = h.rebirth(n) || u.Rebirth
+	}
+	return u
+}
+
+// 限制重生请求的频率, 节点发布出生证明后重新计时
+func (h *Host) rebirth(n *node) bool {
+	now := time.Now()
+	if !n.rebirthAt.IsZero() && now.Sub(n.rebirthAt) < h.config.RebirthInterval {
+		return false
+	}
+	n.rebirthAt = now
+	return true
+}
+
+// 检查消息序号是否紧接上一条, 没有序号的消息不检查
+func (n *node) next(seq *uint64) bool {
+	if seq == nil {
+		return true
+	}
+	expected := (n.seq + 1) % seqModulus
+	n.seq = *seq
+	return *seq == expected
+}
+
+// 记录出生证明中的别名
+func (n *node) learn(metrics []Metric) {
+	for _, m := range metrics {
+		if m.Alias != nil && m.Name != "" {
+			n.aliases[*m.Alias] = Metric{Name: m.Name, DataType: m.DataType}
+		}
+	}
+}
+
+// 以别名表补全指标的名称和类型, 丢弃未知别名的指标
+func (n *node) resolve(metrics []Metric) []Metric {
+	resolved := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if m.Name == "" {
+			if m.Alias == nil {
+				continue
+			}
+			known, ok := n.aliases[*m.Alias]
+			if !ok {
+				continue
+			}
+			m.Name = known.Name
+			if m.DataType == 0 {
+				m.DataType = known.DataType
+				if v, ok := m.Value.(uint64); ok {
+					m.Value = integer(m.DataType, v)
+				}
+			}
+		}
+		resolved = append(resolved, m)
+	}
+	return resolved
+}
+
+// 节点重生或离线时其设备全部离线, 按ID排序返回
+func (n *node) clearDevices() []string {
+	ids := make([]string, 0, len(n.devices))
+	for id := range n.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	n.devices = make(map[string]bool)
+	return ids
+}
+
+func bdSeq(p *Payload) *uint64 {
+	for _, m := range p.Metrics {
+		if m.Name != BdSeqMetric {
+			continue
+		}
+		switch v := m.Value.(type) {
+		case int64:
+			seq := uint64(v)
+			return &seq
+		case uint64:
+			return &v
+		}
+	}
+	return nil
+}
+
+// 请求节点重新发布出生证明的 NCMD
+func RebirthCommand(group, node string) (string, []byte) {
+	p := &Payload{
+		Timestamp: uint64(time.Now().UnixMilli()),
+		Metrics:   []Metric{{Name: RebirthMetric, DataType: Boolean, Value: true}},
+	}
+	payload, _ := p.Marshal() // 布尔指标不会编码失败
+	return Topic{Group: group, Type: NCMD, Node: node}.String(), payload
+}
@@ -0,0 +1,385 @@
+package sparkplug
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrInvalidPayload = errors.New("invalid sparkplug payload")
+	ErrInvalidMetric  = errors.New("invalid sparkplug metric value")
+)
+
+// 指标的数据类型
+type DataType uint32
+
+const (
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13 // 毫秒时间戳
+	Text     DataType = 14
+	UUID     DataType = 15
+	DataSet  DataType = 16
+	Bytes    DataType = 17
+	File     DataType = 18
+	Template DataType = 19
+)
+
+// 数据消息中的指标可以只带别名, 名称和类型来自出生证明
+type Metric struct {
+	Name         string
+	Alias        *uint64
+	Timestamp    uint64 // 毫秒, 0表示未设置
+	DataType     DataType
+	IsHistorical bool
+	IsTransient  bool
+	// int64, uint64, float32, float64, bool, string 或 []byte, 空值为nil.
+	// 数据集, 模板, 属性集和元数据不解码
+	Value interface{}
+}
+
+// Sparkplug B 负载 (protobuf)
+type Payload struct {
+	Timestamp uint64
+	Metrics   []Metric
+	Seq       *uint64 // NDEATH 没有序号
+	UUID      string
+	Body      []byte
+}
+
+// protobuf线路类型
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// 解码后的一个字段, 数值类型的值在 num 中
+type field struct {
+	id    int
+	wire  int
+	num   uint64
+	bytes []byte
+}
+
+func readField(data []byte) (field, []byte, error) {
+	key, n := binary.Uvarint(data)
+	if n <= 0 {
+		return field{}, nil, ErrInvalidPayload
+	}
+	data = data[n:]
+	f := field{id: int(key >> 3), wire: int(key & 7)}
+	if f.id == 0 {
+		return field{}, nil, ErrInvalidPayload
+	}
+
+	switch f.wire {
+	case wireVarint:
+		if f.num, n = binary.Uvarint(data); n <= 0 {
+			return field{}, nil, ErrInvalidPayload
+		}
+		return f, data[n:], nil
+	case wireFixed64:
+		if len(data) < 8 {
+			return field{}, nil, ErrInvalidPayload
+		}
+		f.num = binary.LittleEndian.Uint64(data)
+		return f, data[8:], nil
+	case wireFixed32:
+		if len(data) < 4 {
+			return field{}, nil, ErrInvalidPayload
+		}
+		f.num = uint64(binary.LittleEndian.Uint32(data))
+		return f, data[4:], nil
+	case wireBytes:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return field{}, nil, ErrInvalidPayload
+		}
+		data = data[n:]
+		f.bytes = data[:length]
+		return f, data[length:], nil
+	}
+	// 已废弃的group类型
+	return field{}, nil, fmt.Errorf("%w: wire type %d", ErrInvalidPayload, f.wire)
+}
+
+func Unmarshal(data []byte) (*Payload, error) {
+	p := &Payload{}
+	for len(data) > 0 {
+		f, rest, err := readField(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		switch {
+		case f.id == 1 && f.wire == wireVarint:
+			p.Timestamp = f.num
+		case f.id == 2 && f.wire == wireBytes:
+			m, err := unmarshalMetric(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case f.id == 3 && f.wire == wireVarint:
+			seq := f.num
+			p.Seq = &seq
+		case f.id == 4 && f.wire == wireBytes:
+			p.UUID = string(f.bytes)
+		case f.id == 5 && f.wire == wireBytes:
+			p.Body = append([]byte(nil), f.bytes...)
+		}
+	}
+	return p, nil
+}
+
+func unmarshalMetric(data []byte) (Metric, error) {
+	var (
+		m      Metric
+		isNull bool
+		value  field // 值字段, id为0表示没有值
+	)
+	for len(data) > 0 {
+		f, rest, err := readField(data)
+		if err != nil {
+			return Metric{}, err
+		}
+		data = rest
+
+		switch {
+		case f.id == 1 && f.wire == wireBytes:
+			m.Name = string(f.bytes)
+		case f.id == 2 && f.wire == wireVarint:
+			alias := f.num
+			m.Alias = &alias
+		case f.id == 3 && f.wire == wireVarint:
+			m.Timestamp = f.num
+		case f.id == 4 && f.wire == wireVarint:
+			m.DataType = DataType(f.num)
+		case f.id == 5 && f.wire == wireVarint:
+			m.IsHistorical = f.num != 0
+		case f.id == 6 && f.wire == wireVarint:
+			m.IsTransient = f.num != 0
+		case f.id == 7 && f.wire == wireVarint:
+			isNull = f.num != 0
+		case f.id >= 10 && f.id <= 16:
+			value = f
+		}
+	}
+	if isNull || value.id == 0 {
+		return m, nil
+	}
+
+	switch {
+	case (value.id == 10 || value.id == 11) && value.wire == wireVarint:
+		if value.id == 10 {
+			value.num = uint64(uint32(value.num))
+		}
+		m.Value = integer(m.DataType, value.num)
+	case value.id == 12 && value.wire == wireFixed32:
+		m.Value = math.Float32frombits(uint32(value.num))
+	case value.id == 13 && value.wire == wireFixed64:
+		m.Value = math.Float64frombits(value.num)
+	case value.id == 14 && value.wire == wireVarint:
+		m.Value = value.num != 0
+	case value.id == 15 && value.wire == wireBytes:
+		m.Value = string(value.bytes)
+	case value.id == 16 && value.wire == wireBytes:
+		m.Value = append([]byte(nil), value.bytes...)
+	default:
+		return Metric{}, fmt.Errorf("%w: field %d of %q", ErrInvalidPayload, value.id, m.Name)
+	}
+	return m, nil
+}
+
+// 有符号整数以补码存放在 int_value (32位) 或 long_value 中;
+// 类型未知时 (数据消息中只带别名) 保留无符号值, 解析别名后再转换
+func integer(t DataType, v uint64) interface{} {
+	switch t {
+	case Int8:
+		return int64(int8(v))
+	case Int16:
+		return int64(int16(v))
+	case Int32:
+		return int64(int32(v))
+	case Int64:
+		return int64(v)
+	}
+	return v
+}
+
+func appendKey(b []byte, id, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(id)<<3|uint64(wire))
+}
+
+func appendVarint(b []byte, id int, v uint64) []byte {
+	return binary.AppendUvarint(appendKey(b, id, wireVarint), v)
+}
+
+func appendBytes(b []byte, id int, v []byte) []byte {
+	b = binary.AppendUvarint(appendKey(b, id, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func (p *Payload) Marshal() ([]byte, error) {
+	var b []byte
+	if p.Timestamp != 0 {
+		b = appendVarint(b, 1, p.Timestamp)
+	}
+	for _, m := range p.Metrics {
+		metric, err := m.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = appendBytes(b, 2, metric)
+	}
+	if p.Seq != nil {
+		b = appendVarint(b, 3, *p.Seq)
+	}
+	if p.UUID != "" {
+		b = appendBytes(b, 4, []byte(p.UUID))
+	}
+	if p.Body != nil {
+		b = appendBytes(b, 5, p.Body)
+	}
+	return b, nil
+}
+
+func (m *Metric) marshal() ([]byte, error) {
+	var b []byte
+	if m.Name != "" {
+		b = appendBytes(b, 1, []byte(m.Name))
+	}
+	if m.Alias != nil {
+		b = appendVarint(b, 2, *m.Alias)
+	}
+	if m.Timestamp != 0 {
+		b = appendVarint(b, 3, m.Timestamp)
+	}
+	if m.DataType != 0 {
+		b = appendVarint(b, 4, uint64(m.DataType))
+	}
+	if m.IsHistorical {
+		b = appendVarint(b, 5, 1)
+	}
+	if m.IsTransient {
+		b = appendVarint(b, 6, 1)
+	}
+	if m.Value == nil {
+		return appendVarint(b, 7, 1), nil
+	}
+
+	invalid := fmt.Errorf("%w: %T for %q", ErrInvalidMetric, m.Value, m.Name)
+	// 数据消息中的指标通常不带类型, 按值选择字段
+	dataType := m.DataType
+	if dataType == 0 {
+		dataType = typeOf(m.Value)
+	}
+	switch dataType {
+	case Int8, Int16, Int32, UInt8, UInt16:
+		v, ok := toUint64(m.Value)
+		if !ok {
+			return nil, invalid
+		}
+		return appendVarint(b, 10, uint64(uint32(v))), nil
+	case Int64, UInt32, UInt64, DateTime:
+		v, ok := toUint64(m.Value)
+		if !ok {
+			return nil, invalid
+		}
+		return appendVarint(b, 11, v), nil
+	case Float:
+		v, ok := toFloat64(m.Value)
+		if !ok {
+			return nil, invalid
+		}
+		b = appendKey(b, 12, wireFixed32)
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v))), nil
+	case Double:
+		v, ok := toFloat64(m.Value)
+		if !ok {
+			return nil, invalid
+		}
+		b = appendKey(b, 13, wireFixed64)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v)), nil
+	case Boolean:
+		v, ok := m.Value.(bool)
+		if !ok {
+			return nil, invalid
+		}
+		if v {
+			return appendVarint(b, 14, 1), nil
+		}
+		return appendVarint(b, 14, 0), nil
+	case String, Text, UUID:
+		v, ok := m.Value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		return appendBytes(b, 15, []byte(v)), nil
+	case Bytes, File:
+		v, ok := m.Value.([]byte)
+		if !ok {
+			return nil, invalid
+		}
+		return appendBytes(b, 16, v), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported type %d for %q", ErrInvalidMetric, m.DataType, m.Name)
+}
+
+func typeOf(v interface{}) DataType {
+	switch v.(type) {
+	case int, int64:
+		return Int64
+	case uint64:
+		return UInt64
+	case float32:
+		return Float
+	case float64:
+		return Double
+	case bool:
+		return Boolean
+	case string:
+		return String
+	case []byte:
+		return Bytes
+	}
+	return 0
+}
+
+// 整数值, 负数按补码
+func toUint64(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case int:
+		return uint64(n), true
+	case int64:
+		return uint64(n), true
+	case uint64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,103 @@
+package sparkplug
+
+import (
+	"errors"
+	"strings"
+)
+
+// Sparkplug B 主题命名空间
+const Namespace = "spBv1.0"
+
+// 消息类型, 主题的第三级
+type MessageType string
+
+const (
+	NBIRTH MessageType = "NBIRTH"
+	NDEATH MessageType = "NDEATH"
+	DBIRTH MessageType = "DBIRTH"
+	DDEATH MessageType = "DDEATH"
+	NDATA  MessageType = "NDATA"
+	DDATA  MessageType = "DDATA"
+	NCMD   MessageType = "NCMD"
+	DCMD   MessageType = "DCMD"
+	// 主机应用的在线状态, 主题为 spBv1.0/STATE/<host_id>
+	STATE MessageType = "STATE"
+)
+
+var ErrInvalidTopic = errors.New("invalid sparkplug topic")
+
+// 设备级消息, 主题以设备ID结尾
+func (t MessageType) device() bool {
+	return t == DBIRTH || t == DDEATH || t == DDATA || t == DCMD
+}
+
+// spBv1.0/<group>/<type>/<edge_node>[/<device>]
+type Topic struct {
+	Group  string
+	Type   MessageType
+	Node   string
+	Device string
+	Host   string // STATE
+}
+
+func IsTopic(topic string) bool {
+	return strings.HasPrefix(topic, Namespace+"/")
+}
+
+func ParseTopic(topic string) (Topic, error) {
+	if !IsTopic(topic) {
+		return Topic{}, ErrInvalidTopic
+	}
+	levels := strings.Split(topic[len(Namespace)+1:], "/")
+	for _, level := range levels {
+		if level == "" {
+			return Topic{}, ErrInvalidTopic
+		}
+	}
+	if len(levels) == 2 && MessageType(levels[0]) == STATE {
+		return Topic{Type: STATE, Host: levels[1]}, nil
+	}
+	if len(levels) < 3 {
+		return Topic{}, ErrInvalidTopic
+	}
+
+	t := Topic{Group: levels[0], Type: MessageType(levels[1]), Node: levels[2]}
+	switch t.Type {
+	case NBIRTH, NDEATH, NDATA, NCMD:
+		if len(levels) != 3 {
+			return Topic{}, ErrInvalidTopic
+		}
+	case DBIRTH, DDEATH, DDATA, DCMD:
+		if len(levels) != 4 {
+			return Topic{}, ErrInvalidTopic
+		}
+		t.Device = levels[3]
+	default:
+		return Topic{}, ErrInvalidTopic
+	}
+	return t, nil
+}
+
+func (t Topic) String() string {
+	if t.Type == STATE {
+		return Namespace + "/" + string(STATE) + "/" + t.Host
+	}
+	s := Namespace + "/" + t.Group + "/" + string(t.Type) + "/" + t.Node
+	if t.Type.device() {
+		s += "/" + t.Device
+	}
+	return s
+}
+
+// 边缘节点ID: <group>/<edge_node>
+func (t Topic) NodeID() string {
+	return t.Group + "/" + t.Node
+}
+
+// 设备ID: <group>/<edge_node>/<device>, 节点级消息为节点ID
+func (t Topic) DeviceID() string {
+	if t.Device == "" {
+		return t.NodeID()
+	}
+	return t.NodeID() + "/" + t.Device
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func TestACLSubstitution(t *testing.T) {
+	acl := auth.NewACL([]auth.Rule{
+		{Topic: "devices/%c/commands/#", Access: auth.Publish, Deny: true},
+		{Topic: "devices/%c/secrets/#", Access: auth.Subscribe, Deny: true},
+		{Topic: "devices/%c/#", Access: auth.ReadWrite},
+		{Topic: "users/%u/+", Access: auth.Subscribe},
+		{Username: "ops", Topic: "$SYS/#", Access: auth.Subscribe},
+	})
+	sensor := &auth.Client{ID: "sensor-1", Username: "line-1"}
+	ops := &auth.Client{ID: "console", Username: "ops"}
+
+	cases := []struct {
+		client *auth.Client
+		access auth.Access
+		topic  string
+		want   bool
+	}{
+		{sensor, auth.Publish, "devices/sensor-1/telemetry", true},
+		{sensor, auth.Publish, "devices/sensor-2/telemetry", false},
+		{sensor, auth.Publish, "devices/sensor-1/commands/reboot", false},
+		{sensor, auth.Subscribe, "devices/sensor-1/commands/#", true},
+		{sensor, auth.Subscribe, "devices/+/commands", false},
+		// 与拒绝规则有交集的订阅被拒绝
+		{sensor, auth.Subscribe, "devices/sensor-1/#", false},
+		{sensor, auth.Subscribe, "devices/sensor-1/+/key", false},
+		{sensor, auth.Subscribe, "devices/sensor-1/secrets", false},
+		{sensor, auth.Subscribe, "devices/sensor-1/+", false},
+		{sensor, auth.Subscribe, "devices/sensor-1/telemetry/+", true},
+		{sensor, auth.Subscribe, "devices/sensor-1/telemetry", true},
+		{sensor, auth.Subscribe, "devices/#", false},
+		{sensor, auth.Subscribe, "users/line-1/+", true},
+		{sensor, auth.Subscribe, "users/line-1/#", false},
+		{sensor, auth.Subscribe, "$SYS/broker/uptime", false},
+		{ops, auth.Subscribe, "$SYS/#", true},
+		{ops, auth.Publish, "$SYS/broker/uptime", false},
+		// 含通配符的客户端ID不能借 %c 越权
+		{&auth.Client{ID: "+"}, auth.Publish, "devices/sensor-1/telemetry", false},
+	}
+	for _, c := range cases {
+		if got := acl.Authorize(c.client, c.access, c.topic); got != c.want {
+			t.Errorf("%s %s %s: got %v, want %v", c.client.ID, c.access, c.topic, got, c.want)
+		}
+	}
+}
+
+func writeAuthFile(t *testing.T) string {
+	// 最低强度以免拖慢测试, 强度保存在摘要中
+	password, err := auth.HashSecretWithCost("secret", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.HashSecretWithCost("tok-123", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(auth.FileConfig{
+		Users:  []auth.FileUser{{Username: "line-1", Password: password, ClientIDs: []string{"sensor-1"}}},
+		Tokens: []auth.FileToken{{ClientID: "sensor-2", Token: token}},
+		ACL:    auth.DefaultDeviceRules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	store, err := auth.LoadFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	authn := auth.Chain{auth.CertificateAuthenticator{}, store}
+	ctx := context.Background()
+
+	// 只有密码和证书验证过的身份作为用户名, 令牌认证时 CONNECT 中的用户名不被采用
+	cases := []struct {
+		creds    auth.Credentials
+		method   auth.Method
+		username string
+		code     mqtt.ConnackCode
+	}{
+		{auth.Credentials{ClientID: "sensor-1", Username: "line-1", Password: []byte("secret")}, auth.MethodPassword, "line-1", mqtt.ConnectionAccepted},
+		{auth.Credentials{ClientID: "sensor-1", Username: "line-1", Password: []byte("wrong")}, "", "", mqtt.RefusedBadCredentials},
+		{auth.Credentials{ClientID: "sensor-9", Username: "line-1", Password: []byte("secret")}, "", "", mqtt.RefusedNotAuthorized},
+		{auth.Credentials{ClientID: "sensor-2", Password: []byte("tok-123")}, auth.MethodToken, "", mqtt.ConnectionAccepted},
+		{auth.Credentials{ClientID: "sensor-2", Username: "ops", Password: []byte("tok-123")}, auth.MethodToken, "", mqtt.ConnectionAccepted},
+		{auth.Credentials{ClientID: "sensor-1", Password: []byte("tok-123")}, "", "", mqtt.RefusedBadCredentials},
+		{auth.Credentials{ClientID: "sensor-3", Certificates: []string{"sensor-3"}}, auth.MethodCertificate, "sensor-3", mqtt.ConnectionAccepted},
+		{auth.Credentials{ClientID: "sensor-3", Username: "ops", Certificates: []string{"sensor-3"}}, auth.MethodCertificate, "sensor-3", mqtt.ConnectionAccepted},
+		{auth.Credentials{ClientID: "sensor-3"}, "", "", mqtt.RefusedNotAuthorized},
+	}
+	for i, c := range cases {
+		client, err := authn.Authenticate(ctx, &c.creds)
+		if c.code == mqtt.ConnectionAccepted {
+			if err != nil || client.Method != c.method || client.Username != c.username {
+				t.Errorf("case %d: expected %s authentication as %q, got %+v %v", i, c.method, c.username, client, err)
+			}
+			continue
+		}
+		if err == nil || auth.ConnackCode(err) != c.code {
+			t.Errorf("case %d: expected CONNACK %d, got %v", i, c.code, err)
+		}
+	}
+
+	if !store.Authorize(&auth.Client{ID: "sensor-1"}, auth.Publish, "devices/sensor-1/telemetry") ||
+		store.Authorize(&auth.Client{ID: "sensor-1"}, auth.Publish, "devices/sensor-2/telemetry") {
+		t.Error("file ACL not applied")
+	}
+	if auth.ConnackCode(errors.New("db down")) != mqtt.RefusedServerUnavailable {
+		t.Error("backend errors should map to server unavailable")
+	}
+}
+
+func TestHashSecret(t *testing.T) {
+	hash, err := auth.HashSecret("secret")
+	if err != nil {
+		t.Fatalf("hash failed: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$2") || auth.NeedsRehash(hash) {
+		t.Errorf("expected bcrypt hash, got %q", hash)
+	}
+	if !auth.VerifySecret(hash, []byte("secret")) || auth.VerifySecret(hash, []byte("wrong")) {
+		t.Error("bcrypt hash not verified")
+	}
+	if _, err := auth.HashSecret(strings.Repeat("x", 73)); !errors.Is(err, auth.ErrSecretTooLong) {
+		t.Errorf("expected ErrSecretTooLong, got %v", err)
+	}
+
+	// 旧版摘要仍然接受, 并提示重新生成
+	salt := []byte("0123456789abcdef")
+	sum := sha256.Sum256(append(append([]byte(nil), salt...), "secret"...))
+	legacy := "sha256$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(sum[:])
+	if !auth.NeedsRehash(legacy) {
+		t.Error("sha256 hash should need rehash")
+	}
+	if !auth.VerifySecret(legacy, []byte("secret")) || auth.VerifySecret(legacy, []byte("wrong")) {
+		t.Error("legacy hash not verified")
+	}
+}
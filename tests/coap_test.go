@@ -0,0 +1,362 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/coap"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func TestCoAPMessageEncoding(t *testing.T) {
+	m := &coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.POST,
+		MessageID: 0x1234,
+		Token:     []byte{1, 2, 3, 4},
+		Payload:   []byte("21.5"),
+	}
+	m.SetPath("/sensors/temp")
+	m.AddQuery("ep", "sensor-1")
+	m.SetUint(coap.ContentFormat, coap.AppJSON)
+	m.SetBlock(coap.Block1, coap.Block{Num: 3, More: true, SZX: 2})
+	m.SetUint(coap.Size1, 1<<16)                                   // 增量超过13
+	m.AddOption(coap.OptionID(2000), bytes.Repeat([]byte{7}, 300)) // 增量和长度超过269
+
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	got, err := coap.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if got.Type != m.Type || got.Code != m.Code || got.MessageID != m.MessageID || !bytes.Equal(got.Token, m.Token) || string(got.Payload) != "21.5" {
+		t.Errorf("header mismatch: %v", got)
+	}
+	if got.Path() != "sensors/temp" || got.Query("ep") != "sensor-1" {
+		t.Errorf("unexpected path %q query %q", got.Path(), got.Query("ep"))
+	}
+	if format, _ := got.Uint(coap.ContentFormat); format != coap.AppJSON {
+		t.Errorf("unexpected content format %d", format)
+	}
+	if b, ok := got.Block(coap.Block1); !ok || b.Num != 3 || !b.More || b.Size() != 64 {
+		t.Errorf("unexpected block %+v", b)
+	}
+	if size, _ := got.Uint(coap.Size1); size != 1<<16 {
+		t.Errorf("unexpected size %d", size)
+	}
+	if value, _ := got.Option(coap.OptionID(2000)); len(value) != 300 {
+		t.Errorf("unexpected long option length %d", len(value))
+	}
+	if coap.Content.String() != "2.05" || coap.NotFound.String() != "4.04" {
+		t.Errorf("unexpected code strings %v %v", coap.Content, coap.NotFound)
+	}
+
+	for _, data := range [][]byte{
+		{0x40, 0x01},                   // 过短
+		{0x80, 0x01, 0, 1},             // 版本2
+		{0x49, 0x01, 0, 1},             // 令牌长度9
+		{0x40, 0x01, 0, 1, 0xff},       // 标记后没有负载
+		{0x40, 0x01, 0, 1, 0xf1, 0x00}, // 保留的增量15
+		{0x41, 0x00, 0, 1, 0xaa},       // 带令牌的空消息
+	} {
+		if _, err := coap.Unmarshal(data); err == nil {
+			t.Errorf("expected % x to be rejected", data)
+		}
+	}
+}
+
+func coapTestConfig() coap.Config {
+	config := coap.DefaultConfig
+	config.AckTimeout = 50 * time.Millisecond
+	return config
+}
+
+// 接受连接并以 handler 处理请求的CoAP服务端
+func serveCoAP(t *testing.T, config coap.Config, handler coap.Handler) string {
+	server, err := coap.Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conn.Handle(handler)
+			go conn.Serve()
+		}
+	}()
+	return server.Addr().String()
+}
+
+func TestCoAPBlockwiseTransfer(t *testing.T) {
+	upload := bytes.Repeat([]byte("0123456789"), 100)
+	download := bytes.Repeat([]byte("abcdefghij"), 50)
+	var received atomic.Value
+
+	config := coapTestConfig()
+	config.BlockSize = 128
+	addr := serveCoAP(t, config, func(c *coap.Conn, req *coap.Message) *coap.Message {
+		received.Store(req.Payload)
+		return &coap.Message{Code: coap.Changed, Payload: download}
+	})
+
+	clientConfig := coapTestConfig()
+	clientConfig.BlockSize = 64
+	client, err := coap.Dial(addr, clientConfig)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := &coap.Message{Code: coap.POST, Payload: upload}
+	req.SetPath("firmware")
+	resp, err := client.Do(ctx, req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.Code != coap.Changed || !bytes.Equal(resp.Payload, download) {
+		t.Errorf("unexpected response %v with %d bytes", resp, len(resp.Payload))
+	}
+	if got, _ := received.Load().([]byte); !bytes.Equal(got, upload) {
+		t.Errorf("server received %d bytes, want %d", len(got), len(upload))
+	}
+}
+
+func TestCoAPRetransmissionAndDeduplication(t *testing.T) {
+	var calls atomic.Int32
+	addr := serveCoAP(t, coapTestConfig(), func(c *coap.Conn, req *coap.Message) *coap.Message {
+		calls.Add(1)
+		return &coap.Message{Code: coap.Content, Payload: []byte("ok")}
+	})
+
+	// 重复的CON请求只处理一次, 两次都收到相同的响应
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	req := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 42, Token: []byte{9}}
+	data, _ := req.Marshal()
+	buf := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		conn.Write(data)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no response: %v", err)
+		}
+		resp, err := coap.Unmarshal(buf[:n])
+		if err != nil || resp.Type != coap.Acknowledgement || resp.MessageID != 42 || string(resp.Payload) != "ok" {
+			t.Fatalf("unexpected response %v: %v", resp, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times", n)
+	}
+
+	// 对端丢弃第一次发送, 客户端超时后以相同的消息ID重传
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		var first *coap.Message
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, err := coap.Unmarshal(buf[:n])
+			if err != nil {
+				continue
+			}
+			if first == nil {
+				first = m
+				continue
+			}
+			if m.MessageID != first.MessageID {
+				return
+			}
+			ack := &coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: m.MessageID, Token: m.Token, Payload: []byte("late")}
+			data, _ := ack.Marshal()
+			pc.WriteTo(data, from)
+		}
+	}()
+
+	client, err := coap.Dial(pc.LocalAddr().String(), coapTestConfig())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.Do(ctx, &coap.Message{Code: coap.GET})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if string(resp.Payload) != "late" {
+		t.Errorf("unexpected payload %q", resp.Payload)
+	}
+}
+
+func TestCoAPGateway(t *testing.T) {
+	sm := newTestGateway(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "coap", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	subscriber, received := pipeClient(t, sm, "dashboard")
+	if _, err := subscriber.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/+/telemetry", QoS: 1}, {Filter: "alarms/#"}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	device, err := coap.Dial(listener.Addr().String(), coapTestConfig())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer device.Close()
+	reqCtx, reqCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer reqCancel()
+
+	// 未声明设备ID的请求被拒绝
+	anonymous, err := coap.Dial(listener.Addr().String(), coapTestConfig())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer anonymous.Close()
+	req := &coap.Message{Code: coap.POST, Payload: []byte("1")}
+	req.SetPath("telemetry")
+	if resp, err := anonymous.Do(reqCtx, req); err != nil || resp.Code != coap.Unauthorized {
+		t.Errorf("expected 4.01 without endpoint name, got %v: %v", resp, err)
+	}
+
+	// POST 作为遥测发布, 其它路径作为主题
+	post := func(path string, payload []byte) {
+		t.Helper()
+		req := &coap.Message{Code: coap.POST, Payload: payload}
+		req.SetPath(path)
+		req.AddQuery(coap.EndpointQuery, "sensor-1")
+		resp, err := device.Do(reqCtx, req)
+		if err != nil || resp.Code != coap.Changed {
+			t.Fatalf("POST %s failed: %v %v", path, resp, err)
+		}
+	}
+	post("telemetry", []byte("21.5"))
+	expectPublish(t, received, "devices/sensor-1/telemetry", "21.5")
+	post("alarms/overheat", []byte("1"))
+	expectPublish(t, received, "alarms/overheat", "1")
+
+	large := strings.Repeat("x", 3000)
+	post("telemetry", []byte(large))
+	expectPublish(t, received, "devices/sensor-1/telemetry", large)
+
+	// 设备观察命令资源, 命令以通知下发
+	commands := make(chan string, 4)
+	observe := &coap.Message{}
+	observe.SetPath("commands")
+	obs, err := device.Observe(reqCtx, observe, func(m *coap.Message) {
+		if len(m.Payload) > 0 {
+			commands <- string(m.Payload)
+		}
+	})
+	if err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+	for _, cmd := range []string{"reboot", "calibrate"} {
+		if err := sm.SendCommand("sensor-1", []byte(cmd)); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+		select {
+		case got := <-commands:
+			if got != cmd {
+				t.Errorf("expected %q, got %q", cmd, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification for %q", cmd)
+		}
+	}
+
+	// 取消观察后命令改为POST到设备
+	obs.Cancel()
+	device.Handle(func(c *coap.Conn, req *coap.Message) *coap.Message {
+		if req.Code != coap.POST || req.Path() != "commands" {
+			return &coap.Message{Code: coap.NotFound}
+		}
+		commands <- string(req.Payload)
+		return &coap.Message{Code: coap.Changed}
+	})
+	if err := sm.SendCommand("sensor-1", []byte("shutdown")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	select {
+	case got := <-commands:
+		if got != "shutdown" {
+			t.Errorf("expected shutdown, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no POST for shutdown")
+	}
+}
+
+// 配置了认证器时, 第一个请求必须携带有效的令牌
+func TestCoAPGatewayAuthentication(t *testing.T) {
+	sm := newTestGateway(t)
+	store, err := auth.LoadFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	sm.SetAuthenticator(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "coap", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	post := func(token string) coap.Code {
+		t.Helper()
+		device, err := coap.Dial(listener.Addr().String(), coapTestConfig())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer device.Close()
+		req := &coap.Message{Code: coap.POST, Payload: []byte("1")}
+		req.SetPath("telemetry")
+		req.AddQuery(coap.EndpointQuery, "sensor-2")
+		if token != "" {
+			req.AddQuery(coap.TokenQuery, token)
+		}
+		resp, err := device.Do(ctx, req)
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		return resp.Code
+	}
+	if code := post(""); code != coap.Unauthorized {
+		t.Errorf("expected 4.01 without token, got %v", code)
+	}
+	if code := post("wrong"); code != coap.Unauthorized {
+		t.Errorf("expected 4.01 with wrong token, got %v", code)
+	}
+	if code := post("tok-123"); code != coap.Changed {
+		t.Errorf("expected 2.04 with valid token, got %v", code)
+	}
+}
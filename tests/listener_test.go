@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func TestLoadListenersConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listeners.json")
+	data := `{"listeners": [
+		{"protocol": "mqtt", "address": ":1883", "max_connections": 100},
+		{"name": "secure", "protocol": "mqtt", "address": ":8883", "tls": {"cert_file": "server.pem", "key_file": "server.key"}},
+		{"protocol": "mqtt-ws", "address": ":8083", "options": {"path": "/ws"}}
+	]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	configs, err := gateway.LoadListenersConfig(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if len(configs) != 3 {
+		t.Fatalf("expected 3 listeners, got %d", len(configs))
+	}
+	if configs[0].MaxConnections != 100 || configs[0].String() != "mqtt://:1883" {
+		t.Errorf("unexpected listener %+v", configs[0])
+	}
+	if configs[1].TLS == nil || configs[1].TLS.CertFile != "server.pem" || configs[1].String() != "secure" {
+		t.Errorf("unexpected TLS listener %+v", configs[1])
+	}
+	var options struct{ Path string }
+	if err := configs[2].DecodeOptions(&options); err != nil || options.Path != "/ws" {
+		t.Errorf("unexpected options %q: %v", options.Path, err)
+	}
+}
+
+func TestStartListener(t *testing.T) {
+	sm := newTestGateway(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "carrier-pigeon"}); !errors.Is(err, gateway.ErrUnknownProtocol) {
+		t.Errorf("expected unknown protocol error, got %v", err)
+	}
+
+	options, _ := json.Marshal(map[string]string{"command_topic": "cmd/%c"})
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{
+		Protocol:       "mqtt",
+		Address:        "127.0.0.1:0",
+		MaxConnections: 1,
+		Options:        options,
+	})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	addr := listener.Addr().String()
+
+	dialCtx, dialCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer dialCancel()
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "sensor-1"
+	client, err := mqtt.Dial(dialCtx, addr, opts)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer client.Close()
+
+	// 超过连接数上限的连接被直接关闭
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected connection over the limit to be closed, got %v", err)
+	}
+
+	// 连接断开后释放名额
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		opts.ClientID = "sensor-2"
+		second, err := mqtt.Dial(dialCtx, addr, opts)
+		if err == nil {
+			second.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connect after release failed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// ctx 取消后停止监听
+	cancel()
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still accepting after cancel")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 5.0 客户端ID为空时由网关分配并在CONNACK中返回
+func TestMQTTListenerAssignsClientID(t *testing.T) {
+	sm := newTestGateway(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "mqtt", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	connect, err := mqtt.AppendPacket(nil, &mqtt.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: mqtt.ProtocolLevel5,
+		CleanSession:  true,
+		KeepAlive:     60,
+	}, mqtt.ProtocolLevel5)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if _, err := conn.Write(connect); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	packet, err := mqtt.ReadPacketVersion(conn, 0, mqtt.ProtocolLevel5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	connack, ok := packet.(*mqtt.ConnAckPacket)
+	if !ok || connack.ReasonCode != mqtt.Success || connack.Properties == nil {
+		t.Fatalf("unexpected CONNACK %+v", packet)
+	}
+	id := connack.Properties.AssignedClientID
+	if !strings.HasPrefix(id, "auto-") {
+		t.Fatalf("expected assigned client ID, got %q", id)
+	}
+	// 会话以分配的ID注册, 命令发往该ID的命令主题
+	if err := sm.SendCommandQoS(id, []byte("reboot"), 0); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	packet, err = mqtt.ReadPacketVersion(conn, 0, mqtt.ProtocolLevel5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if p, ok := packet.(*mqtt.PublishPacket); !ok || p.Topic != "devices/"+id+"/commands" {
+		t.Errorf("unexpected command %+v", packet)
+	}
+}
@@ -0,0 +1,454 @@
+package tests
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/coap"
+	"edgesphere/internal/protocol/lwm2m"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func formatResources(resources []lwm2m.Resource) string {
+	parts := make([]string, len(resources))
+	for i, r := range resources {
+		parts[i] = fmt.Sprintf("%s=%v", r.Path, r.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestLwM2MTLV(t *testing.T) {
+	// 规范中读取 /3/0 的示例
+	data, _ := hex.DecodeString("" +
+		"c800144f70656e204d6f62696c6520416c6c69616e6365" +
+		"c801164c69676874776569676874204d324d20436c69656e74" +
+		"c80209333435303030313233" +
+		"c303312e30" +
+		"8606410001410105" +
+		"88070842000ed842011388" +
+		"870841007d42010384" +
+		"c10964" +
+		"c10a0f" +
+		"830b410000" +
+		"c40d5182428f" +
+		"c60e2b30323a3030" +
+		"c11055")
+	base, _ := lwm2m.ParsePath("/3/0")
+	resources, err := lwm2m.DefaultModel.DecodeTLV(base, data)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	want := "/3/0/0=Open Mobile Alliance /3/0/1=Lightweight M2M Client /3/0/2=345000123 /3/0/3=1.0 " +
+		"/3/0/6/0=1 /3/0/6/1=5 /3/0/7/0=3800 /3/0/7/1=5000 /3/0/8/0=125 /3/0/8/1=900 " +
+		"/3/0/9=100 /3/0/10=15 /3/0/11/0=0 /3/0/13=1367491215 /3/0/14=+02:00 /3/0/16=U"
+	if got := formatResources(resources); got != want {
+		t.Errorf("unexpected resources:\n got %s\nwant %s", got, want)
+	}
+
+	encoded, err := lwm2m.DefaultModel.EncodeTLV(base, resources)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if hex.EncodeToString(encoded) != hex.EncodeToString(data) {
+		t.Errorf("round trip mismatch:\n got %x\nwant %x", encoded, data)
+	}
+
+	// 对象实例包装和16位标识符, 浮点数为4字节
+	data, _ = hex.DecodeString("08000d" + "e4164441ac0000" + "e3164543656c")
+	resources, err = lwm2m.DefaultModel.DecodeTLV(lwm2m.Path{3303}, data)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got := formatResources(resources); got != "/3303/0/5700=21.5 /3303/0/5701=Cel" {
+		t.Errorf("unexpected resources %s", got)
+	}
+
+	// 长度超出数据, 整数长度错误
+	for _, bad := range []string{"c8", "c805616263", "c20a00", "c309010203"} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := lwm2m.DefaultModel.DecodeTLV(base, data); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestLwM2MSenML(t *testing.T) {
+	data := `[{"bn":"/3303/0/","n":"5700","v":21.5},{"n":"5701","vs":"Cel"},{"n":"5850","vb":true},` +
+		`{"bn":"/3/0/","n":"9","v":87},{"n":"6/0","v":1},{"n":"4"}]`
+	resources, err := lwm2m.DefaultModel.DecodeSenML([]byte(data))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	want := "/3303/0/5700=21.5 /3303/0/5701=Cel /3303/0/5850=true /3/0/9=87 /3/0/6/0=1"
+	if got := formatResources(resources); got != want {
+		t.Errorf("unexpected resources:\n got %s\nwant %s", got, want)
+	}
+	if _, ok := resources[3].Value.(int64); !ok {
+		t.Errorf("integer resource decoded as %T", resources[3].Value)
+	}
+
+	encoded, err := lwm2m.DefaultModel.EncodeSenML(lwm2m.Path{3303, 0}, resources[:3])
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if want := `[{"bn":"/3303/0","n":"/5700","v":21.5},{"n":"/5701","vs":"Cel"},{"n":"/5850","vb":true}]`; string(encoded) != want {
+		t.Errorf("unexpected encoding %s", encoded)
+	}
+	if _, err := lwm2m.DefaultModel.EncodeSenML(lwm2m.Path{1, 0}, resources[:1]); err == nil {
+		t.Error("expected resource outside base path to be rejected")
+	}
+	for _, bad := range []string{`{}`, `[{"n":"/3/x","v":1}]`, `[{"n":"/1/0/9","vd":"!"}]`} {
+		if _, err := lwm2m.DefaultModel.DecodeSenML([]byte(bad)); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+// 记录注册和状态变化的设备注册表
+type fakeRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*types.Device
+	events  chan string
+	block   chan struct{} // 非nil时登记阻塞到关闭, 模拟缓慢的数据库
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{devices: make(map[string]*types.Device), events: make(chan string, 16)}
+}
+
+func (r *fakeRegistry) RegisterDevice(ctx context.Context, device *types.Device) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.devices[device.ID]; ok {
+		return types.ErrDeviceExists
+	}
+	r.devices[device.ID] = device
+	r.events <- device.ID + " registered"
+	return nil
+}
+
+func (r *fakeRegistry) UpdateStatus(deviceID string, status types.DeviceStatus) {
+	state := "offline"
+	if status == types.Online {
+		state = "online"
+	}
+	r.events <- deviceID + " " + state
+}
+
+func (r *fakeRegistry) device(id string) *types.Device {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.devices[id]
+}
+
+func expectEvent(t *testing.T, events chan string, want string, timeout time.Duration) {
+	t.Helper()
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("expected event %q, got %q", want, got)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no event %q", want)
+	}
+}
+
+// 模拟的LwM2M设备: 记录收到的请求, 按路径返回SenML资源
+type fakeLwM2MDevice struct {
+	conn     *coap.Conn
+	requests chan *coap.Message
+
+	mu       sync.Mutex
+	observer []byte
+}
+
+func dialLwM2MDevice(t *testing.T, addr string) *fakeLwM2MDevice {
+	conn, err := coap.Dial(addr, coapTestConfig())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &fakeLwM2MDevice{conn: conn, requests: make(chan *coap.Message, 16)}
+	conn.Handle(d.handle)
+	return d
+}
+
+func (d *fakeLwM2MDevice) handle(c *coap.Conn, req *coap.Message) *coap.Message {
+	d.requests <- req
+	resp := &coap.Message{Code: coap.Changed}
+	switch {
+	case req.Code == coap.GET && req.Path() == "3/0":
+		resp = &coap.Message{Code: coap.Content, Payload: []byte(`[{"bn":"/3/0/","n":"0","vs":"Acme"},{"n":"9","v":87}]`)}
+	case req.Code == coap.GET && req.Path() == "3303/0/5700":
+		resp = &coap.Message{Code: coap.Content, Payload: []byte(`[{"n":"/3303/0/5700","v":21.5}]`)}
+		if observe, ok := req.Uint(coap.Observe); ok && observe == 0 {
+			d.mu.Lock()
+			d.observer = req.Token
+			d.mu.Unlock()
+			resp.SetUint(coap.Observe, 1)
+		}
+	case req.Code == coap.GET:
+		return &coap.Message{Code: coap.NotFound}
+	}
+	if len(resp.Payload) > 0 {
+		resp.SetUint(coap.ContentFormat, lwm2m.FormatSenMLJSON)
+	}
+	return resp
+}
+
+func (d *fakeLwM2MDevice) register(t *testing.T, ctx context.Context, query ...string) string {
+	t.Helper()
+	req := &coap.Message{Code: coap.POST, Payload: []byte(`</>;rt="oma.lwm2m";ct=110,</1/0>,</3/0>,</3303/0>`)}
+	req.SetPath("rd")
+	for i := 0; i+1 < len(query); i += 2 {
+		req.AddQuery(query[i], query[i+1])
+	}
+	req.SetUint(coap.ContentFormat, lwm2m.FormatLinks)
+	resp, err := d.conn.Do(ctx, req)
+	if err != nil || resp.Code != coap.Created || !strings.HasPrefix(resp.LocationPath(), "rd/") {
+		t.Fatalf("registration failed: %v %v", resp, err)
+	}
+	return resp.LocationPath()
+}
+
+func (d *fakeLwM2MDevice) request(ctx context.Context, code coap.Code, path string, query ...string) coap.Code {
+	req := &coap.Message{Code: code}
+	req.SetPath(path)
+	for i := 0; i+1 < len(query); i += 2 {
+		req.AddQuery(query[i], query[i+1])
+	}
+	resp, err := d.conn.Do(ctx, req)
+	if err != nil {
+		return 0
+	}
+	return resp.Code
+}
+
+func (d *fakeLwM2MDevice) expectRequest(t *testing.T, code coap.Code, path string) *coap.Message {
+	t.Helper()
+	select {
+	case req := <-d.requests:
+		if req.Code != code || req.Path() != path {
+			t.Fatalf("expected %v %s, got %v %s", code, path, req.Code, req.Path())
+		}
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %v %s request", code, path)
+	}
+	return nil
+}
+
+func TestLwM2MGateway(t *testing.T) {
+	sm := newTestGateway(t)
+	registry := newFakeRegistry()
+	sm.SetDeviceRegistry(registry)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "lwm2m", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	subscriber, received := pipeClient(t, sm, "dashboard")
+	if _, err := subscriber.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/+/telemetry", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	reqCtx, reqCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer reqCancel()
+
+	// 注册时登记设备, 元数据来自注册参数
+	device := dialLwM2MDevice(t, listener.Addr().String())
+	location := device.register(t, reqCtx, "ep", "meter-1", "lt", "60", "lwm2m", "1.1", "b", "U")
+	expectEvent(t, registry.events, "meter-1 registered", 5*time.Second)
+	registered := registry.device("meter-1")
+	if registered.Status != types.Online || registered.Type != "lwm2m" || registered.Metadata["objects"] != "/1/0,/3/0,/3303/0" ||
+		registered.Metadata["lifetime"] != "60" || registered.Metadata["lwm2m_version"] != "1.1" {
+		t.Errorf("unexpected device %+v", registered)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sm.Stats().ClientsConnected < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 读取结果作为遥测发布
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"read","path":"/3/0"}`)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	req := device.expectRequest(t, coap.GET, "3/0")
+	if accept, _ := req.Uint(coap.Accept); accept != lwm2m.FormatSenMLJSON {
+		t.Errorf("unexpected accept %d", accept)
+	}
+	expectPublish(t, received, "devices/meter-1/telemetry", `{"/3/0/0":"Acme","/3/0/9":87}`)
+
+	// 写资源用PUT, 写对象实例用POST
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"write","path":"/1/0/1","value":300}`)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	req = device.expectRequest(t, coap.PUT, "1/0/1")
+	if string(req.Payload) != `[{"bn":"/1/0/1","v":300}]` {
+		t.Errorf("unexpected write payload %s", req.Payload)
+	}
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"write","path":"/1/0","value":{"1":120,"6":true}}`)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	req = device.expectRequest(t, coap.POST, "1/0")
+	if string(req.Payload) != `[{"bn":"/1/0","n":"/1","v":120},{"n":"/6","vb":true}]` {
+		t.Errorf("unexpected write payload %s", req.Payload)
+	}
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"write","path":"/1/0/1","value":"soon"}`)); err == nil {
+		t.Error("expected string value for integer resource to be rejected")
+	}
+
+	// 执行
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"execute","path":"/3/0/4","args":"0='now'"}`)); err != nil {
+		t.Fatalf("execute failed: %v", err)
+	}
+	if req := device.expectRequest(t, coap.POST, "3/0/4"); string(req.Payload) != "0='now'" {
+		t.Errorf("unexpected execute arguments %q", req.Payload)
+	}
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"read","path":"/9/0"}`)); err == nil {
+		t.Error("expected read of missing object to fail")
+	}
+	device.expectRequest(t, coap.GET, "9/0")
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"delete","path":"/3/0"}`)); err == nil {
+		t.Error("expected unknown operation to be rejected")
+	}
+
+	// 观察: 首个响应和之后的通知都作为遥测发布
+	if err := sm.SendCommand("meter-1", []byte(`{"op":"observe","path":"/3303/0/5700"}`)); err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+	device.expectRequest(t, coap.GET, "3303/0/5700")
+	expectPublish(t, received, "devices/meter-1/telemetry", `{"/3303/0/5700":21.5}`)
+	device.mu.Lock()
+	token := device.observer
+	device.mu.Unlock()
+	notification := &coap.Message{Type: coap.Confirmable, Code: coap.Content, Token: token, Payload: []byte(`[{"n":"/3303/0/5700","v":22.5}]`)}
+	notification.SetUint(coap.Observe, 2)
+	notification.SetUint(coap.ContentFormat, lwm2m.FormatSenMLJSON)
+	if err := device.conn.WriteMessage(reqCtx, notification); err != nil {
+		t.Fatalf("notification failed: %v", err)
+	}
+	expectPublish(t, received, "devices/meter-1/telemetry", `{"/3303/0/5700":22.5}`)
+
+	// 注册更新, 未知的注册ID回复 4.04
+	if code := device.request(reqCtx, coap.POST, location, "lt", "120"); code != coap.Changed {
+		t.Errorf("update failed: %v", code)
+	}
+	if code := device.request(reqCtx, coap.POST, "rd/unknown"); code != coap.NotFound {
+		t.Errorf("expected 4.04 for unknown registration, got %v", code)
+	}
+
+	// 注销后离线, 再次注册时更新为在线
+	if code := device.request(reqCtx, coap.DELETE, location); code != coap.Deleted {
+		t.Errorf("deregistration failed: %v", code)
+	}
+	expectEvent(t, registry.events, "meter-1 offline", 5*time.Second)
+	if code := device.request(reqCtx, coap.POST, location); code != coap.NotFound {
+		t.Errorf("expected 4.04 after deregistration, got %v", code)
+	}
+	device.register(t, reqCtx, "ep", "meter-1", "lwm2m", "1.1")
+	expectEvent(t, registry.events, "meter-1 online", 5*time.Second)
+}
+
+func TestLwM2MLifetimeExpiry(t *testing.T) {
+	sm := newTestGateway(t)
+	registry := newFakeRegistry()
+	sm.SetDeviceRegistry(registry)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "lwm2m", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	reqCtx, reqCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer reqCancel()
+
+	// 有效期内的更新保持在线, 之后没有更新时注册过期
+	device := dialLwM2MDevice(t, listener.Addr().String())
+	location := device.register(t, reqCtx, "ep", "meter-2", "lt", "1")
+	expectEvent(t, registry.events, "meter-2 registered", 5*time.Second)
+	for i := 0; i < 3; i++ {
+		time.Sleep(700 * time.Millisecond)
+		if code := device.request(reqCtx, coap.POST, location); code != coap.Changed {
+			t.Fatalf("update failed: %v", code)
+		}
+	}
+	select {
+	case event := <-registry.events:
+		t.Fatalf("unexpected event %q while updating", event)
+	default:
+	}
+	expectEvent(t, registry.events, "meter-2 offline", 5*time.Second)
+	if code := device.request(reqCtx, coap.POST, location); code != coap.NotFound {
+		t.Errorf("expected 4.04 after expiry, got %v", code)
+	}
+}
+
+func TestLwM2MRegistrationWithSlowRegistry(t *testing.T) {
+	sm := newTestGateway(t)
+	registry := newFakeRegistry()
+	registry.block = make(chan struct{})
+	sm.SetDeviceRegistry(registry)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "lwm2m", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	// 注册表阻塞时注册请求仍立即完成, 登记在注册表恢复后进行
+	reqCtx, reqCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer reqCancel()
+	device := dialLwM2MDevice(t, listener.Addr().String())
+	device.register(t, reqCtx, "ep", "meter-3")
+	close(registry.block)
+	expectEvent(t, registry.events, "meter-3 registered", 5*time.Second)
+}
+
+func TestLwM2MRegistrationAuthentication(t *testing.T) {
+	sm := newTestGateway(t)
+	store, err := auth.LoadFile(writeAuthFile(t))
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	sm.SetAuthenticator(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	listener, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "lwm2m", Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	device := dialLwM2MDevice(t, listener.Addr().String())
+	location := device.register(t, ctx, "ep", "sensor-2", "lt", "60", coap.TokenQuery, "tok-123")
+
+	// 令牌缺失或错误的注册被拒绝, 不接管已注册的设备
+	for _, token := range []string{"", "wrong"} {
+		attacker := dialLwM2MDevice(t, listener.Addr().String())
+		query := []string{"ep", "sensor-2"}
+		if token != "" {
+			query = append(query, coap.TokenQuery, token)
+		}
+		if code := attacker.request(ctx, coap.POST, "rd", query...); code != coap.Unauthorized {
+			t.Errorf("token %q: expected 4.01, got %v", token, code)
+		}
+	}
+	if code := device.request(ctx, coap.POST, location); code != coap.Changed {
+		t.Errorf("expected registration to survive rejected attempts, update got %v", code)
+	}
+	if n := sm.Stats().ClientsConnected; n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
@@ -0,0 +1,385 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/modbus"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func serveModbus(t *testing.T) (*modbus.Server, string) {
+	server := modbus.NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return server, l.Addr().String()
+}
+
+func TestModbusClient(t *testing.T) {
+	server, addr := serveModbus(t)
+	server.SetHoldingRegisters(1, 100, 10, 20, 30)
+	server.SetInputRegisters(1, 0, 7)
+	server.SetCoils(1, 5, true, false, true)
+
+	client := modbus.NewClient(addr, modbus.DefaultClientConfig)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	regs, err := client.ReadHoldingRegisters(ctx, 1, 100, 3)
+	if err != nil || len(regs) != 3 || regs[0] != 10 || regs[2] != 30 {
+		t.Errorf("unexpected holding registers %v: %v", regs, err)
+	}
+	if regs, err := client.ReadInputRegisters(ctx, 1, 0, 1); err != nil || regs[0] != 7 {
+		t.Errorf("unexpected input registers %v: %v", regs, err)
+	}
+	coils, err := client.ReadCoils(ctx, 1, 5, 3)
+	if err != nil || !coils[0] || coils[1] || !coils[2] {
+		t.Errorf("unexpected coils %v: %v", coils, err)
+	}
+	// 其它单元ID的寄存器相互独立
+	if regs, err := client.ReadHoldingRegisters(ctx, 2, 100, 1); err != nil || regs[0] != 0 {
+		t.Errorf("unexpected unit 2 registers %v: %v", regs, err)
+	}
+
+	if err := client.WriteSingleRegister(ctx, 1, 200, 0xbeef); err != nil {
+		t.Fatalf("write register failed: %v", err)
+	}
+	if err := client.WriteMultipleRegisters(ctx, 1, 201, []uint16{1, 2}); err != nil {
+		t.Fatalf("write registers failed: %v", err)
+	}
+	if regs := server.HoldingRegisters(1, 200, 3); regs[0] != 0xbeef || regs[1] != 1 || regs[2] != 2 {
+		t.Errorf("unexpected written registers %v", regs)
+	}
+	if err := client.WriteSingleCoil(ctx, 1, 6, true); err != nil {
+		t.Fatalf("write coil failed: %v", err)
+	}
+	if err := client.WriteMultipleCoils(ctx, 1, 10, []bool{true, true, false, true}); err != nil {
+		t.Fatalf("write coils failed: %v", err)
+	}
+	if coils := server.Coils(1, 6, 1); !coils[0] {
+		t.Error("coil 6 not set")
+	}
+	if coils := server.Coils(1, 10, 4); !coils[0] || !coils[1] || coils[2] || !coils[3] {
+		t.Errorf("unexpected written coils %v", coils)
+	}
+
+	// 异常响应不影响连接
+	server.SetException(1, modbus.ServerDeviceBusy)
+	_, err = client.ReadHoldingRegisters(ctx, 1, 100, 1)
+	var exception *modbus.ExceptionError
+	if !errors.As(err, &exception) || exception.Code != modbus.ServerDeviceBusy || exception.Function != modbus.ReadHoldingRegisters {
+		t.Errorf("expected busy exception, got %v", err)
+	}
+	server.SetException(1, 0)
+	if _, err := client.ReadHoldingRegisters(ctx, 1, 100, 1); err != nil {
+		t.Errorf("read after exception failed: %v", err)
+	}
+	if _, err := client.ReadHoldingRegisters(ctx, 1, 0, 126); !errors.Is(err, modbus.ErrInvalidQuantity) {
+		t.Errorf("expected quantity error, got %v", err)
+	}
+}
+
+func TestModbusPollPlanValidation(t *testing.T) {
+	valid := modbus.DevicePlan{
+		ID:       "plc-1",
+		Address:  "127.0.0.1:502",
+		Interval: modbus.Duration(time.Second),
+		Ranges: []modbus.RegisterRange{{
+			Table: modbus.HoldingRegisters, Start: 0, Count: 4,
+			Points: []modbus.Point{{Name: "flow", Address: 2, Type: modbus.Float32, ByteOrder: modbus.WordSwap}},
+		}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid plan rejected: %v", err)
+	}
+
+	for name, modify := range map[string]func(d *modbus.DevicePlan){
+		"point outside range": func(d *modbus.DevicePlan) { d.Ranges[0].Points[0].Address = 3 },
+		"bool register":       func(d *modbus.DevicePlan) { d.Ranges[0].Points[0].Type = modbus.Bool },
+		"unknown type":        func(d *modbus.DevicePlan) { d.Ranges[0].Points[0].Type = "int24" },
+		"byte order":          func(d *modbus.DevicePlan) { d.Ranges[0].Points[0].ByteOrder = "BACD" },
+		"read-only writable": func(d *modbus.DevicePlan) {
+			d.Ranges[0].Table = modbus.InputRegisters
+			d.Ranges[0].Points[0].Writable = true
+		},
+		"range too large": func(d *modbus.DevicePlan) { d.Ranges[0].Count = 126 },
+		"no interval":     func(d *modbus.DevicePlan) { d.Interval = 0 },
+	} {
+		plan := valid
+		plan.Ranges = []modbus.RegisterRange{valid.Ranges[0]}
+		plan.Ranges[0].Points = append([]modbus.Point(nil), valid.Ranges[0].Points...)
+		modify(&plan)
+		if err := plan.Validate(); !errors.Is(err, modbus.ErrInvalidPlan) {
+			t.Errorf("%s: expected invalid plan, got %v", name, err)
+		}
+	}
+
+	var plan modbus.PollPlan
+	data := `{"devices": [{"id": "plc-1", "address": "127.0.0.1:502", "interval": "250ms", "timeout": 2, "ranges": []}]}`
+	if err := json.Unmarshal([]byte(data), &plan); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if d := plan.Devices[0]; time.Duration(d.Interval) != 250*time.Millisecond || time.Duration(d.Timeout) != 2*time.Second {
+		t.Errorf("unexpected durations %v %v", d.Interval, d.Timeout)
+	}
+}
+
+func TestModbusGateway(t *testing.T) {
+	server, addr := serveModbus(t)
+	server.SetHoldingRegisters(1, 0, 43, 40, 0x0000, 0x4148) // 温度 43*0.5, 设定值 40*0.5, 流量 12.5 (CDAB)
+	server.SetCoils(1, 0, true)
+
+	sm := newTestGateway(t)
+	subscriber, received := pipeClient(t, sm, "dashboard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := subscriber.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/plc-1/telemetry", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	plan := modbus.PollPlan{Devices: []modbus.DevicePlan{{
+		ID:       "plc-1",
+		Address:  addr,
+		UnitID:   1,
+		Interval: modbus.Duration(50 * time.Millisecond),
+		Ranges: []modbus.RegisterRange{
+			{Table: modbus.HoldingRegisters, Start: 0, Count: 4, Points: []modbus.Point{
+				{Name: "temperature", Address: 0, Type: modbus.Int16, Scale: 0.5},
+				{Name: "setpoint", Address: 1, Type: modbus.Int16, Scale: 0.5, Writable: true},
+				{Name: "flow", Address: 2, Type: modbus.Float32, ByteOrder: modbus.WordSwap},
+			}},
+			{Table: modbus.Coils, Start: 0, Count: 1, Points: []modbus.Point{
+				{Name: "running", Address: 0, Writable: true},
+			}},
+		},
+	}}}
+	options, _ := json.Marshal(plan)
+	if _, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "modbus", Options: options}); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	expectPublish(t, received, "devices/plc-1/telemetry", `{"flow":12.5,"running":true,"setpoint":20,"temperature":21.5}`)
+
+	// 按测点写入, 按比例换算
+	if err := sm.SendCommand("plc-1", []byte(`{"point":"setpoint","value":22.5}`)); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if regs := server.HoldingRegisters(1, 1, 1); regs[0] != 45 {
+		t.Errorf("expected setpoint register 45, got %d", regs[0])
+	}
+	if err := sm.SendCommand("plc-1", []byte(`{"table":"coil","address":0,"value":false}`)); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if coils := server.Coils(1, 0, 1); coils[0] {
+		t.Error("coil not cleared")
+	}
+	if err := sm.SendCommand("plc-1", []byte(`{"point":"temperature","value":1}`)); !errors.Is(err, modbus.ErrNotWritable) {
+		t.Errorf("expected not writable error, got %v", err)
+	}
+}
+
+// 模拟串口服务器: 校验请求帧, 按脚本返回响应字节
+func fakeConverter(t *testing.T, exchanges [][2]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, exchange := range exchanges {
+			want, _ := hex.DecodeString(exchange[0])
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("unexpected request % x, want % x", got, want)
+				return
+			}
+			// 响应中的空格表示TCP分段之间的停顿
+			for _, segment := range strings.Fields(exchange[1]) {
+				data, _ := hex.DecodeString(segment)
+				conn.Write(data)
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		io.Copy(io.Discard, conn)
+	}()
+	return l.Addr().String()
+}
+
+func TestModbusRTUFraming(t *testing.T) {
+	addr := fakeConverter(t, [][2]string{
+		// 噪声字节后跟拆成两段的响应
+		{"010300000002c40b", "ff00 0103 04002a0100da6b"},
+		// CRC错误
+		{"010300000002c40b", "0103040000000000ffff"},
+		{"010300000002c40b", "010304002a0100da6b"},
+		// 异常响应
+		{"010600010003980b", "018602c3a1"},
+	})
+	client := modbus.NewRTUClient(addr, modbus.DefaultClientConfig)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	regs, err := client.ReadHoldingRegisters(ctx, 1, 0, 2)
+	if err != nil || regs[0] != 42 || regs[1] != 256 {
+		t.Fatalf("unexpected registers %v: %v", regs, err)
+	}
+	timeout, cancelTimeout := context.WithTimeout(ctx, 200*time.Millisecond)
+	_, err = client.ReadHoldingRegisters(timeout, 1, 0, 2)
+	cancelTimeout()
+	if !errors.Is(err, modbus.ErrChecksum) {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+	// 校验错误后连接仍然可用
+	if regs, err := client.ReadHoldingRegisters(ctx, 1, 0, 2); err != nil || regs[0] != 42 {
+		t.Fatalf("read after checksum error failed %v: %v", regs, err)
+	}
+	err = client.WriteSingleRegister(ctx, 1, 1, 3)
+	var exception *modbus.ExceptionError
+	if !errors.As(err, &exception) || exception.Code != modbus.IllegalDataAddress {
+		t.Errorf("expected illegal address exception, got %v", err)
+	}
+}
+
+func TestModbusRTUMultipleUnits(t *testing.T) {
+	server := modbus.NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.ServeRTU(l)
+	defer server.Close()
+	server.SetSplitResponses(5 * time.Millisecond)
+	for unit := byte(1); unit <= 3; unit++ {
+		server.SetHoldingRegisters(unit, 0, uint16(unit)*100)
+	}
+	server.SetOffline(3, true)
+
+	config := modbus.DefaultClientConfig
+	config.Timeout = 100 * time.Millisecond
+	client := modbus.NewRTUClient(l.Addr().String(), config)
+	defer client.Close()
+	ctx := context.Background()
+
+	// 多个单元并发请求, 在同一连接上串行发送
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		unit := byte(i%2 + 1)
+		go func() {
+			regs, err := client.ReadHoldingRegisters(ctx, unit, 0, 1)
+			if err == nil && regs[0] != uint16(unit)*100 {
+				err = fmt.Errorf("unit %d: unexpected register %d", unit, regs[0])
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// 离线的从站超时, 不影响总线上其它从站
+	if _, err := client.ReadHoldingRegisters(ctx, 3, 0, 1); err == nil {
+		t.Fatal("expected timeout from offline unit")
+	}
+	if err := client.WriteSingleRegister(ctx, 2, 5, 7); err != nil {
+		t.Fatalf("write after timeout failed: %v", err)
+	}
+	if regs := server.HoldingRegisters(2, 5, 1); regs[0] != 7 {
+		t.Errorf("expected register 7, got %d", regs[0])
+	}
+	if regs := server.HoldingRegisters(1, 5, 1); regs[0] != 0 {
+		t.Errorf("write leaked to unit 1: %d", regs[0])
+	}
+}
+
+func TestModbusRTUGateway(t *testing.T) {
+	server := modbus.NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.ServeRTU(l)
+	defer server.Close()
+	server.SetHoldingRegisters(1, 0, 11)
+	server.SetHoldingRegisters(2, 0, 22)
+	server.SetOffline(3, true)
+
+	sm := newTestGateway(t)
+	subscriber, received := pipeClient(t, sm, "dashboard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := subscriber.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/+/telemetry", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	// 从站共用一条总线, 离线从站的探测超时前其它请求要排队等待,
+	// 所以在线从站的超时要容得下一次离线探测和帧间隔
+	const offlineTimeout = 100 * time.Millisecond
+	const frameDelay = 10 * time.Millisecond
+	var plan modbus.PollPlan
+	for unit := byte(1); unit <= 3; unit++ {
+		timeout := 4 * (offlineTimeout + frameDelay)
+		if unit == 3 {
+			timeout = offlineTimeout
+		}
+		plan.Devices = append(plan.Devices, modbus.DevicePlan{
+			ID:         fmt.Sprintf("meter-%d", unit),
+			Address:    l.Addr().String(),
+			Framing:    modbus.FramingRTU,
+			UnitID:     unit,
+			Interval:   modbus.Duration(time.Hour),
+			Timeout:    modbus.Duration(timeout),
+			FrameDelay: modbus.Duration(frameDelay),
+			Ranges: []modbus.RegisterRange{{Table: modbus.HoldingRegisters, Start: 0, Count: 1, Points: []modbus.Point{
+				{Name: "value", Address: 0, Writable: true},
+			}}},
+		})
+	}
+	options, _ := json.Marshal(plan)
+	if _, err := sm.StartListener(ctx, gateway.ListenerConfig{Protocol: "modbus", Options: options}); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	payloads := make(map[string]string)
+	for len(payloads) < 2 {
+		select {
+		case p := <-received:
+			payloads[p.Topic] = string(p.Payload)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("missing telemetry, got %v", payloads)
+		}
+	}
+	if payloads["devices/meter-1/telemetry"] != `{"value":11}` || payloads["devices/meter-2/telemetry"] != `{"value":22}` {
+		t.Errorf("unexpected telemetry %v", payloads)
+	}
+	if err := sm.SendCommand("meter-2", []byte(`{"point":"value","value":99}`)); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if regs := server.HoldingRegisters(2, 0, 1); regs[0] != 99 {
+		t.Errorf("expected register 99, got %d", regs[0])
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func TestMQTT5ConnectRoundTrip(t *testing.T) {
+	expiry, receiveMax := uint32(3600), uint16(10)
+	var buf bytes.Buffer
+	err := mqtt.WritePacket(&buf, &mqtt.ConnectPacket{
+		ProtocolLevel: mqtt.ProtocolLevel5,
+		CleanSession:  true,
+		KeepAlive:     30,
+		ClientID:      "sensor-5",
+		Will: &mqtt.Will{
+			Topic:      "site/1/will",
+			Payload:    []byte("offline"),
+			QoS:        1,
+			Properties: &mqtt.Properties{WillDelay: 10, ContentType: "text/plain"},
+		},
+		Properties: &mqtt.Properties{
+			SessionExpiry:  &expiry,
+			ReceiveMaximum: &receiveMax,
+			User:           []mqtt.UserProperty{{Key: "fw", Value: "2.1"}},
+		},
+	}, mqtt.ProtocolLevel5)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	p, err := mqtt.DecodeConnectPacket(&buf)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if p.ProtocolLevel != mqtt.ProtocolLevel5 || p.ClientID != "sensor-5" || !p.CleanSession {
+		t.Errorf("unexpected connect fields: %+v", p)
+	}
+	props := p.Properties
+	if props == nil || *props.SessionExpiry != 3600 || *props.ReceiveMaximum != 10 ||
+		len(props.User) != 1 || props.User[0].Value != "2.1" {
+		t.Errorf("unexpected connect properties: %+v", props)
+	}
+	if p.Will == nil || p.Will.Properties.WillDelay != 10 || p.Will.Properties.ContentType != "text/plain" {
+		t.Errorf("unexpected will: %+v", p.Will)
+	}
+}
+
+func TestMQTT5PublishProperties(t *testing.T) {
+	expiry := uint32(120)
+	var buf bytes.Buffer
+	mqtt.WritePacket(&buf, &mqtt.PublishPacket{
+		Topic:    "devices/d1/commands",
+		QoS:      1,
+		PacketID: 3,
+		Payload:  []byte("reboot"),
+		Properties: &mqtt.Properties{
+			MessageExpiry:   &expiry,
+			ResponseTopic:   "devices/d1/responses",
+			CorrelationData: []byte{0xCA, 0xFE},
+		},
+	}, mqtt.ProtocolLevel5)
+
+	packet, err := mqtt.ReadPacketVersion(&buf, 1024, mqtt.ProtocolLevel5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	p := packet.(*mqtt.PublishPacket)
+	if string(p.Payload) != "reboot" || p.PacketID != 3 {
+		t.Errorf("unexpected publish: %+v", p)
+	}
+	if *p.Properties.MessageExpiry != 120 || p.Properties.ResponseTopic != "devices/d1/responses" ||
+		!bytes.Equal(p.Properties.CorrelationData, []byte{0xCA, 0xFE}) {
+		t.Errorf("unexpected properties: %+v", p.Properties)
+	}
+
+	// 3.1.1 编码不携带属性
+	buf.Reset()
+	mqtt.WritePacket(&buf, p, mqtt.ProtocolLevel311)
+	if packet, err = mqtt.ReadPacket(&buf, 1024); err != nil || packet.(*mqtt.PublishPacket).Properties != nil {
+		t.Errorf("3.1.1 publish: %+v, %v", packet, err)
+	}
+}
+
+func TestMQTT5AckReasonCodes(t *testing.T) {
+	var buf bytes.Buffer
+	// 原因码为0时使用2字节短格式
+	mqtt.WritePacket(&buf, &mqtt.AckPacket{Kind: mqtt.PubAck, PacketID: 1}, mqtt.ProtocolLevel5)
+	if buf.Len() != 4 {
+		t.Errorf("short PUBACK length %d, want 4", buf.Len())
+	}
+	buf.Reset()
+
+	mqtt.WritePacket(&buf, &mqtt.AckPacket{
+		Kind:       mqtt.PubRec,
+		PacketID:   2,
+		ReasonCode: mqtt.NotAuthorized,
+		Properties: &mqtt.Properties{ReasonString: "denied"},
+	}, mqtt.ProtocolLevel5)
+	packet, err := mqtt.ReadPacketVersion(&buf, 1024, mqtt.ProtocolLevel5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	ack := packet.(*mqtt.AckPacket)
+	if ack.ReasonCode != mqtt.NotAuthorized || !ack.ReasonCode.Failed() || ack.Properties.ReasonString != "denied" {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+}
+
+func TestMQTT5PropertyValidation(t *testing.T) {
+	// PUBLISH 中出现 Session Expiry Interval
+	body := append(mqttString("a/b"), 5, 0x11, 0, 0, 0, 10)
+	raw := append([]byte{0x30, byte(len(body))}, body...)
+	if _, err := mqtt.ReadPacketVersion(bytes.NewReader(raw), 1024, mqtt.ProtocolLevel5); !errors.Is(err, mqtt.ErrProtocolError) {
+		t.Errorf("got %v, want ErrProtocolError", err)
+	}
+
+	// 重复的 Content Type
+	body = append(mqttString("a/b"), 8, 0x03, 0, 1, 'x', 0x03, 0, 1, 'y')
+	raw = append([]byte{0x30, byte(len(body))}, body...)
+	if _, err := mqtt.ReadPacketVersion(bytes.NewReader(raw), 1024, mqtt.ProtocolLevel5); !errors.Is(err, mqtt.ErrProtocolError) {
+		t.Errorf("got %v, want ErrProtocolError", err)
+	}
+}
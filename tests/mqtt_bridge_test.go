@@ -0,0 +1,290 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func newTestGateway(t *testing.T) *gateway.SessionManager {
+	return newTestGatewayWithConfig(t, gateway.DefaultSessionConfig)
+}
+
+func newTestGatewayWithConfig(t *testing.T, config gateway.SessionConfig) *gateway.SessionManager {
+	config.CachePath = filepath.Join(t.TempDir(), "offline.db")
+	sm := gateway.NewSessionManagerWithConfig(config)
+	t.Cleanup(func() { sm.Shutdown(time.Second) })
+	return sm
+}
+
+// 与 edge-gateway 相同的连接处理: 解析CONNECT后交给会话管理器
+func serveGatewayConn(sm *gateway.SessionManager, conn net.Conn) {
+	defer conn.Close()
+	connect, err := mqtt.DecodeConnectPacket(conn)
+	if err != nil {
+		return
+	}
+	config := mqtt.DefaultAdapterConfig
+	config.Traffic = sm.Traffic()
+	adapter := mqtt.NewMQTTAdapterWithConfig(conn, connect.ClientID, config)
+	adapter.Negotiate(connect)
+	go adapter.Listen()
+	sm.ServeMQTT(context.Background(), connect, adapter)
+}
+
+func serveGateway(t *testing.T, sm *gateway.SessionManager, addr string) string {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveGatewayConn(sm, conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// 通过内存管道连接网关的客户端, 收到的消息写入返回的通道
+func pipeClient(t *testing.T, sm *gateway.SessionManager, clientID string) (*mqtt.Client, chan *mqtt.PublishPacket) {
+	received := make(chan *mqtt.PublishPacket, 16)
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = clientID
+	opts.OnPublish = func(p *mqtt.PublishPacket) { received <- p }
+	return dialPipe(t, sm, opts), received
+}
+
+func dialPipe(t *testing.T, sm *gateway.SessionManager, opts mqtt.ClientOptions) *mqtt.Client {
+	server, conn := net.Pipe()
+	go serveGatewayConn(sm, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, err := mqtt.NewClient(ctx, conn, opts)
+	if err != nil {
+		t.Fatalf("connect %s failed: %v", opts.ClientID, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func expectPublish(t *testing.T, received chan *mqtt.PublishPacket, topic, payload string) {
+	t.Helper()
+	select {
+	case p := <-received:
+		if p.Topic != topic || string(p.Payload) != payload {
+			t.Errorf("expected %s %q, got %s %q", topic, payload, p.Topic, p.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message on %s", topic)
+	}
+}
+
+func TestParseBridgeTopic(t *testing.T) {
+	topic, err := gateway.ParseBridgeTopic(`telemetry/# out 1 "" site-1/`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	want := gateway.BridgeTopic{Pattern: "telemetry/#", Direction: gateway.BridgeOut, QoS: 1, RemotePrefix: "site-1/"}
+	if topic != want {
+		t.Errorf("unexpected topic %+v", topic)
+	}
+
+	for _, s := range []string{"", "a/# sideways", "a/# in 3", "a/# in 1 local/", "a/#/b both"} {
+		if _, err := gateway.ParseBridgeTopic(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestMQTTBridgeStoreAndForward(t *testing.T) {
+	edge := newTestGateway(t)
+
+	// 预留上游端口, 上游先不启动
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	upstreamAddr := l.Addr().String()
+	l.Close()
+
+	config := gateway.DefaultBridgeConfig
+	config.Address = upstreamAddr
+	config.MinBackoff = 20 * time.Millisecond
+	config.MaxBackoff = 100 * time.Millisecond
+	for _, s := range []string{`telemetry/# out 1 "" site-1/`, `commands/# in 1 "" site-1/`} {
+		topic, err := gateway.ParseBridgeTopic(s)
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		config.Topics = append(config.Topics, topic)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bridge := gateway.NewBridge(edge, config)
+	bridge.Start(ctx)
+
+	// 上游不可用期间发布的消息保存在离线缓存中
+	device, deviceReceived := pipeClient(t, edge, "sensor-1")
+	if err := device.Publish(ctx, &mqtt.PublishPacket{Topic: "telemetry/temp", QoS: 1, Payload: []byte("21.5")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if err := device.Publish(ctx, &mqtt.PublishPacket{Topic: "telemetry/humidity", Payload: []byte("40")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if bridge.Connected() {
+		t.Fatal("bridge connected without upstream")
+	}
+
+	// 上游的订阅者先于桥接连接, 之后上游开始监听
+	upstream := newTestGateway(t)
+	central, centralReceived := pipeClient(t, upstream, "central")
+	if _, err := central.Subscribe(ctx, []mqtt.Subscription{{Filter: "site-1/telemetry/#", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	serveGateway(t, upstream, upstreamAddr)
+
+	expectPublish(t, centralReceived, "site-1/telemetry/temp", "21.5")
+	expectPublish(t, centralReceived, "site-1/telemetry/humidity", "40")
+
+	// 上游下发的命令按映射在本地路由
+	if _, err := device.Subscribe(ctx, []mqtt.Subscription{{Filter: "commands/sensor-1", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !bridge.Connected() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := central.Publish(ctx, &mqtt.PublishPacket{Topic: "site-1/commands/sensor-1", QoS: 1, Payload: []byte("reboot")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	expectPublish(t, deviceReceived, "commands/sensor-1", "reboot")
+
+	// 在线时直接转发
+	if err := device.Publish(ctx, &mqtt.PublishPacket{Topic: "telemetry/temp", QoS: 1, Payload: []byte("22.0")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	expectPublish(t, centralReceived, "site-1/telemetry/temp", "22.0")
+}
+
+// 上游以失败原因码拒绝的消息被丢弃, 后续消息继续发送
+func TestMQTTBridgeDropsRejectedMessages(t *testing.T) {
+	upstream := newTestGateway(t)
+	upstream.SetAuthorizer(auth.NewACL([]auth.Rule{
+		{Topic: "site-1/telemetry/secret", Access: auth.Publish, Deny: true},
+		{Topic: "#", Access: auth.ReadWrite},
+	}))
+	central, centralReceived := pipeClient(t, upstream, "central")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := central.Subscribe(ctx, []mqtt.Subscription{{Filter: "site-1/telemetry/#", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	upstreamAddr := serveGateway(t, upstream, "127.0.0.1:0")
+
+	edge := newTestGateway(t)
+	config := gateway.DefaultBridgeConfig
+	config.Address = upstreamAddr
+	config.Client.ProtocolLevel = mqtt.ProtocolLevel5
+	topic, err := gateway.ParseBridgeTopic(`telemetry/# out 1 "" site-1/`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	config.Topics = []gateway.BridgeTopic{topic}
+	gateway.NewBridge(edge, config).Start(ctx)
+
+	device, _ := pipeClient(t, edge, "sensor-1")
+	for _, p := range []*mqtt.PublishPacket{
+		{Topic: "telemetry/secret", QoS: 1, Payload: []byte("42")},
+		{Topic: "telemetry/temp", QoS: 1, Payload: []byte("21.5")},
+	} {
+		if err := device.Publish(ctx, p); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+	expectPublish(t, centralReceived, "site-1/telemetry/temp", "21.5")
+}
+
+// 上游接受连接后不再读取时, 本地发布和投递不被桥接阻塞
+func TestMQTTBridgeStalledUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	var conns []net.Conn
+	var mu sync.Mutex
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			if _, err := mqtt.DecodeConnectPacket(conn); err == nil {
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+			}
+		}
+	}()
+
+	edge := newTestGateway(t)
+	config := gateway.DefaultBridgeConfig
+	config.Address = l.Addr().String()
+	topic, err := gateway.ParseBridgeTopic(`telemetry/# out 0 "" site-1/`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	config.Topics = []gateway.BridgeTopic{topic}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bridge := gateway.NewBridge(edge, config)
+	bridge.Start(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for !bridge.Connected() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dashboard, received := pipeClient(t, edge, "dashboard")
+	if _, err := dashboard.Subscribe(ctx, []mqtt.Subscription{{Filter: "telemetry/#"}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	device, _ := pipeClient(t, edge, "sensor-1")
+
+	// 足以填满上游连接的套接字缓冲
+	const count = 32
+	payload := make([]byte, 512<<10)
+	go func() {
+		for i := 0; i < count; i++ {
+			device.Publish(ctx, &mqtt.PublishPacket{Topic: "telemetry/raw", Payload: payload})
+		}
+	}()
+	timeout := time.After(3 * time.Second)
+	for i := 0; i < count; i++ {
+		select {
+		case <-received:
+		case <-timeout:
+			t.Fatalf("local delivery stalled after %d messages", i)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func TestEncodePublishLargePayload(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 70*1024)
+	var buf bytes.Buffer
+	err := mqtt.EncodePublish(&buf, &mqtt.PublishPacket{
+		Topic:    "devices/d1/commands",
+		PacketID: 7,
+		QoS:      1,
+		Payload:  payload,
+	})
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	header, err := mqtt.DecodeHeader(&buf)
+	if err != nil {
+		t.Fatalf("decode header failed: %v", err)
+	}
+	if header.Type != mqtt.Publish || header.Flags != 0x02 {
+		t.Errorf("unexpected header: %+v", header)
+	}
+	want := 2 + len("devices/d1/commands") + 2 + len(payload)
+	if header.Remaining != want || buf.Len() != want {
+		t.Errorf("remaining length %d (buffered %d), want %d", header.Remaining, buf.Len(), want)
+	}
+}
+
+func TestEncodePublishRequiresPacketID(t *testing.T) {
+	err := mqtt.EncodePublish(&bytes.Buffer{}, &mqtt.PublishPacket{Topic: "a/b", QoS: 2})
+	if err != mqtt.ErrMissingPacketID {
+		t.Errorf("got %v, want ErrMissingPacketID", err)
+	}
+}
+
+func TestReadPacketFraming(t *testing.T) {
+	var buf bytes.Buffer
+	mqtt.EncodePublish(&buf, &mqtt.PublishPacket{Topic: "t/1", Payload: []byte("one")})
+	mqtt.EncodePublish(&buf, &mqtt.PublishPacket{Topic: "t/2", Payload: []byte("two"), QoS: 1, PacketID: 9})
+	buf.Write([]byte{0xC0, 0x00}) // PINGREQ
+
+	first, err := mqtt.ReadPacket(&buf, 1024)
+	if err != nil {
+		t.Fatalf("read first: %v", err)
+	}
+	second, err := mqtt.ReadPacket(&buf, 1024)
+	if err != nil {
+		t.Fatalf("read second: %v", err)
+	}
+	p1, p2 := first.(*mqtt.PublishPacket), second.(*mqtt.PublishPacket)
+	if p1.Topic != "t/1" || string(p1.Payload) != "one" {
+		t.Errorf("unexpected first packet: %+v", p1)
+	}
+	if p2.Topic != "t/2" || string(p2.Payload) != "two" || p2.PacketID != 9 {
+		t.Errorf("unexpected second packet: %+v", p2)
+	}
+	if ping, err := mqtt.ReadPacket(&buf, 1024); err != nil || ping.Type() != mqtt.PingReq {
+		t.Errorf("expected PINGREQ, got %v, %v", ping, err)
+	}
+}
+
+func TestReadPacketMaxSize(t *testing.T) {
+	var buf bytes.Buffer
+	mqtt.EncodePublish(&buf, &mqtt.PublishPacket{Topic: "t", Payload: make([]byte, 2048)})
+	if _, err := mqtt.ReadPacket(&buf, 1024); err != mqtt.ErrPacketTooLarge {
+		t.Errorf("got %v, want ErrPacketTooLarge", err)
+	}
+}
@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func buildConnect(name string, level, flags byte, fields ...string) []byte {
+	body := mqttString(name)
+	body = append(body, level, flags, 0x00, 0x3C)
+	for _, f := range fields {
+		body = append(body, mqttString(f)...)
+	}
+	return append([]byte{0x10, byte(len(body))}, body...)
+}
+
+func TestDecodeConnectPacket(t *testing.T) {
+	// clean session + will(QoS 1, retain) + username + password
+	raw := buildConnect("MQTT", 4, 0xEE, "sensor-1", "site/1/will", "offline", "user", "secret")
+
+	p, err := mqtt.DecodeConnectPacket(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if p.ClientID != "sensor-1" || !p.CleanSession || p.KeepAlive != 60 {
+		t.Errorf("unexpected connect fields: %+v", p)
+	}
+	if p.Will == nil || p.Will.Topic != "site/1/will" || string(p.Will.Payload) != "offline" ||
+		p.Will.QoS != 1 || !p.Will.Retain {
+		t.Errorf("unexpected will: %+v", p.Will)
+	}
+	if p.Username != "user" || string(p.Password) != "secret" {
+		t.Errorf("unexpected credentials: %q %q", p.Username, p.Password)
+	}
+}
+
+func TestDecodeConnectPacketErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"bad level", buildConnect("MQTT", 9, 0x02, "c"), mqtt.ErrUnacceptableProtocol},
+		{"bad name", buildConnect("HTTP", 4, 0x02, "c"), mqtt.ErrInvalidProtocolName},
+		{"reserved flag", buildConnect("MQTT", 4, 0x03, "c"), mqtt.ErrMalformedPacket},
+		{"password without user", buildConnect("MQTT", 4, 0x42, "c", "pw"), mqtt.ErrMalformedPacket},
+		{"empty id persistent", buildConnect("MQTT", 4, 0x00, ""), mqtt.ErrIdentifierRejected},
+	}
+	for _, c := range cases {
+		if _, err := mqtt.DecodeConnectPacket(bytes.NewReader(c.raw)); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+// 超过监听器最大报文长度的CONNECT在读取报文体之前被拒绝
+func TestReadConnectPacketMaxSize(t *testing.T) {
+	raw := buildConnect("MQTT", 4, 0x02, strings.Repeat("c", 64))
+	if _, err := mqtt.ReadConnectPacket(bytes.NewReader(raw), 32); !errors.Is(err, mqtt.ErrPacketTooLarge) {
+		t.Errorf("expected ErrPacketTooLarge, got %v", err)
+	}
+	if _, err := mqtt.ReadConnectPacket(bytes.NewReader(raw), 128); err != nil {
+		t.Errorf("decode failed: %v", err)
+	}
+}
+
+func TestEncodeConnack(t *testing.T) {
+	var buf bytes.Buffer
+	mqtt.EncodeConnack(&buf, true, mqtt.RefusedBadCredentials)
+	if !bytes.Equal(buf.Bytes(), []byte{0x20, 0x02, 0x00, 0x04}) {
+		t.Errorf("unexpected CONNACK: % x", buf.Bytes())
+	}
+}
+
+// 对端不再读取时写入超时返回, DISCONNECT 不会无限阻塞关闭
+func TestMQTTAdapterWriteTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	config := mqtt.DefaultAdapterConfig
+	config.WriteTimeout = 100 * time.Millisecond
+	adapter := mqtt.NewMQTTAdapterWithConfig(server, "sensor-1", config)
+	adapter.Negotiate(&mqtt.ConnectPacket{ProtocolLevel: mqtt.ProtocolLevel5})
+
+	start := time.Now()
+	if err := adapter.Send([]byte("reboot")); err == nil {
+		t.Fatal("expected write to a stalled peer to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("write took %v", elapsed)
+	}
+
+	// 不限制写入时间时, 阻塞中的写入也不会拖住关闭
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	config.WriteTimeout = 0
+	adapter = mqtt.NewMQTTAdapterWithConfig(server2, "sensor-2", config)
+	adapter.Negotiate(&mqtt.ConnectPacket{ProtocolLevel: mqtt.ProtocolLevel5})
+	go adapter.Send([]byte("reboot"))
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		adapter.Disconnect(mqtt.SessionTakenOver, nil)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnect blocked on a stalled peer")
+	}
+}
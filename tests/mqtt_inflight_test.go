@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func connect311(clientID string) *mqtt.ConnectPacket {
+	return &mqtt.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: mqtt.ProtocolLevel311,
+		CleanSession:  true,
+		ClientID:      clientID,
+	}
+}
+
+// 管道写入阻塞到对端读取, 命令在单独的协程中下发
+func sendCommands(t *testing.T, sm *gateway.SessionManager, deviceID string, qos byte, payloads ...string) {
+	go func() {
+		for _, payload := range payloads {
+			if err := sm.SendCommandQoS(deviceID, []byte(payload), qos); err != nil {
+				t.Errorf("send %s failed: %v", payload, err)
+			}
+		}
+	}()
+}
+
+func readRaw(t *testing.T, conn net.Conn) mqtt.Packet {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	p, err := mqtt.ReadPacketVersion(conn, 0, mqtt.ProtocolLevel311)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return p
+}
+
+func readRawPublish(t *testing.T, conn net.Conn, payload string, dup bool) *mqtt.PublishPacket {
+	t.Helper()
+	p, ok := readRaw(t, conn).(*mqtt.PublishPacket)
+	if !ok {
+		t.Fatalf("expected PUBLISH, got %T", p)
+	}
+	if string(p.Payload) != payload || p.Dup != dup {
+		t.Fatalf("expected %q dup=%v, got %q dup=%v", payload, dup, p.Payload, p.Dup)
+	}
+	return p
+}
+
+func readRawAck(t *testing.T, conn net.Conn, kind mqtt.ControlPacket, id uint16) {
+	t.Helper()
+	p, ok := readRaw(t, conn).(*mqtt.AckPacket)
+	if !ok || p.Kind != kind || p.PacketID != id {
+		t.Fatalf("expected ack %d for %d, got %+v", kind, id, p)
+	}
+}
+
+// PINGREQ与确认报文按顺序处理, 收到PINGRESP说明之前的报文已处理
+func syncRaw(t *testing.T, conn net.Conn) {
+	t.Helper()
+	writeRaw(t, conn, &mqtt.PingReqPacket{}, mqtt.ProtocolLevel311)
+	if p, ok := readRaw(t, conn).(*mqtt.PingRespPacket); !ok {
+		t.Fatalf("expected PINGRESP, got %T", p)
+	}
+}
+
+// 在给定时间内没有收到任何报文
+func expectNoPacket(t *testing.T, conn net.Conn, d time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	p, err := mqtt.ReadPacketVersion(conn, 0, mqtt.ProtocolLevel311)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected no packet, got %+v %v", p, err)
+	}
+}
+
+// 窗口已满时后续消息等待确认后再发送
+func TestInflightWindowLimit(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.MaxInflight = 2
+	sm := newTestGatewayWithConfig(t, config)
+	conn := dialRaw(t, sm, connect311("sensor-1"))
+	waitConnected(t, sm, 1)
+
+	sendCommands(t, sm, "sensor-1", 1, "cmd-0", "cmd-1", "cmd-2")
+	first := readRawPublish(t, conn, "cmd-0", false)
+	second := readRawPublish(t, conn, "cmd-1", false)
+	if first.PacketID == second.PacketID {
+		t.Fatalf("inflight messages share packet id %d", first.PacketID)
+	}
+	expectNoPacket(t, conn, 200*time.Millisecond)
+
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubAck, PacketID: first.PacketID}, mqtt.ProtocolLevel311)
+	readRawPublish(t, conn, "cmd-2", false)
+}
+
+// QoS 2 在收到PUBCOMP后才释放窗口
+func TestInflightQoS2Flow(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.MaxInflight = 1
+	sm := newTestGatewayWithConfig(t, config)
+	conn := dialRaw(t, sm, connect311("sensor-1"))
+	waitConnected(t, sm, 1)
+
+	sendCommands(t, sm, "sensor-1", 2, "reboot", "reset")
+	p := readRawPublish(t, conn, "reboot", false)
+	if p.QoS != 2 {
+		t.Fatalf("expected QoS 2, got %d", p.QoS)
+	}
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubRec, PacketID: p.PacketID}, mqtt.ProtocolLevel311)
+	readRawAck(t, conn, mqtt.PubRel, p.PacketID)
+	expectNoPacket(t, conn, 200*time.Millisecond)
+
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubComp, PacketID: p.PacketID}, mqtt.ProtocolLevel311)
+	readRawPublish(t, conn, "reset", false)
+}
+
+// 重连后未确认的命令以DUP和原报文标识符重传, 已收到PUBREC的只重发PUBREL
+func TestInflightRetransmitOnReconnect(t *testing.T) {
+	sm := newTestGateway(t)
+	conn := dialRaw(t, sm, connect311("sensor-1"))
+	waitConnected(t, sm, 1)
+
+	sendCommands(t, sm, "sensor-1", 1, "reboot")
+	sent := readRawPublish(t, conn, "reboot", false)
+	sendCommands(t, sm, "sensor-1", 2, "reset")
+	released := readRawPublish(t, conn, "reset", false)
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubRec, PacketID: released.PacketID}, mqtt.ProtocolLevel311)
+	readRawAck(t, conn, mqtt.PubRel, released.PacketID)
+
+	// 接管旧连接, 等待其把未确认的命令写回离线缓存
+	conn = dialRaw(t, sm, connect311("sensor-1"))
+	p := readRawPublish(t, conn, "reboot", true)
+	if p.PacketID != sent.PacketID {
+		t.Errorf("expected packet id %d, got %d", sent.PacketID, p.PacketID)
+	}
+	readRawAck(t, conn, mqtt.PubRel, released.PacketID)
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubAck, PacketID: p.PacketID}, mqtt.ProtocolLevel311)
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubComp, PacketID: released.PacketID}, mqtt.ProtocolLevel311)
+	syncRaw(t, conn)
+
+	// 已确认的命令不再重传
+	conn = dialRaw(t, sm, connect311("sensor-1"))
+	expectNoPacket(t, conn, 200*time.Millisecond)
+}
+
+// 网关重启后从离线缓存恢复未确认的命令
+func TestInflightCommandsSurviveRestart(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.CachePath = filepath.Join(t.TempDir(), "offline.db")
+	sm := gateway.NewSessionManagerWithConfig(config)
+	conn := dialRaw(t, sm, connect311("sensor-1"))
+	waitConnected(t, sm, 1)
+
+	var sent []*mqtt.PublishPacket
+	for i := 0; i < 3; i++ {
+		sendCommands(t, sm, "sensor-1", 1, fmt.Sprintf("cmd-%d", i))
+		sent = append(sent, readRawPublish(t, conn, fmt.Sprintf("cmd-%d", i), false))
+	}
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubAck, PacketID: sent[1].PacketID}, mqtt.ProtocolLevel311)
+	syncRaw(t, conn)
+	sm.Shutdown(time.Second)
+
+	sm = gateway.NewSessionManagerWithConfig(config)
+	t.Cleanup(func() { sm.Shutdown(time.Second) })
+	conn = dialRaw(t, sm, connect311("sensor-1"))
+	for _, i := range []int{0, 2} {
+		p := readRawPublish(t, conn, fmt.Sprintf("cmd-%d", i), true)
+		if p.PacketID != sent[i].PacketID {
+			t.Errorf("expected packet id %d, got %d", sent[i].PacketID, p.PacketID)
+		}
+	}
+}
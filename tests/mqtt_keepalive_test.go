@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 保活时间的1.5倍内没有报文时断开连接, PINGREQ维持连接, keep_alive=0 不检测
+func TestMQTTKeepAlive(t *testing.T) {
+	keepAlive := func(clientID string, seconds uint16) *mqtt.ConnectPacket {
+		connect := connect311(clientID)
+		connect.KeepAlive = seconds
+		return connect
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		t.Parallel()
+		sm := newTestGateway(t)
+		conn := dialRaw(t, sm, keepAlive("sensor-1", 1))
+		start := time.Now()
+
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := mqtt.ReadPacketVersion(conn, 0, mqtt.ProtocolLevel311)
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("expected connection closed, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 1400*time.Millisecond || elapsed > 2500*time.Millisecond {
+			t.Errorf("expected disconnect after 1.5s, got %v", elapsed)
+		}
+		waitConnected(t, sm, 0)
+	})
+
+	t.Run("pingreq", func(t *testing.T) {
+		t.Parallel()
+		sm := newTestGateway(t)
+		conn := dialRaw(t, sm, keepAlive("sensor-1", 1))
+		for i := 0; i < 5; i++ {
+			time.Sleep(500 * time.Millisecond)
+			syncRaw(t, conn)
+		}
+		if n := sm.Stats().ClientsConnected; n != 1 {
+			t.Errorf("expected connection kept alive, got %d connections", n)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		sm := newTestGateway(t)
+		conn := dialRaw(t, sm, keepAlive("sensor-1", 0))
+		expectNoPacket(t, conn, 2500*time.Millisecond)
+		syncRaw(t, conn)
+	})
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 相同客户端ID的新连接关闭旧连接, 上报一次接管事件, 旧连接未确认的消息由新连接重发
+func TestMQTTSessionTakeover(t *testing.T) {
+	sm := newTestGateway(t)
+	events := make(chan *types.DeviceEvent, 16)
+	sm.SetNotifier(func(event *types.DeviceEvent) { events <- event })
+	device, _ := pipeClient(t, sm, "sensor-2")
+
+	old := dialRaw(t, sm, connect311("sensor-1"))
+	writeRaw(t, old, &mqtt.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []mqtt.Subscription{{Filter: "devices/sensor-2/#", QoS: 1}},
+	}, mqtt.ProtocolLevel311)
+	if p, ok := readRaw(t, old).(*mqtt.SubAckPacket); !ok {
+		t.Fatalf("expected SUBACK, got %T", p)
+	}
+	waitConnected(t, sm, 2)
+
+	// 旧连接收到消息后不确认
+	publishQoS1(t, device, "devices/sensor-2/state", "reading")
+	sent := readRawPublish(t, old, "reading", false)
+
+	conn := dialRaw(t, sm, connect311("sensor-1"))
+	old.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := mqtt.ReadPacketVersion(old, 0, mqtt.ProtocolLevel311); !errors.Is(err, io.EOF) {
+		t.Errorf("expected old connection closed, got %v", err)
+	}
+
+	p := readRawPublish(t, conn, "reading", true)
+	if p.PacketID != sent.PacketID {
+		t.Errorf("expected packet id %d, got %d", sent.PacketID, p.PacketID)
+	}
+	writeRaw(t, conn, &mqtt.AckPacket{Kind: mqtt.PubAck, PacketID: p.PacketID}, mqtt.ProtocolLevel311)
+	syncRaw(t, conn)
+
+	select {
+	case event := <-events:
+		if event.Type != types.EventTakeover || event.DeviceID != "sensor-1" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no takeover event")
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := sm.Stats().ClientsConnected; n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+}
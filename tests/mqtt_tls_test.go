@@ -0,0 +1,225 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func issueCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, signer := template, key
+	if parent != nil {
+		parentCert, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writePEM(t *testing.T, certFile, keyFile string) {
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+type tlsFixture struct {
+	ca       *testCert
+	config   mqtt.TLSConfig
+	listener net.Listener
+	reloader *mqtt.CertReloader
+}
+
+func newTLSFixture(t *testing.T, requireClientCert bool) *tlsFixture {
+	dir := t.TempDir()
+	f := &tlsFixture{}
+	f.ca = issueCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "edge-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	f.config = mqtt.TLSConfig{
+		CertFile:          filepath.Join(dir, "server.crt"),
+		KeyFile:           filepath.Join(dir, "server.key"),
+		ClientCAFile:      filepath.Join(dir, "ca.crt"),
+		RequireClientCert: requireClientCert,
+	}
+	f.ca.writePEM(t, f.config.ClientCAFile, "")
+	f.issueServerCert(t, 100)
+
+	var err error
+	f.listener, f.reloader, err = mqtt.ListenTLS("127.0.0.1:0", f.config)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { f.listener.Close() })
+	return f
+}
+
+func (f *tlsFixture) issueServerCert(t *testing.T, serial int64) {
+	server := issueCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "edge-gateway"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, f.ca)
+	server.writePEM(t, f.config.CertFile, f.config.KeyFile)
+}
+
+func (f *tlsFixture) clientCert(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	return issueCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(200),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, f.ca).tlsCertificate()
+}
+
+// 客户端握手的同时在服务端接受连接, 服务端的握手在首次读取时进行
+func (f *tlsFixture) dial(t *testing.T, certs ...tls.Certificate) (*tls.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		accepted <- conn
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	client, err := tls.Dial("tcp", f.listener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: certs,
+	})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+// 客户端发送CONNECT, 服务端解码
+func connectOverTLS(client, server net.Conn, clientID string) (*mqtt.ConnectPacket, error) {
+	go client.Write(buildConnect("MQTT", 4, 0x02, clientID))
+	return mqtt.DecodeConnectPacket(server)
+}
+
+func TestMQTTTLSClientCertificateIdentity(t *testing.T) {
+	f := newTLSFixture(t, true)
+
+	client, conn := f.dial(t, f.clientCert(t, "sensor-1", "sensor-1.site-a"))
+	connect, err := connectOverTLS(client, conn, "sensor-1")
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if connect.ClientID != "sensor-1" {
+		t.Errorf("unexpected client id %q", connect.ClientID)
+	}
+
+	ids := mqtt.PeerIdentities(conn)
+	if len(ids) != 2 || ids[0] != "sensor-1" || ids[1] != "sensor-1.site-a" {
+		t.Errorf("unexpected identities %v", ids)
+	}
+}
+
+func TestMQTTTLSRequiresClientCertificate(t *testing.T) {
+	f := newTLSFixture(t, true)
+
+	client, conn := f.dial(t)
+	if _, err := connectOverTLS(client, conn, "sensor-1"); err == nil {
+		t.Fatal("expected handshake without client certificate to fail")
+	}
+}
+
+func TestMQTTTLSOptionalClientCertificate(t *testing.T) {
+	f := newTLSFixture(t, false)
+
+	client, conn := f.dial(t)
+	_, err := connectOverTLS(client, conn, "sensor-1")
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if ids := mqtt.PeerIdentities(conn); ids != nil {
+		t.Errorf("expected no identities, got %v", ids)
+	}
+}
+
+func TestMQTTTLSCertificateReload(t *testing.T) {
+	f := newTLSFixture(t, false)
+
+	before, beforeConn := f.dial(t)
+	if _, err := connectOverTLS(before, beforeConn, "sensor-1"); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	f.issueServerCert(t, 101)
+	if err := f.reloader.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	after, _ := f.dial(t)
+	if serial := after.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 101 {
+		t.Errorf("expected reloaded certificate, got serial %d", serial)
+	}
+
+	// 已建立的连接不受重载影响
+	if _, err := before.Write([]byte{0xC0, 0x00}); err != nil {
+		t.Errorf("existing connection broken after reload: %v", err)
+	}
+}
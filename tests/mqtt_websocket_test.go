@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func listenWebSocket(t *testing.T) (*mqtt.WebSocketListener, string) {
+	l, err := mqtt.ListenWebSocket("127.0.0.1:0", "/mqtt")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, "ws://" + l.Addr().String() + "/mqtt"
+}
+
+func TestMQTTOverWebSocket(t *testing.T) {
+	l, url := listenWebSocket(t)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		t.Fatalf("subprotocol not negotiated: %q", resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+
+	// CONNECT 跨两个二进制帧发送
+	raw := buildConnect("MQTT", 4, 0x02, "ws-device")
+	go func() {
+		ws.WriteMessage(websocket.BinaryMessage, raw[:5])
+		ws.WriteMessage(websocket.BinaryMessage, raw[5:])
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+
+	connect, err := mqtt.DecodeConnectPacket(conn)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if connect.ClientID != "ws-device" {
+		t.Errorf("unexpected client id %q", connect.ClientID)
+	}
+
+	adapter := mqtt.NewMQTTAdapter(conn)
+	if err := adapter.Connack(false, mqtt.ConnectionAccepted); err != nil {
+		t.Fatalf("connack failed: %v", err)
+	}
+	kind, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if kind != websocket.BinaryMessage || len(msg) != 4 || msg[0] != 0x20 || msg[3] != 0x00 {
+		t.Errorf("unexpected CONNACK frame %d % X", kind, msg)
+	}
+}
+
+// 经HTTPS升级的连接保留客户端证书身份
+func TestMQTTOverWebSocketClientCertificate(t *testing.T) {
+	f := newTLSFixture(t, true)
+	l := mqtt.NewWebSocketListener(f.listener, "/mqtt")
+	t.Cleanup(func() { l.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(f.ca.cert)
+	dialer := websocket.Dialer{
+		Subprotocols: []string{"mqtt"},
+		TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{f.clientCert(t, "sensor-1")},
+		},
+	}
+	ws, _, err := dialer.Dial("wss://"+l.Addr().String()+"/mqtt", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer conn.Close()
+	if ids := mqtt.PeerIdentities(conn); len(ids) != 1 || ids[0] != "sensor-1" {
+		t.Errorf("unexpected identities %v", ids)
+	}
+}
+
+func TestMQTTOverWebSocketRequiresSubprotocol(t *testing.T) {
+	_, url := listenWebSocket(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected dial without mqtt subprotocol to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %v", resp)
+	}
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/pkg/types"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 直接读写报文的客户端, 用于发送 mqtt.Client 不会发送的报文
+func dialRaw(t *testing.T, sm *gateway.SessionManager, connect *mqtt.ConnectPacket) net.Conn {
+	t.Helper()
+	server, conn := net.Pipe()
+	go serveGatewayConn(sm, server)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	writeRaw(t, conn, connect, connect.ProtocolLevel)
+	p, err := mqtt.ReadPacketVersion(conn, 0, connect.ProtocolLevel)
+	if ack, ok := p.(*mqtt.ConnAckPacket); err != nil || !ok || ack.ReasonCode != 0 {
+		t.Fatalf("connect %s failed: %+v %v", connect.ClientID, p, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn
+}
+
+func writeRaw(t *testing.T, conn net.Conn, p mqtt.Packet, version byte) {
+	t.Helper()
+	buf, err := mqtt.AppendPacket(nil, p, version)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+func TestWillOnProtocolErrorDisconnect(t *testing.T) {
+	sm := newTestGateway(t)
+	watcher, received := pipeClient(t, sm, "dashboard")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := watcher.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/+/status", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	conn := dialRaw(t, sm, &mqtt.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: mqtt.ProtocolLevel5,
+		CleanSession:  true,
+		ClientID:      "sensor-1",
+		Will:          &mqtt.Will{Topic: "devices/sensor-1/status", Payload: []byte("offline")},
+	})
+
+	// 会话过期间隔为0时DISCONNECT不能设置非0的过期间隔, 协议错误断开仍发布遗嘱
+	expiry := uint32(60)
+	writeRaw(t, conn, &mqtt.DisconnectPacket{Properties: &mqtt.Properties{SessionExpiry: &expiry}}, mqtt.ProtocolLevel5)
+	expectPublish(t, received, "devices/sensor-1/status", "offline")
+}
+
+// 等待会话完成注册, CONNACK先于注册发送
+func waitConnected(t *testing.T, sm *gateway.SessionManager, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for sm.Stats().ClientsConnected != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections, got %d", n, sm.Stats().ClientsConnected)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 事件通知在后台发送, 阻塞的通知 (例如Redis不可用) 不影响接管和连接
+func TestBlockingNotifierDoesNotStallConnect(t *testing.T) {
+	sm := newTestGateway(t)
+	release := make(chan struct{})
+	defer close(release)
+	sm.SetNotifier(func(event *types.DeviceEvent) { <-release })
+
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "sensor-1"
+	for i := 0; i < 3; i++ {
+		dialPipe(t, sm, opts)
+		waitConnected(t, sm, 1)
+	}
+}
+
+// 未收到DISCONNECT的断开发布遗嘱并上报事件
+func TestWillOnAbnormalDisconnect(t *testing.T) {
+	sm := newTestGateway(t)
+	events := make(chan *types.DeviceEvent, 16)
+	sm.SetNotifier(func(event *types.DeviceEvent) { events <- event })
+	watcher, received := pipeClient(t, sm, "dashboard")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := watcher.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/+/status", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	conn := dialRaw(t, sm, &mqtt.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: mqtt.ProtocolLevel311,
+		CleanSession:  true,
+		ClientID:      "sensor-1",
+		Will:          &mqtt.Will{Topic: "devices/sensor-1/status", Payload: []byte("offline")},
+	})
+	waitConnected(t, sm, 2)
+	conn.Close()
+	expectPublish(t, received, "devices/sensor-1/status", "offline")
+
+	select {
+	case event := <-events:
+		if event.Type != types.EventWill || event.DeviceID != "sensor-1" ||
+			event.Topic != "devices/sensor-1/status" || string(event.Payload) != "offline" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no will event")
+	}
+}
+
+// 正常DISCONNECT丢弃遗嘱, 不上报事件
+func TestNoWillOnCleanDisconnect(t *testing.T) {
+	sm := newTestGateway(t)
+	events := make(chan *types.DeviceEvent, 16)
+	sm.SetNotifier(func(event *types.DeviceEvent) { events <- event })
+	watcher, received := pipeClient(t, sm, "dashboard")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := watcher.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/+/status", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "sensor-1"
+	opts.Will = &mqtt.Will{Topic: "devices/sensor-1/status", Payload: []byte("offline")}
+	device := dialPipe(t, sm, opts)
+	waitConnected(t, sm, 2)
+	device.Close()
+	waitConnected(t, sm, 1)
+
+	select {
+	case p := <-received:
+		t.Errorf("unexpected will %s %q", p.Topic, p.Payload)
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
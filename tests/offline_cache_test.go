@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 离线缓存打开失败时网关仍可运行, 只是不保存离线数据
+func TestGatewayWithoutOfflineCache(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.CachePath = filepath.Join(t.TempDir(), "missing", "offline.db")
+	sm := gateway.NewSessionManagerWithConfig(config)
+	t.Cleanup(func() { sm.Shutdown(time.Second) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	device, _ := pipeClient(t, sm, "sensor-1")
+	if err := device.Publish(ctx, &mqtt.PublishPacket{Topic: "devices/sensor-1/state", Retain: true, Payload: []byte("on")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	// 保留消息仍在内存中
+	subscriber, received := pipeClient(t, sm, "dashboard")
+	if _, err := subscriber.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/#", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	expectPublish(t, received, "devices/sensor-1/state", "on")
+
+	// 持久会话断开和重连
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "line-1"
+	opts.CleanSession = false
+	persistent := dialPipe(t, sm, opts)
+	if _, err := persistent.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/#", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	persistent.Close()
+	if err := device.Publish(ctx, &mqtt.PublishPacket{Topic: "devices/sensor-1/state", QoS: 1, Payload: []byte("off")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	expectPublish(t, received, "devices/sensor-1/state", "off")
+	dialPipe(t, sm, opts)
+
+	if err := sm.SendCommand("offline-device", []byte("reboot")); !errors.Is(err, gateway.ErrNoOfflineCache) {
+		t.Errorf("expected ErrNoOfflineCache, got %v", err)
+	}
+}
+
+// 迁移失败时不返回半初始化的缓存
+func TestSQLiteCacheMigrationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	// 同名视图无法补充列
+	if _, err := db.Exec("CREATE VIEW commands AS SELECT 1 AS id"); err != nil {
+		t.Fatalf("create view failed: %v", err)
+	}
+	db.Close()
+
+	cache, err := gateway.NewSQLiteCache(path)
+	if err == nil || cache != nil {
+		t.Fatalf("expected migration error and nil cache, got %v %v", cache, err)
+	}
+}
+
+// 离线队列超出上限时丢弃最早的消息
+func TestOfflineQueueLimit(t *testing.T) {
+	cache, err := gateway.NewSQLiteCache(filepath.Join(t.TempDir(), "offline.db"))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		msg := &gateway.QueuedMessage{Topic: "devices/sensor-1/telemetry", Payload: []byte{byte('0' + i)}, QoS: 1}
+		if err := cache.QueueMessage("dashboard", msg, 3); err != nil {
+			t.Fatalf("queue failed: %v", err)
+		}
+	}
+	messages, err := cache.TakeQueuedMessages("dashboard")
+	if err != nil {
+		t.Fatalf("take failed: %v", err)
+	}
+	var payloads string
+	for _, msg := range messages {
+		payloads += string(msg.Payload)
+	}
+	if payloads != "234" {
+		t.Errorf("expected the newest 3 messages, got %q", payloads)
+	}
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 使用指定离线缓存文件的网关, 用于模拟重启
+func newTestGatewayAt(t *testing.T, path string) *gateway.SessionManager {
+	config := gateway.DefaultSessionConfig
+	config.CachePath = path
+	sm := gateway.NewSessionManagerWithConfig(config)
+	t.Cleanup(func() { sm.Shutdown(time.Second) })
+	return sm
+}
+
+// 会话断开后状态异步写入离线缓存, 等待写入完成再重连
+func waitSessionSaved(t *testing.T, path, clientID string) {
+	t.Helper()
+	cache, err := gateway.NewSQLiteCache(path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		state, err := cache.LoadSession(clientID)
+		if err != nil {
+			t.Fatalf("load session failed: %v", err)
+		}
+		if state != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %s was not saved", clientID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func persistentOptions(clientID string, received chan *mqtt.PublishPacket) mqtt.ClientOptions {
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = clientID
+	opts.CleanSession = false
+	opts.OnPublish = func(p *mqtt.PublishPacket) { received <- p }
+	return opts
+}
+
+// 持久会话重连后恢复订阅, 并收到离线期间排队的QoS 1消息
+func TestPersistentSessionResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.db")
+	sm := newTestGatewayAt(t, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	device, _ := pipeClient(t, sm, "sensor-1")
+
+	received := make(chan *mqtt.PublishPacket, 16)
+	opts := persistentOptions("dashboard", received)
+	client := dialPipe(t, sm, opts)
+	if client.SessionPresent {
+		t.Error("expected no session on first connect")
+	}
+	if _, err := client.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/#", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	client.Close()
+	waitSessionSaved(t, path, "dashboard")
+
+	publishQoS1(t, device, "devices/sensor-1/state", "queued")
+	// QoS 0 消息不为离线会话排队
+	if err := device.Publish(ctx, &mqtt.PublishPacket{Topic: "devices/sensor-1/state", Payload: []byte("dropped")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	client = dialPipe(t, sm, opts)
+	if !client.SessionPresent {
+		t.Error("expected session present on reconnect")
+	}
+	expectPublish(t, received, "devices/sensor-1/state", "queued")
+	publishQoS1(t, device, "devices/sensor-1/state", "live")
+	expectPublish(t, received, "devices/sensor-1/state", "live")
+}
+
+// 网关重启后从同一SQLite文件恢复持久会话: 离线期间的消息继续排队, 重连后投递
+func TestPersistentSessionSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.db")
+	sm := newTestGatewayAt(t, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan *mqtt.PublishPacket, 16)
+	opts := persistentOptions("dashboard", received)
+	client := dialPipe(t, sm, opts)
+	if _, err := client.Subscribe(ctx, []mqtt.Subscription{{Filter: "devices/#", QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	device, _ := pipeClient(t, sm, "sensor-1")
+	publishQoS1(t, device, "devices/sensor-1/state", "before")
+	expectPublish(t, received, "devices/sensor-1/state", "before")
+	client.Close()
+	sm.Shutdown(time.Second)
+
+	// 重启后订阅者未重连, 消息按恢复的订阅排队
+	sm = newTestGatewayAt(t, path)
+	device, _ = pipeClient(t, sm, "sensor-1")
+	publishQoS1(t, device, "devices/sensor-1/state", "after")
+
+	client = dialPipe(t, sm, opts)
+	if !client.SessionPresent {
+		t.Error("expected session present after restart")
+	}
+	expectPublish(t, received, "devices/sensor-1/state", "after")
+	publishQoS1(t, device, "devices/sensor-1/state", "live")
+	expectPublish(t, received, "devices/sensor-1/state", "live")
+}
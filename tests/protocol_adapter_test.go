@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"edgesphere/internal/pkg/types"
+)
+
+// 非MQTT协议的适配器替身
+type fakeAdapter struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	handler   types.MessageHandler
+	sent      chan []byte
+	listening chan struct{}
+
+	mu      sync.Mutex
+	err     error
+	sendErr error // 非nil时 Send 失败
+}
+
+func newFakeAdapter() *fakeAdapter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fakeAdapter{ctx: ctx, cancel: cancel, sent: make(chan []byte, 16), listening: make(chan struct{})}
+}
+
+func (a *fakeAdapter) Protocol() string {
+	return "fake"
+}
+
+func (a *fakeAdapter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+}
+
+func (a *fakeAdapter) Context() context.Context {
+	return a.ctx
+}
+
+func (a *fakeAdapter) OnMessage(handler types.MessageHandler) {
+	a.handler = handler
+}
+
+func (a *fakeAdapter) Close() error {
+	return a.CloseWithReason(types.CloseNormal)
+}
+
+func (a *fakeAdapter) CloseWithReason(r types.CloseReason) error {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = r
+	}
+	a.mu.Unlock()
+	a.cancel()
+	return nil
+}
+
+func (a *fakeAdapter) Listen() {
+	close(a.listening)
+	<-a.ctx.Done()
+}
+
+func (a *fakeAdapter) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+func (a *fakeAdapter) Send(data []byte) error {
+	a.mu.Lock()
+	err := a.sendErr
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	a.sent <- data
+	return nil
+}
+
+func TestProtocolAdapterIntegration(t *testing.T) {
+	sm := newTestGateway(t)
+	app, received := pipeClient(t, sm, "app")
+	subscribeShared(t, app, "devices/+/telemetry")
+
+	adapter := newFakeAdapter()
+	done := make(chan struct{})
+	go func() {
+		sm.HandleConnection(context.Background(), "meter-1", adapter)
+		close(done)
+	}()
+
+	// 未指定主题的上行消息发布到默认遥测主题
+	<-adapter.listening
+	adapter.handler(&types.Message{Payload: []byte("42"), QoS: 1, Timestamp: time.Now()})
+	expectPublish(t, received, "devices/meter-1/telemetry", "42")
+
+	if err := sm.SendCommand("meter-1", []byte("reset")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if cmd := <-adapter.sent; string(cmd) != "reset" {
+		t.Errorf("unexpected command %q", cmd)
+	}
+
+	// 断开后的命令在重连时下发
+	adapter.CloseWithReason(types.CloseKeepAliveTimeout)
+	<-done
+	if adapter.Err() != types.CloseKeepAliveTimeout {
+		t.Errorf("unexpected close reason %v", adapter.Err())
+	}
+	if err := sm.SendCommand("meter-1", []byte("calibrate")); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	reconnected := newFakeAdapter()
+	go sm.HandleConnection(context.Background(), "meter-1", reconnected)
+	defer reconnected.Close()
+	select {
+	case cmd := <-reconnected.sent:
+		if string(cmd) != "calibrate" {
+			t.Errorf("unexpected command %q", cmd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("cached command not delivered after reconnect")
+	}
+}
+
+// 重连时发送失败的离线命令留在缓存中, 下次连接按顺序重发
+func TestPendingCommandsKeptOnSendFailure(t *testing.T) {
+	sm := newTestGateway(t)
+	for _, cmd := range []string{"reset", "calibrate"} {
+		if err := sm.SendCommand("meter-1", []byte(cmd)); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+
+	failing := newFakeAdapter()
+	failing.sendErr = errors.New("link down")
+	done := make(chan struct{})
+	go func() {
+		sm.HandleConnection(context.Background(), "meter-1", failing)
+		close(done)
+	}()
+	<-failing.listening
+	failing.Close()
+	<-done
+
+	reconnected := newFakeAdapter()
+	go sm.HandleConnection(context.Background(), "meter-1", reconnected)
+	defer reconnected.Close()
+	for _, want := range []string{"reset", "calibrate"} {
+		select {
+		case cmd := <-reconnected.sent:
+			if string(cmd) != want {
+				t.Errorf("expected %q, got %q", want, cmd)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("command %q lost after failed resend", want)
+		}
+	}
+}
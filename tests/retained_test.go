@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func publishRetained(t *testing.T, client *mqtt.Client, topic, payload string) {
+	t.Helper()
+	p := &mqtt.PublishPacket{Topic: topic, QoS: 1, Retain: true, Payload: []byte(payload)}
+	if err := client.Publish(context.Background(), p); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+}
+
+// 新订阅者收到的保留消息, 超时后返回
+func subscribeRetained(t *testing.T, sm *gateway.SessionManager, filter string) map[string]string {
+	t.Helper()
+	client, received := pipeClient(t, sm, "dashboard")
+	defer client.Close()
+	if _, err := client.Subscribe(context.Background(), []mqtt.Subscription{{Filter: filter, QoS: 1}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	retained := make(map[string]string)
+	for {
+		select {
+		case p := <-received:
+			if !p.Retain {
+				t.Errorf("expected retain flag on %s", p.Topic)
+			}
+			retained[p.Topic] = string(p.Payload)
+		case <-time.After(200 * time.Millisecond):
+			return retained
+		}
+	}
+}
+
+// 保留消息写入SQLite, 重启后投递给新订阅者, 空负载清除
+func TestRetainedMessagesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.db")
+	sm := newTestGatewayAt(t, path)
+	device, _ := pipeClient(t, sm, "sensor-1")
+	publishRetained(t, device, "devices/sensor-1/state", "on")
+	publishRetained(t, device, "devices/sensor-1/mode", "auto")
+	publishRetained(t, device, "devices/sensor-1/mode", "")
+
+	want := map[string]string{"devices/sensor-1/state": "on"}
+	if got := subscribeRetained(t, sm, "devices/#"); len(got) != 1 || got["devices/sensor-1/state"] != "on" {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	sm.Shutdown(time.Second)
+
+	sm = newTestGatewayAt(t, path)
+	if got := subscribeRetained(t, sm, "devices/#"); len(got) != 1 || got["devices/sensor-1/state"] != "on" {
+		t.Fatalf("expected %v after restart, got %v", want, got)
+	}
+
+	// 清除后重启不再恢复
+	device, _ = pipeClient(t, sm, "sensor-1")
+	publishRetained(t, device, "devices/sensor-1/state", "")
+	sm.Shutdown(time.Second)
+
+	sm = newTestGatewayAt(t, path)
+	if got := subscribeRetained(t, sm, "devices/#"); len(got) != 0 {
+		t.Errorf("expected no retained messages, got %v", got)
+	}
+}
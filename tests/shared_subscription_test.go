@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+func subscribeShared(t *testing.T, client *mqtt.Client, filter string) {
+	t.Helper()
+	codes, err := client.Subscribe(context.Background(), []mqtt.Subscription{{Filter: filter, QoS: 1}})
+	if err != nil || len(codes) != 1 || codes[0] != 1 {
+		t.Fatalf("subscribe %s failed: %v %v", filter, codes, err)
+	}
+}
+
+func publishQoS1(t *testing.T, client *mqtt.Client, topic, payload string) {
+	t.Helper()
+	if err := client.Publish(context.Background(), &mqtt.PublishPacket{Topic: topic, QoS: 1, Payload: []byte(payload)}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+}
+
+// 在 timeout 内收集消息, 返回负载
+func collect(received chan *mqtt.PublishPacket, n int, timeout time.Duration) []string {
+	var payloads []string
+	deadline := time.After(timeout)
+	for len(payloads) < n {
+		select {
+		case p := <-received:
+			payloads = append(payloads, string(p.Payload))
+		case <-deadline:
+			return payloads
+		}
+	}
+	return payloads
+}
+
+func TestSharedSubscriptionRoundRobin(t *testing.T) {
+	sm := newTestGateway(t)
+	w1, r1 := pipeClient(t, sm, "worker-1")
+	w2, r2 := pipeClient(t, sm, "worker-2")
+	subscribeShared(t, w1, "$share/workers/telemetry/#")
+	subscribeShared(t, w2, "$share/workers/telemetry/#")
+
+	device, _ := pipeClient(t, sm, "sensor-1")
+	for i := 0; i < 4; i++ {
+		publishQoS1(t, device, "telemetry/temp", fmt.Sprint(i))
+	}
+
+	got1 := collect(r1, 2, 2*time.Second)
+	got2 := collect(r2, 2, 2*time.Second)
+	if len(got1) != 2 || len(got2) != 2 {
+		t.Fatalf("expected 2 messages per worker, got %v and %v", got1, got2)
+	}
+	if extra := collect(r1, 1, 100*time.Millisecond); len(extra) != 0 {
+		t.Errorf("message delivered twice: %v", extra)
+	}
+}
+
+func TestSharedSubscriptionSticky(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.SharedStrategy = gateway.SharedSticky
+	sm := newTestGatewayWithConfig(t, config)
+
+	w1, r1 := pipeClient(t, sm, "worker-1")
+	w2, r2 := pipeClient(t, sm, "worker-2")
+	subscribeShared(t, w1, "$share/workers/telemetry/#")
+	subscribeShared(t, w2, "$share/workers/telemetry/#")
+
+	d1, _ := pipeClient(t, sm, "sensor-1")
+	d2, _ := pipeClient(t, sm, "sensor-2")
+	for i := 0; i < 3; i++ {
+		publishQoS1(t, d1, "telemetry/sensor-1", "sensor-1")
+		publishQoS1(t, d2, "telemetry/sensor-2", "sensor-2")
+	}
+
+	for _, got := range [][]string{collect(r1, 3, 2*time.Second), collect(r2, 3, 2*time.Second)} {
+		if len(got) != 3 {
+			t.Fatalf("expected 3 messages per worker, got %v", got)
+		}
+		for _, payload := range got[1:] {
+			if payload != got[0] {
+				t.Errorf("publisher not sticky to one worker: %v", got)
+			}
+		}
+	}
+}
+
+func TestSharedSubscriptionRedelivery(t *testing.T) {
+	sm := newTestGateway(t)
+
+	// worker-1 收到消息后不确认
+	stalled := make(chan *mqtt.PublishPacket, 1)
+	release := make(chan struct{})
+	defer close(release)
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "worker-1"
+	opts.OnPublish = func(p *mqtt.PublishPacket) {
+		stalled <- p
+		<-release
+	}
+	w1 := dialPipe(t, sm, opts)
+	w2, r2 := pipeClient(t, sm, "worker-2")
+	subscribeShared(t, w1, "$share/workers/telemetry/#")
+	subscribeShared(t, w2, "$share/workers/telemetry/#")
+
+	// 轮询从 worker-1 开始
+	device, _ := pipeClient(t, sm, "sensor-1")
+	publishQoS1(t, device, "telemetry/temp", "21.5")
+	select {
+	case <-stalled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker-1 did not receive the message")
+	}
+
+	w1.Close()
+	if got := collect(r2, 1, 2*time.Second); len(got) != 1 || got[0] != "21.5" {
+		t.Errorf("expected redelivery to worker-2, got %v", got)
+	}
+}
+
+func TestSharedSubscriptionRejectsNoLocal(t *testing.T) {
+	sm := newTestGateway(t)
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "worker-1"
+	opts.ProtocolLevel = mqtt.ProtocolLevel5
+	client := dialPipe(t, sm, opts)
+
+	client.Subscribe(context.Background(), []mqtt.Subscription{{Filter: "$share/workers/telemetry/#", QoS: 1, NoLocal: true}})
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected disconnect for No Local on a shared subscription")
+	}
+}
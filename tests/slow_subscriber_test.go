@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 不再读取的订阅者不阻塞发布者和其他订阅者, 超出队列的QoS 0消息被丢弃
+func TestSlowSubscriberDoesNotBlockPublisher(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.MaxQueued = 4
+	sm := newTestGatewayWithConfig(t, config)
+
+	// 订阅后停止读取的客户端
+	server, conn := net.Pipe()
+	go serveGatewayConn(sm, server)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(buildConnect("MQTT", 4, 0x02, "slow")); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	subscribe := append([]byte{0x00, 0x01}, mqttString("telemetry/#")...)
+	subscribe = append(subscribe, 0x00)
+	if _, err := conn.Write(append([]byte{0x82, byte(len(subscribe))}, subscribe...)); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	// CONNACK 和 SUBACK
+	if _, err := io.ReadFull(conn, make([]byte, 4+5)); err != nil {
+		t.Fatalf("read acks failed: %v", err)
+	}
+
+	subscriber, received := pipeClient(t, sm, "dashboard")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := subscriber.Subscribe(ctx, []mqtt.Subscription{{Filter: "telemetry/#"}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+
+	last := make(chan struct{})
+	go func() {
+		for p := range received {
+			if string(p.Payload) == "last" {
+				close(last)
+				return
+			}
+		}
+	}()
+
+	publisher, _ := pipeClient(t, sm, "sensor-1")
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 32; i++ {
+			if err := publisher.Publish(ctx, &mqtt.PublishPacket{Topic: "telemetry/temp", Payload: []byte(fmt.Sprint(i))}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := <-done; err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	// 其他订阅者继续收到消息
+	time.Sleep(100 * time.Millisecond)
+	if err := publisher.Publish(ctx, &mqtt.PublishPacket{Topic: "telemetry/temp", Payload: []byte("last")}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	select {
+	case <-last:
+	case <-ctx.Done():
+		t.Fatal("dashboard stopped receiving messages")
+	}
+}
@@ -0,0 +1,282 @@
+package tests
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"edgesphere/internal/gateway"
+	"edgesphere/internal/protocol/mqtt"
+	"edgesphere/internal/protocol/sparkplug"
+)
+
+func u64(v uint64) *uint64 {
+	return &v
+}
+
+func formatMetrics(metrics []sparkplug.Metric) string {
+	parts := make([]string, len(metrics))
+	for i, m := range metrics {
+		parts[i] = fmt.Sprintf("%s=%v(%T)", m.Name, m.Value, m.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestSparkplugTopic(t *testing.T) {
+	for _, tc := range []struct {
+		topic  string
+		want   sparkplug.Topic
+		device string
+	}{
+		{"spBv1.0/plant/NBIRTH/edge-1", sparkplug.Topic{Group: "plant", Type: sparkplug.NBIRTH, Node: "edge-1"}, "plant/edge-1"},
+		{"spBv1.0/plant/DDATA/edge-1/pump-1", sparkplug.Topic{Group: "plant", Type: sparkplug.DDATA, Node: "edge-1", Device: "pump-1"}, "plant/edge-1/pump-1"},
+		{"spBv1.0/STATE/scada-1", sparkplug.Topic{Type: sparkplug.STATE, Host: "scada-1"}, ""},
+	} {
+		got, err := sparkplug.ParseTopic(tc.topic)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: unexpected topic %+v: %v", tc.topic, got, err)
+			continue
+		}
+		if got.String() != tc.topic || (tc.device != "" && got.DeviceID() != tc.device) {
+			t.Errorf("%s: unexpected string %s or device ID %s", tc.topic, got, got.DeviceID())
+		}
+	}
+
+	for _, topic := range []string{
+		"spAv1.0/plant/NBIRTH/edge-1",
+		"spBv1.0/plant/NBIRTH",
+		"spBv1.0/plant/NBIRTH/edge-1/pump-1",
+		"spBv1.0/plant/DBIRTH/edge-1",
+		"spBv1.0/plant/NSTATUS/edge-1",
+		"spBv1.0//NDATA/edge-1",
+	} {
+		if _, err := sparkplug.ParseTopic(topic); err == nil {
+			t.Errorf("expected %s to be rejected", topic)
+		}
+	}
+}
+
+func TestSparkplugPayload(t *testing.T) {
+	// 有符号整数以补码存放在 int_value 中
+	p := &sparkplug.Payload{
+		Timestamp: 1,
+		Metrics:   []sparkplug.Metric{{Name: "a", Alias: u64(1), DataType: sparkplug.Int32, Value: int64(-1)}},
+		Seq:       u64(0),
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if want := "0801120d0a01611001200350ffffffff0f1800"; hex.EncodeToString(data) != want {
+		t.Errorf("unexpected encoding %x", data)
+	}
+
+	p = &sparkplug.Payload{
+		Timestamp: 1700000000000,
+		Seq:       u64(7),
+		UUID:      "demo",
+		Metrics: []sparkplug.Metric{
+			{Name: "i8", DataType: sparkplug.Int8, Value: int64(-2)},
+			{Name: "i64", DataType: sparkplug.Int64, Value: int64(-3)},
+			{Name: "u32", DataType: sparkplug.UInt32, Value: uint64(4000000000)},
+			{Name: "f", DataType: sparkplug.Float, Value: float32(1.5)},
+			{Name: "d", DataType: sparkplug.Double, Value: 2.25},
+			{Name: "b", DataType: sparkplug.Boolean, Value: true},
+			{Name: "s", DataType: sparkplug.String, Value: "on"},
+			{Name: "raw", DataType: sparkplug.Bytes, Value: []byte{1, 2}},
+			{Name: "ts", DataType: sparkplug.DateTime, Timestamp: 5, IsHistorical: true, Value: uint64(1700000000000)},
+			{Name: "n", DataType: sparkplug.Double},
+		},
+	}
+	data, err = p.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	got, err := sparkplug.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	want := "i8=-2(int64) i64=-3(int64) u32=4000000000(uint64) f=1.5(float32) d=2.25(float64) b=true(bool) " +
+		"s=on(string) raw=[1 2]([]uint8) ts=1700000000000(uint64) n=<nil>(<nil>)"
+	if formatMetrics(got.Metrics) != want {
+		t.Errorf("unexpected metrics:\n got %s\nwant %s", formatMetrics(got.Metrics), want)
+	}
+	if got.Timestamp != p.Timestamp || got.Seq == nil || *got.Seq != 7 || got.UUID != "demo" ||
+		got.Metrics[8].Timestamp != 5 || !got.Metrics[8].IsHistorical {
+		t.Errorf("unexpected payload %+v", got)
+	}
+
+	// 未知字段 (属性集) 跳过
+	data, _ = hex.DecodeString("1207" + "0a0178" + "4a00" + "5805")
+	got, err = sparkplug.Unmarshal(data)
+	if err != nil || formatMetrics(got.Metrics) != "x=5(uint64)" || got.Seq != nil {
+		t.Errorf("unexpected payload %s: %v", formatMetrics(got.Metrics), err)
+	}
+
+	for _, bad := range []string{"08", "12050a", "0b", "00", "1203500102"} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := sparkplug.Unmarshal(data); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+	bad := &sparkplug.Payload{Metrics: []sparkplug.Metric{{Name: "x", DataType: sparkplug.Int32, Value: "1"}}}
+	if _, err := bad.Marshal(); err == nil {
+		t.Error("expected string value for Int32 metric to be rejected")
+	}
+}
+
+func TestSparkplugHost(t *testing.T) {
+	host := sparkplug.NewHost(sparkplug.Config{RebirthInterval: time.Hour})
+	node := sparkplug.Topic{Group: "plant", Type: sparkplug.NDATA, Node: "edge-1"}
+	handle := func(typ sparkplug.MessageType, device string, p *sparkplug.Payload) sparkplug.Update {
+		topic := node
+		topic.Type, topic.Device = typ, device
+		return host.Handle(topic, p)
+	}
+	birth := func(seq, bdSeq uint64) *sparkplug.Payload {
+		return &sparkplug.Payload{Seq: u64(seq), Metrics: []sparkplug.Metric{
+			{Name: sparkplug.BdSeqMetric, DataType: sparkplug.Int64, Value: int64(bdSeq)},
+			{Name: "Temperature", Alias: u64(1), DataType: sparkplug.Int16, Value: int64(20)},
+		}}
+	}
+	data := func(seq uint64, alias uint64, value uint64) *sparkplug.Payload {
+		return &sparkplug.Payload{Seq: u64(seq), Metrics: []sparkplug.Metric{{Alias: u64(alias), Value: value}}}
+	}
+
+	// 出生证明之前的数据请求重生, 间隔内不重复请求
+	if u := handle(sparkplug.NDATA, "", data(5, 1, 1)); !u.Rebirth || len(u.Metrics) != 0 {
+		t.Errorf("expected rebirth for data before birth, got %+v", u)
+	}
+	if u := handle(sparkplug.NDATA, "", data(6, 1, 1)); u.Rebirth {
+		t.Error("expected rebirth request to be throttled")
+	}
+
+	u := handle(sparkplug.NBIRTH, "", birth(0, 3))
+	if strings.Join(u.Online, ",") != "plant/edge-1" || u.Rebirth || !host.Online("plant/edge-1") {
+		t.Errorf("unexpected birth update %+v", u)
+	}
+	// 只带别名的指标按出生证明中的类型转换
+	u = handle(sparkplug.NDATA, "", data(1, 1, 0xfffe))
+	if formatMetrics(u.Metrics) != "Temperature=-2(int64)" || u.Rebirth {
+		t.Errorf("unexpected data update %+v", u)
+	}
+	if u := handle(sparkplug.DDATA, "pump-1", data(2, 1, 1)); !u.Rebirth {
+		t.Error("expected rebirth for data of unknown device")
+	}
+
+	handle(sparkplug.NBIRTH, "", birth(255, 3))
+	u = handle(sparkplug.DBIRTH, "pump-1", &sparkplug.Payload{Seq: u64(0), Metrics: []sparkplug.Metric{
+		{Name: "Speed", Alias: u64(2), DataType: sparkplug.UInt16, Value: uint64(1200)},
+	}})
+	if strings.Join(u.Online, ",") != "plant/edge-1/pump-1" || u.Rebirth || !host.Online("plant/edge-1/pump-1") {
+		t.Errorf("unexpected device birth update %+v", u)
+	}
+	if u := handle(sparkplug.DDATA, "pump-1", data(1, 2, 1300)); formatMetrics(u.Metrics) != "Speed=1300(uint64)" || u.Rebirth {
+		t.Errorf("unexpected device data update %+v", u)
+	}
+
+	// 序号跳跃时请求重生, 之后按新的序号继续检查
+	if u := handle(sparkplug.NDATA, "", data(3, 1, 1)); !u.Rebirth || len(u.Metrics) != 1 {
+		t.Errorf("expected rebirth for sequence gap, got %+v", u)
+	}
+	if u := handle(sparkplug.NDATA, "", data(4, 9, 1)); u.Rebirth || len(u.Metrics) != 0 {
+		t.Errorf("expected unknown alias to be dropped without a second request, got %+v", u)
+	}
+
+	// 旧会话的死亡证明被忽略
+	if u := handle(sparkplug.NDEATH, "", &sparkplug.Payload{Metrics: birth(0, 2).Metrics[:1]}); len(u.Offline) != 0 {
+		t.Errorf("expected stale death to be ignored, got %+v", u)
+	}
+	u = handle(sparkplug.NDEATH, "", &sparkplug.Payload{Metrics: birth(0, 3).Metrics[:1]})
+	if strings.Join(u.Offline, ",") != "plant/edge-1/pump-1,plant/edge-1" || host.Online("plant/edge-1") || host.Online("plant/edge-1/pump-1") {
+		t.Errorf("unexpected death update %+v", u)
+	}
+}
+
+func publishSparkplug(t *testing.T, client *mqtt.Client, topic string, p *sparkplug.Payload) {
+	t.Helper()
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Publish(ctx, &mqtt.PublishPacket{Topic: topic, QoS: 1, Payload: data}); err != nil {
+		t.Fatalf("publish %s failed: %v", topic, err)
+	}
+}
+
+func TestSparkplugGateway(t *testing.T) {
+	config := gateway.DefaultSessionConfig
+	config.SparkplugTopic = "sparkplug/%c/metrics"
+	sm := newTestGatewayWithConfig(t, config)
+	registry := newFakeRegistry()
+	sm.SetDeviceRegistry(registry)
+
+	scada, received := pipeClient(t, sm, "scada")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := scada.Subscribe(ctx, []mqtt.Subscription{{Filter: "spBv1.0/+/NCMD/+"}, {Filter: "sparkplug/#"}}); err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	edge, _ := pipeClient(t, sm, "edge-1")
+	bdSeq := sparkplug.Metric{Name: sparkplug.BdSeqMetric, DataType: sparkplug.UInt64, Value: uint64(0)}
+
+	// 出生证明登记节点和设备, 指标以JSON发布
+	publishSparkplug(t, edge, "spBv1.0/plant/NBIRTH/edge-1", &sparkplug.Payload{Seq: u64(0), Metrics: []sparkplug.Metric{
+		bdSeq,
+		{Name: "Temperature", Alias: u64(1), DataType: sparkplug.Double, Value: 21.5},
+	}})
+	expectEvent(t, registry.events, "plant/edge-1 registered", 5*time.Second)
+	expectPublish(t, received, "sparkplug/plant/edge-1/metrics", `{"Temperature":21.5,"bdSeq":0}`)
+	if device := registry.device("plant/edge-1"); device.Type != "sparkplug" || device.Metadata["group"] != "plant" {
+		t.Errorf("unexpected device %+v", device)
+	}
+
+	publishSparkplug(t, edge, "spBv1.0/plant/DBIRTH/edge-1/pump-1", &sparkplug.Payload{Seq: u64(1), Metrics: []sparkplug.Metric{
+		{Name: "Speed", Alias: u64(2), DataType: sparkplug.Int32, Value: int64(-5)},
+	}})
+	expectEvent(t, registry.events, "plant/edge-1/pump-1 registered", 5*time.Second)
+	expectPublish(t, received, "sparkplug/plant/edge-1/pump-1/metrics", `{"Speed":-5}`)
+
+	publishSparkplug(t, edge, "spBv1.0/plant/DDATA/edge-1/pump-1", &sparkplug.Payload{Seq: u64(2), Metrics: []sparkplug.Metric{
+		{Alias: u64(2), Value: uint64(0xfffffff9)},
+	}})
+	expectPublish(t, received, "sparkplug/plant/edge-1/pump-1/metrics", `{"Speed":-7}`)
+
+	// 序号跳跃: 向节点发送重生命令
+	publishSparkplug(t, edge, "spBv1.0/plant/NDATA/edge-1", &sparkplug.Payload{Seq: u64(4), Metrics: []sparkplug.Metric{
+		{Alias: u64(1), Value: 22.0},
+	}})
+	select {
+	case p := <-received:
+		cmd, err := sparkplug.Unmarshal(p.Payload)
+		if p.Topic != "spBv1.0/plant/NCMD/edge-1" || err != nil || formatMetrics(cmd.Metrics) != sparkplug.RebirthMetric+"=true(bool)" {
+			t.Fatalf("unexpected rebirth command %s: %v", p.Topic, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rebirth command")
+	}
+	expectPublish(t, received, "sparkplug/plant/edge-1/metrics", `{"Temperature":22}`)
+
+	// 节点重生: 设备在重新发布出生证明前离线
+	publishSparkplug(t, edge, "spBv1.0/plant/NBIRTH/edge-1", &sparkplug.Payload{Seq: u64(0), Metrics: []sparkplug.Metric{bdSeq}})
+	expectEvent(t, registry.events, "plant/edge-1/pump-1 offline", 5*time.Second)
+	expectEvent(t, registry.events, "plant/edge-1 online", 5*time.Second)
+	expectPublish(t, received, "sparkplug/plant/edge-1/metrics", `{"bdSeq":0}`)
+
+	// 旧会话的死亡证明被忽略, 当前会话的死亡证明使节点离线
+	stale := bdSeq
+	stale.Value = uint64(9)
+	publishSparkplug(t, edge, "spBv1.0/plant/NDEATH/edge-1", &sparkplug.Payload{Metrics: []sparkplug.Metric{stale}})
+	select {
+	case event := <-registry.events:
+		t.Fatalf("unexpected event %q for stale death", event)
+	default:
+	}
+	publishSparkplug(t, edge, "spBv1.0/plant/NDEATH/edge-1", &sparkplug.Payload{Metrics: []sparkplug.Metric{bdSeq}})
+	expectEvent(t, registry.events, "plant/edge-1 offline", 5*time.Second)
+}
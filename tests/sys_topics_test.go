@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"edgesphere/internal/auth"
+	"edgesphere/internal/protocol/mqtt"
+)
+
+// 等待 $SYS 主题的数值满足条件
+func waitSys(t *testing.T, received chan *mqtt.PublishPacket, topic string, ok func(value string) bool) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	last := ""
+	for {
+		select {
+		case p := <-received:
+			if p.Topic != topic {
+				continue
+			}
+			if last = string(p.Payload); ok(last) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("%s: last value %q", topic, last)
+		}
+	}
+}
+
+func atLeast(n uint64) func(string) bool {
+	return func(value string) bool {
+		v, err := strconv.ParseUint(value, 10, 64)
+		return err == nil && v >= n
+	}
+}
+
+func TestSysTopics(t *testing.T) {
+	sm := newTestGateway(t)
+	sm.SetAuthorizer(auth.NewACL([]auth.Rule{
+		{Username: "ops", Topic: "$SYS/#", Access: auth.Subscribe},
+		{Topic: "#", Access: auth.ReadWrite},
+	}))
+
+	received := make(chan *mqtt.PublishPacket, 256)
+	opts := mqtt.DefaultClientOptions
+	opts.ClientID = "ops-console"
+	opts.Username = "ops"
+	opts.OnPublish = func(p *mqtt.PublishPacket) { received <- p }
+	ops := dialPipe(t, sm, opts)
+	if codes, err := ops.Subscribe(context.Background(), []mqtt.Subscription{{Filter: "$SYS/#"}}); err != nil || codes[0] != 0 {
+		t.Fatalf("subscribe failed: %v %v", codes, err)
+	}
+
+	// 设备不能订阅或发布 $SYS 主题
+	opts = mqtt.DefaultClientOptions
+	opts.ClientID = "sensor-1"
+	opts.ProtocolLevel = mqtt.ProtocolLevel5
+	device := dialPipe(t, sm, opts)
+	if codes, err := device.Subscribe(context.Background(), []mqtt.Subscription{{Filter: "$SYS/#"}}); err != nil || codes[0] != byte(mqtt.NotAuthorized) {
+		t.Errorf("expected subscription to be rejected, got %v %v", codes, err)
+	}
+	fake := &mqtt.PublishPacket{Topic: "$SYS/broker/uptime", QoS: 1, Retain: true, Payload: []byte("forged")}
+	if err := device.Publish(context.Background(), fake); err == nil {
+		t.Error("expected publish to $SYS to be rejected")
+	}
+	publishQoS1(t, device, "telemetry/temp", "21.5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sm.PublishStats(ctx, 20*time.Millisecond)
+
+	waitSys(t, received, "$SYS/broker/clients/connected", func(v string) bool { return v == "2" })
+	waitSys(t, received, "$SYS/broker/messages/received", atLeast(1))
+	waitSys(t, received, "$SYS/broker/messages/sent", atLeast(1))
+	waitSys(t, received, "$SYS/broker/bytes/received", atLeast(1))
+	waitSys(t, received, "$SYS/broker/subscriptions/count", func(v string) bool { return v == "1" })
+	waitSys(t, received, "$SYS/broker/store/commands/count", func(v string) bool { return v == "0" })
+	waitSys(t, received, "$SYS/broker/uptime", func(v string) bool { return strings.HasSuffix(v, " seconds") })
+
+	stats := sm.Stats()
+	if stats.ClientsConnected != 2 || stats.BytesSent == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edgesphere/internal/pkg/utils"
+)
+
+func TestTimingWheelExpiry(t *testing.T) {
+	wheel := utils.NewTimingWheel(time.Millisecond, 2, 3)
+	wheel.Start()
+	defer wheel.Stop()
+
+	// 跨越多层和超出时间轮范围 (4*4*4 tick) 的定时器
+	delays := []time.Duration{3, 7, 20, 50, 90, 150}
+	var mu sync.Mutex
+	fired := make(map[time.Duration]time.Duration)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, d := range delays {
+		d := d * time.Millisecond
+		wg.Add(1)
+		wheel.AfterFunc(d, func() {
+			mu.Lock()
+			fired[d] = time.Since(start)
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+
+	stopped := wheel.AfterFunc(10*time.Millisecond, func() { t.Error("stopped timer fired") })
+	if !stopped.Stop() {
+		t.Fatal("Stop on pending timer returned false")
+	}
+	wg.Wait()
+
+	for _, d := range delays {
+		d *= time.Millisecond
+		if fired[d] < d {
+			t.Errorf("timer %v fired early at %v", d, fired[d])
+		}
+	}
+}
+
+func TestTimingWheelReset(t *testing.T) {
+	wheel := utils.NewTimingWheel(time.Millisecond, 6, 4)
+	wheel.Start()
+	defer wheel.Stop()
+
+	var fired atomic.Int64
+	timer := wheel.AfterFunc(30*time.Millisecond, func() { fired.Store(time.Now().UnixNano()) })
+
+	// 持续重置时不会到期
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if !timer.Reset(30 * time.Millisecond) {
+			t.Fatal("Reset on pending timer returned false")
+		}
+	}
+	if fired.Load() != 0 {
+		t.Fatal("timer fired while being reset")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if fired.Load() == 0 {
+		t.Fatal("timer did not fire after reset stopped")
+	}
+	if elapsed := time.Duration(fired.Load() - start.UnixNano()); elapsed < 80*time.Millisecond {
+		t.Errorf("timer fired after %v, want >= 80ms", elapsed)
+	}
+}
+
+// 以下基准对比每个会话一个 time.Ticker + 检测协程的旧实现与共享时间轮,
+// sys-bytes/session 为注册后进程占用内存的增量
+
+func BenchmarkHeartbeatPerSessionTicker(b *testing.B) {
+	b.ReportAllocs()
+	stop := make(chan struct{})
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := 0; i < b.N; i++ {
+		ticker := time.NewTicker(15 * time.Second)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Sys-before.Sys)/float64(b.N), "sys-bytes/session")
+	close(stop)
+}
+
+func BenchmarkHeartbeatTimingWheel(b *testing.B) {
+	b.ReportAllocs()
+	wheel := utils.NewTimingWheel(100*time.Millisecond, 6, 4)
+	wheel.Start()
+	defer wheel.Stop()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	timers := make([]*utils.WheelTimer, b.N)
+	for i := 0; i < b.N; i++ {
+		timers[i] = wheel.AfterFunc(15*time.Second, func() {})
+	}
+
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Sys-before.Sys)/float64(b.N), "sys-bytes/session")
+	for _, timer := range timers {
+		timer.Stop()
+	}
+}
+
+func BenchmarkHeartbeatTimingWheelReset(b *testing.B) {
+	wheel := utils.NewTimingWheel(100*time.Millisecond, 6, 4)
+	wheel.Start()
+	defer wheel.Stop()
+
+	timers := make([]*utils.WheelTimer, 10000)
+	for i := range timers {
+		timers[i] = wheel.AfterFunc(15*time.Second, func() {})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			timers[i%len(timers)].Reset(15 * time.Second)
+			i++
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"testing"
+
+	"edgesphere/internal/gateway"
+)
+
+func TestTopicTreeWildcards(t *testing.T) {
+	tree := gateway.NewTopicTree()
+	tree.Subscribe("a", "site/1/+/temperature", 1)
+	tree.Subscribe("b", "site/#", 0)
+	tree.Subscribe("c", "site/1/hvac/temperature", 2)
+	tree.Subscribe("d", "#", 0)
+	tree.Subscribe("e", "$SYS/#", 0)
+
+	cases := []struct {
+		topic string
+		want  map[string]byte
+	}{
+		{"site/1/hvac/temperature", map[string]byte{"a": 1, "b": 0, "c": 2, "d": 0}},
+		{"site/1/pump/temperature", map[string]byte{"a": 1, "b": 0, "d": 0}},
+		{"site", map[string]byte{"b": 0, "d": 0}},
+		{"other/1", map[string]byte{"d": 0}},
+		{"$SYS/broker/uptime", map[string]byte{"e": 0}},
+	}
+	for _, c := range cases {
+		got := tree.Match(c.topic)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.topic, got, c.want)
+			continue
+		}
+		for id, qos := range c.want {
+			if got[id] != qos {
+				t.Errorf("%s: client %s got QoS %d, want %d", c.topic, id, got[id], qos)
+			}
+		}
+	}
+
+	tree.Unsubscribe("b", "site/#")
+	tree.RemoveClient("d")
+	if got := tree.Match("site"); len(got) != 0 {
+		t.Errorf("expected no subscribers after removal, got %v", got)
+	}
+	if n := tree.Count(); n != 3 {
+		t.Errorf("expected 3 subscriptions, got %d", n)
+	}
+}
+
+func TestTopicTreeSharedSubscriptions(t *testing.T) {
+	tree := gateway.NewTopicTree()
+	tree.Subscribe("w1", "$share/workers/telemetry/+", 1)
+	tree.Subscribe("w2", "$share/workers/telemetry/+", 0)
+	tree.Subscribe("w3", "$share/audit/telemetry/#", 2)
+	tree.Subscribe("w1", "telemetry/+", 0)
+
+	if got := tree.Match("telemetry/t1"); len(got) != 1 || got["w1"] != 0 {
+		t.Errorf("shared subscriptions should not be plain matches, got %v", got)
+	}
+	shared := tree.MatchShared("telemetry/t1")
+	if len(shared) != 2 {
+		t.Fatalf("expected 2 shared subscriptions, got %v", shared)
+	}
+	if members := shared["$share/workers/telemetry/+"]; len(members) != 2 || members["w1"] != 1 || members["w2"] != 0 {
+		t.Errorf("unexpected workers group %v", members)
+	}
+	if subs := tree.Subscriptions("w1"); len(subs) != 2 || subs["$share/workers/telemetry/+"] != 1 {
+		t.Errorf("unexpected subscriptions of w1: %v", subs)
+	}
+
+	tree.RemoveClient("w1")
+	tree.Unsubscribe("w3", "$share/audit/telemetry/#")
+	if members := tree.SharedMembers("$share/workers/telemetry/+"); len(members) != 1 || members["w2"] != 0 {
+		t.Errorf("unexpected members after removal: %v", members)
+	}
+	if shared := tree.MatchShared("telemetry/t1"); len(shared) != 1 {
+		t.Errorf("expected only workers group, got %v", shared)
+	}
+}